@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Pins the calling OS thread to cpu. The caller must hold runtime.LockOSThread
+func pinThread(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return errors.Wrapf(unix.SchedSetaffinity(0, &set), "affinity: unable to pin thread to cpu %d", cpu)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// Pinning threads to CPUs is only supported on Linux
+func pinThread(cpu int) error {
+	return errors.New("affinity: pinning not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- AGGREGATE --------------------- */
+
+// aggregateStats summarizes one metric over the results of a group
+type aggregateStats struct {
+	Group  string
+	N      int
+	Mean   float64
+	Median float64
+	Stddev float64
+	Min    float64
+	Max    float64
+}
+
+// Reads all results from the files matching patterns. Every file holds json lines like ResultsFile
+func readResults(patterns []string) ([]result, error) {
+	var results []result
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "aggregate: bad pattern %q", pattern)
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, errors.Wrap(err, "aggregate: unable to open results file")
+			}
+			decoder := json.NewDecoder(bufio.NewReader(f))
+			for {
+				var res result
+				err = decoder.Decode(&res)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					f.Close()
+					return nil, errors.Wrapf(err, "aggregate: bad result in %s", file)
+				}
+				results = append(results, res)
+			}
+			f.Close()
+		}
+	}
+	return results, nil
+}
+
+// Returns the result field name as a string to group by, or as a number to aggregate
+func resultField(res result, name string) (reflect.Value, error) {
+	field := reflect.ValueOf(res).FieldByName(name)
+	if !field.IsValid() {
+		return field, errors.New(fmt.Sprintf("aggregate: unknown result field %q", name))
+	}
+	return field, nil
+}
+
+// Returns the value of the numeric result field name as float64. Durations are in seconds
+func resultNumber(res result, name string) (float64, error) {
+	field, err := resultField(res, name)
+	if err != nil {
+		return 0, err
+	}
+	switch v := field.Interface().(type) {
+	case time.Duration:
+		return v.Seconds(), nil
+	}
+	switch field.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(field.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint()), nil
+	}
+	return 0, errors.New(fmt.Sprintf("aggregate: result field %q is not a number", name))
+}
+
+// Returns the statistics of values, which must not be empty
+func summarize(group string, values []float64) aggregateStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	s := aggregateStats{Group: group, N: len(sorted), Min: sorted[0], Max: sorted[len(sorted)-1]}
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	s.Mean = sum / float64(s.N)
+
+	if s.N%2 == 1 {
+		s.Median = sorted[s.N/2]
+	} else {
+		s.Median = (sorted[s.N/2-1] + sorted[s.N/2]) / 2
+	}
+
+	// Sample standard deviation. 0 for a single result
+	if s.N > 1 {
+		var squares float64
+		for _, v := range sorted {
+			squares += (v - s.Mean) * (v - s.Mean)
+		}
+		s.Stddev = math.Sqrt(squares / float64(s.N-1))
+	}
+	return s
+}
+
+// Groups results by the field by and returns the statistics of the field metric per group, sorted by group
+func aggregate(results []result, by string, metric string) ([]aggregateStats, error) {
+	groups := map[string][]float64{}
+	for _, res := range results {
+		field, err := resultField(res, by)
+		if err != nil {
+			return nil, err
+		}
+		value, err := resultNumber(res, metric)
+		if err != nil {
+			return nil, err
+		}
+		group := fmt.Sprint(field.Interface())
+		groups[group] = append(groups[group], value)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := make([]aggregateStats, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, summarize(name, groups[name]))
+	}
+	return stats, nil
+}
+
+// Writes stats as a table or as csv to w
+func writeAggregate(w io.Writer, stats []aggregateStats, by string, format string) error {
+	header := []string{by, "N", "Mean", "Median", "Stddev", "Min", "Max"}
+	rows := [][]string{}
+	for _, s := range stats {
+		row := []string{s.Group, strconv.Itoa(s.N)}
+		for _, v := range []float64{s.Mean, s.Median, s.Stddev, s.Min, s.Max} {
+			row = append(row, strconv.FormatFloat(v, 'f', 2, 64))
+		}
+		rows = append(rows, row)
+	}
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(header)
+		writer.WriteAll(rows)
+		return errors.Wrap(writer.Error(), "aggregate: unable to write csv")
+	case "table":
+		writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		for _, row := range append([][]string{header}, rows...) {
+			for _, cell := range row {
+				fmt.Fprintf(writer, "%s\t", cell)
+			}
+			fmt.Fprintln(writer)
+		}
+		return errors.Wrap(writer.Flush(), "aggregate: unable to write table")
+	}
+	return errors.New(fmt.Sprintf("aggregate: unknown format %q", format))
+}
+
+// runAggregate is the aggregate subcommand: go-nats-go aggregate [-by field] [-metric field] [-format table|csv] files...
+func runAggregate(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	var by, metric, format string
+	flags.StringVar(&by, "by", "Scenario", fmt.Sprintf("Set result field to group by"))
+	flags.StringVar(&metric, "metric", "MessagesPerSecond", fmt.Sprintf("Set numeric result field to aggregate. Durations in seconds"))
+	flags.StringVar(&format, "format", "table", fmt.Sprintf("Set output format, table or csv"))
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("aggregate: no result files given")
+	}
+
+	results, err := readResults(flags.Args())
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("aggregate: no results found")
+	}
+
+	stats, err := aggregate(results, by, metric)
+	if err != nil {
+		return err
+	}
+	return writeAggregate(w, stats, by, format)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregate(t *testing.T) {
+	dir := t.TempDir()
+
+	// Fixture results spread over two files, as written by ResultsFile
+	fixtures := map[string][]result{
+		"sweep1.json": {
+			{Scenario: "json", MessagesPerSecond: 1000, TotalDuration: time.Second},
+			{Scenario: "json", MessagesPerSecond: 2000, TotalDuration: 2 * time.Second},
+			{Scenario: "emptybytes", MessagesPerSecond: 5000, TotalDuration: time.Second},
+		},
+		"sweep2.json": {
+			{Scenario: "json", MessagesPerSecond: 3000, TotalDuration: 3 * time.Second},
+			{Scenario: "json", MessagesPerSecond: 6000, TotalDuration: 4 * time.Second},
+		},
+	}
+	for name, results := range fixtures {
+		for _, res := range results {
+			assert.Equal(t, appendResult(filepath.Join(dir, name), res), nil, "appendResult failed")
+		}
+	}
+
+	results, err := readResults([]string{filepath.Join(dir, "sweep*.json")})
+	assert.Equal(t, err, nil, "readResults failed")
+	assert.Equal(t, 5, len(results))
+
+	stats, err := aggregate(results, "Scenario", "MessagesPerSecond")
+	assert.Equal(t, err, nil, "aggregate failed")
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, aggregateStats{Group: "emptybytes", N: 1, Mean: 5000, Median: 5000, Min: 5000, Max: 5000}, stats[0])
+	json := stats[1]
+	assert.Equal(t, "json", json.Group)
+	assert.Equal(t, 4, json.N)
+	assert.Equal(t, 3000.0, json.Mean)
+	assert.Equal(t, 2500.0, json.Median)
+	assert.Equal(t, 1000.0, json.Min)
+	assert.Equal(t, 6000.0, json.Max)
+	assert.True(t, math.Abs(json.Stddev-2160.2469) < 0.001, "Sample standard deviation")
+
+	// Durations are aggregated in seconds
+	stats, err = aggregate(results, "Scenario", "TotalDuration")
+	assert.Equal(t, err, nil, "aggregate failed")
+	assert.Equal(t, 2.5, stats[1].Mean)
+
+	_, err = aggregate(results, "Nonexistent", "MessagesPerSecond")
+	assert.NotEqual(t, err, nil, "Unknown group field should fail")
+	_, err = aggregate(results, "Scenario", "Mode")
+	assert.NotEqual(t, err, nil, "Non-numeric metric should fail")
+
+	// The subcommand writes csv
+	var output bytes.Buffer
+	err = runAggregate([]string{"-format", "csv", filepath.Join(dir, "sweep1.json"), filepath.Join(dir, "sweep2.json")}, &output)
+	assert.Equal(t, err, nil, "runAggregate failed")
+	records, err := csv.NewReader(&output).ReadAll()
+	assert.Equal(t, err, nil, "Output should be valid csv")
+	assert.Equal(t, []string{"Scenario", "N", "Mean", "Median", "Stddev", "Min", "Max"}, records[0])
+	assert.Equal(t, []string{"json", "4", "3000.00", "2500.00", "2160.25", "1000.00", "6000.00"}, records[2])
+
+	output.Reset()
+	err = runAggregate([]string{filepath.Join(dir, "*.json")}, &output)
+	assert.Equal(t, err, nil, "runAggregate failed")
+	assert.Equal(t, 3, strings.Count(output.String(), "\n"))
+}
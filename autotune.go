@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- AUTO TUNE --------------------- */
+
+// findSustainableRate binary searches between low and high for the highest rate where probe passes
+// The search stops when the rate is known within precision. low itself must pass
+func findSustainableRate(low, high, precision float64, probe func(rate float64) (bool, error)) (float64, error) {
+	ok, err := probe(low)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("autotune: not sustainable at the lowest rate %.0f msgs/sec", low))
+	}
+
+	for high-low > precision {
+		mid := (low + high) / 2
+		ok, err := probe(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
+
+// runAutoTune finds the highest RateLimit the slave sustains. Every probe is a run of config.Total messages
+// A probe passes if no publish fails and the slave completes within config.Master.TargetLatency after the last message is due
+// A probe where messages are dropped never completes and fails on the same deadline
+func runAutoTune(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) (float64, error) {
+	probe := func(rate float64) (bool, error) {
+		probeConfig := config
+		probeConfig.Master.RateLimit = rate
+		expected := time.Duration(float64(config.Total) / rate * float64(time.Second))
+
+		probeCtx, cancel := context.WithTimeout(ctx, expected+config.Master.TargetLatency)
+		defer cancel()
+		res, err := runMaster(probeCtx, nc, probeConfig, generateMessage, log)
+		switch {
+		case ctx.Err() != nil:
+			return false, ctx.Err()
+		case err == context.DeadlineExceeded, err == errIdleTimeout:
+			log.Logf(logrus.InfoLevel, "Probe rate=%.0f msgs/sec failed - slave did not complete in time", rate)
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+
+		lag := res.TotalDuration - expected
+		ok := lag <= config.Master.TargetLatency && res.PublishFailures == 0
+		log.Logf(logrus.InfoLevel, "Probe rate=%.0f msgs/sec lag=%v publish failures=%d ok=%v", rate, lag, res.PublishFailures, ok)
+		return ok, nil
+	}
+
+	return findSustainableRate(config.Master.AutoTuneMinRate, config.Master.AutoTuneMaxRate, config.Master.AutoTunePrecision, probe)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindSustainableRate(t *testing.T) {
+	// Simulated system that sustains up to capacity
+	capacity := 12345.0
+	var probes int
+	probe := func(rate float64) (bool, error) {
+		probes++
+		return rate <= capacity, nil
+	}
+
+	rate, err := findSustainableRate(100, 1000000, 10, probe)
+	assert.Equal(t, err, nil, "findSustainableRate failed")
+	assert.True(t, rate <= capacity, "Found rate above capacity")
+	assert.True(t, capacity-rate <= 10, "Found rate not within precision")
+	assert.True(t, float64(probes) <= 2+math.Ceil(math.Log2((1000000-100)/10)), "Too many probes")
+
+	// Not even the lowest rate is sustainable
+	_, err = findSustainableRate(100, 1000000, 10, func(rate float64) (bool, error) { return false, nil })
+	assert.NotEqual(t, err, nil, "Unsustainable lowest rate should fail")
+
+	// Probe errors stop the search
+	probeErr := errors.New("probe failed")
+	_, err = findSustainableRate(100, 1000000, 10, func(rate float64) (bool, error) { return rate < 500, probeErr })
+	assert.Equal(t, probeErr, err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- BIDIRECTIONAL --------------------- */
+
+// Returns the subject of the return stream the slave publishes with Bidirectional
+func returnSubject(config configuration) string {
+	return config.Subject + ".rdata"
+}
+
+// Returns the generator of the return stream: byte messages of NumBytes zeros, whatever the scenario of the master
+func returnMessageFunc(config configuration) rawMessageGenerator {
+	return rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, config.NumBytes)))
+}
+
+// Publishes the return stream of a job, counts 0 to total-1, until done or ctx is done
+func publishReturn(ctx context.Context, nc publisher, subject string, total uint64, generateMessage rawMessageGenerator) error {
+	for count := uint64(0); count < total; count++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := nc.Publish(subject, generateMessage(count, total))
+		if err != nil {
+			return errors.Wrapf(err, "slave: unable to publish return message %d", count)
+		}
+	}
+	return nil
+}
+
+// returnCounter counts the return stream at the master like the slave counts the data: every count of the job
+// once, in any order. Safe for concurrent use
+type returnCounter struct {
+	total uint64
+	job   uint64
+	done  chan time.Time // Gets the time the last count arrived
+
+	mu       sync.Mutex
+	seen     *dedup
+	received uint64
+	bytes    uint64
+}
+
+func newReturnCounter(total uint64, job uint64) *returnCounter {
+	return &returnCounter{total: total, job: job, done: make(chan time.Time, 1), seen: newDedup(0, total)}
+}
+
+// Handler for the return subject
+func (r *returnCounter) handler() nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		data := rawMessage(msg.Data)
+		if data.checkHeader() != nil || data.jobID() != r.job || !byteMessage(data.message()).valid() {
+			return
+		}
+		count := byteMessage(data.message()).count()
+		receivedAt := time.Now()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.seen.contains(count) || r.seen.duplicate(count) {
+			return
+		}
+		r.received++
+		r.bytes += uint64(len(msg.Data))
+		if r.received == r.total {
+			r.done <- receivedAt
+		}
+	}
+}
+
+// Returns the messages and bytes received so far
+func (r *returnCounter) counts() (uint64, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received, r.bytes
+}
+
+// Waits for the whole return stream and adds it to res. The duration runs from base, when the master
+// published the start marker that made the slave send
+func (r *returnCounter) wait(ctx context.Context, base time.Time, res *result) error {
+	select {
+	case last := <-r.done:
+		received, bytes := r.counts()
+		res.ReturnMessages = received
+		res.ReturnDuration = last.Sub(base)
+		if res.ReturnDuration > 0 {
+			res.ReturnMessagesPerSecond = float64(received) / res.ReturnDuration.Seconds()
+			res.ReturnBytesPerSecond = float64(bytes) / res.ReturnDuration.Seconds()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// peerConn is one of two fakes connected to each other like two connections to one server. A publish reaches
+// the subscriptions of both ends, and every end counts what it published itself
+type peerConn struct {
+	*fakeConn
+	peer *peerConn
+}
+
+func newPeerConns() (*peerConn, *peerConn) {
+	a, b := &peerConn{fakeConn: newFakeConn()}, &peerConn{fakeConn: newFakeConn()}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *peerConn) Publish(subj string, data []byte) error {
+	return c.PublishMsg(&nats.Msg{Subject: subj, Data: data})
+}
+
+func (c *peerConn) PublishMsg(m *nats.Msg) error {
+	c.fakeConn.PublishMsg(m)
+	c.peer.mu.Lock()
+	handlers := c.peer.handlers[m.Subject]
+	c.peer.mu.Unlock()
+	for _, handler := range handlers {
+		handler(m)
+	}
+	return nil
+}
+
+func (c *peerConn) Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	return fakeRequest(c, subj, data, timeout)
+}
+
+func TestBidirectional(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Total = 500
+	config.NumBytes = 64
+	config.Bidirectional = true
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, 128)))
+
+	master, slave := newPeerConns()
+	stop, err := startSlave(slave, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, master, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+
+	// Both streams are complete and counted on their own
+	assert.Equal(t, int(config.Total)+1, master.count(config.DataSubject), "Start marker and the data")
+	assert.Equal(t, int(config.Total), slave.count(returnSubject(config)), "Return stream")
+	assert.Equal(t, config.Total, res.TotalMessages)
+	assert.Equal(t, config.Total, res.ReturnMessages)
+	assert.True(t, res.ReturnDuration > 0, "Return duration")
+	assert.True(t, res.ReturnMessagesPerSecond > 0, "Return throughput")
+	size := len(returnMessageFunc(config)(1, 1))
+	assert.InDelta(t, res.ReturnMessagesPerSecond*float64(size), res.ReturnBytesPerSecond, 1, "Bytes of the return stream")
+}
+
+func TestBidirectionalNoReturn(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Bidirectional = true
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	// A slave without Bidirectional completes the data but never sends the return stream
+	master, slave := newPeerConns()
+	slaveConfig := config
+	slaveConfig.Bidirectional = false
+	stop, err := startSlave(slave, slaveConfig, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = runMaster(ctx, master, config, generateMessage, log)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestReturnCounter(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	counter := newReturnCounter(3, 0)
+	handler := counter.handler()
+
+	// Duplicates, counts outside the stream and garbage are not counted
+	for _, count := range []uint64{2, 2, 7, 0} {
+		handler(&nats.Msg{Data: generateMessage(count, 3)})
+	}
+	handler(&nats.Msg{Data: []byte("garbage")})
+	received, bytes := counter.counts()
+	assert.Equal(t, uint64(2), received)
+	assert.Equal(t, uint64(2*len(generateMessage(0, 3))), bytes)
+	select {
+	case <-counter.done:
+		t.Fatal("Done before the whole stream")
+	default:
+	}
+
+	base := time.Now().Add(-time.Second)
+	handler(&nats.Msg{Data: generateMessage(1, 3)})
+	var res result
+	assert.Equal(t, nil, counter.wait(context.Background(), base, &res))
+	assert.Equal(t, uint64(3), res.ReturnMessages)
+	assert.True(t, res.ReturnDuration >= time.Second, "Duration runs from base")
+}
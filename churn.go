@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/* --------------------- SUBJECT CHURN --------------------- */
+
+// churnStats is what the churn loop did during a run
+type churnStats struct {
+	subscribed   uint64
+	unsubscribed uint64
+	errors       uint64
+	duration     time.Duration
+}
+
+// Returns the achieved subscribe and unsubscribe rates per second
+func (c churnStats) rates() (float64, float64) {
+	if c.duration <= 0 {
+		return 0, 0
+	}
+	return float64(c.subscribed) / c.duration.Seconds(), float64(c.unsubscribed) / c.duration.Seconds()
+}
+
+// churnSubjects subscribes to a fresh subject under prefix and unsubscribes right away, paced to rate per second
+// Stresses the subscription management of the server, like ephemeral inboxes and per-entity subjects do
+// Stops when ctx is done or after limit subscriptions. 0 means no limit
+func churnSubjects(ctx context.Context, nc subscriber, prefix string, rate float64, limit uint64) (stats churnStats) {
+	start := time.Now()
+	defer func() { stats.duration = time.Since(start) }()
+
+	for n := uint64(0); limit == 0 || n < limit; n++ {
+		due := start.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return stats
+			}
+		} else if ctx.Err() != nil {
+			return stats
+		}
+
+		sub, err := subscribe(nc, fmt.Sprintf("%s.%d", prefix, n), func(*nats.Msg) {})
+		if err != nil {
+			stats.errors++
+			continue
+		}
+		stats.subscribed++
+
+		if err := sub.Unsubscribe(); err != nil {
+			stats.errors++
+			continue
+		}
+		stats.unsubscribed++
+	}
+	return stats
+}
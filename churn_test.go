@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChurnSubjects(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+
+	// Every subscription is created and removed again
+	stats := churnSubjects(context.Background(), nc, "go-nats-go.churn", 1000, 50)
+	assert.Equal(t, uint64(50), stats.subscribed)
+	assert.Equal(t, uint64(50), stats.unsubscribed)
+	assert.Equal(t, uint64(0), stats.errors)
+	assert.Equal(t, 0, nc.NumSubscriptions())
+
+	subscribeRate, unsubscribeRate := stats.rates()
+	assert.True(t, subscribeRate > 0 && subscribeRate <= 1100, "Churn not paced to the rate")
+	assert.Equal(t, subscribeRate, unsubscribeRate)
+
+	// Without limit the churn stops with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stats = churnSubjects(ctx, nc, "go-nats-go.churn", 1000, 0)
+	assert.True(t, stats.subscribed > 0, "No churn before the context was done")
+	assert.Equal(t, stats.subscribed, stats.unsubscribed)
+	assert.Equal(t, 0, nc.NumSubscriptions())
+}
@@ -0,0 +1,68 @@
+package main
+
+import "math"
+
+/* --------------------- DEDUP --------------------- */
+
+// Counts per chunk of the bitset of a dedup
+const dedupChunk = 1 << 16
+
+// dedup remembers the counts seen in a job of total messages starting at start
+// The bitset grows in chunks as counts arrive, so the slave never allocates for the Total a message claims
+type dedup struct {
+	start    uint64
+	total    uint64
+	seen     map[uint64]*[dedupChunk / 64]uint64 // One bit per count, by chunk
+	distinct uint64                              // Counts seen at least once
+}
+
+func newDedup(start uint64, total uint64) *dedup {
+	return &dedup{start: start, total: total, seen: map[uint64]*[dedupChunk / 64]uint64{}}
+}
+
+// Returns true if count belongs to the job
+func (d *dedup) contains(count uint64) bool {
+	return count >= d.start && count-d.start < d.total
+}
+
+// Returns true if count was seen before, and marks it seen. Counts outside the job are never duplicates
+func (d *dedup) duplicate(count uint64) bool {
+	if !d.contains(count) {
+		return false
+	}
+	i := count - d.start
+	chunk, ok := d.seen[i/dedupChunk]
+	if !ok {
+		chunk = &[dedupChunk / 64]uint64{}
+		d.seen[i/dedupChunk] = chunk
+	}
+	word, bit := i%dedupChunk/64, uint64(1)<<(i%64)
+	if chunk[word]&bit != 0 {
+		return true
+	}
+	chunk[word] |= bit
+	d.distinct++
+	return false
+}
+
+// Returns the number of distinct counts of the job seen so far
+func (d *dedup) count() uint64 {
+	return d.distinct
+}
+
+// Returns true if the master resends the i:th message of a job of total to inject fraction duplicates
+// Spread evenly, never the last message since its resend would arrive after the slave completed the job
+func duplicateAt(i uint64, total uint64, fraction float64) bool {
+	if fraction <= 0 || i+1 >= total {
+		return false
+	}
+	return math.Floor(float64(i+1)*fraction) > math.Floor(float64(i)*fraction)
+}
+
+// Returns the number of duplicates duplicateAt injects in a job of total
+func injectedDuplicates(total uint64, fraction float64) uint64 {
+	if fraction <= 0 || total == 0 {
+		return 0
+	}
+	return uint64(math.Floor(float64(total-1) * fraction))
+}
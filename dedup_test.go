@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+	d := newDedup(100, 130)
+	for count := uint64(100); count < 230; count++ {
+		assert.False(t, d.duplicate(count), "First time should not be a duplicate")
+	}
+	assert.True(t, d.duplicate(100), "Second time should be a duplicate")
+	assert.True(t, d.duplicate(229), "Second time should be a duplicate")
+	assert.False(t, d.duplicate(99), "Before the job is never a duplicate")
+	assert.False(t, d.duplicate(230), "After the job is never a duplicate")
+	assert.Equal(t, uint64(130), d.count(), "Every count once, duplicates and other jobs not at all")
+
+	assert.True(t, d.contains(100))
+	assert.True(t, d.contains(229))
+	assert.False(t, d.contains(99))
+	assert.False(t, d.contains(230))
+
+	// A huge Total allocates only the chunks of the counts seen
+	d = newDedup(math.MaxUint64-10, math.MaxUint64)
+	assert.False(t, d.duplicate(math.MaxUint64-10))
+	assert.False(t, d.duplicate(math.MaxUint64-1))
+	assert.True(t, d.duplicate(math.MaxUint64-1), "Second time should be a duplicate")
+	assert.False(t, d.duplicate(100), "Before the job is never a duplicate")
+	assert.Equal(t, 1, len(d.seen))
+	d = newDedup(0, 1<<60)
+	assert.False(t, d.duplicate(0))
+	assert.False(t, d.duplicate(1<<59))
+	assert.True(t, d.duplicate(1<<59), "Second time should be a duplicate")
+	assert.Equal(t, 2, len(d.seen))
+}
+
+func TestSlaveHugeTotal(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	// A Total the slave could never hold a bitset for, and one that overflows when rounded up to words
+	for _, total := range []uint64{1 << 60, math.MaxUint64} {
+		publishStart(nc, config.DataSubject, 0, generateMessage)
+		assert.NotPanics(t, func() {
+			nc.Publish(config.DataSubject, generateMessage(0, total))
+			nc.Publish(config.DataSubject, generateMessage(total-2, total))
+			nc.Publish(config.DataSubject, generateMessage(total-2, total))
+		})
+	}
+}
+
+func TestDuplicateAt(t *testing.T) {
+	for _, fraction := range []float64{0, 0.1, 0.25, 1} {
+		var n uint64
+		for i := uint64(0); i < 1000; i++ {
+			if duplicateAt(i, 1000, fraction) {
+				n++
+			}
+		}
+		assert.Equal(t, injectedDuplicates(1000, fraction), n)
+	}
+	assert.Equal(t, uint64(99), injectedDuplicates(1000, 0.1))
+	assert.False(t, duplicateAt(999, 1000, 1), "The last message is never resent")
+}
+
+func TestInjectedDuplicates(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Total = 1000
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Master.DuplicateFraction = 0.2
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Run with duplicates should complete")
+	assert.Equal(t, uint64(199), res.InjectedDuplicates)
+	assert.Equal(t, res.InjectedDuplicates, res.Duplicates)
+	assert.Equal(t, int(config.Total+res.InjectedDuplicates)+1, nc.count("go-nats-go.data"))
+}
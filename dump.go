@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- DUMP --------------------- */
+
+// Messages are framed with their length so they can be read back from a stream
+//
+// [length (4 bytes)][message (length bytes)]
+
+// Writes msg as a single frame to w
+func writeFrame(w io.Writer, msg []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(msg)))
+	_, err := w.Write(length[:])
+	if err != nil {
+		return errors.Wrap(err, "frame: unable to write length")
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return errors.Wrap(err, "frame: unable to write message")
+	}
+	return nil
+}
+
+// Reads the next frame from r. Returns io.EOF when there are no more frames
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r, length[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "frame: unable to read length")
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "frame: unable to read message")
+	}
+	return msg, nil
+}
+
+// Writes the config.Total messages the master would publish as frames to fileName instead of publishing them
+func dumpMessages(fileName string, config configuration, generateMessage rawMessageGenerator) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrap(err, "dump: unable to create file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	generateMessage = magicMessageFunc(config.Magic, sendTimeMessageFunc(config.StampSendTime, time.Now, generateMessage))
+	var count uint64
+	for ; count < config.Total; count++ {
+		err = writeFrame(w, generateMessage(count, config.Total))
+		if err != nil {
+			return errors.Wrap(err, "dump")
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return errors.Wrap(err, "dump: unable to write file")
+	}
+	return f.Close()
+}
+
+// Returns a hex dump of the wire header of raw: type, format, version, flags and job ID, then the first 24 bytes of the
+// message body, which are count, total and length of a plain byte message
+func headerDump(raw rawMessage) string {
+	if len(raw) < headerSize {
+		return fmt.Sprintf("short message % x", []byte(raw))
+	}
+	body := raw.message()
+	if len(body) > 24 {
+		body = body[:24]
+	}
+	return fmt.Sprintf("type=%s format=%s version=%d flags=%#02x job=%d [% x] [% x]", raw.messageType(), raw.format(), raw.version(), raw.flags(), raw.jobID(), []byte(raw[:headerSize]), body)
+}
+
+// Wraps generateMessage and logs the header of the messages with count first and last
+func headerLoggingFunc(generateMessage rawMessageGenerator, first uint64, last uint64, log *logrus.Logger) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		if total != 0 && (count == first || count == last) {
+			log.Logf(logrus.InfoLevel, "Sent header count=%d %s", count, headerDump(msg))
+		}
+		return msg
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nats-go")
+	assert.Equal(t, err, nil, "TempDir failed")
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "dump.bin")
+
+	data := []byte("This is the test string that is the bulk of our message")
+	config := testConfig()
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+	err = dumpMessages(fileName, config, generateMessage)
+	assert.Equal(t, err, nil, "dumpMessages failed")
+
+	f, err := os.Open(fileName)
+	assert.Equal(t, err, nil, "Unable to open dump")
+	defer f.Close()
+
+	// Total frames in order, that decode like on the slave
+	var count uint64
+	for {
+		frame, err := readFrame(f)
+		if err == io.EOF {
+			break
+		}
+		assert.Equal(t, err, nil, "readFrame failed")
+
+		raw := rawMessage(frame)
+		assert.Equal(t, "byte", raw.messageType())
+		assert.Equal(t, "byte", raw.format())
+		message := byteMessage(raw.message())
+		assert.Equal(t, count, message.count())
+		assert.Equal(t, config.Total, message.total())
+		assert.Equal(t, data, message.data())
+		count++
+	}
+	assert.Equal(t, config.Total, count)
+}
+
+func TestHeaderDump(t *testing.T) {
+	generateMessage := jobMessageFunc(0x0102, rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data"))))
+	assert.Equal(t, "type=byte format=byte version=3 flags=0x00 job=258 [62 79 74 65 62 79 74 65 03 00 00 00 00 00 00 00 01 02] "+
+		"[00 00 00 00 00 00 00 03 00 00 00 00 00 00 00 0a 00 00 00 00 00 00 00 04]",
+		headerDump(generateMessage(3, 10)))
+	assert.Equal(t, "short message 62 79", headerDump(rawMessage("by")))
+
+	// Only the first and last message are logged
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	logged := headerLoggingFunc(generateMessage, 5, 14, log)
+	logged(5, 0) // Start marker
+	for count := uint64(5); count < 15; count++ {
+		logged(count, 10)
+	}
+	assert.Equal(t, 2, strings.Count(output.String(), "Sent header"))
+	assert.Contains(t, output.String(), "Sent header count=5 type=byte format=byte")
+	assert.Contains(t, output.String(), "Sent header count=14 type=byte format=byte")
+}
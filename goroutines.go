@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* --------------------- GOROUTINES --------------------- */
+
+// A run may end with this many more goroutines than it started with before it is reported as a likely leak
+// nats and the runtime may be a little late to wind down their own
+const goroutineLeakTolerance = 2
+
+// goroutineSampler tracks the number of goroutines over a run
+type goroutineSampler struct {
+	mu    sync.Mutex
+	start int
+	max   int
+}
+
+// Records a sample
+func (s *goroutineSampler) sample(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.max {
+		s.max = n
+	}
+}
+
+// Samples count every interval until the returned func is called. The func takes the final sample and adds
+// start, max and final to res. An interval of 0 samples nothing and the func does nothing
+func sampleGoroutines(interval time.Duration, count func() int) func(res *result) {
+	if interval <= 0 {
+		return func(*result) {}
+	}
+
+	s := &goroutineSampler{start: count()}
+	s.sample(s.start)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample(count())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func(res *result) {
+		close(done)
+		<-stopped // The sampler is not counted in the final sample
+		final := count()
+		s.sample(final)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		res.StartGoroutines, res.MaxGoroutines, res.FinalGoroutines = s.start, s.max, final
+	}
+}
+
+// Returns true if res ended with more goroutines than it started with, beyond goroutineLeakTolerance
+func goroutinesLeaked(res result) bool {
+	return res.MaxGoroutines > 0 && res.FinalGoroutines-res.StartGoroutines > goroutineLeakTolerance
+}
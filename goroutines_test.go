@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleGoroutines(t *testing.T) {
+	// Off
+	var res result
+	sampleGoroutines(0, func() int { return 100 })(&res)
+	assert.Equal(t, 0, res.MaxGoroutines, "Sampled with interval 0")
+
+	// The count peaks during the run and drops back
+	var n int64 = 10
+	count := func() int { return int(atomic.LoadInt64(&n)) }
+	stop := sampleGoroutines(time.Millisecond, count)
+	atomic.StoreInt64(&n, 25)
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt64(&n, 11)
+	time.Sleep(20 * time.Millisecond)
+	stop(&res)
+	assert.Equal(t, 10, res.StartGoroutines)
+	assert.Equal(t, 25, res.MaxGoroutines)
+	assert.Equal(t, 11, res.FinalGoroutines)
+	assert.False(t, goroutinesLeaked(res), "Within tolerance")
+
+	// The final count is a sample too
+	stop = sampleGoroutines(time.Hour, count)
+	atomic.StoreInt64(&n, 40)
+	stop(&res)
+	assert.Equal(t, 40, res.MaxGoroutines)
+	assert.True(t, goroutinesLeaked(res), "Growth not detected")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- JETSTREAM --------------------- */
+
+// Time to wait for an answer of the JetStream API, and for the ack of every published message. A variable for the tests
+var jetStreamTimeout = 5 * time.Second
+
+// jetStreamer is the part of *nats.Conn needed to use JetStream
+type jetStreamer interface {
+	JetStream(opts ...nats.JSOpt) (nats.JetStreamContext, error)
+}
+
+// Returns the JetStream context of nc, waiting up to jetStreamTimeout for every answer
+func jetStreamContext(nc jetStreamer) (nats.JetStreamContext, error) {
+	js, err := nc.JetStream(nats.MaxWait(jetStreamTimeout))
+	if err != nil {
+		return nil, errors.Wrap(err, "jetstream: unable to get the JetStream context")
+	}
+	return js, nil
+}
+
+// Returns true if err means that nobody answers the JetStream API
+func jetStreamDisabled(err error) bool {
+	return err == nats.ErrJetStreamNotEnabled || err == nats.ErrNoResponders || err == nats.ErrTimeout
+}
+
+// Creates the file stream name capturing subjects unless it exists
+func ensureStream(js nats.JetStreamManager, name string, subjects []string) error {
+	_, err := js.StreamInfo(name)
+	switch {
+	case err == nil:
+		return nil
+	case jetStreamDisabled(err):
+		return errors.Wrapf(err, "jetstream: no answer for stream %s. Is JetStream enabled?", name)
+	case err != nats.ErrStreamNotFound:
+		return errors.Wrapf(err, "jetstream: stream %s", name)
+	}
+	_, err = js.AddStream(&nats.StreamConfig{Name: name, Subjects: subjects, Storage: nats.FileStorage})
+	if err != nil {
+		return errors.Wrapf(err, "jetstream: unable to create stream %s", name)
+	}
+	return nil
+}
+
+// Subscribes handler to subject with the durable push consumer of stream, delivering new messages to deliver
+// The consumer is created unless it exists and continues where it left off. Every message is acked once handled
+func subscribeDurable(js nats.JetStream, stream string, subject string, durable string, deliver string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := js.Subscribe(subject, handler, nats.BindStream(stream), nats.Durable(durable), nats.DeliverSubject(deliver), nats.DeliverNew(), nats.AckExplicit())
+	if err != nil {
+		return nil, errors.Wrapf(err, "jetstream: unable to consume stream %s as %s", stream, durable)
+	}
+	return sub, nil
+}
+
+// Returns the durable name of the slave's consumer, the same from run to run
+func durableName(config configuration) string {
+	return fmt.Sprintf("%s-slave", config.StreamName)
+}
+
+// Returns the subject the consumer of the slave delivers to
+func deliverSubject(config configuration) string {
+	return config.Subject + ".deliver"
+}
+
+// Returns the Nats-Msg-Id of message count of job. The stream drops a message with an ID it stored within its
+// duplicate window, the job keeps the IDs of one run from suppressing the messages of the next
+func dedupMsgID(job uint64, count uint64) string {
+	return fmt.Sprintf("%d-%d", job, count)
+}
+
+// Publishes msg on subject, with the Nats-Msg-Id msgID(count) if msgID is set
+func publishCount(nc publisher, subject string, msg rawMessage, count uint64, msgID func(uint64) string) error {
+	if msgID == nil {
+		return nc.Publish(subject, msg)
+	}
+	m := nats.NewMsg(subject)
+	m.Data = msg
+	m.Header.Set(nats.MsgIdHdr, msgID(count))
+	return publishMsg(nc, m)
+}
+
+// Publishes m with its headers if nc can send headers
+func publishMsg(nc publisher, m *nats.Msg) error {
+	p, ok := nc.(msgPublisher)
+	if !ok {
+		return errors.New("master: DedupMsgID needs a publisher that sends headers")
+	}
+	return p.PublishMsg(m)
+}
+
+// jetStreamPublisher publishes every message to JetStream and waits for the stream to ack it, so the
+// throughput is that of persisted messages
+type jetStreamPublisher struct {
+	js         nats.JetStream
+	duplicates uint64 // Acked as a duplicate of a Nats-Msg-Id the stream had stored, not stored again
+}
+
+func (p *jetStreamPublisher) Publish(subj string, data []byte) error {
+	return p.PublishMsg(&nats.Msg{Subject: subj, Data: data})
+}
+
+func (p *jetStreamPublisher) PublishMsg(m *nats.Msg) error {
+	ack, err := p.js.PublishMsg(m)
+	if err != nil {
+		return errors.Wrapf(err, "jetstream: message on %s not stored", m.Subject)
+	}
+	if ack.Duplicate {
+		atomic.AddUint64(&p.duplicates, 1)
+	}
+	return nil
+}
+
+// Returns the number of messages the stream acked as duplicates. Safe for concurrent use
+func (p *jetStreamPublisher) duplicateCount() uint64 {
+	return atomic.LoadUint64(&p.duplicates)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts an embedded server with JetStream enabled, storing in a temporary directory
+func runJetStreamServer(t *testing.T) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	return natsserver.RunServer(&opts)
+}
+
+func TestJetStream(t *testing.T) {
+	s := runJetStreamServer(t)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	config := testConfig()
+	config.Total = 5
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.UseJetStream = true
+	config.StreamName = "GO-NATS-GO"
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	slaveNC, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect slave")
+	defer slaveNC.Close()
+	stop, err := startSlave(slaveNC, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+	slaveNC.Flush()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect master")
+	defer nc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+	assert.Equal(t, config.Total, res.TotalMessages)
+
+	js, err := nc.JetStream()
+	assert.Equal(t, err, nil, "Unable to get the JetStream context")
+	stream, err := js.StreamInfo(config.StreamName)
+	assert.Equal(t, err, nil, "Stream not created")
+	if err == nil {
+		assert.Equal(t, []string{"go-nats-go.data"}, stream.Config.Subjects)
+		assert.Equal(t, config.Total+1, stream.State.Msgs, "Start marker and data should be stored")
+	}
+
+	// The slave acks the last message after it completed the job
+	var consumer *nats.ConsumerInfo
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		consumer, err = js.ConsumerInfo(config.StreamName, durableName(config))
+		if err == nil && consumer.AckFloor.Consumer == config.Total+1 {
+			break
+		}
+	}
+	assert.Equal(t, err, nil, "Consumer not created")
+	if err == nil {
+		assert.Equal(t, "go-nats-go.deliver", consumer.Config.DeliverSubject)
+		assert.Equal(t, config.Total+1, consumer.AckFloor.Consumer, "Slave should ack every message")
+		assert.Equal(t, 0, consumer.NumAckPending)
+	}
+
+	// A second slave continues with the same durable consumer
+	stop()
+	stop, err = startSlave(slaveNC, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave should reuse the stream and consumer")
+	defer stop()
+	names := 0
+	for range js.ConsumerNames(config.StreamName) {
+		names++
+	}
+	assert.Equal(t, 1, names, "Consumer created once")
+}
+
+func TestJetStreamErrors(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+
+	// Nobody answers without JetStream
+	defer func(timeout time.Duration) { jetStreamTimeout = timeout }(jetStreamTimeout)
+	jetStreamTimeout = 100 * time.Millisecond
+	js, err := jetStreamContext(nc)
+	assert.Equal(t, err, nil, "jetStreamContext failed")
+	err = ensureStream(js, "GO-NATS-GO", []string{"go-nats-go.data"})
+	assert.NotEqual(t, err, nil, "Stream without JetStream should fail")
+	if err != nil {
+		assert.Contains(t, err.Error(), "Is JetStream enabled?")
+	}
+
+	// A message no stream captures is not stored
+	s = runJetStreamServer(t)
+	defer s.Shutdown()
+	nc, err = nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+	js, err = jetStreamContext(nc)
+	assert.Equal(t, err, nil, "jetStreamContext failed")
+	err = (&jetStreamPublisher{js: js}).Publish("go-nats-go.data", []byte("data"))
+	assert.NotEqual(t, err, nil, "Publish without stream should fail")
+	if err != nil {
+		assert.Contains(t, err.Error(), "not stored")
+	}
+
+	// Subjects of another stream are rejected
+	err = ensureStream(js, "OTHER", []string{"go-nats-go.data"})
+	assert.Equal(t, err, nil, "ensureStream failed")
+	err = ensureStream(js, "GO-NATS-GO", []string{"go-nats-go.data"})
+	assert.NotEqual(t, err, nil, "Overlapping stream should fail")
+}
+
+// headerPublisher records the Nats-Msg-Id of every published message by its count
+type headerPublisher struct {
+	ids map[uint64]string
+}
+
+func (p *headerPublisher) Publish(subj string, data []byte) error {
+	return p.PublishMsg(&nats.Msg{Subject: subj, Data: data})
+}
+
+func (p *headerPublisher) PublishMsg(m *nats.Msg) error {
+	p.ids[byteMessage(rawMessage(m.Data).message()).count()] = m.Header.Get(nats.MsgIdHdr)
+	return nil
+}
+
+func TestPublishDedupMsgID(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.msgID = func(count uint64) string { return dedupMsgID(42, count) }
+
+	nc := &headerPublisher{ids: map[uint64]string{}}
+	_, err := publishAll(context.Background(), &sentCounter{publisher: nc}, "data", config, generateMessage)
+	assert.Equal(t, err, nil, "publishAll failed")
+	assert.Equal(t, int(config.Total), len(nc.ids))
+	for count, id := range nc.ids {
+		assert.Equal(t, dedupMsgID(42, count), id, "Nats-Msg-Id should be rebuilt from the count")
+	}
+	assert.Equal(t, "42-7", dedupMsgID(42, 7))
+	assert.NotEqual(t, dedupMsgID(42, 7), dedupMsgID(43, 7), "Another job should not collide")
+
+	// Without headers there is no Nats-Msg-Id to set
+	failures, err := publishAll(context.Background(), &flakyPublisher{}, "data", config, generateMessage)
+	assert.Equal(t, err, nil, "skip should not fail")
+	assert.Equal(t, config.Total, failures, "DedupMsgID without headers should fail every publish")
+}
+
+func TestJetStreamDedup(t *testing.T) {
+	s := runJetStreamServer(t)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	config := testConfig()
+	config.Total = 20
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.UseJetStream = true
+	config.StreamName = "GO-NATS-GO"
+	config.DedupMsgID = true
+	config.Master.DuplicateFraction = 0.25
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	slaveNC, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect slave")
+	defer slaveNC.Close()
+	stop, err := startSlave(slaveNC, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+	slaveNC.Flush()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect master")
+	defer nc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+	assert.Equal(t, uint64(4), res.InjectedDuplicates)
+	assert.Equal(t, res.InjectedDuplicates, res.ServerDuplicates, "The stream should suppress every resent message")
+	assert.Equal(t, uint64(0), res.Duplicates, "No duplicate should reach the slave")
+
+	js, err := nc.JetStream()
+	assert.Equal(t, err, nil, "Unable to get the JetStream context")
+	stream, err := js.StreamInfo(config.StreamName)
+	assert.Equal(t, err, nil, "Stream not created")
+	if err == nil {
+		assert.Equal(t, config.Total+1, stream.State.Msgs, "Start marker and data should be stored once")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- LATENCY CSV --------------------- */
+
+// Size of the send time in front of every data message with StampSendTime
+const sendTimeSize = 8
+
+// Wraps a rawMessage generator and prefixes every message with the time it was generated, right before it is published,
+// as unix nanoseconds (big endian). Returns generateMessage as is unless stamp is set
+// Note: the result is no longer a plain rawMessage. Use stripSendTime to remove the prefix
+func sendTimeMessageFunc(stamp bool, now func() time.Time, generateMessage rawMessageGenerator) rawMessageGenerator {
+	if !stamp {
+		return generateMessage
+	}
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		stampedMessage := make(rawMessage, sendTimeSize+len(msg))
+		copy(stampedMessage[sendTimeSize:], msg)
+		binary.BigEndian.PutUint64(stampedMessage, uint64(now().UnixNano()))
+		return stampedMessage
+	}
+}
+
+// Reverses sendTimeMessageFunc. Returns the message and its send time
+func stripSendTime(data rawMessage) (rawMessage, time.Time, error) {
+	if len(data) < sendTimeSize {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("latency: len(data)(%v) too short for a send time", len(data)))
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	return data[sendTimeSize:], sent, nil
+}
+
+// latencyCSV streams one row per data message to a file: count,sent,received,latency,size
+// Times are unix nanoseconds, the latency in nanoseconds and the size the bytes on the wire. Safe for concurrent use
+type latencyCSV struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	err  error // First write error, later rows are dropped
+}
+
+// Creates fileName and writes the csv header
+func createLatencyCSV(fileName string) (*latencyCSV, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "latency: unable to create file")
+	}
+	l := &latencyCSV{file: file, w: bufio.NewWriter(file)}
+	_, l.err = l.w.WriteString("count,sent,received,latency,size\n")
+	return l, l.err
+}
+
+// Writes the row of one message. Buffered, see flush
+func (l *latencyCSV) write(count uint64, sent time.Time, received time.Time, size int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	_, l.err = fmt.Fprintf(l.w, "%d,%d,%d,%d,%d\n", count, sent.UnixNano(), received.UnixNano(), received.Sub(sent).Nanoseconds(), size)
+}
+
+// Writes the buffered rows to the file. Returns the first error of any write
+func (l *latencyCSV) flush() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = l.w.Flush()
+	}
+	return l.err
+}
+
+// Flushes and closes the file
+func (l *latencyCSV) close() error {
+	if l == nil {
+		return nil
+	}
+	err := l.flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/* --------------------- LATENCY HISTOGRAM --------------------- */
+
+// Buckets per power of two in latencyHistogram. Every bucket is at most 1/8 = 12.5% wide
+const histogramSubBuckets = 8
+
+// latencyHistogram counts latencies in log-linear buckets: exact below 8ns, then 8 buckets per power of two.
+// Small enough to send with the completion metric whatever the number of messages. Not safe for concurrent use
+type latencyHistogram struct {
+	Counts []uint64      // Messages per bucket, up to the highest bucket used
+	Max    time.Duration // Exact
+}
+
+// Returns the bucket of d
+func histogramBucket(d time.Duration) int {
+	if d < histogramSubBuckets {
+		if d < 0 {
+			return 0
+		}
+		return int(d)
+	}
+	e := bits.Len64(uint64(d)) // 4 or more
+	m := int(uint64(d) >> uint(e-4))
+	return (e-3)*histogramSubBuckets + m - histogramSubBuckets
+}
+
+// Returns the highest latency in bucket i
+func histogramUpper(i int) time.Duration {
+	if i < histogramSubBuckets {
+		return time.Duration(i)
+	}
+	e := i/histogramSubBuckets + 3
+	m := i%histogramSubBuckets + histogramSubBuckets
+	return time.Duration((uint64(m)+1)<<uint(e-4)) - 1
+}
+
+// Records the latency of one message
+func (h *latencyHistogram) record(d time.Duration) {
+	i := histogramBucket(d)
+	for len(h.Counts) <= i {
+		h.Counts = append(h.Counts, 0)
+	}
+	h.Counts[i]++
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Starts over for a new job
+func (h *latencyHistogram) reset() {
+	h.Counts = h.Counts[:0]
+	h.Max = 0
+}
+
+// Returns a copy of the histogram to send, nil if nothing was recorded
+func (h *latencyHistogram) snapshot() *latencyHistogram {
+	if len(h.Counts) == 0 {
+		return nil
+	}
+	return &latencyHistogram{Counts: append([]uint64(nil), h.Counts...), Max: h.Max}
+}
+
+// latencyPercentiles is the distribution of the time from send to receive of the data messages
+type latencyPercentiles struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Returns the percentiles of the recorded latencies, nil if none. A percentile is the highest latency of its
+// bucket, never above Max
+func (h *latencyHistogram) percentiles() *latencyPercentiles {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	at := func(q float64) time.Duration {
+		rank := uint64(math.Ceil(q * float64(total))) // Nearest rank, 1 based
+		if rank < 1 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range h.Counts {
+			seen += n
+			if seen >= rank {
+				if upper := histogramUpper(i); upper < h.Max {
+					return upper
+				}
+				break
+			}
+		}
+		return h.Max
+	}
+	return &latencyPercentiles{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: h.Max}
+}
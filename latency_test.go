@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendTimeMessageFunc(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	sent := time.Unix(1700000000, 123456789)
+	stamped := sendTimeMessageFunc(true, func() time.Time { return sent }, generateMessage)
+
+	msg, at, err := stripSendTime(stamped(7, 10))
+	assert.Equal(t, err, nil, "stripSendTime failed")
+	assert.Equal(t, sent.UnixNano(), at.UnixNano())
+	assert.Equal(t, generateMessage(7, 10), msg)
+
+	_, _, err = stripSendTime(rawMessage{1, 2, 3})
+	assert.NotEqual(t, err, nil, "Short message should fail")
+
+	// Unstamped messages are left alone
+	assert.Equal(t, generateMessage(7, 10), sendTimeMessageFunc(false, time.Now, generateMessage)(7, 10))
+}
+
+func TestLatencyFile(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	fileName := filepath.Join(t.TempDir(), "latency.csv")
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.StampSendTime = true
+	config.Slave.LatencyFile = fileName
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	var completion metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		decodeMetric(msg.Data, &completion)
+	})
+
+	// Every message sent a second ago
+	sent := time.Now().Add(-time.Second)
+	generateMessage := sendTimeMessageFunc(true, func() time.Time { return sent },
+		rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data"))))
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	stop()
+
+	// The completion carries the latency histogram
+	assert.NotEqual(t, (*latencyHistogram)(nil), completion.Latency, "No latency histogram")
+	if completion.Latency != nil {
+		assert.True(t, completion.Latency.percentiles().P50 >= time.Second, "Latency shorter than the delay")
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	assert.Equal(t, err, nil, "ReadFile failed")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, "count,sent,received,latency,size", lines[0])
+	assert.Equal(t, int(config.Total)+1, len(lines), "One row per message")
+	for i, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		assert.Equal(t, 5, len(fields))
+		values := make([]int64, len(fields))
+		for j, field := range fields {
+			values[j], err = strconv.ParseInt(field, 10, 64)
+			assert.Equal(t, err, nil, "Not a number in "+line)
+		}
+		assert.Equal(t, int64(i), values[0], "Rows should be in count order")
+		assert.Equal(t, sent.UnixNano(), values[1])
+		assert.Equal(t, values[2]-values[1], values[3], "Latency should be received - sent")
+		assert.True(t, values[3] >= int64(time.Second), "Latency shorter than the delay")
+		assert.Equal(t, int64(len(generateMessage(uint64(i), config.Total))), values[4])
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	// Every bucket holds d and is at most 12.5% wide
+	for d := time.Duration(0); d < 10*time.Second; d = d*9/8 + 1 {
+		upper := histogramUpper(histogramBucket(d))
+		assert.True(t, upper >= d, fmt.Sprintf("Bucket of %d ends at %d", d, upper))
+		assert.True(t, upper <= d+d/8, fmt.Sprintf("Bucket of %d ends at %d", d, upper))
+	}
+
+	h := &latencyHistogram{}
+	assert.Equal(t, (*latencyPercentiles)(nil), h.percentiles())
+	assert.Equal(t, (*latencyHistogram)(nil), h.snapshot())
+
+	// 1ms to 100ms, in random order
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		h.record(time.Duration(i+1) * time.Millisecond)
+	}
+	p := h.percentiles()
+	for _, c := range []struct {
+		name  string
+		got   time.Duration
+		exact time.Duration
+	}{{"p50", p.P50, 50 * time.Millisecond}, {"p95", p.P95, 95 * time.Millisecond}, {"p99", p.P99, 99 * time.Millisecond}} {
+		assert.True(t, c.got >= c.exact && c.got <= c.exact+c.exact/8, fmt.Sprintf("%s=%v, expected %v", c.name, c.got, c.exact))
+	}
+	assert.Equal(t, 100*time.Millisecond, p.Max)
+
+	// Short latencies are exact, and a percentile never exceeds the max
+	h.reset()
+	for _, d := range []time.Duration{1, 2, 3, 4, 5} {
+		h.record(d)
+	}
+	assert.Equal(t, latencyPercentiles{P50: 3, P95: 5, P99: 5, Max: 5}, *h.snapshot().percentiles())
+}
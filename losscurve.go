@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- LOSS CURVE --------------------- */
+
+// lossPoint is the message loss at one offered rate
+type lossPoint struct {
+	Rate     float64 // Offered msgs/sec
+	Sent     uint64
+	Received uint64
+	Loss     float64 // Percent of Sent not received
+}
+
+// Runs step at every rate in order and returns the loss per rate. step sends total messages and returns the number received
+func lossCurve(rates []float64, total uint64, step func(rate float64) (uint64, error)) ([]lossPoint, error) {
+	points := make([]lossPoint, 0, len(rates))
+	for _, rate := range rates {
+		received, err := step(rate)
+		if err != nil {
+			return points, err
+		}
+		point := lossPoint{Rate: rate, Sent: total, Received: received}
+		if received < total {
+			point.Loss = float64(total-received) / float64(total) * 100
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// Returns the loss curve as csv: rate,loss% per line
+func lossCSV(points []lossPoint) string {
+	var b bytes.Buffer
+	b.WriteString("rate,loss%\n")
+	for _, p := range points {
+		fmt.Fprintf(&b, "%.0f,%.2f\n", p.Rate, p.Loss)
+	}
+	return b.String()
+}
+
+// receivedReply is the slave's answer on Subject+".received"
+type receivedReply struct {
+	Received uint64 // Data messages received since the slave started, start markers included
+}
+
+// Subscribes to subject and replies to every request with the number of data messages received so far
+func serveReceived(nc subscriber, subject string, received *uint64) (*nats.Subscription, error) {
+	return subscribe(nc, subject, func(msg *nats.Msg) {
+		bytes, _ := json.Marshal(&receivedReply{atomic.LoadUint64(received)})
+		msg.Respond(bytes)
+	})
+}
+
+// Asks the slave on subject how many data messages it has received so far
+func queryReceived(nc requester, subject string, timeout time.Duration) (uint64, error) {
+	msg, err := nc.Request(subject, nil, timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "losscurve: slave not reachable on subject %s", subject)
+	}
+	reply := receivedReply{}
+	err = json.Unmarshal(msg.Data, &reply)
+	if err != nil {
+		return 0, errors.Wrapf(err, "losscurve: unexpected reply on subject %s", subject)
+	}
+	return reply.Received, nil
+}
+
+// runLossCurve runs config.Total messages at every rate of config.Master.LossCurveRates and returns the loss per rate
+// The slave counts what it receives until config.Master.TargetLatency after the last message is due. The rest is lost
+func runLossCurve(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) ([]lossPoint, error) {
+	subject := config.Subject + ".received"
+	step := func(rate float64) (uint64, error) {
+		before, err := queryReceived(nc, subject, config.Master.CanaryTimeout)
+		if err != nil {
+			return 0, err
+		}
+
+		stepConfig := config
+		stepConfig.Master.RateLimit = rate
+		expected := time.Duration(float64(config.Total) / rate * float64(time.Second))
+		stepCtx, cancel := context.WithTimeout(ctx, expected+config.Master.TargetLatency)
+		defer cancel()
+		_, err = runMaster(stepCtx, nc, stepConfig, generateMessage, log)
+		switch {
+		case ctx.Err() != nil:
+			return 0, ctx.Err()
+		case err == nil, err == context.DeadlineExceeded, err == errIdleTimeout:
+		default:
+			return 0, err
+		}
+
+		after, err := queryReceived(nc, subject, config.Master.CanaryTimeout)
+		if err != nil {
+			return 0, err
+		}
+		received := after - before
+		if received > 0 {
+			received-- // The start marker
+		}
+		log.Logf(logrus.InfoLevel, "Loss curve rate=%.0f msgs/sec received=%d of %d", rate, received, config.Total)
+		return received, nil
+	}
+
+	return lossCurve(config.Master.LossCurveRates, config.Total, step)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLossCurve(t *testing.T) {
+	// A simulated system that delivers everything up to 5000 msgs/sec and then at most 5000 msgs/sec
+	var total uint64 = 1000
+	step := func(rate float64) (uint64, error) {
+		if rate <= 5000 {
+			return total, nil
+		}
+		return uint64(float64(total) * 5000 / rate), nil
+	}
+
+	points, err := lossCurve([]float64{1000, 5000, 10000, 20000}, total, step)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []lossPoint{
+		{Rate: 1000, Sent: 1000, Received: 1000, Loss: 0},
+		{Rate: 5000, Sent: 1000, Received: 1000, Loss: 0},
+		{Rate: 10000, Sent: 1000, Received: 500, Loss: 50},
+		{Rate: 20000, Sent: 1000, Received: 250, Loss: 75},
+	}, points)
+	assert.Equal(t, "rate,loss%\n1000,0.00\n5000,0.00\n10000,50.00\n20000,75.00\n", lossCSV(points))
+
+	// Duplicates never make a negative loss
+	points, _ = lossCurve([]float64{1000}, total, func(float64) (uint64, error) { return total + 5, nil })
+	assert.Equal(t, 0.0, points[0].Loss)
+
+	// A failing step stops the curve with the points so far
+	points, err = lossCurve([]float64{1000, 5000}, total, func(rate float64) (uint64, error) {
+		if rate > 1000 {
+			return 0, errors.New("slave gone")
+		}
+		return total, nil
+	})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 1, len(points))
+}
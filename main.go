@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/direktoren/go-nats-go/pkg/easycrypt"
@@ -17,418 +27,2646 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/tkanos/gonfig"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 /* --------------------- CONFIGURATION --------------------- */
 
 type configuration struct {
-	Subject       string
-	Total         uint64
-	NATSServerURL string
-	Timeout       time.Duration
+	Subject          string
+	Total            uint64
+	MaxTotal         uint64 // Safety cap on Total against typos flooding a shared server. Defaults to defaultMaxTotal
+	OverrideMaxTotal bool   // Set to allow a Total above MaxTotal
+	NATSServerURL    string
+	TLSCert          string // Client certificate file (PEM) for a server that verifies clients. Requires TLSKey
+	TLSKey           string // Private key file (PEM) of TLSCert
+	TLSCACert        string // CA certificate file (PEM) to verify the server with. Empty means the system roots
+	Username         string // Authenticate with Username and Password. Only one of Username, Token and CredentialsFile
+	Password         string
+	Token            string        // Authenticate with a token
+	CredentialsFile  string        // Authenticate with a .creds file holding a user JWT and nkey seed
+	StartupJitter    time.Duration // Sleep a random duration up to this long before connecting, to stagger many clients. 0 means no delay
+	NoEcho           bool          // The server does not deliver messages back to the connection that published them
+	ReconnectBufSize int           // Bytes buffered while disconnected. 0 means the nats default (8MB), -1 disables buffering
+	MaxReconnects    int           // Reconnect attempts after the server is lost. 0 means the nats default (60), -1 forever
+	ReconnectWait    time.Duration // Wait between reconnect attempts. 0 means the nats default (2s)
+	Pedantic         bool          // The server checks every protocol message strictly, e.g. subject names. For debugging
+	Verbose          bool          // The server acknowledges every protocol message. For debugging
+	Timeout          time.Duration // Slave stays alive this long. Default for Master.MaxRuntime
 
 	Scenario         string
 	AESEncryptionKey string
+	AESPassphrase    string // Instead of AESEncryptionKey: the key is derived from the passphrase with PBKDF2
+	AESSalt          string // Salt for AESPassphrase, the same on master and slave. Defaults to "go-nats-go"
+	CipherSuite      string // Cipher of the ".encrypted" scenarios: "aes-gcm" (default) or "chacha20". The slave decrypts either
 
-	NumBytes uint
-	Filename string
-}
+	Template     string                 // Scenario "json.template": path to a Go text/template that renders the JSON data of a message
+	TemplateVars map[string]interface{} // Variables for Template as .Vars. .Count and .Total are set per message
 
-func readConfig(fileName string, config *configuration) error {
-	err := gonfig.GetConf(fileName, config)
-	if err != nil {
-		return errors.Wrap(err, "config: gonfig.getconf issue")
-	}
+	Mix map[string]float64 // Scenario "mix": weight per message kind, e.g. {"byte": 70, "json": 20, "json.encrypted": 10}
 
-	// Now verify some of the configs
-	if len(config.AESEncryptionKey) != 32 {
-		return errors.New("config: len(config.AESEncryptionKey) != 32")
-	}
+	NumBytes  uint
+	Filename  string
+	ChunkSize uint // Scenario "file.stream": bytes of the file per message. Defaults to 64KiB
 
-	if config.Subject == "" {
-		config.Subject = "go-nats-go"
-	}
+	SeedTransform string // Scenario "file.seeded": "xor" (default), "append" or "rotate" applied to the file for every message
 
-	if config.NATSServerURL == "" {
-		config.NATSServerURL = nats.DefaultURL
-	}
+	TransformChain []string // Ordered payload transforms, e.g. ["compress:gzip","encrypt:gcm","checksum:crc32"]. Requires a scenario without encryption
 
-	return nil
-}
+	Checksum bool // Master appends a crc32 of the body to every plain message (format "ck32"), the slave drops mismatches
 
-/* --------------------- BYTE MESSAGE STRUCTURE  ---------------------
+	CompressionLevel int // gzip level 1 (best speed) to 9 (best compression). 0 means gzip default
 
-			Type		Format			Message
-			[4]byte		[4]byte			[]byte
+	RandomSource string // "crypto" (default) or "math"
+	RandomSeed   int64  // Seed for "math". 0 means derived from -seed
 
-Type									Count				Total				Data
-			"byte"					-->	[8]byte (uint64)	[8]byte (uint64)	[]byte
+	CompletionSubject string // Subject for the final completion signal. Defaults to Subject+".done"
+	DataSubject       string // Subject of the data messages. Defaults to Subject+".data"
+	MetricSubject     string // Subject of the first and progress metrics. Defaults to Subject+".metric"
 
-			"json"					-->	Message.Count		Message.Total		Message.Data (interface{})
-										Struct marshalled into json message ([]byte)
+	RequestReply bool   // Master sends every message as a request on Subject+".request" and the slave replies
+	Name         string // Name of this instance in reports. Defaults to hostname:pid
 
+	Bidirectional bool // Slave answers every job with a return stream of Total messages on Subject+".rdata" that the master counts. Set on master and slave
 
-Format
-						"byte"		--> Raw []byte data for Message
+	UseJetStream bool                // Master publishes the data to JetStream and waits for every ack, the slave consumes with a durable consumer
+	StreamName   string              // JetStream stream capturing the data subject. Created if missing. Defaults to "GO-NATS-GO"
+	DedupMsgID   bool                // With UseJetStream the master sets a Nats-Msg-Id header derived from the count on every message, so the stream drops duplicates
+	msgID        func(uint64) string // Nats-Msg-Id of every message. Set per run from DedupMsgID, not read from the config file
 
-						"encr"		--> Encrypted []byte with AES 32 byte key
+	DataQueueGroup string // Slaves share the data messages in this queue group and report partial counts the master adds up. Empty means every slave gets every message
 
-*/
+	Subscriptions int // Slave subscribes to this many data subjects, DataSubject+".0" to ".N-1", and the master round-robins across them. 0 or 1 means one
 
-type rawMessage []byte
+	SubjectLengths []int // Master runs Total messages with the data subjects padded to every length (bytes) and logs the throughput per length. The slave subscribes to all of them
+	subjectLength  int   // Pads the data subjects of a run to this length. Set per run from SubjectLengths, not read from the config file
 
-func (raw rawMessage) messageType() string {
-	return string(raw[:4])
-}
+	Magic string // Prefix on every data message. The slave drops messages without it. Empty means no prefix
 
-func (raw rawMessage) format() string {
-	return string(raw[4:8])
-}
+	StampSendTime bool // Master prefixes every data message with its send time, for the latency percentiles and Slave.LatencyFile. Set on master and slave
 
-func (raw rawMessage) message() []byte {
-	return raw[8:]
-}
+	TraceEvery uint64       // Trace the time per pipeline stage of every TraceEvery:th message. 0 means no tracing
+	tracer     *stageTracer // Set up from TraceEvery in main, not read from the config file
 
-type message interface {
-	count() uint64
-	total() uint64
-}
+	seed int64 // Seed of all non-cryptographic randomness. Set from -seed in main, not read from the config file
 
-// byteMessage
-type byteMessage []byte
+	daemon           bool          // Master runs repeatedly until stopped. Set from -daemon in main, not read from the config file
+	daemonInterval   time.Duration // Time between daemon runs. Set from -interval in main
+	daemonIterations int           // Number of daemon runs, 0 until stopped. Set from -iterations in main
 
-func (bytes byteMessage) count() uint64 {
-	value, _ := binary.Uvarint(bytes[:8])
-	return value
-}
+	CheckPermissions bool // Probe publish and subscribe permissions on every subject before starting, to fail fast instead of losing messages silently
 
-func (bytes byteMessage) total() uint64 {
-	value, _ := binary.Uvarint(bytes[8:16])
-	return value
-}
+	LogHeaders bool // Log a hex dump of the header of the first and last message sent and received, to debug the wire format
 
-func (bytes byteMessage) data() []byte {
-	return bytes[16:]
+	Master masterConfig // Only read and validated when running as master
+	Slave  slaveConfig  // Only read and validated when running as slave, or as master with Pairs > 1
 }
 
-// structMessage
-type structMessage struct {
-	Count uint64
-	Total uint64
-	Data  interface{}
-}
+// masterConfig holds the settings only the master uses
+type masterConfig struct {
+	StartOffset uint64        // Master counts from StartOffset instead of 0, to continue the count sequence of a resumed stream
+	MaxRuntime  time.Duration // Hard cap on a master run. Defaults to Timeout
+	IdleTimeout time.Duration // Master aborts a run with no progress from the slave for this long. 0 means never
 
-func (msg structMessage) count() uint64 {
-	return msg.Count
-}
+	UnexpectedMetrics uint64 // Master warns after this many metrics with a wrong job or count and no completion. Defaults to 10
 
-func (msg structMessage) total() uint64 {
-	return msg.Total
-}
+	Slaves           int    // Number of slaves receiving every message, e.g. several slaves on the same Subject. Defaults to 1
+	CompletionQuorum string // Completions of distinct slaves needed to end a run: "all" (default), "majority", "any" or a number
+	completionQuorum int    // Number of completions from CompletionQuorum, set by readConfig
 
-/* --------------------- MESSAGE FUNCS --------------------- */
+	RequestTimeout time.Duration // Time to wait for each reply. Defaults to 1s
+	Requesters     uint          // Number of concurrent requesters on the master. Defaults to 1
 
-// Type for functions that generates a raw message with data on current count and total
-type rawMessageGenerator func(uint64, uint64) rawMessage
+	CanaryTimeout time.Duration // Master waits this long for the slave to echo the canary before a run. Defaults to 1s
+	FlushTimeout  time.Duration // Master waits this long for the server to confirm the published messages. Defaults to 10s
 
-// Most basic rawMessage generator. copies the data to a new message and adds metadata bytes
-func byteMessageFunc(data []byte) rawMessageGenerator {
-	return func(count uint64, total uint64) rawMessage {
-		msg := make(rawMessage, 4+4+8+8+len(data))
-		binary.PutUvarint(msg[8:16], count)  // Add count
-		binary.PutUvarint(msg[16:24], total) // Add total
-		copy(msg[24:], data)                 // Copy the date to byte 24+
-		return msg
-	}
-}
+	GenerateWorkers int  // Master generates, encrypts and compresses the messages on this many goroutines ahead of the publisher. 0 or 1 means in the publisher
+	GenerateOrdered bool // Generate workers keep the messages in count order. Otherwise they are published in the order they are done
 
-// rawMessage generator for structs, using json.Marshal. No error handling
-func structMessageFunc(v interface{}) rawMessageGenerator {
-	return func(count uint64, total uint64) rawMessage {
-		myStruct := structMessage{count, total, v} // Adds count, total and the v struct data
-		msgBody, _ := json.Marshal(&myStruct)
-		msg := make(rawMessage, 4+4+len(msgBody))
-		copy(msg[8:], msgBody)
-		return msg
-	}
-}
+	Publishers int // Master publishes disjoint count ranges from this many goroutines. Defaults to 1
 
-// Takes a rawMessage generator and wraps with encryption based on aes key
-func encryptedMessageFunc(generateMessage rawMessageGenerator, key string) rawMessageGenerator {
-	return func(count uint64, total uint64) rawMessage {
-		msg := generateMessage(count, total)
-		encryptedBody, _ := easycrypt.Encrypt(msg[8:], key)
-		encryptedMessage := make(rawMessage, 8+len(encryptedBody))
-		copy(encryptedMessage[8:], encryptedBody)
-		return encryptedMessage
-	}
-}
+	LockPublisherThreads bool // Lock every publisher goroutine to its own OS thread to reduce scheduling jitter
+	PinPublishers        bool // Also pin publisher threads to CPUs (Linux only). Implies LockPublisherThreads
 
-// Wraps rawmessage generators and sets the final msgType and format bytes
-func rawMessageFunc(msgType []byte, format []byte, generateMessage rawMessageGenerator) rawMessageGenerator {
-	return func(count uint64, total uint64) rawMessage {
-		msg := generateMessage(count, total)
-		copy(msg[:4], msgType) // Add MsgType
-		copy(msg[4:8], format) // Add format
-		return msg
-	}
+	TLSServerURL string // Master repeats a single run over a connection to this tls:// URL of the same server and logs the TLS overhead. Empty means no comparison
 
-}
+	LinkCapacityMbps float64 // Capacity of the link between master and slave. Enables link utilization in the result. 0 means unknown
 
-/* --- */
+	ChurnRate float64 // Master subscribes to and unsubscribes from this many short-lived subjects per second during the run. 0 means off
 
-// Just a simple struct to use in json tests
-type bigStruct struct {
-	Name string
+	Pairs int // Master runs this many independent master/slave pairs concurrently in this process. 0 or 1 means a single master
 
-	Pets []struct {
-		Bites   bool
-		CanFly  bool
-		Ignores string
-	}
+	GoroutineInterval time.Duration // Master samples the number of goroutines every GoroutineInterval during a run and reports start, max and final. 0 means never
 
-	LastGolfScores []int
+	RateLimit float64 // Messages per second the master publishes. 0 means as fast as possible
 
-	Points float64
-	Games  []struct {
-		Against       string
-		Fun           bool
-		MinutesPlayed float64
-	}
-}
+	DuplicateFraction float64 // Master resends this fraction (0-1) of the messages with the same count to load the slave's dedup. 0 means none
 
-func fillBigStruct() bigStruct {
-	return bigStruct{Name: "Steve Rogers",
-		Pets: []struct {
-			Bites   bool
-			CanFly  bool
-			Ignores string
-		}{{true, true, "Polly"}, {false, false, "Nothing"}, {true, false, "Cat/MrCat/*"}, {false, false, "Turtle"},
-			{false, true, "Parrot2"}, {true, false, "Leave my backyard!"}},
-		LastGolfScores: []int{83, 87, 89, 104, 90, 113, 104, 88, 88, 98, 79, 97, 120, 110},
-		Points:         345.32,
-		Games: []struct {
-			Against       string
-			Fun           bool
-			MinutesPlayed float64
-		}{{"Stoke", false, 30.2}, {"Flyfield", false, 60.4}, {"Figgerish", false, 73.4}, {"Tomland", true, 30.4},
-			{"Huddersfield", true, 33.12}, {"Fulham", true, 13.112}, {"Brentford", false, 94}, {"Magneto", false, 1000.4},
-			{"Mom", true, 90.4}, {"Sis", true, 45.2}, {"Pop", true, 89.2}, {"Brother", false, 10.4}}}
-}
+	WarmupMessages uint64 // Master publishes this many messages as a job of their own before every run, outside the measurement. 0 means none
 
-/* --------------------- MAIN --------------------- */
+	MinMessagesPerSecond float64 // Master exits non-zero if a run achieves less. 0 means no check
+	MinMBPerSecond       float64 // Master exits non-zero if a run achieves less, in MB (1000000 bytes) per second. 0 means no check
 
-// metrics is the struct for the message to communicate time spend between master & slave
-type metric struct {
-	Job   string
-	Time  time.Time
-	Count uint64
-}
+	AutoTune          bool          // Master searches for the highest RateLimit the slave sustains instead of a single run
+	AutoTuneMinRate   float64       // Lowest rate to probe. Defaults to 100
+	AutoTuneMaxRate   float64       // Highest rate to probe. Defaults to 1000000
+	AutoTunePrecision float64       // Search stops when the rate is known within this. Defaults to 1% of AutoTuneMaxRate
+	TargetLatency     time.Duration // A probe fails if the slave completes later than this after the last message is due. Defaults to 100ms
 
-func main() {
-	log := logrus.New()
-	log.Out = os.Stderr
+	LossCurveRates []float64 // Master runs Total messages at every rate (msgs/sec) and logs the loss per rate instead of a single run
 
-	// Select flag options and parse
-	var configFile string
-	var slave bool
-	flag.StringVar(&configFile, "o", "config.json", fmt.Sprintf("Set name and path to config file"))
-	flag.BoolVar(&slave, "s", false, fmt.Sprintf("Set to run as slave"))
-	flag.Parse()
+	Matrix [][]string // Master runs Total messages with every TransformChain, e.g. [[], ["encrypt:gcm"], ["compress:gzip","encrypt:gcm"]], and logs a comparison table
 
-	// Get & Set configs & global vards
-	var config = configuration{}
-	err := readConfig(configFile, &config)
-	if err != nil {
-		log.Logf(logrus.FatalLevel, "readConfig issue err=%v", err)
-		return
-	}
+	PublishErrorPolicy string // "skip" (default) drops a message that fails to publish, "retry" retries with backoff, "abort" stops the run
 
-	// Create context & waitgroup & nats connection
-	ctx, cancelFunction := context.WithTimeout(context.Background(), config.Timeout)
-	defer cancelFunction()
-	//var wg sync.WaitGroup
+	SummaryDurationUnit   string // Show summary durations in "ns", "us", "ms" or "s". Empty shows them as time.Duration
+	SummaryThroughputUnit string // "B/s" (default), "kB/s", "MB/s", "GB/s", "KiB/s", "MiB/s", "GiB/s", "kbps", "Mbps" or "Gbps"
+	SummaryPrecision      int    // Decimals of durations and throughput in the summary
 
-	log.Logf(logrus.InfoLevel, "Starting to do the work as slave=%v.", slave)
-	defer log.Logf(logrus.InfoLevel, "Closing down.")
+	PrometheusFile string // Master writes the result of every run in Prometheus text format to this file. Empty means no file
 
-	nc, err := nats.Connect(config.NATSServerURL)
-	if err != nil {
-		log.Logf(logrus.FatalLevel, "Unable to connect to nats server err=%v", err)
-		return
-	}
-	defer nc.Close()
+	ResultsFile    string // Master appends the result of every run as a json line. Empty means no file
+	ResultsFormat  string // "json" (default) or "csv" for ResultsFile
+	PublishResults bool   // Master publishes the result of every run as json on ResultsSubject
+	ResultsSubject string // Defaults to Subject+".results"
+}
 
-	var generateMessageFunction rawMessageGenerator
+// slaveConfig holds the settings only the slave uses
+type slaveConfig struct {
+	MaxDecryptFailures uint64 // Slave aborts after this many consecutive decrypt failures, most likely a key mismatch. Defaults to 1000
 
-	/* ------------- SCENARIOS ------------- */
+	ErrorPolicy string // "tolerate" (default) skips a message that fails to decode or verify, "abort" stops the slave on the first one
 
-	switch config.Scenario {
+	JSONSchema string // Path to a JSON schema the slave validates the data of json messages against. Empty means no validation
 
-	case "json":
+	ProgressEvery  uint64        // Slave sends a progress metric every ProgressEvery messages. 0 means never
+	StatsInterval  time.Duration // Slave streams a throughput sample on Subject+".stats" every StatsInterval. 0 means never
+	MetricInterval time.Duration // Slave sends at most one progress metric per MetricInterval, the latest. 0 means no limit
+	MetricEncoding string        // "protobuf" (default, see metric.proto) or "json" for the metrics the slave sends. The master reads both
 
-		// Message based on Marshal the bigStruct
-		myStruct := fillBigStruct()
-		generateMessageFunction = rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct))
+	QueueGroup string // Slave responders join this queue group so requests are load balanced. Empty means no group
 
-	case "json.encrypted":
+	PendingMsgsLimit  int // Messages buffered in the client for the data subscription before it is a slow consumer. 0 means the nats default (65536), -1 no limit
+	PendingBytesLimit int // Bytes buffered likewise. 0 means the nats default (64MB), -1 no limit
 
-		// Message based on encrypted Marshal of the bigStruct
-		myStruct := fillBigStruct()
-		generateMessageFunction = rawMessageFunc([]byte("json"), []byte("encr"), encryptedMessageFunc(structMessageFunc(&myStruct), config.AESEncryptionKey))
+	StrictScenario bool // Slave aborts instead of warning when the master announces messages it does not expect
 
-	case "emptybytes":
+	LatencyFile string // Slave writes a csv row per data message with send time, receive time, latency and size to this file. Requires StampSendTime. Empty means no file
 
-		// Messages with config.Numbytes empty zeros
-		data := make([]byte, config.NumBytes)
-		generateMessageFunction = rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+	PercentileWarmup uint64 // Slave leaves the processing times of the first PercentileWarmup messages of a job out of the percentiles. 0 means none
+}
 
-	case "file":
+// Default safety cap on Total
+const defaultMaxTotal = 10000000
+
+// Reads the config from fileName. The shared settings are always validated, the Master or Slave section
+// only when it is used by the role
+func readConfig(fileName string, slave bool, config *configuration) error {
+	// A wrong path is the common first-run mistake, tell it apart from a broken file
+	_, err := os.Stat(fileName)
+	switch {
+	case os.IsNotExist(err):
+		return errors.New(fmt.Sprintf("config: file %s not found. Pass the path of your config.json with -o", fileName))
+	case err != nil:
+		return errors.Wrapf(err, "config: unable to read file %s", fileName)
+	}
 
-		// Messages created from config.Filename. No error handling. Note: file data is copied in memory for message generation
-		// Not read from disk except this first time
-		data, err := ioutil.ReadFile(config.Filename)
+	err = gonfig.GetConf(fileName, config)
+	if err != nil {
+		return errors.Wrapf(err, "config: unable to parse file %s", fileName)
+	}
+
+	// Now verify some of the configs
+	if config.AESPassphrase != "" {
+		if config.AESEncryptionKey != "" {
+			return errors.New("config: set only one of AESEncryptionKey and AESPassphrase")
+		}
+		if config.AESSalt == "" {
+			config.AESSalt = "go-nats-go"
+		}
+		config.AESEncryptionKey, err = easycrypt.DeriveKey(config.AESPassphrase, []byte(config.AESSalt))
 		if err != nil {
-			log.Logf(logrus.FatalLevel, "Unable to read file err=%v", err)
-			return
+			return errors.Wrap(err, "config")
 		}
-		generateMessageFunction = rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+	}
+	switch len(config.AESEncryptionKey) {
+	case 16, 24, 32: // AES-128, AES-192 or AES-256
+	default:
+		return errors.New(fmt.Sprintf("config: len(config.AESEncryptionKey) is %d, expected 16, 24 or 32", len(config.AESEncryptionKey)))
+	}
 
-	case "file.encrypted":
+	if config.Subject == "" {
+		config.Subject = "go-nats-go"
+	}
 
-		// Encrypted file data
-		data, err := ioutil.ReadFile(config.Filename)
-		if err != nil {
-			log.Logf(logrus.FatalLevel, "Unable to read file err=%v", err)
-			return
+	if config.MaxTotal == 0 {
+		config.MaxTotal = defaultMaxTotal
+	}
+
+	if config.Total > config.MaxTotal && !config.OverrideMaxTotal {
+		return errors.New(fmt.Sprintf("config: Total %d exceeds MaxTotal %d. Set OverrideMaxTotal to run it anyway", config.Total, config.MaxTotal))
+	}
+
+	switch config.CipherSuite {
+	case "":
+		config.CipherSuite = "aes-gcm"
+	case "aes-gcm":
+	case "chacha20":
+		if len(config.AESEncryptionKey) != 32 {
+			return errors.New(fmt.Sprintf("config: CipherSuite chacha20 needs a 32 byte AESEncryptionKey, got %d", len(config.AESEncryptionKey)))
 		}
-		generateMessageFunction = rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc(data), config.AESEncryptionKey))
+	default:
+		return errors.New(fmt.Sprintf("config: CipherSuite %q is not \"aes-gcm\" or \"chacha20\"", config.CipherSuite))
+	}
 
+	if config.MaxReconnects < -1 {
+		return errors.New("config: MaxReconnects < -1")
+	}
+	if config.ReconnectWait < 0 {
+		return errors.New("config: ReconnectWait < 0")
 	}
 
-	/* ---------------------- SERVICES ----------------------*/
+	if config.CompressionLevel < 0 || config.CompressionLevel > gzip.BestCompression {
+		return errors.New(fmt.Sprintf("config: CompressionLevel %d not in 1-9", config.CompressionLevel))
+	}
 
-	totalDuration := -1 * time.Second
-	fc := make(chan struct{})
+	_, err = parseTransformChain(config.TransformChain, *config)
+	if err != nil {
+		return errors.Wrap(err, "config")
+	}
+	if config.Checksum && len(config.TransformChain) > 0 {
+		return errors.New("config: Checksum and TransformChain both transform the message, use the checksum:crc32 stage instead")
+	}
 
-	switch slave {
-	case false:
+	if config.StartupJitter < 0 {
+		return errors.New("config: StartupJitter < 0")
+	}
 
-		// We are the master. Store the first 'base' time stamp
-		base := metric{"base", time.Now(), config.Total}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = streamChunkSize
+	}
 
-		// Fire away the config.Total number of messages on subject config.Subject+".data"
-		go func(ctx context.Context, nc *nats.Conn, subject string, generateMessage rawMessageGenerator) {
-			var count uint64
-			for ; count < config.Total; count++ {
-				msg := generateMessage(count, config.Total)
-				nc.Publish(subject, []byte(msg))
-			}
+	if config.Scenario == "pingpong" {
+		// Round trips only make sense as requests
+		config.RequestReply = true
+	}
 
-		}(ctx, nc, config.Subject+".data", generateMessageFunction)
+	if config.Scenario == "mix" {
+		_, err = mixedMessageFunc(config.Mix, *config)
+		if err != nil {
+			return errors.Wrap(err, "config")
+		}
+	}
 
-		// Service that listens to the .metric subject to get timestamp back from the slave
-		nc.Subscribe(config.Subject+".metric", func(msg *nats.Msg) {
-			m := metric{}
-			json.Unmarshal(msg.Data, &m)
-			if m.Job == "received" && m.Count == config.Total {
-				totalDuration = m.Time.Sub(base.Time)
+	if config.Name == "" {
+		hostname, _ := os.Hostname()
+		config.Name = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
 
-				// Signal that we are done
-				fc <- struct{}{}
-			}
-		})
+	config.CompletionSubject = resolveSubject(config.CompletionSubject, config.Subject, ".done")
+	config.DataSubject = resolveSubject(config.DataSubject, config.Subject, ".data")
+	config.MetricSubject = resolveSubject(config.MetricSubject, config.Subject, ".metric")
 
-	case true:
+	if config.NATSServerURL == "" {
+		config.NATSServerURL = nats.DefaultURL
+	}
 
-		// We found ourselves to be slave...
-		// We listen to the .data subject
-		// Send back timestamp when we have received Total amount of messages and we started with Count 0 and ended with Count == Total-1
-		// Succesful decrypt is required before sending back timestamp. But limited message verification
-		// If times are not in sync between master and slave then the message/duration times will be wrong
-		var receivedCounter uint64
-		nc.Subscribe(config.Subject+".data", func(msg *nats.Msg) {
-			defer func() { receivedCounter++ }()
-
-			// First decrypt the "message body"
-			msgBytes := rawMessage(msg.Data).message()
-			switch rawMessage(msg.Data).format() {
-			case "encr":
-				msgBytes, err = easycrypt.Decrypt(msgBytes, config.AESEncryptionKey)
-				if err != nil {
-					// Ignore messages that cannot be decrypted
-					return
-				}
-			case "byte":
-			}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return errors.New("config: TLSCert and TLSKey must be set together")
+	}
 
-			// Extract the message
-			var receivedMessage message
-			switch rawMessage(msg.Data).messageType() {
-			case "byte":
-				receivedMessage = byteMessage(msgBytes)
-			case "json":
-				tmpStruct := structMessage{Data: &bigStruct{}}
-				err := json.Unmarshal(msgBytes, &tmpStruct)
-				if err != nil {
-					// Ignore messages that cannot be unmarshalled
-					return
-				}
-				receivedMessage = tmpStruct
-			default:
-				receivedMessage = byteMessage(msgBytes)
-			}
+	err = checkAuth(*config)
+	if err != nil {
+		return err
+	}
 
-			if receivedMessage.total() == 0 {
-				return // Ignore messages with total==0
-			}
+	switch config.RandomSource {
+	case "":
+		config.RandomSource = "crypto"
+	case "crypto", "math":
+	default:
+		return errors.New(fmt.Sprintf("config: unknown RandomSource %q", config.RandomSource))
+	}
 
-			if receivedMessage.count() == 0 {
-				receivedCounter = 0 // First message in the "stream". We have a new job!
-				log.Logf(logrus.InfoLevel, "Accepted a new job with Total=%d", receivedMessage.total())
-			}
+	if config.Subscriptions < 0 {
+		return errors.New("config: Subscriptions < 0")
+	}
+
+	if config.Bidirectional && (config.RequestReply || config.DataQueueGroup != "") {
+		return errors.New("config: Bidirectional supports neither RequestReply nor DataQueueGroup")
+	}
+
+	if config.UseJetStream {
+		if config.StreamName == "" {
+			config.StreamName = "GO-NATS-GO"
+		}
+		if strings.ContainsAny(config.StreamName, ".*> ") {
+			return errors.New(fmt.Sprintf("config: StreamName %q must not contain '.', '*', '>' or spaces", config.StreamName))
+		}
+		if config.Subscriptions > 1 || len(config.SubjectLengths) > 0 || config.DataQueueGroup != "" || config.RequestReply {
+			return errors.New("config: UseJetStream supports neither Subscriptions, SubjectLengths, DataQueueGroup nor RequestReply")
+		}
+	}
+	if config.DedupMsgID && !config.UseJetStream {
+		return errors.New("config: DedupMsgID needs UseJetStream")
+	}
 
-			if receivedMessage.count() == receivedMessage.total()-1 && receivedCounter == receivedMessage.total()-1 {
-				// Send back metrics when received and message with right count is received
-				bytes, _ := json.Marshal(&metric{"received", time.Now(), receivedMessage.total()})
-				nc.Publish(config.Subject+".metric", bytes)
-				log.Logf(logrus.InfoLevel, "Completed a job with Total=%d", receivedMessage.total())
+	for _, length := range config.SubjectLengths {
+		for _, subject := range dataSubjects(*config) {
+			_, err = padSubject(subject, length)
+			if err != nil {
+				return errors.Wrap(err, "config: SubjectLengths")
 			}
+		}
+	}
 
-		})
+	if config.SeedTransform == "" {
+		config.SeedTransform = "xor"
+	}
+	if seedTransforms[config.SeedTransform] == nil {
+		return errors.New(fmt.Sprintf("config: unknown SeedTransform %q", config.SeedTransform))
+	}
 
+	if !slave {
+		err = validateMaster(config)
+		if err != nil {
+			return err
+		}
 	}
 
-	/* ---------------------- END SERVICES ----------------------*/
+	// Pairs run their slaves in the master process
+	if slave || config.Master.Pairs > 1 {
+		err = validateSlave(config)
+		if err != nil {
+			return err
+		}
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	select {
-	case <-fc: // Work is done - we have received confirmation back from the slave
+	return nil
+}
+
+// Validates the Master section and sets its defaults
+func validateMaster(config *configuration) error {
+	master := &config.Master
 
-		beforeMessageTime := time.Now()
-		testMessage := generateMessageFunction(1, 1)
-		afterMessageTime := time.Now()
-		msgDuration := afterMessageTime.Sub(beforeMessageTime)
+	switch master.PublishErrorPolicy {
+	case "":
+		master.PublishErrorPolicy = "skip"
+	case "skip", "retry", "abort":
+	default:
+		return errors.New(fmt.Sprintf("config: unknown Master.PublishErrorPolicy %q", master.PublishErrorPolicy))
+	}
 
-		// Compile a short summary of the outcome
-		log.Logf(logrus.InfoLevel, "All messages sent & summary message received.")
-		log.Logf(logrus.InfoLevel, "Mode=%s/%s", testMessage.messageType(), testMessage.format())
-		log.Logf(logrus.InfoLevel, "Message size=%d (byte)", len(testMessage))
-		log.Logf(logrus.InfoLevel, "Message generation=%v", msgDuration)
-		log.Logf(logrus.InfoLevel, "Total duration=%v", totalDuration)
-		log.Logf(logrus.InfoLevel, "Total Messages=%d", config.Total)
-		log.Logf(logrus.InfoLevel, "Duration/Message=%v", totalDuration/(time.Duration)(config.Total))
+	if _, ok := durationUnits[master.SummaryDurationUnit]; !ok && master.SummaryDurationUnit != "" {
+		return errors.New(fmt.Sprintf("config: unknown Master.SummaryDurationUnit %q", master.SummaryDurationUnit))
+	}
 
-	case <-ctx.Done(): // Context expired. Likely timeout
+	if _, ok := throughputUnits[master.SummaryThroughputUnit]; !ok && master.SummaryThroughputUnit != "" {
+		return errors.New(fmt.Sprintf("config: unknown Master.SummaryThroughputUnit %q", master.SummaryThroughputUnit))
+	}
 
-		log.Logf(logrus.InfoLevel, "Timeout! For longer timeout - Change the settings in config file!")
+	if master.SummaryPrecision < 0 {
+		return errors.New("config: Master.SummaryPrecision < 0")
+	}
 
-	case <-c: // User interrupt
+	switch master.ResultsFormat {
+	case "":
+		master.ResultsFormat = "json"
+	case "json", "csv":
+	default:
+		return errors.New(fmt.Sprintf("config: unknown Master.ResultsFormat %q", master.ResultsFormat))
+	}
 
-		log.Logf(logrus.InfoLevel, "User abort.")
+	if master.CanaryTimeout == 0 {
+		master.CanaryTimeout = time.Second
+	}
+
+	if master.LinkCapacityMbps < 0 {
+		return errors.New("config: Master.LinkCapacityMbps < 0")
+	}
+
+	if master.ChurnRate < 0 {
+		return errors.New("config: Master.ChurnRate < 0")
 	}
 
-	nc.Flush()
-	nc.Drain()
+	if master.GoroutineInterval < 0 {
+		return errors.New("config: Master.GoroutineInterval < 0")
+	}
+
+	if master.Pairs < 0 {
+		return errors.New("config: Master.Pairs < 0")
+	}
+
+	if master.RateLimit < 0 {
+		return errors.New("config: Master.RateLimit < 0")
+	}
+
+	if master.DuplicateFraction < 0 || master.DuplicateFraction > 1 {
+		return errors.New("config: Master.DuplicateFraction not in 0-1")
+	}
+
+	if master.MinMessagesPerSecond < 0 || master.MinMBPerSecond < 0 {
+		return errors.New("config: Master.MinMessagesPerSecond or Master.MinMBPerSecond < 0")
+	}
+
+	if master.TLSServerURL != "" && !strings.HasPrefix(master.TLSServerURL, "tls://") {
+		return errors.New(fmt.Sprintf("config: Master.TLSServerURL %q is not a tls:// URL", master.TLSServerURL))
+	}
+
+	if master.AutoTuneMinRate == 0 {
+		master.AutoTuneMinRate = 100
+	}
+
+	if master.AutoTuneMaxRate == 0 {
+		master.AutoTuneMaxRate = 1000000
+	}
+
+	if master.AutoTuneMinRate >= master.AutoTuneMaxRate {
+		return errors.New("config: Master.AutoTuneMinRate >= Master.AutoTuneMaxRate")
+	}
+
+	if master.AutoTunePrecision == 0 {
+		master.AutoTunePrecision = master.AutoTuneMaxRate / 100
+	}
+
+	for _, rate := range master.LossCurveRates {
+		if rate <= 0 {
+			return errors.New("config: Master.LossCurveRates must be > 0")
+		}
+	}
+
+	if master.Slaves == 0 {
+		master.Slaves = 1
+	}
+	quorum, err := parseQuorum(master.CompletionQuorum, master.Slaves)
+	if err != nil {
+		return errors.Wrap(err, "config: Master.CompletionQuorum")
+	}
+	master.completionQuorum = quorum
+
+	for _, combination := range master.Matrix {
+		_, err := parseTransformChain(combination, *config)
+		if err != nil {
+			return errors.Wrap(err, "config: Master.Matrix")
+		}
+	}
+	if len(master.Matrix) > 0 && len(config.TransformChain) > 0 {
+		return errors.New("config: Master.Matrix replaces TransformChain, set only one")
+	}
+	if len(master.Matrix) > 0 && config.Checksum {
+		return errors.New("config: Master.Matrix and Checksum both transform the message, use the checksum:crc32 stage instead")
+	}
+
+	if master.TargetLatency == 0 {
+		master.TargetLatency = 100 * time.Millisecond
+	}
+
+	if master.MaxRuntime == 0 {
+		master.MaxRuntime = config.Timeout
+	}
+
+	if master.GenerateWorkers < 0 {
+		return errors.New("config: Master.GenerateWorkers < 0")
+	}
+
+	if master.Publishers < 0 {
+		return errors.New("config: Master.Publishers < 0")
+	}
+	if master.Publishers == 0 {
+		master.Publishers = 1
+	}
+	if master.Publishers > 1 && master.GenerateWorkers > 1 {
+		return errors.New("config: Master.Publishers and Master.GenerateWorkers both parallelize the master, set only one")
+	}
+
+	if master.FlushTimeout < 0 {
+		return errors.New("config: Master.FlushTimeout < 0")
+	}
+	if master.FlushTimeout == 0 {
+		master.FlushTimeout = defaultFlushTimeout
+	}
+
+	if master.RequestTimeout == 0 {
+		master.RequestTimeout = time.Second
+	}
+
+	if master.Requesters == 0 {
+		master.Requesters = 1
+	}
+
+	if master.UnexpectedMetrics == 0 {
+		master.UnexpectedMetrics = 10
+	}
+
+	if master.ResultsSubject == "" {
+		master.ResultsSubject = config.Subject + ".results"
+	}
+
+	return nil
+}
+
+// Validates the Slave section and sets its defaults
+func validateSlave(config *configuration) error {
+	slave := &config.Slave
+
+	if slave.LatencyFile != "" && !config.StampSendTime {
+		return errors.New("config: Slave.LatencyFile requires StampSendTime")
+	}
+
+	if slave.MaxDecryptFailures == 0 {
+		slave.MaxDecryptFailures = 1000
+	}
+
+	switch slave.ErrorPolicy {
+	case "":
+		slave.ErrorPolicy = "tolerate"
+	case "tolerate", "abort":
+	default:
+		return errors.New(fmt.Sprintf("config: unknown Slave.ErrorPolicy %q", slave.ErrorPolicy))
+	}
+
+	if slave.StatsInterval < 0 {
+		return errors.New("config: Slave.StatsInterval < 0")
+	}
+
+	if slave.MetricInterval < 0 {
+		return errors.New("config: Slave.MetricInterval < 0")
+	}
+
+	switch slave.MetricEncoding {
+	case "":
+		slave.MetricEncoding = "protobuf"
+	case "protobuf", "json":
+	default:
+		return errors.New(fmt.Sprintf("config: unknown Slave.MetricEncoding %q", slave.MetricEncoding))
+	}
+
+	return nil
+}
+
+/* --------------------- BYTE MESSAGE STRUCTURE  ---------------------
+
+			Type		Format		Version		Flags		Job ID		Message
+			[4]byte		[4]byte		[1]byte		[1]byte		[8]byte		[]byte
+
+The header is self-describing. The slave decodes every message from its header alone, without a scenario
+
+Type									Count				Total				Data
+			"byte"					-->	[8]byte (uint64)	[8]byte (uint64)	[8]byte (uint64) length + []byte
+										All three uint64 big endian
+
+			"json"					-->	Message.Count		Message.Total		Message.Data (interface{})
+										Struct marshalled into json message ([]byte)
+
+			"tmpl"					-->	Like "json", Message.Data is a rendered template decoded as generic json
+
+			"mpck"					-->	Like "json", struct marshalled with msgpack instead of json
+
+
+Format
+						"byte"		--> Raw []byte data for Message
+
+						"encr"		--> Encrypted []byte with AES 16, 24 or 32 byte key
+
+						"chch"		--> Encrypted []byte with ChaCha20-Poly1305 and a 32 byte key
+
+						"encz"		--> gzip compressed and then encrypted []byte with AES 16, 24 or 32 byte key
+
+						"rtch"		--> [8]byte (uint64) count in clear + Encrypted []byte with a per message AES key
+										derived from the AES key and count (HKDF ratchet)
+
+						"ck32"		--> Raw []byte data for Message + [4]byte crc32 (IEEE, big endian) of it
+
+						"strm"		--> Raw []byte data for Message. The data is a chunk of a streamed file:
+										[8]byte (uint64 big endian) offset in the file + [4]byte crc32 + []byte chunk
+
+						"seed"		--> Raw []byte data for Message. The data is a seed file transformed with the count
+
+Version
+						3			--> This layout. The slave drops other versions
+						2			--> Without Job ID
+						1			--> Count, total and length of "byte" as uvarint, which overflowed 8 bytes above 2^56
+
+Flags
+						0x01		--> Message is encrypted ("encr", "encz", "rtch" or an encrypting TransformChain)
+						0x02		--> Message is compressed ("gzip", "encz" or a compressing TransformChain)
+						Other bits are reserved. The slave drops messages with unknown flags
+
+Job ID
+						[8]byte (uint64 big endian), random per run of the master. The slave takes the job ID of
+						the start marker and drops data messages of other jobs. 0 for messages outside a run
+
+
+Start marker
+			Every job starts with a message with Total 0 and the Count of the first message (StartOffset)
+			The data messages follow with Count StartOffset to StartOffset+Total-1
+
+Magic
+			With Magic set in config every data message on the wire is prefixed with it:
+			Magic		Type		Format		Version		Flags		Job ID		Message
+			[]byte		[4]byte		[4]byte		[1]byte		[1]byte		[8]byte		[]byte
+
+Send time
+			With StampSendTime set in config the send time follows Magic, as unix nanoseconds (big endian):
+			Magic		Send time	Type		Format		Version		Flags		Job ID		Message
+			[]byte		[8]byte		[4]byte		[4]byte		[1]byte		[1]byte		[8]byte		[]byte
+
+*/
+
+// Size of the header in front of every message: type, format, version, flags and job ID
+const headerSize = 18
+
+// Version of the header and message layout
+const headerVersion = 3
+
+// Header flags
+const (
+	flagEncrypted  = 0x01
+	flagCompressed = 0x02
+	knownFlags     = flagEncrypted | flagCompressed
+)
+
+// Returns the header flags of format
+func formatFlags(format string) byte {
+	switch format {
+	case "encr", "rtch", "chch":
+		return flagEncrypted
+	case "gzip":
+		return flagCompressed
+	case "encz":
+		return flagEncrypted | flagCompressed
+	}
+	return 0
+}
+
+type rawMessage []byte
+
+func (raw rawMessage) messageType() string {
+	return string(raw[:4])
+}
+
+func (raw rawMessage) format() string {
+	return string(raw[4:8])
+}
+
+func (raw rawMessage) version() byte {
+	return raw[8]
+}
+
+func (raw rawMessage) flags() byte {
+	return raw[9]
+}
+
+func (raw rawMessage) jobID() uint64 {
+	return binary.BigEndian.Uint64(raw[10:18])
+}
+
+func (raw rawMessage) message() []byte {
+	return raw[headerSize:]
+}
+
+// Returns an error if raw is shorter than the header, has another version or unknown flags
+func (raw rawMessage) checkHeader() error {
+	if len(raw) < headerSize {
+		return errors.New(fmt.Sprintf("header: len(raw)(%v) < %d", len(raw), headerSize))
+	}
+	if raw.version() != headerVersion {
+		return errors.New(fmt.Sprintf("header: unknown version %d", raw.version()))
+	}
+	if unknown := raw.flags() &^ knownFlags; unknown != 0 {
+		return errors.New(fmt.Sprintf("header: unknown flags %#02x", unknown))
+	}
+	return nil
+}
+
+type message interface {
+	count() uint64
+	total() uint64
+}
+
+// byteMessage
+type byteMessage []byte
+
+func (bytes byteMessage) count() uint64 {
+	return binary.BigEndian.Uint64(bytes[:8])
+}
+
+func (bytes byteMessage) total() uint64 {
+	return binary.BigEndian.Uint64(bytes[8:16])
+}
+
+// Declared length of data
+func (bytes byteMessage) length() uint64 {
+	return binary.BigEndian.Uint64(bytes[16:24])
+}
+
+func (bytes byteMessage) data() []byte {
+	return bytes[24:]
+}
+
+// Returns false if the message is shorter than its header or data does not have the declared length
+// This catches silent truncation through the crypto/compression pipeline
+func (bytes byteMessage) valid() bool {
+	return len(bytes) >= 24 && uint64(len(bytes)-24) == bytes.length()
+}
+
+// structMessage
+type structMessage struct {
+	Count uint64
+	Total uint64
+	Data  interface{}
+}
+
+func (msg structMessage) count() uint64 {
+	return msg.Count
+}
+
+func (msg structMessage) total() uint64 {
+	return msg.Total
+}
+
+/* --------------------- MESSAGE FUNCS --------------------- */
+
+// Type for functions that generates a raw message with data on current count and total
+type rawMessageGenerator func(uint64, uint64) rawMessage
+
+// Input of scenario "stdin"
+var stdin io.Reader = os.Stdin
+
+// Reads all of r as the payload of scenario "stdin". Fails on an empty payload, and on a terminal instead of waiting for input
+func readPayload(r io.Reader) ([]byte, error) {
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return nil, errors.New("stdin: no payload piped in, e.g. cat bytes.txt | go-nats-go -o config.json")
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "stdin: unable to read payload")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("stdin: empty payload")
+	}
+	return data, nil
+}
+
+// Most basic rawMessage generator. copies the data to a new message and adds metadata bytes
+func byteMessageFunc(data []byte) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := make(rawMessage, headerSize+8+8+8+len(data))
+		body := msg[headerSize:]
+		binary.BigEndian.PutUint64(body[0:8], count)               // Add count
+		binary.BigEndian.PutUint64(body[8:16], total)              // Add total
+		binary.BigEndian.PutUint64(body[16:24], uint64(len(data))) // Add length of data
+		copy(body[24:], data)                                      // Copy the date to byte 24+ of the body
+		return msg
+	}
+}
+
+// Returns the reader used for random payloads. "math" is fast but predictable, "crypto" is slow but secure
+func randomSource(source string, seed int64) (io.Reader, error) {
+	switch source {
+	case "crypto":
+		return crand.Reader, nil
+	case "math":
+		return rand.New(rand.NewSource(seed)), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown random source %q", source))
+}
+
+// Returns seed, or a seed from now if it is 0
+func resolveSeed(seed int64, now func() int64) int64 {
+	if seed == 0 {
+		return now()
+	}
+	return seed
+}
+
+// Returns a math/rand source for one use of randomness, e.g. "jitter", derived from seed and the use
+// Every use gets its own sequence, so the values of one do not depend on how much the others drew. Not safe for concurrent use
+func seededRand(seed int64, use string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(use))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+// byteMessage generator that fills numBytes of fresh random data from source for every message. No error handling
+func randomByteMessageFunc(numBytes uint, source io.Reader) rawMessageGenerator {
+	data := make([]byte, numBytes)
+	generateMessage := byteMessageFunc(data)
+	var mu sync.Mutex // Generate workers share data and source
+	return func(count uint64, total uint64) rawMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		io.ReadFull(source, data)
+		return generateMessage(count, total)
+	}
+}
+
+// rawMessage generator for structs, using json.Marshal. No error handling, a v that does not marshal gives
+// messages without a body. Use structMessageFuncE to find out up front
+func structMessageFunc(v interface{}) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		myStruct := structMessage{count, total, v} // Adds count, total and the v struct data
+		msgBody, _ := json.Marshal(&myStruct)
+		msg := make(rawMessage, headerSize+len(msgBody))
+		copy(msg[headerSize:], msgBody)
+		return msg
+	}
+}
+
+// Like structMessageFunc, but returns an error if v does not marshal
+func structMessageFuncE(v interface{}) (rawMessageGenerator, error) {
+	_, err := json.Marshal(&structMessage{0, 0, v})
+	if err != nil {
+		return nil, errors.Wrap(err, "json: unable to marshal message")
+	}
+	return structMessageFunc(v), nil
+}
+
+// rawMessage generator for structs like structMessageFunc, using msgpack.Marshal. No error handling, use
+// msgpackMessageFuncE to find out up front
+func msgpackMessageFunc(v interface{}) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		myStruct := structMessage{count, total, v}
+		msgBody, _ := msgpack.Marshal(&myStruct)
+		msg := make(rawMessage, headerSize+len(msgBody))
+		copy(msg[headerSize:], msgBody)
+		return msg
+	}
+}
+
+// Like msgpackMessageFunc, but returns an error if v does not marshal
+func msgpackMessageFuncE(v interface{}) (rawMessageGenerator, error) {
+	_, err := msgpack.Marshal(&structMessage{0, 0, v})
+	if err != nil {
+		return nil, errors.Wrap(err, "msgpack: unable to marshal message")
+	}
+	return msgpackMessageFunc(v), nil
+}
+
+// Takes a rawMessage generator and wraps with encryption based on aes key
+func encryptedMessageFunc(generateMessage rawMessageGenerator, key string) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		encryptedBody, _ := easycrypt.Encrypt(msg.message(), key)
+		encryptedMessage := make(rawMessage, headerSize+len(encryptedBody))
+		copy(encryptedMessage[headerSize:], encryptedBody)
+		return encryptedMessage
+	}
+}
+
+// Takes a rawMessage generator and wraps with ChaCha20-Poly1305 encryption using key
+func chaChaMessageFunc(generateMessage rawMessageGenerator, key string) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		encryptedBody, _ := easycrypt.EncryptChaCha(msg.message(), key)
+		encryptedMessage := make(rawMessage, headerSize+len(encryptedBody))
+		copy(encryptedMessage[headerSize:], encryptedBody)
+		return encryptedMessage
+	}
+}
+
+// Returns the format and the encrypting wrapper of cipherSuite, "aes-gcm" or "chacha20"
+func cipherSuiteFunc(cipherSuite string) (string, func(rawMessageGenerator, string) rawMessageGenerator) {
+	if cipherSuite == "chacha20" {
+		return "chch", chaChaMessageFunc
+	}
+	return "encr", encryptedMessageFunc
+}
+
+// Takes a rawMessage generator and wraps with encryption using a fresh key per message, derived from rootKey and count
+// The count is kept in clear in front of the encrypted body so the receiver can derive the same key
+func ratchetMessageFunc(generateMessage rawMessageGenerator, rootKey string) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		key, _ := easycrypt.DeriveMessageKey(rootKey, count)
+		encryptedBody, _ := easycrypt.Encrypt(msg.message(), key)
+		encryptedMessage := make(rawMessage, headerSize+8+len(encryptedBody))
+		binary.BigEndian.PutUint64(encryptedMessage[headerSize:headerSize+8], count)
+		copy(encryptedMessage[headerSize+8:], encryptedBody)
+		return encryptedMessage
+	}
+}
+
+// Reverses ratchetMessageFunc. Derives the message key from rootKey and the count in clear and decrypts the rest
+func ratchetDecrypt(body []byte, rootKey string) ([]byte, error) {
+	if len(body) < 8 {
+		return []byte{}, errors.New(fmt.Sprintf("ratchet: len(body)(%v) < 8", len(body)))
+	}
+	key, err := easycrypt.DeriveMessageKey(rootKey, binary.BigEndian.Uint64(body[:8]))
+	if err != nil {
+		return []byte{}, err
+	}
+	return easycrypt.Decrypt(body[8:], key)
+}
+
+// Takes a rawMessage generator and wraps with gzip compression at level. 0 means gzip default
+func compressedMessageFunc(generateMessage rawMessageGenerator, level int) rawMessageGenerator {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		compressedMessage := bytes.NewBuffer(make([]byte, headerSize, headerSize+len(msg)))
+		zw, _ := gzip.NewWriterLevel(compressedMessage, level)
+		zw.Write(msg.message())
+		zw.Close()
+		return compressedMessage.Bytes()
+	}
+}
+
+// Reverses compressedMessageFunc
+func decompress(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "gzip: unable to read header")
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// Wraps a rawMessage generator and prefixes every message with magic, so the slave can filter out foreign messages
+// Note: the result is no longer a plain rawMessage. Use magicFilter to strip the prefix
+func magicMessageFunc(magic string, generateMessage rawMessageGenerator) rawMessageGenerator {
+	if magic == "" {
+		return generateMessage
+	}
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		magicMessage := make(rawMessage, len(magic)+len(msg))
+		copy(magicMessage, magic)
+		copy(magicMessage[len(magic):], msg)
+		return magicMessage
+	}
+}
+
+// magicFilter drops messages without the magic prefix and counts them
+type magicFilter struct {
+	magic   []byte
+	dropped uint64
+}
+
+// Returns the message without the magic prefix, or false if the prefix is missing
+func (f *magicFilter) filter(data []byte) (rawMessage, bool) {
+	if !bytes.HasPrefix(data, f.magic) {
+		atomic.AddUint64(&f.dropped, 1)
+		return nil, false
+	}
+	return rawMessage(data[len(f.magic):]), true
+}
+
+// Number of dropped messages so far
+func (f *magicFilter) droppedCount() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// Wraps rawmessage generators and sets the final msgType, format, version and flags bytes
+func rawMessageFunc(msgType []byte, format []byte, generateMessage rawMessageGenerator) rawMessageGenerator {
+	flags := formatFlags(string(format))
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		copy(msg[:4], msgType) // Add MsgType
+		copy(msg[4:8], format) // Add format
+		msg[8] = headerVersion // Add version
+		msg[9] = flags         // Add flags
+		return msg
+	}
+
+}
+
+// Wraps rawmessage generators and sets the job ID in the header
+func jobMessageFunc(job uint64, generateMessage rawMessageGenerator) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		binary.BigEndian.PutUint64(msg[10:18], job)
+		return msg
+	}
+}
+
+// Returns a random job ID for a run of the master. Never 0, the job ID of messages outside a run
+func newJobID() uint64 {
+	var b [8]byte
+	for {
+		crand.Read(b[:])
+		if job := binary.BigEndian.Uint64(b[:]); job != 0 {
+			return job
+		}
+	}
+}
+
+/* --- */
+
+// Just a simple struct to use in json tests
+type bigStruct struct {
+	Name string
+
+	Pets []struct {
+		Bites   bool
+		CanFly  bool
+		Ignores string
+	}
+
+	LastGolfScores []int
+
+	Points float64
+	Games  []struct {
+		Against       string
+		Fun           bool
+		MinutesPlayed float64
+	}
+}
+
+func fillBigStruct() bigStruct {
+	return bigStruct{Name: "Steve Rogers",
+		Pets: []struct {
+			Bites   bool
+			CanFly  bool
+			Ignores string
+		}{{true, true, "Polly"}, {false, false, "Nothing"}, {true, false, "Cat/MrCat/*"}, {false, false, "Turtle"},
+			{false, true, "Parrot2"}, {true, false, "Leave my backyard!"}},
+		LastGolfScores: []int{83, 87, 89, 104, 90, 113, 104, 88, 88, 98, 79, 97, 120, 110},
+		Points:         345.32,
+		Games: []struct {
+			Against       string
+			Fun           bool
+			MinutesPlayed float64
+		}{{"Stoke", false, 30.2}, {"Flyfield", false, 60.4}, {"Figgerish", false, 73.4}, {"Tomland", true, 30.4},
+			{"Huddersfield", true, 33.12}, {"Fulham", true, 13.112}, {"Brentford", false, 94}, {"Magneto", false, 1000.4},
+			{"Mom", true, 90.4}, {"Sis", true, 45.2}, {"Pop", true, 89.2}, {"Brother", false, 10.4}}}
+}
+
+// decryptGuard calls abort once after threshold consecutive decrypt failures
+// Not safe for concurrent use. The slave calls it from the data subscription only
+type decryptGuard struct {
+	threshold   uint64
+	consecutive uint64
+	abort       func(consecutive uint64)
+}
+
+// Records the outcome of a decrypt
+func (g *decryptGuard) record(err error) {
+	if err == nil {
+		g.consecutive = 0
+		return
+	}
+	g.consecutive++
+	if g.consecutive == g.threshold {
+		g.abort(g.consecutive)
+	}
+}
+
+// failurePolicy applies Slave.ErrorPolicy to messages the slave cannot decode or verify
+// Not safe for concurrent use. The slave calls it from the data subscription only
+type failurePolicy struct {
+	abortOnError bool
+	aborted      bool
+	abort        func(message string, err error)
+}
+
+// Records a failure of message, e.g. "count=5". With abortOnError calls abort on the first failure, once
+func (p *failurePolicy) failed(message string, err error) {
+	if !p.abortOnError || p.aborted {
+		return
+	}
+	p.aborted = true
+	p.abort(message, err)
+}
+
+/* --------------------- NATS --------------------- */
+
+// publisher is the part of *nats.Conn needed to publish
+type publisher interface {
+	Publish(subj string, data []byte) error
+}
+
+// msgPublisher is the part of *nats.Conn needed to publish a message with headers
+type msgPublisher interface {
+	PublishMsg(m *nats.Msg) error
+}
+
+// subscriber is the part of *nats.Conn needed to set up a subscription
+type subscriber interface {
+	Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// natsConn is the connection of the master and slave, from the first subscription to close. *nats.Conn
+// satisfies it, the tests pass an in-process fake
+type natsConn interface {
+	Publish(subj string, data []byte) error
+	PublishMsg(m *nats.Msg) error
+	Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error)
+	QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error)
+	ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscription, error)
+	ChanQueueSubscribe(subj, group string, ch chan *nats.Msg) (*nats.Subscription, error)
+	Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error)
+	Flush() error
+	FlushTimeout(timeout time.Duration) error
+	LastError() error
+	MaxPayload() int64
+	Drain() error
+	Close()
+}
+
+// Flushes what nc published so far and drains its subscriptions. Errors are only logged, the connection
+// is going away anyway
+func drainConn(nc natsConn, log *logrus.Logger) {
+	err := nc.Flush()
+	if err != nil {
+		log.Logf(logrus.DebugLevel, "Unable to flush before drain err=%v", err)
+	}
+	err = nc.Drain()
+	if err != nil {
+		log.Logf(logrus.DebugLevel, "Unable to drain err=%v", err)
+	}
+}
+
+// Returns subject if set, otherwise the default layout base+suffix
+func resolveSubject(subject string, base string, suffix string) string {
+	if subject != "" {
+		return subject
+	}
+	return base + suffix
+}
+
+// Returns an error if a message of size bytes exceeds maxPayload, the largest message the server accepts
+func checkPayload(size int, maxPayload int64) error {
+	if int64(size) > maxPayload {
+		return errors.New(fmt.Sprintf("master: message size %d exceeds the max payload %d of the server. Lower NumBytes or use a smaller file", size, maxPayload))
+	}
+	return nil
+}
+
+// Subscribes cb to subject. Errors are wrapped with the subject so the caller can abort with a clear message
+func subscribe(nc subscriber, subject string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	sub, err := nc.Subscribe(subject, cb)
+	if err != nil {
+		return nil, errors.Wrapf(err, "nats: unable to subscribe to %s", subject)
+	}
+	return sub, nil
+}
+
+// bufferTracker counts the messages and bytes published while the connection was down
+// They are buffered by the client (up to ReconnectBufSize) and replayed on reconnect
+type bufferTracker struct {
+	mu           sync.Mutex
+	disconnected bool
+	atDisconnect nats.Statistics
+	messages     uint64
+	bytes        uint64
+}
+
+// Records the connection statistics when the connection is lost
+func (b *bufferTracker) disconnect(stats nats.Statistics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.disconnected {
+		b.disconnected = true
+		b.atDisconnect = stats
+	}
+}
+
+// Everything published since the disconnect was buffered and is now replayed
+func (b *bufferTracker) reconnect(stats nats.Statistics) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.disconnected {
+		b.disconnected = false
+		b.messages += stats.OutMsgs - b.atDisconnect.OutMsgs
+		b.bytes += stats.OutBytes - b.atDisconnect.OutBytes
+	}
+}
+
+// Returns the total messages and bytes buffered across all reconnects so far
+func (b *bufferTracker) buffered() (uint64, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.messages, b.bytes
+}
+
+// Returns the options for nats.Connect. buffered is updated on every disconnect and reconnect
+// Asynchronous errors from the server, like a permissions violation, are logged to log
+func buildConnectOptions(config configuration, buffered *bufferTracker, log *logrus.Logger) []nats.Option {
+	options := []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			buffered.disconnect(nc.Stats())
+			log.Logf(logrus.WarnLevel, "Disconnected from the server err=%v. Reconnecting", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			buffered.reconnect(nc.Stats())
+			log.Logf(logrus.InfoLevel, "Reconnected to %s", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if err := nc.LastError(); err != nil {
+				log.Logf(logrus.ErrorLevel, "Connection closed err=%v", err)
+				return
+			}
+			log.Logf(logrus.DebugLevel, "Connection closed")
+		}),
+		nats.ErrorHandler(asyncErrorHandler(config.Pedantic, log)),
+	}
+	if config.ReconnectBufSize != 0 {
+		options = append(options, nats.ReconnectBufSize(config.ReconnectBufSize))
+	}
+	if config.MaxReconnects != 0 {
+		options = append(options, nats.MaxReconnects(config.MaxReconnects))
+	}
+	if config.ReconnectWait != 0 {
+		options = append(options, nats.ReconnectWait(config.ReconnectWait))
+	}
+	if config.NoEcho {
+		options = append(options, nats.NoEcho())
+	}
+	// At most one of them, see checkAuth
+	switch {
+	case config.Username != "" || config.Password != "":
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	case config.Token != "":
+		options = append(options, nats.Token(config.Token))
+	case config.CredentialsFile != "":
+		options = append(options, nats.UserCredentials(config.CredentialsFile))
+	}
+	if config.TLSCert != "" {
+		options = append(options, nats.ClientCert(config.TLSCert, config.TLSKey))
+	}
+	if config.TLSCACert != "" {
+		options = append(options, nats.RootCAs(config.TLSCACert))
+	}
+	if config.Pedantic || config.Verbose {
+		// No option funcs for these in nats.go
+		options = append(options, func(o *nats.Options) error {
+			o.Pedantic = config.Pedantic
+			o.Verbose = config.Verbose
+			return nil
+		})
+	}
+	return options
+}
+
+// Returns an error if more than one way to authenticate is set in config
+func checkAuth(config configuration) error {
+	var modes []string
+	if config.Username != "" || config.Password != "" {
+		modes = append(modes, "Username/Password")
+	}
+	if config.Token != "" {
+		modes = append(modes, "Token")
+	}
+	if config.CredentialsFile != "" {
+		modes = append(modes, "CredentialsFile")
+	}
+	if len(modes) > 1 {
+		return errors.New(fmt.Sprintf("config: set only one of %s to authenticate", strings.Join(modes, " and ")))
+	}
+	return nil
+}
+
+// Returns the handler for asynchronous nats errors. They are otherwise only visible as missing messages
+func asyncErrorHandler(pedantic bool, log *logrus.Logger) nats.ErrHandler {
+	return func(nc *nats.Conn, sub *nats.Subscription, err error) {
+		subject := "connection"
+		if sub != nil {
+			subject = sub.Subject
+		}
+		if pedantic {
+			log.Logf(logrus.ErrorLevel, "NATS error on %s err=%v. Pedantic is set, check the subject and permissions", subject, err)
+			return
+		}
+		log.Logf(logrus.ErrorLevel, "NATS error on %s err=%v", subject, err)
+	}
+}
+
+// Applies the pending limits of config to the subscription sub. 0 keeps the nats default
+func setPendingLimits(sub *nats.Subscription, config configuration) error {
+	msgs, bytes := config.Slave.PendingMsgsLimit, config.Slave.PendingBytesLimit
+	if msgs == 0 && bytes == 0 {
+		return nil
+	}
+	if msgs == 0 {
+		msgs = nats.DefaultSubPendingMsgsLimit
+	}
+	if bytes == 0 {
+		bytes = nats.DefaultSubPendingBytesLimit
+	}
+	err := sub.SetPendingLimits(msgs, bytes)
+	if err != nil {
+		return errors.Wrapf(err, "nats: unable to set pending limits on %s", sub.Subject)
+	}
+	return nil
+}
+
+// Sleeps a random duration in [0, max) before calling connect, so many clients launched at once spread their load on the server. Returns the applied delay
+func jitteredConnect(max time.Duration, random func(int64) int64, sleep func(time.Duration), connect func() (*nats.Conn, error)) (*nats.Conn, time.Duration, error) {
+	var delay time.Duration
+	if max > 0 {
+		delay = time.Duration(random(int64(max)))
+		sleep(delay)
+	}
+	nc, err := connect()
+	return nc, delay, err
+}
+
+/* --------------------- METRICS --------------------- */
+
+// metrics is the struct for the message to communicate time spend between master & slave
+// Job "first" is sent once on the .metric subject when the first message of the job is received
+// Job "progress" is streamed on the .metric subject during the run
+// Job "received" is sent once on the completion subject when all messages are received
+type metric struct {
+	Job          string
+	Time         time.Time
+	Count        uint64
+	Slave        string                 `json:",omitempty"` // Sent with "received" and "partial": Name of the slave
+	Processing   *processingPercentiles `json:",omitempty"` // Sent with "received": slave time per message in the data handler
+	Latency      *latencyHistogram      `json:",omitempty"` // Sent with "received" with StampSendTime: time from send to receive per message
+	Types        map[string]uint64      `json:",omitempty"` // Sent with "received": messages per type/format from the header
+	Duplicates   uint64                 `json:",omitempty"` // Sent with "received": resent messages dropped by the slave
+	BadChunks    uint64                 `json:",omitempty"` // Sent with "received" for scenario "file.stream": chunks with a checksum mismatch
+	FirstBad     uint64                 `json:",omitempty"` // Offset in the file of the first bad chunk
+	BadSeeded    uint64                 `json:",omitempty"` // Sent with "received" for scenario "file.seeded": payloads that do not match the transform
+	BadChecksums uint64                 `json:",omitempty"` // Sent with "received" with Checksum: messages with a crc32 mismatch
+
+	ShortCiphertexts uint64 `json:",omitempty"` // Sent with "received": encrypted messages too short to decrypt, the other decrypt failures are auth failures
+	SchemaViolations uint64 `json:",omitempty"` // Sent with "received" with Slave.JSONSchema: json messages whose data violates the schema
+
+	Subscriptions []uint64 `json:",omitempty"` // Sent with "received" with Subscriptions > 1: messages per data subscription
+
+	Sizes *sizeDistribution `json:",omitempty"` // Sent with "received" when the message sizes of the job varied
+
+	JobID uint64 `json:",omitempty"` // Job ID of the start marker of the job, the master drops metrics of other jobs
+}
+
+// unexpectedMetrics counts metrics the master cannot use, like a wrong job or count. Many of them
+// and no completion mean that master and slave are not paired as intended
+type unexpectedMetrics struct {
+	threshold uint64 // Warn when this many were seen. 0 means never
+	count     uint64
+	log       *logrus.Logger
+}
+
+// Logs the unexpected metric and warns once when the threshold is reached. Safe for concurrent use
+func (u *unexpectedMetrics) record(subject string, data []byte, reason string) {
+	count := atomic.AddUint64(&u.count, 1)
+	u.log.Logf(logrus.DebugLevel, "Unexpected metric on %s: %s %q", subject, reason, data)
+	if count == u.threshold {
+		u.log.Logf(logrus.WarnLevel, "%d unexpected metrics and no completion. Check that master and slave use the same Subject, Total and version", count)
+	}
+}
+
+// Logs a metric that does not unmarshal with the error and counts it as unexpected. A malformed metric
+// is never a stale one from another run, so it is always worth a warning
+func (u *unexpectedMetrics) malformed(subject string, data []byte, err error) {
+	u.log.Logf(logrus.WarnLevel, "Malformed metric on %s err=%v", subject, err)
+	u.record(subject, data, "malformed")
+}
+
+// Handler for the completion subject. Passes on the metric when the slave has received all total messages
+// With a quorum, the metric of the slave that completes the quorum is passed on
+func completionHandler(total uint64, job uint64, quorum *quorumTracker, unexpected *unexpectedMetrics, done chan<- metric) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		m := metric{}
+		err := decodeMetric(msg.Data, &m)
+		switch {
+		case len(msg.Data) == 0: // Permission probe
+		case err != nil:
+			unexpected.malformed(msg.Subject, msg.Data, err)
+		case m.JobID != job:
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job id %d, expected %d", m.JobID, job))
+		case m.Job != "received":
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job %q", m.Job))
+		case m.Count != total:
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("count %d, expected %d", m.Count, total))
+		case !quorum.complete(m.Slave): // Waiting for more slaves, or the quorum is already reached
+		default:
+			// Signal that we are done. Never block on duplicates
+			select {
+			case done <- m:
+			default:
+			}
+		}
+	}
+}
+
+// Handler for the .metric subject. Logs the progress and signals activity - completion is signalled separately
+// The metric of the first message of the job is passed on to first
+func progressHandler(total uint64, job uint64, log *logrus.Logger, unexpected *unexpectedMetrics, activity chan<- struct{}, first chan<- metric) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		m := metric{}
+		err := decodeMetric(msg.Data, &m)
+		switch {
+		case len(msg.Data) == 0: // Permission probe
+		case err != nil:
+			unexpected.malformed(msg.Subject, msg.Data, err)
+		case m.JobID != job:
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job id %d, expected %d", m.JobID, job))
+		case m.Job == "first":
+			select {
+			case first <- m:
+			default:
+			}
+		case m.Job != "progress":
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job %q", m.Job))
+		default:
+			log.Logf(logrus.InfoLevel, "Progress %d/%d", m.Count, total)
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// metricCoalescer sends at most one progress metric per interval, always the latest snapshot
+// The completion metric is never delayed
+type metricCoalescer struct {
+	interval       time.Duration
+	sendProgress   func(metric)
+	sendCompletion func(metric)
+
+	mu      sync.Mutex
+	last    time.Time
+	pending *metric
+	timer   *time.Timer
+}
+
+func newMetricCoalescer(interval time.Duration, sendProgress func(metric), sendCompletion func(metric)) *metricCoalescer {
+	return &metricCoalescer{interval: interval, sendProgress: sendProgress, sendCompletion: sendCompletion}
+}
+
+// Sends m now if the interval has passed since the last progress metric. Otherwise keeps it until the interval has passed
+func (c *metricCoalescer) progress(m metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.last) >= c.interval {
+		c.last = now
+		c.pending = nil
+		c.sendProgress(m)
+		return
+	}
+
+	c.pending = &m
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.last.Add(c.interval).Sub(now), c.flush)
+	}
+}
+
+// Sends the latest pending progress metric, if any
+func (c *metricCoalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer = nil
+	if c.pending != nil {
+		c.last = time.Now()
+		c.sendProgress(*c.pending)
+		c.pending = nil
+	}
+}
+
+// Sends the completion metric immediately. Pending progress is dropped since it is older news
+func (c *metricCoalescer) complete(m metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.pending = nil
+	c.sendCompletion(m)
+}
+
+// stats is a live throughput sample the slave streams on the .stats subject, independent of the completion protocol
+type stats struct {
+	Time     time.Time
+	Interval time.Duration
+	Messages uint64  // Received during the interval
+	Rate     float64 // Messages per second during the interval
+}
+
+// Sends a stats sample every interval until ctx is done. received is the running count of received messages
+func streamStats(ctx context.Context, interval time.Duration, received *uint64, send func(stats)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := atomic.LoadUint64(received)
+	lastTime := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			current := atomic.LoadUint64(received)
+			elapsed := now.Sub(lastTime)
+			send(stats{now, elapsed, current - last, float64(current-last) / elapsed.Seconds()})
+			last, lastTime = current, now
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// announcement is sent by the master on the .control subject before a run
+// so the slave can check that it expects the same kind of messages
+type announcement struct {
+	Scenario string
+	Type     string
+	Format   string
+	Name     string `json:",omitempty"` // Name of the master
+}
+
+// Message types and formats the slave knows how to handle
+var (
+	supportedTypes   = map[string]bool{"byte": true, "json": true, "tmpl": true, "mpck": true}
+	supportedFormats = map[string]bool{"byte": true, "encr": true, "rtch": true, "gzip": true, "encz": true, "chch": true, "ck32": true, "chan": true, "strm": true, "seed": true}
+)
+
+// Returns an error if the slave cannot handle the announced messages, or if they differ from the expected message
+// expected is a sample message from the slave's own scenario. nil means the slave has no expectation
+func checkAnnouncement(a announcement, expected rawMessage) error {
+	if !supportedTypes[a.Type] || !supportedFormats[a.Format] {
+		return errors.New(fmt.Sprintf("slave cannot handle %s/%s messages from scenario %q", a.Type, a.Format, a.Scenario))
+	}
+	if expected != nil && (a.Type != expected.messageType() || a.Format != expected.format()) {
+		return errors.New(fmt.Sprintf("master sends %s/%s messages from scenario %q but slave expects %s/%s",
+			a.Type, a.Format, a.Scenario, expected.messageType(), expected.format()))
+	}
+	return nil
+}
+
+// Handler for the .control subject on the slave. Warns on a mismatched announcement, or calls abort if strict
+// name is the slave's own name. A master with the same name runs in the same process, which is only safe with NoEcho
+func announcementHandler(expected rawMessage, name string, strict bool, log *logrus.Logger, abort func()) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if len(msg.Data) == 0 { // Permission probe
+			return
+		}
+		a := announcement{}
+		json.Unmarshal(msg.Data, &a)
+		if a.Name != "" && a.Name == name {
+			log.Logf(logrus.WarnLevel, "Master %s runs in the same process as this slave. Use separate connections and NoEcho on the master", name)
+		}
+
+		err := checkAnnouncement(a, expected)
+		if err == nil {
+			return
+		}
+
+		if strict {
+			log.Logf(logrus.FatalLevel, "Scenario mismatch err=%v", err)
+			abort()
+			return
+		}
+		log.Logf(logrus.WarnLevel, "Scenario mismatch - results will be wrong err=%v", err)
+	}
+}
+
+/* --------------------- MAIN --------------------- */
+
+func main() {
+	// Runs last, after every other deferred cleanup
+	var exitCode int
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	log := logrus.New()
+	log.Out = os.Stderr
+
+	// Analysis of result files needs neither config nor nats
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		err := runAggregate(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Aggregate failed err=%v", err)
+			exitCode = 1
+		}
+		return
+	}
+
+	// Server info needs no config
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		err := runProbe(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Probe failed err=%v", err)
+			exitCode = 1
+		}
+		return
+	}
+
+	// Select flag options and parse
+	var configFile string
+	var slave bool
+	var daemon bool
+	var interval time.Duration
+	var iterations int
+	var dumpTo string
+	var seed int64
+	flag.StringVar(&configFile, "o", "config.json", fmt.Sprintf("Set name and path to config file"))
+	flag.BoolVar(&slave, "s", false, fmt.Sprintf("Set to run as slave"))
+	flag.BoolVar(&daemon, "daemon", false, fmt.Sprintf("Set to run the master benchmark repeatedly until stopped"))
+	flag.DurationVar(&interval, "interval", 5*time.Minute, fmt.Sprintf("Set time between runs in daemon mode"))
+	flag.IntVar(&iterations, "iterations", 0, fmt.Sprintf("Set number of runs in daemon mode. 0 runs until stopped"))
+	flag.StringVar(&dumpTo, "dumpto", "", fmt.Sprintf("Set to write the generated messages to this file instead of publishing"))
+	flag.Int64Var(&seed, "seed", 0, fmt.Sprintf("Set to seed all non-cryptographic randomness to reproduce a run. 0 seeds from the clock"))
+	flag.Parse()
+
+	// Get & Set configs & global vards
+	var config = configuration{}
+	err := readConfig(configFile, slave, &config)
+	if err != nil {
+		log.Logf(logrus.FatalLevel, "readConfig issue err=%v", err)
+		return
+	}
+	config.seed = resolveSeed(seed, func() int64 { return time.Now().UnixNano() })
+	config.daemon, config.daemonInterval, config.daemonIterations = daemon, interval, iterations
+	log.Logf(logrus.InfoLevel, "Random seed=%d. Rerun with -seed %d to reproduce", config.seed, config.seed)
+
+	// Create context & nats connection. User interrupt cancels the context
+	ctx, cancelFunction := context.WithCancel(context.Background())
+	defer cancelFunction()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		log.Logf(logrus.InfoLevel, "User abort.")
+		cancelFunction()
+	}()
+
+	log.Logf(logrus.InfoLevel, "Starting to do the work as slave=%v.", slave)
+	defer log.Logf(logrus.InfoLevel, "Closing down.")
+
+	// Every TraceEvery:th message is traced through the stages of its scenario
+	config.tracer = newStageTracer(config.TraceEvery)
+	generateMessageFunction, err := setupScenario(&config, log)
+	if err != nil {
+		log.Logf(logrus.FatalLevel, "Unable to set up scenario err=%v", err)
+		return
+	}
+
+	// Capture exactly what the master would send, without nats
+	if dumpTo != "" && !slave {
+		if generateMessageFunction == nil {
+			log.Logf(logrus.FatalLevel, "Unknown scenario %q", config.Scenario)
+			return
+		}
+		err = dumpMessages(dumpTo, config, generateMessageFunction)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Unable to dump messages err=%v", err)
+			return
+		}
+		log.Logf(logrus.InfoLevel, "Dumped %d messages to %s", config.Total, dumpTo)
+		return
+	}
+
+	buffered := &bufferTracker{}
+	var connectTime time.Duration
+	nc, delay, err := jitteredConnect(config.StartupJitter, seededRand(config.seed, "jitter").Int63n, time.Sleep, timedConnect(&connectTime, func() (*nats.Conn, error) {
+		return nats.Connect(config.NATSServerURL, buildConnectOptions(config, buffered, log)...)
+	}))
+	if err != nil {
+		log.Logf(logrus.FatalLevel, "Unable to connect to nats server err=%v", err)
+		return
+	}
+	if config.StartupJitter > 0 {
+		log.Logf(logrus.InfoLevel, "Connected after a startup jitter of %v", delay)
+	}
+	defer nc.Close()
+
+	/* ---------------------- SERVICES ----------------------*/
+
+	switch slave {
+	case false:
+		exitCode = serveMaster(ctx, nc, config, generateMessageFunction, connectTime, buffered, log)
+	case true:
+		serveSlave(ctx, nc, config, generateMessageFunction, log)
+	}
+
+	/* ---------------------- END SERVICES ----------------------*/
+
+	drainConn(nc, log)
+}
+
+/* --------------------- SERVICES --------------------- */
+
+// serveMaster does the work of the master on nc as configured: a single run, unless pairs, auto tune, a loss curve,
+// a matrix, subject lengths or daemon mode is configured. connectTime and buffered belong to nc
+// Returns the exit code, 1 when the run failed, publishes failed or the throughput was not met
+func serveMaster(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, connectTime time.Duration, buffered *bufferTracker, log *logrus.Logger) (exitCode int) {
+	// Every publish of a message above the server's limit would fail
+	sample := magicMessageFunc(config.Magic, sendTimeMessageFunc(config.StampSendTime, time.Now, generateMessage))(1, 1)
+	err := checkPayload(len(sample), nc.MaxPayload())
+	if err != nil {
+		log.Logf(logrus.FatalLevel, "Aborting err=%v", err)
+		exitCode = 1
+		return
+	}
+
+	// A single run on nc is limited by config.Master.MaxRuntime
+	// Messages buffered during a disconnect are attributed to the run
+	runOn := func(ctx context.Context, nc natsConn, buffered *bufferTracker) (result, error) {
+		ctx, cancel := context.WithTimeout(ctx, config.Master.MaxRuntime)
+		defer cancel()
+		messagesBefore, bytesBefore := buffered.buffered()
+		stopSampling := sampleGoroutines(config.Master.GoroutineInterval, runtime.NumGoroutine)
+
+		// Subject churn runs alongside until the run is over
+		var churned chan churnStats
+		churnCtx, stopChurn := context.WithCancel(ctx)
+		defer stopChurn()
+		if config.Master.ChurnRate > 0 {
+			churned = make(chan churnStats, 1)
+			go func() {
+				churned <- churnSubjects(churnCtx, nc, config.Subject+".churn", config.Master.ChurnRate, 0)
+			}()
+		}
+
+		var res result
+		var err error
+		if config.RequestReply {
+			res, err = runRequestReply(ctx, nc, config.Subject+".request", config, generateMessage, log)
+		} else {
+			res, err = runMaster(ctx, nc, config, generateMessage, log)
+		}
+
+		messagesAfter, bytesAfter := buffered.buffered()
+		res.BufferedMessages = messagesAfter - messagesBefore
+		res.BufferedBytes = bytesAfter - bytesBefore
+
+		if churned != nil {
+			stopChurn()
+			stats := <-churned
+			res.ChurnSubscribeRate, res.ChurnUnsubscribeRate = stats.rates()
+			res.ChurnErrors = stats.errors
+		}
+		stopSampling(&res)
+		return res, err
+	}
+	run := func(ctx context.Context) (result, error) {
+		return runOn(ctx, nc, buffered)
+	}
+
+	// Every result is logged, written and published as configured
+	report := func(res result) error {
+		return reportResult(log, nc, config, res)
+	}
+
+	// The pairs bring their own slaves
+	if config.Master.Pairs > 1 {
+		pairsCtx, cancel := context.WithTimeout(ctx, config.Master.MaxRuntime)
+		stopSampling := sampleGoroutines(config.Master.GoroutineInterval, runtime.NumGoroutine)
+		res, err := runPairs(pairsCtx, config.NATSServerURL, buildConnectOptions(config, &bufferTracker{}, log), config, generateMessage, log)
+		cancel()
+		stopSampling(&res)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Pairs failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		err = report(res)
+		if err != nil {
+			log.Logf(logrus.ErrorLevel, "Unable to report results err=%v", err)
+		}
+		met := throughputMet(log, res, config)
+		if !publishSucceeded(log, res) || !met {
+			exitCode = 1
+		}
+		return
+	}
+
+	if config.CheckPermissions {
+		publish, subscribe := requiredSubjects(config, false)
+		err = checkPermissions(nc, publish, subscribe, permissionTimeout)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Aborting err=%v", err)
+			exitCode = 1
+			return
+		}
+	}
+
+	// Make sure the slave is there before committing to a run
+	err = canary(nc, config.Subject+".canary", config.Master.CanaryTimeout)
+	if err != nil {
+		log.Logf(logrus.FatalLevel, "Aborting err=%v", err)
+		exitCode = 1
+		return
+	}
+
+	if config.Master.AutoTune {
+		rate, err := runAutoTune(ctx, nc, config, generateMessage, log)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Auto tune failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		log.Logf(logrus.InfoLevel, "Max sustainable rate=%.0f msgs/sec (precision %.0f msgs/sec)", rate, config.Master.AutoTunePrecision)
+		return
+	}
+
+	if len(config.Master.LossCurveRates) > 0 {
+		points, err := runLossCurve(ctx, nc, config, generateMessage, log)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Loss curve failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		log.Logf(logrus.InfoLevel, "Loss curve of %d messages per rate\n%s", config.Total, lossCSV(points))
+		return
+	}
+
+	if len(config.Master.Matrix) > 0 {
+		if format := generateMessage(1, 1).format(); format != "byte" {
+			log.Logf(logrus.FatalLevel, "Master.Matrix requires a scenario without encryption or compression, got format=%s", format)
+			exitCode = 1
+			return
+		}
+		rows, err := runMatrix(ctx, nc, config, generateMessage, log)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Matrix failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		log.Logf(logrus.InfoLevel, "Matrix of %d messages per combination\n%s", config.Total, matrixTable(rows, newSummaryFormat(config)))
+		return
+	}
+
+	if len(config.SubjectLengths) > 0 {
+		points, err := runSubjectLengths(ctx, nc, config, generateMessage, log)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Subject lengths failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		log.Logf(logrus.InfoLevel, "Throughput of %d messages per subject length (%.2f ns/msg per subject byte)\n%s", config.Total, subjectLengthSlope(points), subjectLengthCSV(points))
+		return
+	}
+
+	if config.daemon {
+		log.Logf(logrus.InfoLevel, "Running as daemon with interval=%v", config.daemonInterval)
+		err = runDaemon(ctx, config.daemonInterval, config.daemonIterations, run, report, log)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Daemon stopped err=%v", err)
+			exitCode = 1
+		}
+		return
+	}
+
+	res, err := run(ctx)
+	switch {
+	case err == context.DeadlineExceeded: // Context expired. Run took longer than MaxRuntime
+		log.Logf(logrus.InfoLevel, "Timeout! For longer timeout - Change the settings in config file!")
+		exitCode = 1
+	case err == errIdleTimeout: // No progress from the slave
+		log.Logf(logrus.InfoLevel, "No progress from slave for IdleTimeout=%v. Giving up!", config.Master.IdleTimeout)
+		exitCode = 1
+	case err == context.Canceled: // User interrupt
+	case err != nil:
+		log.Logf(logrus.FatalLevel, "Run failed err=%v", err)
+		exitCode = 1
+	default: // Work is done - we have received confirmation back from the slave
+		err = report(res)
+		if err != nil {
+			log.Logf(logrus.ErrorLevel, "Unable to report results err=%v", err)
+		}
+		met := throughputMet(log, res, config)
+		if !publishSucceeded(log, res) || !met {
+			exitCode = 1
+		}
+		if config.Master.TLSServerURL == "" {
+			return
+		}
+
+		// The same run again over TLS
+		var tlsConnectTime time.Duration
+		tlsBuffered := &bufferTracker{}
+		tc, err := timedConnect(&tlsConnectTime, func() (*nats.Conn, error) {
+			return nats.Connect(config.Master.TLSServerURL, buildConnectOptions(config, tlsBuffered, log)...)
+		})()
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Unable to connect to nats server over TLS err=%v", err)
+			exitCode = 1
+			return
+		}
+		defer tc.Close()
+		secure, err := runOn(ctx, tc, tlsBuffered)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "TLS run failed err=%v", err)
+			exitCode = 1
+			return
+		}
+		overhead := compareTLS(res, secure, connectTime, tlsConnectTime)
+		secure.TLS, secure.TLSHandshake = true, overhead.Handshake
+		err = report(secure)
+		if err != nil {
+			log.Logf(logrus.ErrorLevel, "Unable to report results err=%v", err)
+		}
+		logTLSOverhead(log, overhead)
+	}
+	return
+}
+
+// serveSlave handles jobs on nc until config.Timeout, user interrupt or abort
+func serveSlave(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) {
+	// We found ourselves to be slave...
+	// Remain alive handling jobs until timeout, user interrupt or abort
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	if config.CheckPermissions {
+		publish, subscribe := requiredSubjects(config, true)
+		err := checkPermissions(nc, publish, subscribe, permissionTimeout)
+		if err != nil {
+			log.Logf(logrus.FatalLevel, "Aborting err=%v", err)
+			return
+		}
+	}
+
+	err := runSlave(ctx, nc, config, generateMessage, log)
+	switch {
+	case err == context.DeadlineExceeded:
+		log.Logf(logrus.InfoLevel, "Timeout! For longer timeout - Change the settings in config file!")
+	case err == context.Canceled: // User interrupt or abort, already logged
+	case err != nil:
+		log.Logf(logrus.FatalLevel, "Slave failed err=%v", err)
+	}
+}
+
+/* --------------------- SCENARIOS --------------------- */
+
+// Returns the message generator of config.Scenario with the TransformChain and Checksum on top. Nil for no
+// scenario, which is fine for a slave. file.stream sets config.Total to the number of chunks
+func setupScenario(config *configuration, log *logrus.Logger) (rawMessageGenerator, error) {
+	var generateMessage rawMessageGenerator
+	trace := config.tracer
+
+	switch config.Scenario {
+
+	case "json":
+
+		// Message based on Marshal the bigStruct
+		myStruct := fillBigStruct()
+		structMessages, err := structMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		generateMessage = rawMessageFunc([]byte("json"), []byte("byte"), trace.stage("generate", structMessages))
+
+	case "msgpack":
+
+		// Same bigStruct as json, marshalled with msgpack
+		myStruct := fillBigStruct()
+		msgpackMessages, err := msgpackMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		generateMessage = rawMessageFunc([]byte("mpck"), []byte("byte"), trace.stage("generate", msgpackMessages))
+
+	case "json.encrypted":
+
+		// Message based on encrypted Marshal of the bigStruct
+		myStruct := fillBigStruct()
+		structMessages, err := structMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		format, encrypt := cipherSuiteFunc(config.CipherSuite)
+		generateMessage = rawMessageFunc([]byte("json"), []byte(format), trace.stage("encrypt", encrypt(trace.stage("generate", structMessages), config.AESEncryptionKey)))
+
+	case "json.ratchet":
+
+		// Message based on Marshal of the bigStruct, encrypted with a fresh derived key per message
+		myStruct := fillBigStruct()
+		structMessages, err := structMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		generateMessage = rawMessageFunc([]byte("json"), []byte("rtch"), trace.stage("encrypt", ratchetMessageFunc(trace.stage("generate", structMessages), config.AESEncryptionKey)))
+
+	case "json.gzip":
+
+		// Message based on gzip compressed Marshal of the bigStruct
+		myStruct := fillBigStruct()
+		structMessages, err := structMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		generateMessage = rawMessageFunc([]byte("json"), []byte("gzip"), trace.stage("compress", compressedMessageFunc(trace.stage("generate", structMessages), config.CompressionLevel)))
+
+	case "json.encz":
+
+		// Message based on Marshal of the bigStruct, gzip compressed and then encrypted
+		myStruct := fillBigStruct()
+		structMessages, err := structMessageFuncE(&myStruct)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to generate message")
+		}
+		generateMessage = rawMessageFunc([]byte("json"), []byte("encz"), trace.stage("encrypt", encryptedMessageFunc(trace.stage("compress", compressedMessageFunc(trace.stage("generate", structMessages), config.CompressionLevel)), config.AESEncryptionKey)))
+
+	case "json.template":
+
+		// Messages rendered from the template in config.Template with the count and config.TemplateVars. Sizes vary
+		tmpl, err := loadTemplate(config.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to load template")
+		}
+		templateMessages, err := templateMessageFunc(tmpl, config.TemplateVars)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to render template")
+		}
+		generateMessage = rawMessageFunc([]byte("tmpl"), []byte("byte"), trace.stage("generate", templateMessages))
+
+	case "mix":
+
+		// Message kinds mixed by the weights in config.Mix
+		generateMessage, _ = mixedMessageFunc(config.Mix, *config)
+
+	case "emptybytes", "pingpong":
+
+		// Messages with config.Numbytes empty zeros
+		data := make([]byte, config.NumBytes)
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("byte"), trace.stage("generate", byteMessageFunc(data)))
+
+	case "randombytes":
+
+		// Messages with config.NumBytes random bytes, regenerated for every message
+		seed := config.RandomSeed
+		if seed == 0 {
+			seed = seededRand(config.seed, "payload").Int63()
+		}
+		source, err := randomSource(config.RandomSource, seed)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to set up random source")
+		}
+		if config.RandomSource == "math" {
+			log.Logf(logrus.InfoLevel, "Random source=math seed=%d", seed)
+		} else {
+			log.Logf(logrus.InfoLevel, "Random source=%s", config.RandomSource)
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("byte"), trace.stage("generate", randomByteMessageFunc(config.NumBytes, source)))
+
+	case "file":
+
+		// Messages created from config.Filename. No error handling. Note: file data is copied in memory for message generation
+		// Not read from disk except this first time
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("byte"), trace.stage("generate", byteMessageFunc(data)))
+
+	case "stdin":
+
+		// Messages created from all of stdin, read once like "file"
+		data, err := readPayload(stdin)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read payload")
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("byte"), trace.stage("generate", byteMessageFunc(data)))
+
+	case "file.encrypted":
+
+		// Encrypted file data
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		format, encrypt := cipherSuiteFunc(config.CipherSuite)
+		generateMessage = rawMessageFunc([]byte("byte"), []byte(format), trace.stage("encrypt", encrypt(trace.stage("generate", byteMessageFunc(data)), config.AESEncryptionKey)))
+
+	case "file.ratchet":
+
+		// File data encrypted with a fresh derived key per message
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("rtch"), trace.stage("encrypt", ratchetMessageFunc(trace.stage("generate", byteMessageFunc(data)), config.AESEncryptionKey)))
+
+	case "file.gzip":
+
+		// File data compressed with gzip at config.CompressionLevel
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("gzip"), trace.stage("compress", compressedMessageFunc(trace.stage("generate", byteMessageFunc(data)), config.CompressionLevel)))
+
+	case "file.encz":
+
+		// File data gzip compressed and then encrypted
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("encz"), trace.stage("encrypt", encryptedMessageFunc(trace.stage("compress", compressedMessageFunc(trace.stage("generate", byteMessageFunc(data)), config.CompressionLevel)), config.AESEncryptionKey)))
+
+	case "file.stream":
+
+		// File data streamed in chunks, one chunk per message. A job delivers the file once
+		data, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		streamMessages, chunks := streamMessageFunc(data, int(config.ChunkSize), config.Master.StartOffset)
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("strm"), trace.stage("generate", streamMessages))
+		config.Total = chunks
+		log.Logf(logrus.InfoLevel, "Streaming %s in %d chunks of %d bytes", config.Filename, chunks, config.ChunkSize)
+
+	case "file.seeded":
+
+		// File data as a seed, transformed for every message so each message differs. Only the seed is in memory
+		seed, err := ioutil.ReadFile(config.Filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "scenario: unable to read file")
+		}
+		seededMessages, _ := seededMessageFunc(seed, config.SeedTransform)
+		generateMessage = rawMessageFunc([]byte("byte"), []byte("seed"), trace.stage("generate", seededMessages))
+		log.Logf(logrus.InfoLevel, "Seed %s transformed with %s", config.Filename, config.SeedTransform)
+
+	}
+
+	// Apply the transform chain on top of the plain scenario
+	if len(config.TransformChain) > 0 && generateMessage != nil {
+		if format := generateMessage(1, 1).format(); format != "byte" {
+			return nil, errors.New(fmt.Sprintf("scenario: TransformChain requires a scenario without encryption or compression, got format=%s", format))
+		}
+		chain, _ := parseTransformChain(config.TransformChain, *config)
+		generateMessage = chainMessageFunc(generateMessage, chain)
+	}
+
+	// Checksum the plain scenario so the slave detects corruption
+	if config.Checksum && generateMessage != nil {
+		plain := generateMessage(1, 1)
+		if plain.format() != "byte" {
+			return nil, errors.New(fmt.Sprintf("scenario: Checksum requires a scenario without encryption or compression, got format=%s", plain.format()))
+		}
+		generateMessage = rawMessageFunc([]byte(plain.messageType()), []byte("ck32"), trace.stage("checksum", checksumMessageFunc(generateMessage)))
+	}
+
+	return generateMessage, nil
+}
+
+/* --------------------- RUN --------------------- */
+
+// errIdleTimeout is returned by runMaster when there is no progress from the slave for config.Master.IdleTimeout
+var errIdleTimeout = errors.New("master: no progress from slave within IdleTimeout")
+
+// runMaster publishes config.Total messages and waits for the slave to signal completion
+// Returns ctx.Err() if ctx is done before completion, or errIdleTimeout if the slave stops making progress
+func runMaster(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) (result, error) {
+	// The measured run starts when the warmup is complete
+	if config.Master.WarmupMessages > 0 {
+		err := warmup(ctx, nc, config, generateMessage, log)
+		if err != nil {
+			return result{}, err
+		}
+	}
+
+	// Every message of the run carries its job ID, the slave drops messages of other runs
+	job := newJobID()
+	generateMessage = jobMessageFunc(job, generateMessage)
+	log.Logf(logrus.DebugLevel, "Job ID=%d", job)
+	if config.DedupMsgID {
+		config.msgID = func(count uint64) string { return dedupMsgID(job, count) }
+	}
+
+	done := make(chan metric, 1)
+	first := make(chan metric, 1)
+	activity := make(chan struct{}, 1)
+	unexpected := &unexpectedMetrics{threshold: config.Master.UnexpectedMetrics, log: log}
+
+	// Service that listens to the completion subject to get timestamp back from the slave
+	// Must be in place before we publish, otherwise the run can never complete
+	// With DataQueueGroup every slave only sees its share, the master adds up their partial counts
+	completion := completionHandler(config.Total, job, newQuorumTracker(config.Master.completionQuorum), unexpected, done)
+	var shares *shareTracker
+	if config.DataQueueGroup != "" {
+		shares = newShareTracker(config.Total)
+		completion = shareHandler(shares, job, unexpected, done)
+	}
+	completionSub, err := subscribe(nc, config.CompletionSubject, completion)
+	if err != nil {
+		return result{}, errors.Wrap(err, "master: unable to establish completion subscription")
+	}
+	defer completionSub.Unsubscribe()
+
+	// Service that listens to the .metric subject for progress during the run
+	metricSub, err := subscribe(nc, config.MetricSubject, progressHandler(config.Total, job, log, unexpected, activity, first))
+	if err != nil {
+		return result{}, errors.Wrap(err, "master: unable to establish metric subscription")
+	}
+	defer metricSub.Unsubscribe()
+
+	// With Bidirectional the slave answers the start marker with a return stream, counted from now
+	var returns *returnCounter
+	if config.Bidirectional {
+		returns = newReturnCounter(config.Total, job)
+		returnSub, err := subscribe(nc, returnSubject(config), returns.handler())
+		if err != nil {
+			return result{}, errors.Wrap(err, "master: unable to establish return subscription")
+		}
+		defer returnSub.Unsubscribe()
+	}
+
+	// Tell the slave what we are about to send
+	err = announce(nc, config.Subject+".control", config.Scenario, config.Name, generateMessage(1, 1))
+	if err != nil {
+		return result{}, err
+	}
+
+	// Persisted messages. The stream must capture the data subject before the start marker
+	var js nats.JetStreamContext
+	if config.UseJetStream {
+		conn, ok := nc.(jetStreamer)
+		if !ok {
+			return result{}, errors.New("master: UseJetStream needs a connection that supports JetStream")
+		}
+		js, err = jetStreamContext(conn)
+		if err != nil {
+			return result{}, err
+		}
+		err = ensureStream(js, config.StreamName, dataSubjects(config))
+		if err != nil {
+			return result{}, err
+		}
+	}
+
+	// Tell the slave where the job starts. Sent on the (first) data subject so it arrives before the data
+	// With DataQueueGroup on the start subject, where every slave in the group gets it
+	subjects := dataSubjects(config)
+	start := subjects[0]
+	if config.DataQueueGroup != "" {
+		start = startSubject(config)
+	}
+	err = publishStart(nc, start, config.Master.StartOffset, magicMessageFunc(config.Magic, sendTimeMessageFunc(config.StampSendTime, time.Now, generateMessage)))
+	if err != nil {
+		return result{}, err
+	}
+
+	// Store the first 'base' time stamp
+	base := metric{Job: "base", Time: time.Now(), Count: config.Total}
+
+	// Fire away the config.Total number of messages on subject config.DataSubject
+	dataMessage := generateMessage
+	if config.LogHeaders {
+		dataMessage = headerLoggingFunc(generateMessage, config.Master.StartOffset, config.Master.StartOffset+config.Total-1, log)
+	}
+	published := make(chan publishOutcome, 1)
+	go func(ctx context.Context, nc publisher, subject string, generateMessage rawMessageGenerator) {
+		var affinity string
+		if config.Master.LockPublisherThreads || config.Master.PinPublishers {
+			unlock, pinned := lockPublisher(config.Master.PinPublishers, 0)
+			defer unlock()
+			affinity = "locked"
+			if pinned {
+				affinity = "pinned"
+			}
+		}
+		// Round-robin across the data subscriptions of the slave
+		var dataPublisher publisher = nc
+		if len(subjects) > 1 {
+			dataPublisher = &roundRobinPublisher{publisher: nc, subjects: subjects}
+		}
+		var stored *jetStreamPublisher
+		if js != nil {
+			// Every message waits for the ack of the stream
+			stored = &jetStreamPublisher{js: js}
+			dataPublisher = stored
+		}
+		// Generate on a pool of workers, or here right before every publish
+		// With Publishers every publisher generates its own range of counts
+		stamped := magicMessageFunc(config.Magic, sendTimeMessageFunc(config.StampSendTime, time.Now, generateMessage))
+		source := func(first uint64, n uint64) messageSource {
+			return rangeMessages(first, n, config.Total, config.tracer, stamped)
+		}
+		var pipeline *generatePipeline
+		if config.Master.GenerateWorkers > 1 {
+			pipelineCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			pipeline = startPipeline(pipelineCtx, config.Master.GenerateWorkers, config.Master.GenerateOrdered, config.Master.StartOffset, config.Total, config.tracer, generateMessage)
+			queued := wrappedSource(pipeline.source(), config.Total, func(generateMessage rawMessageGenerator) rawMessageGenerator {
+				// The send time is taken when the message leaves the queue
+				return magicMessageFunc(config.Magic, sendTimeMessageFunc(config.StampSendTime, time.Now, generateMessage))
+			})
+			source = func(uint64, uint64) messageSource { return queued }
+		}
+		counter := &sentCounter{publisher: dataPublisher}
+		failures, err := publishParallel(ctx, counter, subject, config, source)
+		if ctx.Err() != nil {
+			log.Logf(logrus.InfoLevel, "Publishing stopped after %d of %d messages", atomic.LoadUint64(&counter.sent), config.Total)
+		}
+		if err == nil {
+			// Sending is complete when the server has confirmed every message
+			err = flushPublished(nc, config.Master.FlushTimeout)
+		}
+		outcome := publishOutcome{failures: failures, affinity: affinity, sent: time.Since(base.Time), err: err}
+		if stored != nil {
+			outcome.serverDuplicates = stored.duplicateCount()
+		}
+		if pipeline != nil {
+			outcome.workers, outcome.speedup = config.Master.GenerateWorkers, pipeline.speedup()
+		}
+		published <- outcome
+	}(ctx, nc, subjects[0], dataMessage)
+	var outcome publishOutcome
+
+	// The idle timer is restarted on every progress metric. The nil channel never fires when disabled
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if config.Master.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(config.Master.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case outcome = <-published:
+			if outcome.err != nil {
+				return result{}, outcome.err
+			}
+			if outcome.failures > 0 {
+				log.Logf(logrus.WarnLevel, "%d publish failures with PublishErrorPolicy=%s", outcome.failures, config.Master.PublishErrorPolicy)
+			}
+			published = nil // Done publishing. The nil channel never fires again
+		case m := <-done:
+			// The slave can see the last message just before the publisher returns, or the server confirms it
+			if published != nil {
+				outcome = <-published
+				if outcome.err != nil {
+					return result{}, outcome.err
+				}
+			}
+			res := newResult(config, generateMessage, m.Time.Sub(base.Time))
+			res.JobID = job
+			res.PublishFailures = outcome.failures
+			res.PublisherAffinity = outcome.affinity
+			res.SendDuration = outcome.sent
+			if config.Master.RateLimit > 0 && outcome.sent > 0 {
+				res.TargetRate = config.Master.RateLimit
+				res.SendRate = float64(config.Total) / outcome.sent.Seconds()
+			}
+			res.GenerateWorkers, res.GenerateSpeedup = outcome.workers, outcome.speedup
+			res.SlaveProcessing = m.Processing
+			if m.Latency != nil {
+				res.Latency = m.Latency.percentiles()
+			}
+			res.Types = m.Types
+			res.Duplicates = m.Duplicates
+			if averages := config.tracer.averages(); averages != nil {
+				log.Logf(logrus.InfoLevel, "Trace of every %d:th message (folded)\n%s", config.TraceEvery, folded("master", averages))
+			}
+			res.BadChunks, res.FirstBadChunk = m.BadChunks, m.FirstBad
+			res.BadSeeded = m.BadSeeded
+			res.BadChecksums = m.BadChecksums
+			res.ShortCiphertexts = m.ShortCiphertexts
+			res.SchemaViolations = m.SchemaViolations
+			res.MessageSizes = m.Sizes
+			if m.Subscriptions != nil {
+				res.Subscriptions, res.SubscriptionImbalance = m.Subscriptions, subscriptionImbalance(m.Subscriptions)
+			}
+			res.InjectedDuplicates = injectedDuplicates(config.Total, config.Master.DuplicateFraction)
+			res.ServerDuplicates = outcome.serverDuplicates
+			if shares != nil {
+				res.Shares = shares.counts()
+			}
+			select {
+			case f := <-first:
+				res.FirstLatency = f.Time.Sub(base.Time)
+			default:
+			}
+			if returns != nil {
+				err = returns.wait(ctx, base.Time, &res)
+				if err != nil {
+					return result{}, err
+				}
+			}
+			return res, nil
+		case <-activity:
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(config.Master.IdleTimeout)
+			}
+		case <-idle:
+			return result{}, errIdleTimeout
+		case <-ctx.Done():
+			return result{}, ctx.Err()
+		}
+	}
+}
+
+// Number of retries and first backoff for PublishErrorPolicy "retry". The backoff doubles for every retry
+const (
+	publishRetries = 5
+	publishBackoff = time.Millisecond
+)
+
+// Publishes the start marker of a job: a message with total 0 and the count of the first message
+func publishStart(nc publisher, subject string, start uint64, generateMessage rawMessageGenerator) error {
+	err := nc.Publish(subject, generateMessage(start, 0))
+	if err != nil {
+		return errors.Wrap(err, "master: unable to publish start marker")
+	}
+	return nil
+}
+
+// publishOutcome is reported by the publisher when it is done
+type publishOutcome struct {
+	failures uint64
+	affinity string        // "locked", "pinned" or empty
+	sent     time.Duration // From the first message until the server confirmed the last
+	workers  int           // Master.GenerateWorkers, 0 when generated by the publisher
+	speedup  float64       // Parallel speedup of the generate workers
+	err      error
+
+	serverDuplicates uint64 // Messages JetStream acked as duplicates of a Nats-Msg-Id it had stored
+}
+
+// Time the server has to confirm the published messages when no Master.FlushTimeout is set. The nats default
+const defaultFlushTimeout = 10 * time.Second
+
+// flusher is the part of *nats.Conn needed to confirm that published messages reached the server
+type flusher interface {
+	FlushTimeout(timeout time.Duration) error
+}
+
+// Waits up to timeout for the server to confirm every message published on nc so far. 0 means defaultFlushTimeout
+// Publishers that cannot flush, like in-process fakes, deliver synchronously and need no confirmation
+func flushPublished(nc publisher, timeout time.Duration) error {
+	f, ok := nc.(flusher)
+	if !ok {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = defaultFlushTimeout
+	}
+	err := f.FlushTimeout(timeout)
+	if err != nil {
+		return errors.Wrapf(err, "master: server did not confirm the published messages within %v", timeout)
+	}
+	return nil
+}
+
+// Indirection so tests can observe the thread locking
+var (
+	lockOSThread   = runtime.LockOSThread
+	unlockOSThread = runtime.UnlockOSThread
+)
+
+// Locks the calling publisher goroutine to its OS thread and with pin set also pins the thread to cpu
+// Returns the func to call when the publisher is done and whether pinning was applied
+// A pinned thread is never unlocked, so it exits with the goroutine instead of carrying its affinity back to the scheduler
+func lockPublisher(pin bool, cpu int) (func(), bool) {
+	lockOSThread()
+	if pin {
+		if err := pinThread(cpu % runtime.NumCPU()); err == nil {
+			return func() {}, true
+		}
+	}
+	return unlockOSThread, false
+}
+
+// publishAll publishes config.Total messages on subject, paced to config.Master.RateLimit messages per second if set
+// Every message that fails to publish, and every injected duplicate that fails to resend, is counted once
+// config.Master.PublishErrorPolicy decides what happens to a failed message: "skip" drops the message,
+// "retry" retries with doubling backoff and drops the message after publishRetries retries, "abort" stops and returns the error
+func publishAll(ctx context.Context, nc publisher, subject string, config configuration, generateMessage rawMessageGenerator) (uint64, error) {
+	return publishMessages(ctx, nc, subject, config, inlineMessages(config.Master.StartOffset, config.Total, config.tracer, generateMessage))
+}
+
+// publishMessages is publishAll with the messages from source
+func publishMessages(ctx context.Context, nc publisher, subject string, config configuration, source messageSource) (uint64, error) {
+	total := config.Total
+	policy := config.Master.PublishErrorPolicy
+	start := time.Now()
+
+	var failures uint64
+	var count uint64
+	for ; count < total; count++ {
+		// Stop between sends once the run is timed out or interrupted
+		select {
+		case <-ctx.Done():
+			return failures, ctx.Err()
+		default:
+		}
+
+		if config.Master.RateLimit > 0 {
+			// Wait until message count is due
+			due := start.Add(time.Duration(float64(count) / config.Master.RateLimit * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return failures, ctx.Err()
+				}
+			}
+		}
+
+		messageCount, msg, ok := source()
+		if !ok {
+			return failures, ctx.Err()
+		}
+		err := publishCount(nc, subject, msg, messageCount, config.msgID)
+		config.tracer.finish(messageCount, "publish")
+		if err == nil {
+			if duplicateAt(messageCount-config.Master.StartOffset, total, config.Master.DuplicateFraction) {
+				// Resend with the same count for the slave, or with DedupMsgID the stream, to drop
+				// The message itself is sent, so a failed resend is only counted, whatever the policy
+				if publishCount(nc, subject, msg, messageCount, config.msgID) != nil {
+					failures++
+				}
+			}
+			continue
+		}
+		failures++
+
+		switch policy {
+		case "abort":
+			return failures, errors.Wrapf(err, "master: publish of message %d failed", messageCount)
+		case "retry":
+			backoff := publishBackoff
+			for retry := 0; err != nil && retry < publishRetries; retry++ {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return failures, ctx.Err()
+				}
+				backoff *= 2
+
+				err = publishCount(nc, subject, msg, messageCount, config.msgID)
+			}
+		}
+	}
+	return failures, nil
+}
+
+// sentCounter counts the messages its publisher accepted. Safe for concurrent use
+type sentCounter struct {
+	publisher
+	sent uint64
+}
+
+func (p *sentCounter) Publish(subj string, data []byte) error {
+	err := p.publisher.Publish(subj, data)
+	if err == nil {
+		atomic.AddUint64(&p.sent, 1)
+	}
+	return err
+}
+
+func (p *sentCounter) PublishMsg(m *nats.Msg) error {
+	err := publishMsg(p.publisher, m)
+	if err == nil {
+		atomic.AddUint64(&p.sent, 1)
+	}
+	return err
+}
+
+// Publishes the announcement of sample's type and format on subject
+func announce(nc publisher, subject string, scenario string, name string, sample rawMessage) error {
+	bytes, _ := json.Marshal(&announcement{scenario, sample.messageType(), sample.format(), name})
+	err := nc.Publish(subject, bytes)
+	if err != nil {
+		return errors.Wrap(err, "master: unable to announce scenario")
+	}
+	return nil
+}
+
+// runDaemon calls run every interval until ctx is done, or until iterations runs are done if iterations > 0
+// Each result is passed to report. A failed run is logged but does not stop the daemon, a failed report does
+func runDaemon(ctx context.Context, interval time.Duration, iterations int, run func(context.Context) (result, error), report func(result) error, log *logrus.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; iterations <= 0 || i < iterations; i++ {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		res, err := run(ctx)
+		if ctx.Err() != nil {
+			return nil // Stopped by the user
+		}
+		if err != nil {
+			log.Logf(logrus.ErrorLevel, "Run %d failed err=%v", i+1, err)
+			continue
+		}
+
+		err = report(res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
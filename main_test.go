@@ -1,11 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/direktoren/go-nats-go/pkg/easycrypt"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 func TestByteMessageFunc(t *testing.T) {
@@ -27,6 +46,24 @@ func TestByteMessageFunc(t *testing.T) {
 	}
 }
 
+func TestByteMessageFuncLargeCounts(t *testing.T) {
+	data := []byte("data")
+	generateMessage := byteMessageFunc(data)
+
+	// Above 2^56 a uvarint needs more than 8 bytes
+	for _, c := range []struct{ count, total uint64 }{
+		{1<<56 + 1, 1<<56 + 2},
+		{1<<63 + 12345, math.MaxUint64},
+		{math.MaxUint64 - 1, math.MaxUint64},
+	} {
+		message := byteMessage(generateMessage(c.count, c.total).message())
+		assert.Equal(t, c.count, message.count())
+		assert.Equal(t, c.total, message.total())
+		assert.Equal(t, uint64(len(data)), message.length())
+		assert.Equal(t, data, message.data())
+	}
+}
+
 func TestStructMessageFunc(t *testing.T) {
 	data := struct{ MyData string }{"This is the test string that is the bulk of our message"}
 	generateMessage := structMessageFunc(&data)
@@ -54,6 +91,42 @@ func TestStructMessageFunc(t *testing.T) {
 	}
 }
 
+func TestStructMessageFuncE(t *testing.T) {
+	data := struct{ MyData string }{"This is the test string that is the bulk of our message"}
+	generateMessage, err := structMessageFuncE(&data)
+	assert.Equal(t, err, nil, "structMessageFuncE failed")
+	assert.Equal(t, structMessageFunc(&data)(3, 10), generateMessage(3, 10))
+
+	// A channel does not marshal
+	bad := struct{ Updates chan int }{make(chan int)}
+	_, err = structMessageFuncE(&bad)
+	assert.NotEqual(t, err, nil, "Channel should fail to marshal")
+	assert.Equal(t, headerSize, len(structMessageFunc(&bad)(3, 10)), "Without error handling the body is empty")
+}
+
+func TestMsgpackMessageFunc(t *testing.T) {
+	data := fillBigStruct()
+	generateMessage, err := msgpackMessageFuncE(&data)
+	assert.Equal(t, err, nil, "msgpackMessageFuncE failed")
+
+	var total uint64 = 10
+	var count uint64
+	for ; count < total; count++ {
+		copyStruct := structMessage{Data: &bigStruct{}}
+		err := msgpack.Unmarshal(generateMessage(count, total).message(), &copyStruct)
+		assert.Equal(t, err, nil, "msgpack.Unmarshal failed")
+
+		assert.Equal(t, count, copyStruct.count())
+		assert.Equal(t, total, copyStruct.total())
+		assert.Equal(t, &data, copyStruct.Data)
+	}
+
+	// A channel does not marshal
+	bad := struct{ Updates chan int }{make(chan int)}
+	_, err = msgpackMessageFuncE(&bad)
+	assert.NotEqual(t, err, nil, "Channel should fail to marshal")
+}
+
 func TestEncryptedMessageFunc(t *testing.T) {
 	data := []byte("This is the test string that is the bulk of our message")
 	key := "ThisIsMy32BytesKeyForTestingFine"
@@ -78,6 +151,74 @@ func TestEncryptedMessageFunc(t *testing.T) {
 	}
 }
 
+func TestCompressedMessageFuncLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("This is the test string that is the bulk of our message"), 100)
+
+	// The gzip header XFL byte records best speed (4) or best compression (2)
+	for level, xfl := range map[int]byte{gzip.BestSpeed: 4, gzip.BestCompression: 2} {
+		generateMessage := compressedMessageFunc(byteMessageFunc(data), level)
+		compressed := generateMessage(3, 10).message()
+		assert.Equal(t, xfl, compressed[8], fmt.Sprintf("Level %d not applied", level))
+
+		decompressed, err := decompress(compressed)
+		assert.Equal(t, err, nil, "decompress failed")
+		message := byteMessage(decompressed)
+		assert.Equal(t, uint64(3), message.count())
+		assert.Equal(t, uint64(10), message.total())
+		assert.Equal(t, data, message.data())
+	}
+
+	// The level and ratio are reported
+	config := testConfig()
+	config.CompressionLevel = gzip.BestCompression
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("gzip"), compressedMessageFunc(byteMessageFunc(data), config.CompressionLevel))
+	res := newResult(config, generateMessage, time.Second)
+	assert.Equal(t, gzip.BestCompression, res.CompressionLevel)
+	assert.True(t, res.CompressionRatio > 10, "Repetitive data should compress well")
+}
+
+func TestCompressedMessageFuncRoundTrip(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("gzip"), compressedMessageFunc(byteMessageFunc(data), 0))
+	raw := generateMessage(7, 9)
+	assert.Equal(t, "gzip", raw.format())
+
+	decompressed, err := decompress(raw.message())
+	assert.Equal(t, err, nil, "decompress failed")
+	message := byteMessage(decompressed)
+	assert.Equal(t, uint64(7), message.count())
+	assert.Equal(t, uint64(9), message.total())
+	assert.Equal(t, data, message.data())
+
+	_, err = decompress(data)
+	assert.NotEqual(t, err, nil, "Plain data should not decompress")
+}
+
+func TestCompressedEncryptedMessageFunc(t *testing.T) {
+	data := bytes.Repeat([]byte("This is the test string that is the bulk of our message"), 100)
+	key := "12345678901234567890123456789012"
+	config := testConfig()
+	config.AESEncryptionKey = key
+
+	encz := rawMessageFunc([]byte("byte"), []byte("encz"), encryptedMessageFunc(compressedMessageFunc(byteMessageFunc(data), 0), key))
+	encr := rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc(data), key))
+	raw := encz(3, 10)
+	assert.Equal(t, byte(flagEncrypted|flagCompressed), raw.flags())
+	assert.True(t, len(raw) < len(encr(3, 10))/10, "Compressible data should be smaller than encr")
+
+	compressed, err := easycrypt.Decrypt(raw.message(), key)
+	assert.Equal(t, err, nil, "Decrypt failed")
+	decompressed, err := decompress(compressed)
+	assert.Equal(t, err, nil, "decompress failed")
+	message := byteMessage(decompressed)
+	assert.Equal(t, uint64(3), message.count())
+	assert.Equal(t, uint64(10), message.total())
+	assert.Equal(t, data, message.data())
+
+	res := newResult(config, encz, time.Second)
+	assert.True(t, res.CompressionRatio > 10, "Ratio of the compressed body should be reported")
+}
+
 func TestRawMessageFunc(t *testing.T) {
 	data := []byte("This is the test string that is the bulk of our message")
 	msgType := "test"
@@ -98,3 +239,1868 @@ func TestRawMessageFunc(t *testing.T) {
 		assert.Equal(t, data, message.data())
 	}
 }
+
+func TestRandomByteMessageFunc(t *testing.T) {
+	var numBytes uint = 1024
+	for _, source := range []string{"crypto", "math"} {
+		reader, err := randomSource(source, 42)
+		assert.Equal(t, err, nil, "randomSource failed")
+
+		generateMessage := randomByteMessageFunc(numBytes, reader)
+		message := byteMessage(generateMessage(1, 10).message())
+		assert.Equal(t, int(numBytes), len(message.data()), source)
+		assert.NotEqual(t, make([]byte, numBytes), message.data(), source)
+	}
+
+	_, err := randomSource("dice", 42)
+	assert.NotEqual(t, err, nil, "Unknown source should fail")
+}
+
+func TestRandomByteMessageFuncSeed(t *testing.T) {
+	first, _ := randomSource("math", 42)
+	second, _ := randomSource("math", 42)
+	other, _ := randomSource("math", 43)
+
+	firstMessage := randomByteMessageFunc(64, first)(0, 1)
+	secondMessage := randomByteMessageFunc(64, second)(0, 1)
+	otherMessage := randomByteMessageFunc(64, other)(0, 1)
+
+	assert.Equal(t, firstMessage, secondMessage, "Same seed should give same payload")
+	assert.NotEqual(t, firstMessage, otherMessage, "Different seed should give different payload")
+}
+
+func TestSeededRand(t *testing.T) {
+	draw := func(r *rand.Rand) []int64 {
+		values := make([]int64, 10)
+		for i := range values {
+			values[i] = r.Int63n(1000000)
+		}
+		return values
+	}
+
+	// Two runs with the same seed draw the same, every use its own sequence
+	for _, use := range []string{"payload", "jitter", "processing"} {
+		assert.Equal(t, draw(seededRand(42, use)), draw(seededRand(42, use)), use)
+		assert.NotEqual(t, draw(seededRand(42, use)), draw(seededRand(43, use)), use)
+	}
+	assert.NotEqual(t, draw(seededRand(42, "payload")), draw(seededRand(42, "jitter")))
+
+	// Also the processing samples a job keeps
+	record := func() []time.Duration {
+		times := &processingTimes{random: seededRand(42, "processing")}
+		for i := 0; i < processingSamples+1000; i++ {
+			times.record(time.Duration(i))
+		}
+		return times.samples
+	}
+	assert.Equal(t, record(), record())
+
+	// A seed is made up only when none is given
+	now := func() int64 { return 1234 }
+	assert.Equal(t, int64(1234), resolveSeed(0, now))
+	assert.Equal(t, int64(42), resolveSeed(42, now))
+}
+
+type failingSubscriber struct{}
+
+func (failingSubscriber) Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	return nil, nats.ErrBadSubject
+}
+
+func TestSubscribeError(t *testing.T) {
+	sub, err := subscribe(failingSubscriber{}, "go-nats-go.metric", func(msg *nats.Msg) {})
+	assert.NotEqual(t, err, nil, "Subscribe error was swallowed")
+	assert.Equal(t, nats.ErrBadSubject, errors.Cause(err))
+	assert.Contains(t, err.Error(), "go-nats-go.metric")
+	assert.Nil(t, sub)
+}
+
+func TestCompletionHandler(t *testing.T) {
+	var total uint64 = 10
+	base := time.Now()
+	done := make(chan metric, 1)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	handler := completionHandler(total, 0, nil, &unexpectedMetrics{log: log}, done)
+
+	// Progress metrics - even with a full count - must not complete the run
+	for _, m := range []metric{{Job: "progress", Time: base.Add(time.Second), Count: 5}, {Job: "progress", Time: base.Add(time.Second), Count: total}} {
+		data, _ := json.Marshal(&m)
+		handler(&nats.Msg{Data: data})
+	}
+	assert.Equal(t, 0, len(done), "Progress metric triggered completion")
+
+	data, _ := json.Marshal(&metric{Job: "received", Time: base.Add(2 * time.Second), Count: total})
+	handler(&nats.Msg{Data: data})
+	handler(&nats.Msg{Data: data}) // Duplicates must not block
+	assert.Equal(t, 1, len(done), "Completion metric did not trigger completion")
+	assert.Equal(t, 2*time.Second, (<-done).Time.Sub(base))
+}
+
+func TestCompletionHandlerMalformed(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+
+	var total uint64 = 10
+	done := make(chan metric, 1)
+	handler := completionHandler(total, 0, nil, &unexpectedMetrics{log: log}, done)
+
+	// Malformed metrics are logged and skipped. Empty permission probes are skipped silently
+	for _, data := range [][]byte{[]byte("garbage"), []byte(`{"Job": "received", "Count": "ten"}`), nil} {
+		handler(&nats.Msg{Subject: "go-nats-go.done", Data: data})
+	}
+	assert.Equal(t, 2, strings.Count(output.String(), "Malformed metric on go-nats-go.done"))
+	assert.Equal(t, 0, len(done), "Malformed metric triggered completion")
+
+	// A well-formed metric still completes afterwards
+	data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: total})
+	handler(&nats.Msg{Subject: "go-nats-go.done", Data: data})
+	assert.Equal(t, 1, len(done), "Completion metric did not trigger completion")
+}
+
+func TestUnexpectedMetrics(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	log.Level = logrus.DebugLevel
+
+	var total uint64 = 10
+	done := make(chan metric, 1)
+	activity := make(chan struct{}, 1)
+	unexpected := &unexpectedMetrics{threshold: 3, log: log}
+	completion := completionHandler(total, 0, nil, unexpected, done)
+	progress := progressHandler(total, 0, log, unexpected, activity, make(chan metric, 1))
+
+	wrongCount, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: 5})
+	completion(&nats.Msg{Subject: "go-nats-go.done", Data: wrongCount})
+	assert.Contains(t, output.String(), "count 5, expected 10")
+	completion(&nats.Msg{Subject: "go-nats-go.done", Data: []byte("garbage")})
+	assert.Contains(t, output.String(), "malformed")
+	assert.NotContains(t, output.String(), "unexpected metrics and no completion")
+
+	wrongJob, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: total})
+	progress(&nats.Msg{Subject: "go-nats-go.metric", Data: wrongJob})
+	assert.Contains(t, output.String(), `job \"received\"`)
+	assert.Contains(t, output.String(), "3 unexpected metrics and no completion")
+
+	// Warned once
+	completion(&nats.Msg{Subject: "go-nats-go.done", Data: wrongCount})
+	assert.Equal(t, 1, strings.Count(output.String(), "unexpected metrics and no completion"))
+	assert.Equal(t, 0, len(done), "Unexpected metric triggered completion")
+	assert.Equal(t, 0, len(activity), "Unexpected metric signalled activity")
+}
+
+func TestRunDaemon(t *testing.T) {
+	resultsFile := filepath.Join(t.TempDir(), "results.json")
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	var runs uint64
+	run := func(ctx context.Context) (result, error) {
+		runs++
+		return result{Scenario: "test", TotalMessages: runs}, nil
+	}
+
+	report := func(res result) error {
+		return appendResult(resultsFile, res)
+	}
+
+	err := runDaemon(context.Background(), time.Millisecond, 3, run, report, log)
+	assert.Equal(t, err, nil, "runDaemon failed")
+	assert.Equal(t, uint64(3), runs)
+
+	f, err := os.Open(resultsFile)
+	assert.Equal(t, err, nil, "Results file missing")
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	var count uint64
+	for ; decoder.More(); count++ {
+		res := result{}
+		err := decoder.Decode(&res)
+		assert.Equal(t, err, nil, "Unable to decode result")
+		assert.Equal(t, count+1, res.TotalMessages)
+	}
+	assert.Equal(t, uint64(3), count, "Every run should append a result")
+}
+
+func TestRunDaemonStops(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs int
+	run := func(ctx context.Context) (result, error) {
+		runs++
+		cancel()
+		return result{}, ctx.Err()
+	}
+
+	report := func(res result) error {
+		t.Error("Stopped run should not be reported")
+		return nil
+	}
+
+	err := runDaemon(ctx, time.Millisecond, 0, run, report, log)
+	assert.Equal(t, err, nil, "Stopping the daemon is not an error")
+	assert.Equal(t, 1, runs)
+}
+
+func TestRatchetMessageFunc(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	generateMessage := ratchetMessageFunc(byteMessageFunc(data), key)
+
+	var total uint64 = 10
+	var count uint64
+	for ; count < total; count++ {
+		message := generateMessage(count, total).message()
+
+		// Every message is encrypted with its own key, never the root key
+		_, err := easycrypt.Decrypt(message[8:], key)
+		assert.NotEqual(t, err, nil, "Message decrypted with the root key")
+
+		tmpDecrypted, err := ratchetDecrypt(message, key)
+		assert.Equal(t, err, nil, "ratchetDecrypt failed")
+
+		decryptedMessage := byteMessage(tmpDecrypted)
+		assert.Equal(t, count, decryptedMessage.count())
+		assert.Equal(t, total, decryptedMessage.total())
+		assert.Equal(t, data, decryptedMessage.data())
+	}
+
+	_, err := ratchetDecrypt([]byte{1, 2, 3}, key)
+	assert.NotEqual(t, err, nil, "Short message should fail")
+}
+
+func TestMetricCoalescer(t *testing.T) {
+	var mu sync.Mutex
+	var progress, completion []metric
+	coalescer := newMetricCoalescer(50*time.Millisecond, func(m metric) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress = append(progress, m)
+	}, func(m metric) {
+		mu.Lock()
+		defer mu.Unlock()
+		completion = append(completion, m)
+	})
+
+	// A burst is coalesced into the first and, after the interval, the latest
+	var count uint64
+	for ; count < 100; count++ {
+		coalescer.progress(metric{Job: "progress", Time: time.Now(), Count: count + 1})
+	}
+	mu.Lock()
+	assert.Equal(t, 1, len(progress), "Only the first progress metric should be sent at once")
+	mu.Unlock()
+
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 2, len(progress), "The latest progress metric should be sent after the interval")
+	assert.Equal(t, uint64(100), progress[len(progress)-1].Count)
+	mu.Unlock()
+
+	// Completion is sent immediately, even right after a progress metric
+	coalescer.progress(metric{Job: "progress", Time: time.Now(), Count: 101})
+	coalescer.progress(metric{Job: "progress", Time: time.Now(), Count: 102})
+	coalescer.complete(metric{Job: "received", Time: time.Now(), Count: 102})
+	mu.Lock()
+	assert.Equal(t, 1, len(completion), "Completion metric was delayed")
+	mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 3, len(progress), "Pending progress should be dropped on completion")
+	mu.Unlock()
+}
+
+func TestMetricCoalescerNoInterval(t *testing.T) {
+	var sent int
+	coalescer := newMetricCoalescer(0, func(m metric) { sent++ }, func(m metric) {})
+	for i := 0; i < 10; i++ {
+		coalescer.progress(metric{Job: "progress", Time: time.Now(), Count: uint64(i)})
+	}
+	assert.Equal(t, 10, sent, "Zero interval should not coalesce")
+}
+
+func TestAnnouncementHandler(t *testing.T) {
+	myStruct := fillBigStruct()
+	expected := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))(1, 1)
+	jsonMessage := rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct))(1, 1)
+
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+
+	// Master announces what the slave expects - no warning
+	nc := &recordingPublisher{}
+	announce(nc, "go-nats-go.control", "file", "master", expected)
+	aborted := false
+	handler := announcementHandler(expected, "slave", false, log, func() { aborted = true })
+	handler(&nats.Msg{Data: nc.data[0]})
+	assert.Equal(t, "", output.String(), "Matching scenario should not warn")
+
+	// Master sends json while the slave expects byte
+	announce(nc, "go-nats-go.control", "json", "master", jsonMessage)
+	handler(&nats.Msg{Data: nc.data[1]})
+	assert.Contains(t, output.String(), "Scenario mismatch")
+	assert.False(t, aborted, "Should only warn unless strict")
+
+	// Strict slave aborts
+	strictHandler := announcementHandler(expected, "slave", true, log, func() { aborted = true })
+	strictHandler(&nats.Msg{Data: nc.data[1]})
+	assert.True(t, aborted, "Strict slave should abort on mismatch")
+
+	// A master in the same process is detected
+	output.Reset()
+	announce(nc, "go-nats-go.control", "file", "slave", expected)
+	handler(&nats.Msg{Data: nc.data[2]})
+	assert.Contains(t, output.String(), "same process")
+
+	// A slave without a scenario accepts anything it can handle, but not unknown formats
+	assert.Equal(t, nil, checkAnnouncement(announcement{"json", "json", "encr", ""}, nil))
+	assert.NotEqual(t, nil, checkAnnouncement(announcement{"?", "json", "zzzz", ""}, nil))
+}
+
+// fakeConn is an in-process stand in for *nats.Conn. Published messages are delivered to the subscribed handlers
+type fakeConn struct {
+	mu        sync.Mutex
+	handlers  map[string][]nats.MsgHandler
+	published map[string]int
+	flushes   int
+	drained   bool
+	closed    bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{handlers: map[string][]nats.MsgHandler{}, published: map[string]int{}}
+}
+
+func (c *fakeConn) Publish(subj string, data []byte) error {
+	return c.PublishMsg(&nats.Msg{Subject: subj, Data: data})
+}
+
+func (c *fakeConn) PublishMsg(m *nats.Msg) error {
+	c.mu.Lock()
+	c.published[m.Subject]++
+	handlers := c.handlers[m.Subject]
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(m)
+	}
+	return nil
+}
+
+func (c *fakeConn) Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[subj] = append(c.handlers[subj], cb)
+	return &nats.Subscription{Subject: subj}, nil
+}
+
+func (c *fakeConn) QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	return c.Subscribe(subj, cb)
+}
+
+func (c *fakeConn) ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return c.Subscribe(subj, func(msg *nats.Msg) { ch <- msg })
+}
+
+func (c *fakeConn) ChanQueueSubscribe(subj, group string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	return c.ChanSubscribe(subj, ch)
+}
+
+func (c *fakeConn) Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	return fakeRequest(c, subj, data, timeout)
+}
+
+// Publishes data on subj with a reply subject on nc and waits for the first message published on it
+func fakeRequest(nc interface {
+	subscriber
+	msgPublisher
+}, subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	replies := make(chan *nats.Msg, 1)
+	inbox := nats.NewInbox()
+	nc.Subscribe(inbox, func(msg *nats.Msg) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	nc.PublishMsg(&nats.Msg{Subject: subj, Reply: inbox, Data: data})
+	select {
+	case msg := <-replies:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, nats.ErrTimeout
+	}
+}
+
+func (c *fakeConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushes++
+	return nil
+}
+
+// Published messages are delivered synchronously, there is nothing to confirm
+func (c *fakeConn) FlushTimeout(timeout time.Duration) error {
+	return nil
+}
+
+func (c *fakeConn) LastError() error {
+	return nil
+}
+
+func (c *fakeConn) MaxPayload() int64 {
+	return 1024 * 1024
+}
+
+func (c *fakeConn) Drain() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drained = true
+	c.handlers = map[string][]nats.MsgHandler{}
+	return nil
+}
+
+func (c *fakeConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func (c *fakeConn) count(subj string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.published[subj]
+}
+
+func testConfig() configuration {
+	return configuration{
+		Subject:           "go-nats-go",
+		Total:             10,
+		Scenario:          "emptybytes",
+		CompletionSubject: "go-nats-go.done",
+		DataSubject:       "go-nats-go.data",
+		MetricSubject:     "go-nats-go.metric",
+	}
+}
+
+func TestRunMasterMaxRuntime(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	// Nobody answers. The run is stopped by the context deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := runMaster(ctx, newFakeConn(), testConfig(), generateMessage, log)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestRunMasterIdleTimeout(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Master.IdleTimeout = 50 * time.Millisecond
+
+	// Nobody answers. The run is stopped by the idle timer long before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := runMaster(ctx, newFakeConn(), config, generateMessage, log)
+	assert.Equal(t, errIdleTimeout, err)
+
+	// Steady progress keeps the run alive past the idle timeout until completion
+	nc := newFakeConn()
+	jobs := make(chan uint64, 1)
+	nc.Subscribe("go-nats-go.data", func(msg *nats.Msg) {
+		if byteMessage(rawMessage(msg.Data).message()).total() == 0 {
+			jobs <- rawMessage(msg.Data).jobID()
+		}
+	})
+	go func() {
+		job := <-jobs
+		for i := 0; i < 8; i++ {
+			time.Sleep(20 * time.Millisecond)
+			data, _ := json.Marshal(&metric{Job: "progress", Time: time.Now(), Count: uint64(i), JobID: job})
+			nc.Publish("go-nats-go.metric", data)
+		}
+		data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: config.Total, JobID: job})
+		nc.Publish("go-nats-go.done", data)
+	}()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Progress should reset the idle timer")
+	assert.Equal(t, config.Total, res.TotalMessages)
+}
+
+// flushingConn is a fakeConn that confirms published messages like a server, after delay or with err
+type flushingConn struct {
+	*fakeConn
+	delay   time.Duration
+	err     error
+	flushes int
+}
+
+func (c *flushingConn) FlushTimeout(timeout time.Duration) error {
+	c.flushes++
+	if c.delay > timeout {
+		time.Sleep(timeout)
+		return nats.ErrTimeout
+	}
+	time.Sleep(c.delay)
+	return c.err
+}
+
+func TestFlushPublished(t *testing.T) {
+	// Fakes without flush need no confirmation
+	assert.Equal(t, nil, flushPublished(newFakeConn(), time.Millisecond))
+
+	nc := &flushingConn{fakeConn: newFakeConn()}
+	assert.Equal(t, nil, flushPublished(nc, time.Second))
+	assert.Equal(t, 1, nc.flushes)
+
+	nc = &flushingConn{fakeConn: newFakeConn(), delay: time.Second}
+	err := flushPublished(nc, 10*time.Millisecond)
+	assert.NotEqual(t, nil, err, "Flush timeout not reported")
+	assert.Equal(t, nats.ErrTimeout, errors.Cause(err))
+	assert.Contains(t, err.Error(), "did not confirm")
+}
+
+func TestRunMasterFlush(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Master.FlushTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The send is complete when the flush is, even if the slave completes first
+	nc := &flushingConn{fakeConn: newFakeConn(), delay: 20 * time.Millisecond}
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	stop()
+	assert.Equal(t, err, nil, "Run with a confirmed flush should complete")
+	assert.Equal(t, 1, nc.flushes)
+	assert.True(t, res.SendDuration >= 20*time.Millisecond, "Send duration does not include the flush")
+
+	// A server that never confirms fails the run
+	nc = &flushingConn{fakeConn: newFakeConn(), delay: time.Second}
+	stop, err = startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	_, err = runMaster(ctx, nc, config, generateMessage, log)
+	stop()
+	assert.Equal(t, nats.ErrTimeout, errors.Cause(err))
+}
+
+func TestMagicMessageFunc(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+	magicGenerateMessage := magicMessageFunc("GNG1", generateMessage)
+	filter := &magicFilter{magic: []byte("GNG1")}
+
+	var total uint64 = 10
+	var count uint64
+	for ; count < total; count++ {
+		received, ok := filter.filter(magicGenerateMessage(count, total))
+		assert.True(t, ok, "Message with magic was dropped")
+		assert.Equal(t, generateMessage(count, total), received)
+	}
+	assert.Equal(t, uint64(0), filter.droppedCount())
+
+	// Messages without the magic are dropped and counted
+	for count = 0; count < 3; count++ {
+		_, ok := filter.filter(generateMessage(count, total))
+		assert.False(t, ok, "Message without magic was accepted")
+	}
+	assert.Equal(t, uint64(3), filter.droppedCount())
+
+	// No magic configured - nothing is added and nothing is dropped
+	assert.Equal(t, generateMessage(1, total), magicMessageFunc("", generateMessage)(1, total))
+	_, ok := (&magicFilter{}).filter(generateMessage(1, total))
+	assert.True(t, ok)
+}
+
+// flakyPublisher fails to publish the messages in failOn, each the given number of times
+type flakyPublisher struct {
+	failOn    map[uint64]int
+	published []uint64
+}
+
+func (p *flakyPublisher) Publish(subj string, data []byte) error {
+	count := byteMessage(rawMessage(data).message()).count()
+	if p.failOn[count] > 0 {
+		p.failOn[count]--
+		return nats.ErrConnectionClosed
+	}
+	p.published = append(p.published, count)
+	return nil
+}
+
+func withPolicy(config configuration, policy string) configuration {
+	config.Master.PublishErrorPolicy = policy
+	return config
+}
+
+func TestPublishAllPolicies(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+
+	// skip drops the failing messages and carries on
+	nc := &flakyPublisher{failOn: map[uint64]int{3: 1, 7: 1}}
+	failures, err := publishAll(context.Background(), nc, "data", withPolicy(config, "skip"), generateMessage)
+	assert.Equal(t, err, nil, "skip should not fail")
+	assert.Equal(t, uint64(2), failures)
+	assert.Equal(t, []uint64{0, 1, 2, 4, 5, 6, 8, 9}, nc.published)
+
+	// retry publishes every message in order after transient failures
+	nc = &flakyPublisher{failOn: map[uint64]int{3: 2, 7: 1}}
+	failures, err = publishAll(context.Background(), nc, "data", withPolicy(config, "retry"), generateMessage)
+	assert.Equal(t, err, nil, "retry should not fail")
+	assert.Equal(t, uint64(2), failures, "A retried message should count once")
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, nc.published)
+
+	// retry gives up on a message after publishRetries retries
+	nc = &flakyPublisher{failOn: map[uint64]int{5: publishRetries + 1}}
+	failures, err = publishAll(context.Background(), nc, "data", withPolicy(config, "retry"), generateMessage)
+	assert.Equal(t, err, nil, "retry should not fail")
+	assert.Equal(t, uint64(1), failures)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4, 6, 7, 8, 9}, nc.published)
+
+	// abort stops at the first failure
+	nc = &flakyPublisher{failOn: map[uint64]int{3: 1, 7: 1}}
+	failures, err = publishAll(context.Background(), nc, "data", withPolicy(config, "abort"), generateMessage)
+	assert.NotEqual(t, err, nil, "abort should fail")
+	assert.Equal(t, nats.ErrConnectionClosed, errors.Cause(err))
+	assert.Equal(t, uint64(1), failures)
+	assert.Equal(t, []uint64{0, 1, 2}, nc.published)
+
+	// abort names the failing message, not its index in the run
+	config.Master.StartOffset = 100
+	nc = &flakyPublisher{failOn: map[uint64]int{103: 1}}
+	_, err = publishAll(context.Background(), nc, "data", withPolicy(config, "abort"), generateMessage)
+	assert.NotEqual(t, err, nil, "abort should fail")
+	assert.Contains(t, err.Error(), "message 103 failed")
+}
+
+// resendFailer fails every publish of a count it published before
+type resendFailer struct {
+	published map[uint64]bool
+}
+
+func (p *resendFailer) Publish(subj string, data []byte) error {
+	count := byteMessage(rawMessage(data).message()).count()
+	if p.published[count] {
+		return nats.ErrConnectionClosed
+	}
+	p.published[count] = true
+	return nil
+}
+
+func TestPublishAllFailedResend(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Master.DuplicateFraction = 0.2
+
+	// The resend of message 4 fails. The message itself is sent, so the run carries on even with abort
+	for _, policy := range []string{"skip", "retry", "abort"} {
+		nc := &resendFailer{published: map[uint64]bool{}}
+		failures, err := publishAll(context.Background(), nc, "data", withPolicy(config, policy), generateMessage)
+		assert.Equal(t, err, nil, "A failed resend should not fail the run")
+		assert.Equal(t, uint64(1), failures, "A failed resend should be counted")
+		assert.Equal(t, int(config.Total), len(nc.published))
+	}
+}
+
+func TestPublishAllRateLimit(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Total = 10
+	config.Master.RateLimit = 100
+
+	// The last of 10 messages at 100 msgs/sec is due after 90ms
+	nc := &flakyPublisher{}
+	began := time.Now()
+	_, err := publishAll(context.Background(), nc, "data", config, generateMessage)
+	elapsed := time.Since(began)
+	assert.Equal(t, err, nil, "publishAll failed")
+	assert.Equal(t, int(config.Total), len(nc.published))
+	assert.True(t, elapsed >= 90*time.Millisecond, fmt.Sprintf("Published 10 messages at 100 msgs/sec in %v", elapsed))
+
+	// Parallel publishers share the rate
+	config.Master.Publishers = 3
+	source := func(first uint64, n uint64) messageSource {
+		return rangeMessages(first, n, config.Total, config.tracer, generateMessage)
+	}
+	began = time.Now()
+	_, err = publishParallel(context.Background(), &countingPublisher{}, "data", config, source)
+	elapsed = time.Since(began)
+	assert.Equal(t, err, nil, "publishParallel failed")
+	assert.True(t, elapsed >= 60*time.Millisecond, fmt.Sprintf("Published 10 messages from 3 publishers at 100 msgs/sec in %v", elapsed))
+}
+
+func TestPublishAllCancel(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Total = 1000
+
+	// Canceled from within the publish of count 99, the loop stops before the next send
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc := newFakeConn()
+	nc.Subscribe("data", func(msg *nats.Msg) {
+		if byteMessage(rawMessage(msg.Data).message()).count() == 99 {
+			cancel()
+		}
+	})
+	_, err := publishAll(ctx, nc, "data", config, generateMessage)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 100, nc.count("data"))
+
+	// Parallel publishers stop too, and so does the last message
+	config.Master.Publishers = 4
+	source := func(first uint64, n uint64) messageSource {
+		return rangeMessages(first, n, config.Total, config.tracer, generateMessage)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	nc = newFakeConn()
+	counter := &sentCounter{publisher: nc}
+	nc.Subscribe("data", func(msg *nats.Msg) {
+		if atomic.LoadUint64(&counter.sent) == 100 {
+			cancel()
+		}
+	})
+	_, err = publishParallel(ctx, counter, "data", config, source)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, nc.count("data") < int(config.Total), fmt.Sprintf("Published %d of %d", nc.count("data"), config.Total))
+	assert.Equal(t, uint64(nc.count("data")), atomic.LoadUint64(&counter.sent))
+}
+
+// failingDataConn fails to publish the data messages with the counts in failOn
+type failingDataConn struct {
+	*fakeConn
+	failOn map[uint64]bool
+}
+
+func (c *failingDataConn) Publish(subj string, data []byte) error {
+	raw := rawMessage(data)
+	if subj == "go-nats-go.data" && raw.checkHeader() == nil {
+		message := byteMessage(raw.message())
+		if message.total() != 0 && c.failOn[message.count()] {
+			return nats.ErrMaxPayload
+		}
+	}
+	return c.fakeConn.Publish(subj, data)
+}
+
+func TestRunMasterPublishFailures(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+
+	// Complete on the last message, whatever was dropped before it
+	nc := &failingDataConn{fakeConn: newFakeConn(), failOn: map[uint64]bool{2: true, 5: true, 6: true}}
+	nc.Subscribe("go-nats-go.data", func(msg *nats.Msg) {
+		message := byteMessage(rawMessage(msg.Data).message())
+		if message.total() != 0 && message.count() == config.Total-1 {
+			data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: config.Total, JobID: rawMessage(msg.Data).jobID()})
+			nc.Publish("go-nats-go.done", data)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+	assert.Equal(t, uint64(3), res.PublishFailures, "Every failed publish should be tallied")
+	assert.Equal(t, int(config.Total)-3+1, nc.count("go-nats-go.data"), "Start marker and the published messages")
+	assert.False(t, publishSucceeded(log, res), "A run with publish failures should fail")
+}
+
+func TestResolveSubject(t *testing.T) {
+	assert.Equal(t, "go-nats-go.data", resolveSubject("", "go-nats-go", ".data"), "Default layout")
+	assert.Equal(t, "tenant.a.in", resolveSubject("tenant.a.in", "go-nats-go", ".data"), "Override")
+
+	// readConfig resolves every subject
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Subject": "bench"}`), 0644), nil, "WriteFile failed")
+	var config configuration
+	assert.Equal(t, readConfig(fileName, false, &config), nil, "readConfig failed")
+	assert.Equal(t, "bench.data", config.DataSubject)
+	assert.Equal(t, "bench.metric", config.MetricSubject)
+	assert.Equal(t, "bench.done", config.CompletionSubject)
+
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Subject": "bench", "DataSubject": "tenant.a.in", "MetricSubject": "tenant.a.progress"}`), 0644), nil, "WriteFile failed")
+	config = configuration{}
+	assert.Equal(t, readConfig(fileName, false, &config), nil, "readConfig failed")
+	assert.Equal(t, "tenant.a.in", config.DataSubject)
+	assert.Equal(t, "tenant.a.progress", config.MetricSubject)
+	assert.Equal(t, "bench.done", config.CompletionSubject)
+	assert.Equal(t, []string{"tenant.a.in"}, dataSubjects(config))
+	config.Subscriptions = 2
+	assert.Equal(t, []string{"tenant.a.in.0", "tenant.a.in.1"}, dataSubjects(config))
+}
+
+func TestCheckPayload(t *testing.T) {
+	maxPayload := int64(1024 * 1024) // Server default
+	for size, valid := range map[int]bool{
+		0:                    true,
+		int(maxPayload) - 1:  true,
+		int(maxPayload):      true,
+		int(maxPayload) + 1:  false,
+		10 * int(maxPayload): false,
+	} {
+		err := checkPayload(size, maxPayload)
+		assert.Equal(t, valid, err == nil, fmt.Sprintf("Message of %d bytes", size))
+	}
+	err := checkPayload(2048, 1024)
+	assert.Contains(t, err.Error(), "message size 2048 exceeds the max payload 1024")
+}
+
+func TestServeMasterExitCode(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+
+	// No slave answers the canary
+	config := testConfig()
+	config.Master.CanaryTimeout = 50 * time.Millisecond
+	config.Master.MaxRuntime = 100 * time.Millisecond
+	assert.Equal(t, 1, serveMaster(context.Background(), nc, config, generateMessage, 0, &bufferTracker{}, log), "An aborted run should exit with status 1")
+
+	// The slave answers the canary but never completes the job
+	_, err = serveCanary(nc, config.Subject+".canary")
+	assert.Equal(t, err, nil, "serveCanary failed")
+	assert.Equal(t, 1, serveMaster(context.Background(), nc, config, generateMessage, 0, &bufferTracker{}, log), "A timed out run should exit with status 1")
+}
+
+func TestServeOnFakeConn(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Timeout = 5 * time.Second
+	config.Master.CanaryTimeout = time.Second
+	config.Master.MaxRuntime = 2 * time.Second
+
+	// Master and slave on two connected fakes instead of a server
+	master, slave := newPeerConns()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		serveSlave(ctx, slave, config, generateMessage, log)
+		close(served)
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := master.Request(config.Subject+".canary", nil, time.Millisecond); err == nil {
+			break
+		}
+	}
+
+	assert.Equal(t, 0, serveMaster(context.Background(), master, config, generateMessage, 0, &bufferTracker{}, log), "The run should succeed")
+	assert.Equal(t, int(config.Total)+1, master.count("go-nats-go.data"), "Start marker and data")
+	cancel()
+	<-served
+}
+
+func TestRunMasterLockPublisherThreads(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Master.LockPublisherThreads = true
+
+	// Count the lock and unlock calls
+	var mu sync.Mutex
+	var locks, unlocks int
+	defer func(lock, unlock func()) { lockOSThread, unlockOSThread = lock, unlock }(lockOSThread, unlockOSThread)
+	lockOSThread = func() {
+		mu.Lock()
+		locks++
+		mu.Unlock()
+		runtime.LockOSThread()
+	}
+	unlockOSThread = func() {
+		mu.Lock()
+		unlocks++
+		mu.Unlock()
+		runtime.UnlockOSThread()
+	}
+
+	// Complete when the last message arrives
+	nc := newFakeConn()
+	nc.Subscribe("go-nats-go.data", func(msg *nats.Msg) {
+		if nc.count("go-nats-go.data") == int(config.Total) {
+			data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: config.Total, JobID: rawMessage(msg.Data).jobID()})
+			nc.Publish("go-nats-go.done", data)
+		}
+	})
+
+	for i := 0; i < 3; i++ {
+		nc.published["go-nats-go.data"] = 0
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := runMaster(ctx, nc, config, generateMessage, log)
+		cancel()
+		assert.Equal(t, err, nil, "runMaster failed")
+		assert.Equal(t, "locked", res.PublisherAffinity)
+	}
+
+	// The unlock runs as the publisher goroutine returns
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, locks, "One lock per publisher goroutine")
+	assert.Equal(t, 3, unlocks, "One unlock per publisher goroutine")
+}
+
+func TestBuildConnectOptionsReconnectBufSize(t *testing.T) {
+	config := testConfig()
+	config.ReconnectBufSize = 1024
+
+	opts := nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(config, &bufferTracker{}, logrus.New()) {
+		assert.Equal(t, option(&opts), nil, "Option failed")
+	}
+	assert.Equal(t, 1024, opts.ReconnectBufSize)
+
+	// Unset keeps the nats default
+	opts = nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(testConfig(), &bufferTracker{}, logrus.New()) {
+		option(&opts)
+	}
+	assert.Equal(t, nats.DefaultReconnectBufSize, opts.ReconnectBufSize)
+}
+
+func TestBuildConnectOptionsReconnect(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.MaxReconnects = -1
+	config.ReconnectWait = 250 * time.Millisecond
+
+	opts := nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(config, &bufferTracker{}, log) {
+		assert.Equal(t, option(&opts), nil, "Option failed")
+	}
+	assert.Equal(t, -1, opts.MaxReconnect)
+	assert.Equal(t, 250*time.Millisecond, opts.ReconnectWait)
+	assert.NotNil(t, opts.DisconnectedErrCB, "No disconnect handler")
+	assert.NotNil(t, opts.ReconnectedCB, "No reconnect handler")
+	assert.NotNil(t, opts.ClosedCB, "No closed handler")
+
+	// Unset keeps the nats defaults
+	opts = nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(testConfig(), &bufferTracker{}, log) {
+		option(&opts)
+	}
+	assert.Equal(t, nats.DefaultMaxReconnect, opts.MaxReconnect)
+	assert.Equal(t, nats.DefaultReconnectWait, opts.ReconnectWait)
+}
+
+func TestBuildConnectOptionsPedantic(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	config := testConfig()
+	config.Pedantic = true
+	config.Verbose = true
+
+	opts := nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(config, &bufferTracker{}, log) {
+		assert.Equal(t, option(&opts), nil, "Option failed")
+	}
+	assert.True(t, opts.Pedantic, "Pedantic should be set")
+	assert.True(t, opts.Verbose, "Verbose should be set")
+
+	// Unset keeps the nats defaults
+	defaults := nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(testConfig(), &bufferTracker{}, log) {
+		option(&defaults)
+	}
+	assert.False(t, defaults.Pedantic, "Pedantic should not be set")
+	assert.False(t, defaults.Verbose, "Verbose should not be set")
+
+	// A simulated pedantic error from the server is surfaced
+	opts.AsyncErrorCB(nil, &nats.Subscription{Subject: "go-nats-go..data"}, errors.New("nats: invalid subject"))
+	assert.Contains(t, output.String(), "NATS error on go-nats-go..data err=nats: invalid subject. Pedantic is set")
+	output.Reset()
+	opts.AsyncErrorCB(nil, nil, errors.New("nats: permissions violation"))
+	assert.Contains(t, output.String(), "NATS error on connection err=nats: permissions violation")
+}
+
+func TestBuildConnectOptionsAuth(t *testing.T) {
+	apply := func(config configuration) nats.Options {
+		opts := nats.GetDefaultOptions()
+		for _, option := range buildConnectOptions(config, &bufferTracker{}, logrus.New()) {
+			assert.Equal(t, option(&opts), nil, "Option failed")
+		}
+		return opts
+	}
+
+	config := testConfig()
+	config.Username, config.Password = "bench", "secret"
+	opts := apply(config)
+	assert.Equal(t, "bench", opts.User)
+	assert.Equal(t, "secret", opts.Password)
+	assert.Equal(t, "", opts.Token)
+
+	config = testConfig()
+	config.Token = "s3cr3t"
+	opts = apply(config)
+	assert.Equal(t, "s3cr3t", opts.Token)
+	assert.Equal(t, "", opts.User)
+
+	config = testConfig()
+	config.CredentialsFile = "bench.creds"
+	opts = apply(config)
+	assert.NotNil(t, opts.UserJWT, "Credentials not set up")
+	assert.Equal(t, "", opts.Token)
+
+	// Anonymous by default
+	opts = apply(testConfig())
+	assert.Equal(t, "", opts.User)
+	assert.Equal(t, "", opts.Token)
+	assert.Nil(t, opts.UserJWT)
+}
+
+func TestCheckAuth(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		set   func(*configuration)
+		valid bool
+	}{
+		{"none", func(c *configuration) {}, true},
+		{"user", func(c *configuration) { c.Username, c.Password = "bench", "secret" }, true},
+		{"token", func(c *configuration) { c.Token = "s3cr3t" }, true},
+		{"credentials", func(c *configuration) { c.CredentialsFile = "bench.creds" }, true},
+		{"user and token", func(c *configuration) { c.Username, c.Token = "bench", "s3cr3t" }, false},
+		{"password and credentials", func(c *configuration) { c.Password, c.CredentialsFile = "secret", "bench.creds" }, false},
+		{"all", func(c *configuration) { c.Username, c.Token, c.CredentialsFile = "bench", "s3cr3t", "bench.creds" }, false},
+	} {
+		config := testConfig()
+		c.set(&config)
+		err := checkAuth(config)
+		assert.Equal(t, c.valid, err == nil, c.name)
+	}
+
+	config := testConfig()
+	config.Token, config.CredentialsFile = "s3cr3t", "bench.creds"
+	assert.Equal(t, "config: set only one of Token and CredentialsFile to authenticate", checkAuth(config).Error())
+}
+
+func TestBufferTracker(t *testing.T) {
+	b := &bufferTracker{}
+	b.disconnect(nats.Statistics{OutMsgs: 10, OutBytes: 1000})
+	b.disconnect(nats.Statistics{OutMsgs: 12, OutBytes: 1200}) // Repeated disconnect keeps the first
+	b.reconnect(nats.Statistics{OutMsgs: 15, OutBytes: 1500})
+	b.reconnect(nats.Statistics{OutMsgs: 20, OutBytes: 2000}) // Not disconnected
+	messages, bytes := b.buffered()
+	assert.Equal(t, uint64(5), messages)
+	assert.Equal(t, uint64(500), bytes)
+
+	b.disconnect(nats.Statistics{OutMsgs: 20, OutBytes: 2000})
+	b.reconnect(nats.Statistics{OutMsgs: 22, OutBytes: 2200})
+	messages, bytes = b.buffered()
+	assert.Equal(t, uint64(7), messages)
+	assert.Equal(t, uint64(700), bytes)
+}
+
+func TestNoEcho(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	config := testConfig()
+	config.NoEcho = true
+	master, err := nats.Connect(s.ClientURL(), buildConnectOptions(config, &bufferTracker{}, logrus.New())...)
+	assert.Equal(t, err, nil, "Unable to connect master")
+	defer master.Close()
+	slave, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect slave")
+	defer slave.Close()
+
+	// Both connections listen on .data in the same process
+	var mu sync.Mutex
+	received := map[string]int{}
+	for name, nc := range map[string]*nats.Conn{"master": master, "slave": slave} {
+		name := name
+		_, err := nc.Subscribe("go-nats-go.data", func(msg *nats.Msg) {
+			mu.Lock()
+			received[name]++
+			mu.Unlock()
+		})
+		assert.Equal(t, err, nil, "Subscribe failed")
+		nc.Flush()
+	}
+
+	for i := 0; i < 10; i++ {
+		master.Publish("go-nats-go.data", []byte("data"))
+	}
+	master.Flush()
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 0, received["master"], "Master should not receive its own data")
+	assert.Equal(t, 10, received["slave"])
+}
+
+func TestStreamStats(t *testing.T) {
+	interval := 20 * time.Millisecond
+	var received uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every sample adds a known number of messages for the next interval
+	var samples []stats
+	done := make(chan struct{})
+	go func() {
+		streamStats(ctx, interval, &received, func(s stats) {
+			samples = append(samples, s)
+			atomic.AddUint64(&received, uint64(len(samples)))
+			if len(samples) == 5 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+	<-done
+
+	assert.Equal(t, 5, len(samples))
+	assert.Equal(t, uint64(0), samples[0].Messages)
+	for i := 1; i < len(samples); i++ {
+		assert.Equal(t, uint64(i), samples[i].Messages, "Wrong count for interval")
+		assert.True(t, samples[i].Interval >= interval/2 && samples[i].Interval <= 5*interval, "Interval off cadence")
+		assert.True(t, samples[i].Time.After(samples[i-1].Time), "Samples out of order")
+	}
+}
+
+func TestReadConfigMaxTotal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nats-go")
+	assert.Equal(t, err, nil, "TempDir failed")
+	defer os.RemoveAll(dir)
+
+	read := func(content string) (configuration, error) {
+		fileName := filepath.Join(dir, "config.json")
+		assert.Equal(t, ioutil.WriteFile(fileName, []byte(content), 0644), nil, "WriteFile failed")
+		var config configuration
+		err := readConfig(fileName, false, &config)
+		return config, err
+	}
+
+	// Within the default cap
+	config, err := read(`{"Total": 10000, "AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`)
+	assert.Equal(t, err, nil, "Total within cap should be accepted")
+	assert.Equal(t, uint64(defaultMaxTotal), config.MaxTotal)
+
+	// An extra zero too many
+	_, err = read(`{"Total": 100000000, "AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`)
+	assert.NotEqual(t, err, nil, "Total over cap should be rejected")
+
+	_, err = read(`{"Total": 1000, "MaxTotal": 100, "AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`)
+	assert.NotEqual(t, err, nil, "Total over configured cap should be rejected")
+
+	// Explicit override
+	config, err = read(`{"Total": 100000000, "OverrideMaxTotal": true, "AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`)
+	assert.Equal(t, err, nil, "Override should allow Total over cap")
+	assert.Equal(t, uint64(100000000), config.Total)
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nats-go")
+	assert.Equal(t, err, nil, "TempDir failed")
+	defer os.RemoveAll(dir)
+
+	// A wrong path
+	missing := filepath.Join(dir, "missing.json")
+	var config configuration
+	err = readConfig(missing, false, &config)
+	assert.NotEqual(t, err, nil, "Missing file should be rejected")
+	assert.Contains(t, err.Error(), "not found")
+	assert.Contains(t, err.Error(), missing)
+
+	// The right path, broken contents
+	malformed := filepath.Join(dir, "malformed.json")
+	assert.Equal(t, ioutil.WriteFile(malformed, []byte(`{"Total": 10`), 0644), nil, "WriteFile failed")
+	err = readConfig(malformed, false, &config)
+	assert.NotEqual(t, err, nil, "Malformed file should be rejected")
+	assert.Contains(t, err.Error(), "unable to parse")
+	assert.Contains(t, err.Error(), malformed)
+	assert.NotContains(t, err.Error(), "not found")
+}
+
+func TestReadConfigPassphrase(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+
+	// Master and slave derive the same key from the same passphrase and salt
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESPassphrase": "correct horse battery staple"}`), 0644), nil, "WriteFile failed")
+	var master, slave configuration
+	assert.Equal(t, readConfig(fileName, true, &master), nil, "readConfig failed")
+	assert.Equal(t, readConfig(fileName, false, &slave), nil, "readConfig failed")
+	assert.Equal(t, 32, len(master.AESEncryptionKey))
+	assert.Equal(t, master.AESEncryptionKey, slave.AESEncryptionKey)
+
+	// Another salt gives another key
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESPassphrase": "correct horse battery staple", "AESSalt": "other"}`), 0644), nil, "WriteFile failed")
+	var salted configuration
+	assert.Equal(t, readConfig(fileName, true, &salted), nil, "readConfig failed")
+	assert.NotEqual(t, master.AESEncryptionKey, salted.AESEncryptionKey)
+
+	// A key and a passphrase are ambiguous
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESPassphrase": "correct horse battery staple", "AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`), 0644), nil, "WriteFile failed")
+	var both configuration
+	assert.NotEqual(t, readConfig(fileName, true, &both), nil, "Key and passphrase should be rejected")
+}
+
+func TestReadConfigCipherSuite(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	for content, valid := range map[string]bool{
+		`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine"}`:                            true,
+		`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "CipherSuite": "aes-gcm"}`:  true,
+		`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "CipherSuite": "chacha20"}`: true,
+		`{"AESEncryptionKey": "ThisIs16BytesKey", "CipherSuite": "chacha20"}`:                 false,
+		`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "CipherSuite": "des"}`:      false,
+	} {
+		assert.Equal(t, ioutil.WriteFile(fileName, []byte(content), 0644), nil, "WriteFile failed")
+		var config configuration
+		err := readConfig(fileName, true, &config)
+		assert.Equal(t, valid, err == nil, content)
+	}
+
+	// The cipher suite selects the format, so the slave picks the cipher per message
+	format, encrypt := cipherSuiteFunc("chacha20")
+	assert.Equal(t, "chch", format)
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	msg := rawMessageFunc([]byte("byte"), []byte(format), encrypt(byteMessageFunc([]byte("data")), key))(1, 1)
+	_, err := easycrypt.DecryptChaCha(msg.message(), key)
+	assert.Equal(t, err, nil, "DecryptChaCha failed")
+	format, _ = cipherSuiteFunc("aes-gcm")
+	assert.Equal(t, "encr", format)
+}
+
+func TestReadConfigKeySizes(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	for key, valid := range map[string]bool{
+		"ThisIs16BytesKey":                 true,
+		"ThisIsMy24BytesKeyForAES":         true,
+		"ThisIsMy32BytesKeyForTestingFine": true,
+		"ThisIsMy20BytesKey!!":             false,
+		"":                                 false,
+	} {
+		assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESEncryptionKey": "`+key+`"}`), 0644), nil, "WriteFile failed")
+		var config configuration
+		err := readConfig(fileName, true, &config)
+		assert.Equal(t, valid, err == nil, key)
+	}
+}
+
+func TestReadConfigRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nats-go")
+	assert.Equal(t, err, nil, "TempDir failed")
+	defer os.RemoveAll(dir)
+
+	read := func(slave bool, content string) (configuration, error) {
+		fileName := filepath.Join(dir, "config.json")
+		assert.Equal(t, ioutil.WriteFile(fileName, []byte(content), 0644), nil, "WriteFile failed")
+		var config configuration
+		err := readConfig(fileName, slave, &config)
+		return config, err
+	}
+
+	// An invalid Master section only fails the master
+	badMaster := `{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Master": {"RateLimit": -1}}`
+	_, err = read(false, badMaster)
+	assert.NotEqual(t, err, nil, "Master should reject a negative RateLimit")
+	config, err := read(true, badMaster)
+	assert.Equal(t, err, nil, "Slave should ignore the Master section")
+	assert.Equal(t, uint64(1000), config.Slave.MaxDecryptFailures)
+	assert.Equal(t, "", config.Master.PublishErrorPolicy)
+
+	// An invalid Slave section only fails the slave
+	badSlave := `{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Slave": {"StatsInterval": -1}}`
+	_, err = read(true, badSlave)
+	assert.NotEqual(t, err, nil, "Slave should reject a negative StatsInterval")
+	config, err = read(false, badSlave)
+	assert.Equal(t, err, nil, "Master should ignore the Slave section")
+	assert.Equal(t, "skip", config.Master.PublishErrorPolicy)
+	assert.Equal(t, uint64(0), config.Slave.MaxDecryptFailures)
+
+	// Pairs run slaves in the master process
+	_, err = read(false, `{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Master": {"Pairs": 2}, "Slave": {"StatsInterval": -1}}`)
+	assert.NotEqual(t, err, nil, "Master with Pairs should validate the Slave section")
+
+	// Shared settings are validated for both roles
+	for _, slave := range []bool{false, true} {
+		_, err = read(slave, `{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "StartupJitter": -1}`)
+		assert.NotEqual(t, err, nil, "Both roles should reject a negative StartupJitter")
+	}
+}
+
+func TestDecryptGuard(t *testing.T) {
+	var aborts []uint64
+	guard := &decryptGuard{threshold: 5, abort: func(consecutive uint64) { aborts = append(aborts, consecutive) }}
+	failure := errors.New("easycrypt: gcm.Open issue")
+
+	// A success resets the count
+	for i := 0; i < 4; i++ {
+		guard.record(failure)
+	}
+	guard.record(nil)
+	for i := 0; i < 4; i++ {
+		guard.record(failure)
+	}
+	assert.Equal(t, 0, len(aborts), "Should not abort below threshold")
+
+	// N consecutive failures abort, once
+	guard.record(failure)
+	guard.record(failure)
+	assert.Equal(t, []uint64{5}, aborts)
+}
+
+func TestStartOffset(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Master.StartOffset = 1000
+
+	// The in-process slave starts the job on the marker and completes at StartOffset+Total-1
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Run with StartOffset should complete")
+	assert.Equal(t, config.Total, res.TotalMessages)
+	assert.Contains(t, output.String(), "Accepted a new job starting at Count=1000")
+	assert.Contains(t, output.String(), "Completed a job with Total=10")
+
+	// Counts that do not continue from the marker never complete
+	stale := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	output.Reset()
+	publishStart(nc, "go-nats-go.data", 1000, stale)
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish("go-nats-go.data", stale(count, config.Total))
+	}
+	assert.NotContains(t, output.String(), "Completed a job")
+}
+
+func TestByteMessageLength(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	msg := byteMessage(byteMessageFunc(data)(3, 10).message())
+	assert.Equal(t, uint64(len(data)), msg.length())
+	assert.True(t, msg.valid(), "Complete message should be valid")
+	assert.False(t, msg[:len(msg)-3].valid(), "Truncated message should be detected")
+	assert.False(t, msg[:10].valid(), "Truncated header should be detected")
+
+	// The slave counts the truncated message
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		raw := generateMessage(count, config.Total)
+		if count == 3 {
+			raw = raw[:len(raw)-5]
+		}
+		nc.Publish("go-nats-go.data", raw)
+	}
+	// The job completes once count 3 arrives intact
+	nc.Publish("go-nats-go.data", generateMessage(3, config.Total))
+	assert.Contains(t, output.String(), "Completed a job with Total=10")
+	assert.Contains(t, output.String(), "Length mismatches=1")
+}
+
+func TestSlaveErrorPolicy(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+
+	for _, policy := range []string{"tolerate", "abort"} {
+		var output bytes.Buffer
+		log := logrus.New()
+		log.Out = &output
+		config := testConfig()
+		config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+		config.Slave.MaxDecryptFailures = 1000
+		config.Slave.ErrorPolicy = policy
+
+		aborts := 0
+		nc := newFakeConn()
+		stop, err := startSlave(nc, config, generateMessage, log, func() { aborts++ })
+		assert.Equal(t, err, nil, "startSlave failed")
+
+		// Message 3 is truncated on the way
+		publishStart(nc, "go-nats-go.data", 0, generateMessage)
+		for count := uint64(0); count < config.Total; count++ {
+			raw := generateMessage(count, config.Total)
+			if count == 3 || count == 5 {
+				raw = raw[:len(raw)-5]
+			}
+			nc.Publish("go-nats-go.data", raw)
+		}
+		// Resent intact, the job completes
+		nc.Publish("go-nats-go.data", generateMessage(3, config.Total))
+		nc.Publish("go-nats-go.data", generateMessage(5, config.Total))
+		stop()
+
+		switch policy {
+		case "tolerate":
+			assert.Equal(t, 0, aborts, "tolerate aborted")
+			assert.Contains(t, output.String(), "Completed a job with Total=10")
+			assert.Contains(t, output.String(), "Length mismatches=2")
+		case "abort":
+			assert.Equal(t, 1, aborts, "abort did not abort once")
+			assert.Contains(t, output.String(), "Aborting on the first bad message count=3 err=slave: data does not have the declared length")
+		}
+	}
+}
+
+func TestSelfDescribingHeader(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	myStruct := fillBigStruct()
+	data := []byte("data")
+
+	// A slave without a scenario decodes every message from its header
+	config := testConfig()
+	config.Scenario = ""
+	config.AESEncryptionKey = key
+	config.Slave.MaxDecryptFailures = 1000
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	for name, generateMessage := range map[string]rawMessageGenerator{
+		"byte":           rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data)),
+		"json":           rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct)),
+		"byte.encrypted": rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc(data), key)),
+		"json.encrypted": rawMessageFunc([]byte("json"), []byte("encr"), encryptedMessageFunc(structMessageFunc(&myStruct), key)),
+		"json.ratchet":   rawMessageFunc([]byte("json"), []byte("rtch"), ratchetMessageFunc(structMessageFunc(&myStruct), key)),
+		"json.gzip":      rawMessageFunc([]byte("json"), []byte("gzip"), compressedMessageFunc(structMessageFunc(&myStruct), 0)),
+		"json.encz":      rawMessageFunc([]byte("json"), []byte("encz"), encryptedMessageFunc(compressedMessageFunc(structMessageFunc(&myStruct), 0), key)),
+		"json.chacha20":  rawMessageFunc([]byte("json"), []byte("chch"), chaChaMessageFunc(structMessageFunc(&myStruct), key)),
+		"msgpack":        rawMessageFunc([]byte("mpck"), []byte("byte"), msgpackMessageFunc(&myStruct)),
+	} {
+		raw := generateMessage(1, 1)
+		assert.Equal(t, nil, raw.checkHeader(), name)
+		assert.Equal(t, byte(headerVersion), raw.version(), name)
+		assert.Equal(t, formatFlags(raw.format()), raw.flags(), name)
+
+		output.Reset()
+		publishStart(nc, "go-nats-go.data", 0, generateMessage)
+		for count := uint64(0); count < config.Total; count++ {
+			nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+		}
+		assert.Contains(t, output.String(), "Completed a job with Total=10", name)
+	}
+
+	// Unknown flag bits and versions are rejected
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data))
+	raw := generateMessage(1, 1)
+	raw[9] = 0x80
+	assert.NotEqual(t, nil, raw.checkHeader(), "Unknown flags accepted")
+	raw[9], raw[8] = 0, headerVersion+1
+	assert.NotEqual(t, nil, raw.checkHeader(), "Unknown version accepted")
+	assert.NotEqual(t, nil, rawMessage("byteby").checkHeader(), "Short header accepted")
+
+	output.Reset()
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		raw := generateMessage(count, config.Total)
+		if count == 3 {
+			raw[9] |= 0x80
+		}
+		nc.Publish("go-nats-go.data", raw)
+	}
+	assert.NotContains(t, output.String(), "Completed a job", "Message with unknown flags counted")
+
+	// A message of a newer layout version is dropped and counted, not misread
+	output.Reset()
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		raw := generateMessage(count, config.Total)
+		if count == 5 {
+			raw[8] = headerVersion + 1
+		}
+		nc.Publish("go-nats-go.data", raw)
+	}
+	assert.NotContains(t, output.String(), "Completed a job", "Message with a newer version counted")
+
+	// The next job of this version completes and reports the dropped messages
+	output.Reset()
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	assert.Contains(t, output.String(), "Completed a job with Total=10")
+	assert.Contains(t, output.String(), "Bad headers=2 so far")
+}
+
+func TestStartupJitter(t *testing.T) {
+	max := 50 * time.Millisecond
+	random := rand.New(rand.NewSource(1)).Int63n
+	for i := 0; i < 100; i++ {
+		var events []string
+		var slept time.Duration
+		sleep := func(d time.Duration) {
+			slept = d
+			events = append(events, "sleep")
+		}
+		connect := func() (*nats.Conn, error) {
+			events = append(events, "connect")
+			return nil, nil
+		}
+		_, delay, err := jitteredConnect(max, random, sleep, connect)
+		assert.Equal(t, err, nil, "jitteredConnect failed")
+		assert.True(t, delay >= 0 && delay < max, fmt.Sprintf("Delay %v out of bounds", delay))
+		assert.Equal(t, delay, slept)
+		assert.Equal(t, []string{"sleep", "connect"}, events)
+	}
+
+	// No jitter connects right away
+	var events []string
+	_, delay, _ := jitteredConnect(0, random, func(time.Duration) { events = append(events, "sleep") }, func() (*nats.Conn, error) {
+		events = append(events, "connect")
+		return nil, nil
+	})
+	assert.Equal(t, time.Duration(0), delay)
+	assert.Equal(t, []string{"connect"}, events)
+}
+
+func TestSlaveShortCiphertexts(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	config := testConfig()
+	config.AESEncryptionKey = key
+	config.Slave.MaxDecryptFailures = 1000
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	var completion metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		decodeMetric(msg.Data, &completion)
+	})
+
+	// Truncated messages are short ciphertexts, corrupted ones fail authentication
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc([]byte("data")), key))
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		msg := generateMessage(count, config.Total)
+		switch count {
+		case 1, 2, 3:
+			msg = msg[:headerSize+5]
+		case 4:
+			msg[len(msg)-1] ^= 0xff
+		}
+		nc.Publish("go-nats-go.data", msg)
+	}
+	// Resent intact, the job completes
+	for count := uint64(1); count <= 4; count++ {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	stop()
+	assert.Equal(t, uint64(3), completion.ShortCiphertexts, "Only truncated messages are short ciphertexts")
+}
+
+func TestReadPayload(t *testing.T) {
+	data, err := readPayload(bytes.NewReader([]byte("piped payload")))
+	assert.Equal(t, err, nil, "readPayload failed")
+	assert.Equal(t, []byte("piped payload"), data)
+
+	_, err = readPayload(bytes.NewReader(nil))
+	assert.NotEqual(t, err, nil, "Empty stdin should fail")
+
+	// A pipe like os.Stdin in a shell pipeline
+	r, w, err := os.Pipe()
+	assert.Equal(t, err, nil, "Pipe failed")
+	defer r.Close()
+	w.Write([]byte("piped payload"))
+	w.Close()
+	data, err = readPayload(r)
+	assert.Equal(t, err, nil, "readPayload of a pipe failed")
+	assert.Equal(t, []byte("piped payload"), data)
+}
+
+// Returns once a handler is subscribed to subject on nc
+func waitSubscribed(t *testing.T, nc *fakeConn, subject string) {
+	for i := 0; i < 1000; i++ {
+		nc.mu.Lock()
+		n := len(nc.handlers[subject])
+		nc.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Nothing subscribed to %s", subject)
+}
+
+func TestRunSlaveSequence(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	nc := newFakeConn()
+	var mu sync.Mutex
+	var completions []metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		var m metric
+		assert.Equal(t, nil, decodeMetric(msg.Data, &m), "Malformed completion")
+		mu.Lock()
+		completions = append(completions, m)
+		mu.Unlock()
+	})
+	completed := func() []metric {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]metric(nil), completions...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- runSlave(ctx, nc, config, nil, log)
+	}()
+	waitSubscribed(t, nc, config.DataSubject)
+	send := func(counts ...uint64) {
+		for _, count := range counts {
+			nc.Publish(config.DataSubject, generateMessage(count, config.Total))
+		}
+	}
+
+	// A job starting at 100 with message 103 resent. The last message completes it
+	publishStart(nc, config.DataSubject, 100, generateMessage)
+	send(100, 101, 102, 103, 103, 104, 105, 106, 107, 108)
+	assert.Equal(t, 0, len(completed()), "Completed before the last message")
+	send(109)
+	assert.Equal(t, 1, len(completed()), "Last message should complete the job")
+	assert.Equal(t, "received", completed()[0].Job)
+	assert.Equal(t, config.Total, completed()[0].Count)
+	assert.Equal(t, uint64(1), completed()[0].Duplicates)
+
+	// A new job where the last message overtakes the others completes on the last count to arrive
+	// Stragglers of the previous job are not counted
+	publishStart(nc, config.DataSubject, 0, generateMessage)
+	send(9, 0, 1, 2, 105, 3, 4, 5, 6, 7)
+	assert.Equal(t, 1, len(completed()), "Completed without message 8")
+	send(8)
+	assert.Equal(t, 2, len(completed()), "Job with the last message out of order should complete")
+	assert.Equal(t, uint64(0), completed()[1].Duplicates)
+
+	// Late duplicates do not complete the job again
+	send(8, 9)
+	assert.Equal(t, 2, len(completed()), "Completed twice")
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestSetupScenario(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	config := testConfig()
+	config.Scenario = "json"
+	generateMessage, err := setupScenario(&config, log)
+	assert.Equal(t, err, nil, "setupScenario failed")
+	assert.Equal(t, "json", generateMessage(1, 1).messageType())
+
+	// A slave may run without a scenario
+	config.Scenario = ""
+	generateMessage, err = setupScenario(&config, log)
+	assert.Equal(t, err, nil, "setupScenario failed")
+	assert.Nil(t, generateMessage)
+
+	// file.stream sets Total to the number of chunks
+	fileName := filepath.Join(t.TempDir(), "bytes.txt")
+	assert.Equal(t, ioutil.WriteFile(fileName, make([]byte, 2500), 0644), nil, "WriteFile failed")
+	config = testConfig()
+	config.Scenario = "file.stream"
+	config.Filename = fileName
+	config.ChunkSize = 1000
+	_, err = setupScenario(&config, log)
+	assert.Equal(t, err, nil, "setupScenario failed")
+	assert.Equal(t, uint64(3), config.Total)
+
+	config.Filename = filepath.Join(t.TempDir(), "missing.txt")
+	_, err = setupScenario(&config, log)
+	assert.NotEqual(t, err, nil, "Missing file should fail")
+
+	// Checksum needs the plain scenario
+	config = testConfig()
+	config.Scenario = "json.gzip"
+	config.Checksum = true
+	_, err = setupScenario(&config, log)
+	assert.NotEqual(t, err, nil, "Checksum on a compressed scenario should fail")
+}
+
+func TestSlaveOutOfOrder(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Total = 1000
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	nc := newFakeConn()
+	var completions []metric
+	var mu sync.Mutex
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		var m metric
+		decodeMetric(msg.Data, &m)
+		mu.Lock()
+		completions = append(completions, m)
+		mu.Unlock()
+	})
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	// Shuffled counts, every tenth resent, delivered by concurrent goroutines like a fake with many publishers
+	counts := rand.New(rand.NewSource(1)).Perm(int(config.Total))
+	for i := 0; i < len(counts); i += 10 {
+		counts = append(counts, counts[i])
+	}
+	publishStart(nc, config.DataSubject, 0, generateMessage)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(counts); i += 8 {
+				nc.Publish(config.DataSubject, generateMessage(uint64(counts[i]), config.Total))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	assert.Equal(t, 1, len(completions), "Every count received should complete the job once")
+	if len(completions) == 1 {
+		assert.Equal(t, config.Total, completions[0].Count)
+		assert.True(t, completions[0].Duplicates <= 100, "Resent messages after completion are not in the metric")
+	}
+	completions = nil
+	mu.Unlock()
+
+	// A message that fails to decrypt does not stand in for a missing count
+	config.Total = 3
+	undecryptable := rawMessageFunc([]byte("byte"), []byte("encr"), byteMessageFunc([]byte("data")))
+	publishStart(nc, config.DataSubject, 0, generateMessage)
+	nc.Publish(config.DataSubject, generateMessage(0, config.Total))
+	nc.Publish(config.DataSubject, generateMessage(2, config.Total))
+	nc.Publish(config.DataSubject, undecryptable(1, config.Total))
+	mu.Lock()
+	assert.Equal(t, 0, len(completions), "Job completed while count 1 never arrived")
+	mu.Unlock()
+	nc.Publish(config.DataSubject, generateMessage(1, config.Total))
+	mu.Lock()
+	assert.Equal(t, 1, len(completions), "Every count received should complete the job")
+	mu.Unlock()
+}
+
+func TestSlaveStaleJob(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	current, stale := jobMessageFunc(1, generateMessage), jobMessageFunc(2, generateMessage)
+
+	nc := newFakeConn()
+	var completions []metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		var m metric
+		decodeMetric(msg.Data, &m)
+		completions = append(completions, m)
+	})
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	// Late messages of an earlier run with the same counts are not counted in the current job
+	publishStart(nc, config.DataSubject, 0, current)
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish(config.DataSubject, stale(count, config.Total))
+	}
+	assert.Equal(t, 0, len(completions), "Messages of another job completed the job")
+
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish(config.DataSubject, current(count, config.Total))
+	}
+	assert.Equal(t, 1, len(completions))
+	if len(completions) == 1 {
+		assert.Equal(t, config.Total, completions[0].Count)
+		assert.Equal(t, uint64(1), completions[0].JobID, "The completion carries the job ID")
+		assert.Equal(t, uint64(0), completions[0].Duplicates)
+	}
+}
+
+func TestCompletionHandlerJobID(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+	log.Level = logrus.DebugLevel
+
+	var total uint64 = 10
+	done := make(chan metric, 1)
+	handler := completionHandler(total, 7, nil, &unexpectedMetrics{log: log}, done)
+
+	// A completion of another run is reported, not taken
+	data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: total, JobID: 8})
+	handler(&nats.Msg{Subject: "go-nats-go.done", Data: data})
+	assert.Equal(t, 0, len(done), "Completion of another job")
+	assert.Contains(t, output.String(), "job id 8, expected 7")
+
+	data, _ = json.Marshal(&metric{Job: "received", Time: time.Now(), Count: total, JobID: 7})
+	handler(&nats.Msg{Subject: "go-nats-go.done", Data: data})
+	assert.Equal(t, 1, len(done))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- MATRIX --------------------- */
+
+// matrixRow is the result of one combination of transforms over the same payload
+type matrixRow struct {
+	Combination string
+	Result      result
+}
+
+// Returns the name of a combination in the table: the stages joined with "+", "raw" without stages
+func combinationName(chain []string) string {
+	if len(chain) == 0 {
+		return "raw"
+	}
+	return strings.Join(chain, "+")
+}
+
+// runMatrix runs config.Total messages for every combination of config.Master.Matrix in order, every one a
+// TransformChain over the plain messages of generateMessage, and returns one row per combination
+func runMatrix(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) ([]matrixRow, error) {
+	rows := make([]matrixRow, 0, len(config.Master.Matrix))
+	for _, combination := range config.Master.Matrix {
+		name := combinationName(combination)
+		chain, _ := parseTransformChain(combination, config) // Validated with the config
+		combinationMessages := generateMessage
+		if len(chain) > 0 {
+			combinationMessages = chainMessageFunc(generateMessage, chain)
+		}
+		res, err := runMaster(ctx, nc, config, combinationMessages, log)
+		if err != nil {
+			return rows, errors.Wrapf(err, "matrix: %s", name)
+		}
+		log.Logf(logrus.InfoLevel, "Matrix %s msgs/sec=%.0f", name, res.MessagesPerSecond)
+		rows = append(rows, matrixRow{Combination: name, Result: res})
+	}
+	return rows, nil
+}
+
+// Returns the rows as an aligned table of throughput, latency and on-wire message size
+func matrixTable(rows []matrixRow, format summaryFormat) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "combination\tmsgs/sec\tthroughput\tduration/msg\tfirst latency\tsize (byte)")
+	for _, row := range rows {
+		res := row.Result
+		fmt.Fprintf(w, "%s\t%.0f\t%s\t%s\t%s\t%d\n", row.Combination, res.MessagesPerSecond, format.throughput(res.BytesPerSecond),
+			format.duration(res.DurationPerMessage), format.duration(res.FirstLatency), res.MessageSize)
+	}
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunMatrix(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, 1000)))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Master.Matrix = [][]string{{}, {"encrypt:gcm"}, {"compress:gzip", "encrypt:gcm"}}
+
+	// One slave decodes every combination from the tags in the messages
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := runMatrix(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Every combination should complete")
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, "raw", rows[0].Combination)
+	assert.Equal(t, "encrypt:gcm", rows[1].Combination)
+	assert.Equal(t, "compress:gzip+encrypt:gcm", rows[2].Combination)
+	for _, row := range rows {
+		assert.Equal(t, config.Total, row.Result.TotalMessages, row.Combination)
+	}
+
+	// Encryption adds to the zeros, compression takes most of them away
+	assert.True(t, rows[1].Result.MessageSize > rows[0].Result.MessageSize, "Encrypted should be larger than raw")
+	assert.True(t, rows[2].Result.MessageSize < rows[0].Result.MessageSize, "Compressed should be smaller than raw")
+
+	table := strings.Split(strings.TrimSpace(matrixTable(rows, newSummaryFormat(config))), "\n")
+	assert.Equal(t, 4, len(table))
+	assert.True(t, strings.HasPrefix(table[0], "combination"), "Table should start with a header")
+	assert.True(t, strings.HasPrefix(table[3], "compress:gzip+encrypt:gcm"), "Rows should be in order")
+}
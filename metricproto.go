@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- METRIC PROTOBUF --------------------- */
+
+// The metric on the wire in the Protocol Buffers encoding of metric.proto. The codec is written out by hand
+// for the handful of field types the metric uses, so the build needs neither protoc nor the protobuf runtime
+// Zero values are left out like proto3 does
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+var errTruncatedProto = errors.New("metric: truncated protobuf")
+
+// Encodes m with encoding, "json" or "protobuf". Anything but "json" is protobuf
+func encodeMetric(m *metric, encoding string) []byte {
+	if encoding == "json" {
+		bytes, _ := json.Marshal(m)
+		return bytes
+	}
+	return marshalMetricProto(m)
+}
+
+// Decodes a metric in either encoding. A json metric is an object and starts with '{', a protobuf
+// metric starts with the tag of Job
+func decodeMetric(data []byte, m *metric) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, m)
+	}
+	return unmarshalMetricProto(data, m)
+}
+
+// protoWriter appends protobuf fields
+type protoWriter []byte
+
+func (w *protoWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*w = append(*w, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (w *protoWriter) tag(field int, wire int) {
+	w.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, wireVarint)
+		w.varint(v)
+	}
+}
+
+func (w *protoWriter) int(field int, v int64) {
+	w.uint(field, uint64(v))
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	if v != 0 {
+		w.tag(field, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		*w = append(*w, buf[:]...)
+	}
+}
+
+// Writes a length delimited field, also when empty. Used for embedded messages
+func (w *protoWriter) message(field int, body []byte) {
+	w.tag(field, wireBytes)
+	w.varint(uint64(len(body)))
+	*w = append(*w, body...)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if s != "" {
+		w.message(field, []byte(s))
+	}
+}
+
+// Writes a repeated uint64 field packed, the proto3 default
+func (w *protoWriter) packed(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var body protoWriter
+	for _, v := range vs {
+		body.varint(v)
+	}
+	w.message(field, body)
+}
+
+// Encodes m according to metric.proto
+func marshalMetricProto(m *metric) []byte {
+	var w protoWriter
+	w.string(1, m.Job)
+	if !m.Time.IsZero() {
+		w.int(2, m.Time.UnixNano())
+	}
+	w.uint(3, m.Count)
+	w.string(4, m.Slave)
+	if p := m.Processing; p != nil {
+		var body protoWriter
+		body.int(1, int64(p.P50))
+		body.int(2, int64(p.P90))
+		body.int(3, int64(p.P99))
+		body.int(4, int64(p.Max))
+		body.uint(5, p.Discarded)
+		w.message(5, body)
+	}
+	if l := m.Latency; l != nil {
+		var body protoWriter
+		body.packed(1, l.Counts)
+		body.int(2, int64(l.Max))
+		w.message(6, body)
+	}
+	// Map entries in key order so the same metric always encodes the same
+	keys := make([]string, 0, len(m.Types))
+	for key := range m.Types {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry protoWriter
+		entry.string(1, key)
+		entry.uint(2, m.Types[key])
+		w.message(7, entry)
+	}
+	w.uint(8, m.Duplicates)
+	w.uint(9, m.BadChunks)
+	w.uint(10, m.FirstBad)
+	w.uint(11, m.BadSeeded)
+	w.uint(12, m.BadChecksums)
+	w.uint(13, m.ShortCiphertexts)
+	w.packed(14, m.Subscriptions)
+	if s := m.Sizes; s != nil {
+		var body protoWriter
+		body.int(1, int64(s.Min))
+		body.double(2, s.Mean)
+		body.int(3, int64(s.Max))
+		w.message(15, body)
+	}
+	w.uint(16, m.JobID)
+	w.uint(17, m.SchemaViolations)
+	return w
+}
+
+// protoReader consumes protobuf fields
+type protoReader []byte
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(*r)
+	if n <= 0 {
+		return 0, errTruncatedProto
+	}
+	*r = (*r)[n:]
+	return v, nil
+}
+
+// Returns the field number and wire type of the next field
+func (r *protoReader) tag() (int, int, error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(*r) < 8 {
+		return 0, errTruncatedProto
+	}
+	v := binary.LittleEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(*r)) {
+		return nil, errTruncatedProto
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, nil
+}
+
+// Reads the value of a field of wire type wire, the only wire type the field may have
+func (r *protoReader) value(field int, wire int, expected int) (uint64, []byte, error) {
+	if wire != expected {
+		return 0, nil, errors.New(fmt.Sprintf("metric: field %d has wire type %d, expected %d", field, wire, expected))
+	}
+	return r.skip(wire)
+}
+
+// Reads the value of a field, for fields the codec does not know. Groups are not supported
+func (r *protoReader) skip(wire int) (uint64, []byte, error) {
+	switch wire {
+	case wireVarint:
+		v, err := r.varint()
+		return v, nil, err
+	case wireFixed64:
+		v, err := r.fixed64()
+		return v, nil, err
+	case wireBytes:
+		b, err := r.bytes()
+		return 0, b, err
+	case 5: // fixed32
+		if len(*r) < 4 {
+			return 0, nil, errTruncatedProto
+		}
+		v := binary.LittleEndian.Uint32(*r)
+		*r = (*r)[4:]
+		return uint64(v), nil, nil
+	default:
+		return 0, nil, errors.New(fmt.Sprintf("metric: unsupported wire type %d", wire))
+	}
+}
+
+// Reads a repeated uint64 field, packed or one value per field
+func (r *protoReader) repeated(field int, wire int, vs []uint64) ([]uint64, error) {
+	if wire == wireVarint {
+		v, err := r.varint()
+		return append(vs, v), err
+	}
+	_, body, err := r.value(field, wire, wireBytes)
+	if err != nil {
+		return vs, err
+	}
+	packed := protoReader(body)
+	for len(packed) > 0 {
+		v, err := packed.varint()
+		if err != nil {
+			return vs, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// Calls f with every field of data
+func readProto(data []byte, f func(r *protoReader, field int, wire int) error) error {
+	r := protoReader(data)
+	for len(r) > 0 {
+		field, wire, err := r.tag()
+		if err != nil {
+			return err
+		}
+		err = f(&r, field, wire)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes data encoded according to metric.proto into m. Unknown fields are skipped
+func unmarshalMetricProto(data []byte, m *metric) error {
+	return readProto(data, func(r *protoReader, field int, wire int) error {
+		var v uint64
+		var b []byte
+		var err error
+		switch field {
+		case 1, 4, 5, 6, 7, 15:
+			_, b, err = r.value(field, wire, wireBytes)
+		case 14:
+			m.Subscriptions, err = r.repeated(field, wire, m.Subscriptions)
+			return err
+		case 2, 3, 8, 9, 10, 11, 12, 13, 16, 17:
+			v, _, err = r.value(field, wire, wireVarint)
+		default:
+			_, _, err = r.skip(wire)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		switch field {
+		case 1:
+			m.Job = string(b)
+		case 2:
+			m.Time = time.Unix(0, int64(v))
+		case 3:
+			m.Count = v
+		case 4:
+			m.Slave = string(b)
+		case 5:
+			m.Processing = &processingPercentiles{}
+			return unmarshalProcessingProto(b, m.Processing)
+		case 6:
+			m.Latency = &latencyHistogram{}
+			return unmarshalLatencyProto(b, m.Latency)
+		case 7:
+			if m.Types == nil {
+				m.Types = map[string]uint64{}
+			}
+			var key string
+			var value uint64
+			err = readProto(b, func(r *protoReader, field int, wire int) error {
+				switch field {
+				case 1:
+					_, b, err := r.value(field, wire, wireBytes)
+					key = string(b)
+					return err
+				case 2:
+					var err error
+					value, _, err = r.value(field, wire, wireVarint)
+					return err
+				}
+				_, _, err := r.skip(wire)
+				return err
+			})
+			m.Types[key] = value
+			return err
+		case 8:
+			m.Duplicates = v
+		case 9:
+			m.BadChunks = v
+		case 10:
+			m.FirstBad = v
+		case 11:
+			m.BadSeeded = v
+		case 12:
+			m.BadChecksums = v
+		case 13:
+			m.ShortCiphertexts = v
+		case 15:
+			m.Sizes = &sizeDistribution{}
+			return unmarshalSizesProto(b, m.Sizes)
+		case 16:
+			m.JobID = v
+		case 17:
+			m.SchemaViolations = v
+		}
+		return nil
+	})
+}
+
+func unmarshalProcessingProto(data []byte, p *processingPercentiles) error {
+	return readProto(data, func(r *protoReader, field int, wire int) error {
+		if field < 1 || field > 5 {
+			_, _, err := r.skip(wire)
+			return err
+		}
+		v, _, err := r.value(field, wire, wireVarint)
+		switch field {
+		case 1:
+			p.P50 = time.Duration(v)
+		case 2:
+			p.P90 = time.Duration(v)
+		case 3:
+			p.P99 = time.Duration(v)
+		case 4:
+			p.Max = time.Duration(v)
+		case 5:
+			p.Discarded = v
+		}
+		return err
+	})
+}
+
+func unmarshalLatencyProto(data []byte, l *latencyHistogram) error {
+	return readProto(data, func(r *protoReader, field int, wire int) error {
+		switch field {
+		case 1:
+			var err error
+			l.Counts, err = r.repeated(field, wire, l.Counts)
+			return err
+		case 2:
+			v, _, err := r.value(field, wire, wireVarint)
+			l.Max = time.Duration(v)
+			return err
+		}
+		_, _, err := r.skip(wire)
+		return err
+	})
+}
+
+func unmarshalSizesProto(data []byte, s *sizeDistribution) error {
+	return readProto(data, func(r *protoReader, field int, wire int) error {
+		switch field {
+		case 1:
+			v, _, err := r.value(field, wire, wireVarint)
+			s.Min = int(int64(v))
+			return err
+		case 2:
+			v, _, err := r.value(field, wire, wireFixed64)
+			s.Mean = math.Float64frombits(v)
+			return err
+		case 3:
+			v, _, err := r.value(field, wire, wireVarint)
+			s.Max = int(int64(v))
+			return err
+		}
+		_, _, err := r.skip(wire)
+		return err
+	})
+}
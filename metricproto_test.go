@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricProto(t *testing.T) {
+	m := metric{
+		Job:              "received",
+		Time:             time.Unix(1700000000, 123456789),
+		Count:            10000,
+		Slave:            "slave-1",
+		Processing:       &processingPercentiles{P50: 1500, P90: 3 * time.Microsecond, P99: time.Millisecond, Max: time.Second, Discarded: 100},
+		Latency:          &latencyHistogram{Counts: []uint64{0, 3, 0, 1 << 40}, Max: 42 * time.Millisecond},
+		Types:            map[string]uint64{"byte/byte": 70, "json/encr": 30, "json/": 0},
+		Duplicates:       1,
+		BadChunks:        2,
+		FirstBad:         65536,
+		BadSeeded:        3,
+		BadChecksums:     4,
+		ShortCiphertexts: 5,
+		SchemaViolations: 6,
+		Subscriptions:    []uint64{5000, 0, 5000},
+		Sizes:            &sizeDistribution{Min: -1, Mean: 1234.5, Max: 4096},
+		JobID:            1<<63 + 5,
+	}
+
+	data := marshalMetricProto(&m)
+	assert.Equal(t, byte(1<<3|wireBytes), data[0], "Job should come first")
+
+	var decoded metric
+	err := unmarshalMetricProto(data, &decoded)
+	assert.Equal(t, err, nil, "unmarshalMetricProto failed")
+	assert.Equal(t, m, decoded)
+	assert.Equal(t, data, marshalMetricProto(&decoded), "Encoding should be stable")
+
+	// Zero values are left out
+	var empty metric
+	assert.Equal(t, 0, len(marshalMetricProto(&empty)))
+	assert.Equal(t, nil, unmarshalMetricProto(nil, &empty))
+	assert.Equal(t, metric{}, empty)
+
+	// Unknown fields are skipped, repeated fields may also come unpacked
+	var w protoWriter
+	w.string(1, "progress")
+	w.uint(99, 7)
+	w.double(98, 1.5)
+	w.string(97, "future")
+	w.uint(14, 11)
+	w.uint(14, 12)
+	var skipped metric
+	assert.Equal(t, nil, unmarshalMetricProto(w, &skipped))
+	assert.Equal(t, metric{Job: "progress", Subscriptions: []uint64{11, 12}}, skipped)
+
+	// Truncated data and wrong wire types are errors
+	assert.NotEqual(t, nil, unmarshalMetricProto(data[:len(data)-1], &metric{}), "Truncated")
+	var wrong protoWriter
+	wrong.uint(1, 5)
+	assert.NotEqual(t, nil, unmarshalMetricProto(wrong, &metric{}), "Job as varint")
+}
+
+func TestEncodeDecodeMetric(t *testing.T) {
+	m := metric{Job: "received", Time: time.Unix(1700000000, 0), Count: 10, Slave: "a"}
+	for _, encoding := range []string{"protobuf", "json", ""} {
+		data := encodeMetric(&m, encoding)
+		var decoded metric
+		assert.Equal(t, nil, decodeMetric(data, &decoded), encoding)
+		assert.Equal(t, m.Time.UnixNano(), decoded.Time.UnixNano(), encoding)
+		decoded.Time = m.Time
+		assert.Equal(t, m, decoded, encoding)
+	}
+
+	// The master still reads json metrics from slaves of earlier versions
+	data, _ := json.Marshal(&m)
+	var decoded metric
+	assert.Equal(t, nil, decodeMetric(data, &decoded))
+	assert.Equal(t, m.Count, decoded.Count)
+	assert.Equal(t, data, encodeMetric(&m, "json"))
+
+	// Malformed metrics are reported, whatever the encoding
+	assert.NotEqual(t, nil, decodeMetric([]byte("{not json"), &metric{}))
+	assert.NotEqual(t, nil, decodeMetric([]byte{0x0a, 0x10, 'x'}, &metric{}))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- MIX --------------------- */
+
+// Returns the message kinds available in a Mix by name, set up with the key, size and level from config
+func mixRegistry(config configuration) map[string]func() rawMessageGenerator {
+	key := config.AESEncryptionKey
+	return map[string]func() rawMessageGenerator{
+		"byte": func() rawMessageGenerator {
+			return rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, config.NumBytes)))
+		},
+		"byte.encrypted": func() rawMessageGenerator {
+			return rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc(make([]byte, config.NumBytes)), key))
+		},
+		"json": func() rawMessageGenerator {
+			myStruct := fillBigStruct()
+			return rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct))
+		},
+		"json.encrypted": func() rawMessageGenerator {
+			myStruct := fillBigStruct()
+			return rawMessageFunc([]byte("json"), []byte("encr"), encryptedMessageFunc(structMessageFunc(&myStruct), key))
+		},
+		"json.ratchet": func() rawMessageGenerator {
+			myStruct := fillBigStruct()
+			return rawMessageFunc([]byte("json"), []byte("rtch"), ratchetMessageFunc(structMessageFunc(&myStruct), key))
+		},
+		"json.gzip": func() rawMessageGenerator {
+			myStruct := fillBigStruct()
+			return rawMessageFunc([]byte("json"), []byte("gzip"), compressedMessageFunc(structMessageFunc(&myStruct), config.CompressionLevel))
+		},
+	}
+}
+
+// Returns a generator that picks the kind of every message from mix by weight, e.g. {"byte": 70, "json": 20, "json.encrypted": 10}
+// The pick only depends on the count, so master and slave agree and concurrent publishers need no lock
+func mixedMessageFunc(mix map[string]float64, config configuration) (rawMessageGenerator, error) {
+	if len(mix) == 0 {
+		return nil, errors.New("mix: no message kinds")
+	}
+
+	// Sorted for the same picks on every run
+	names := make([]string, 0, len(mix))
+	var sum float64
+	for name, weight := range mix {
+		if weight <= 0 {
+			return nil, errors.New(fmt.Sprintf("mix: weight of %q must be > 0", name))
+		}
+		names = append(names, name)
+		sum += weight
+	}
+	sort.Strings(names)
+
+	registry := mixRegistry(config)
+	generators := make([]rawMessageGenerator, len(names))
+	bounds := make([]float64, len(names))
+	var cumulative float64
+	for i, name := range names {
+		newGenerator, ok := registry[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("mix: unknown message kind %q", name))
+		}
+		generators[i] = newGenerator()
+		cumulative += mix[name]
+		bounds[i] = cumulative / sum
+	}
+
+	return func(count uint64, total uint64) rawMessage {
+		// Golden ratio sequence. Spreads the kinds evenly over any stretch of counts
+		_, u := math.Modf(float64(count) * (math.Sqrt(5) - 1) / 2)
+		for i, bound := range bounds {
+			if u < bound {
+				return generators[i](count, total)
+			}
+		}
+		return generators[len(generators)-1](count, total)
+	}, nil
+}
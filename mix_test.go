@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMixedMessageFunc(t *testing.T) {
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.NumBytes = 16
+	generateMessage, err := mixedMessageFunc(map[string]float64{"byte": 70, "json": 20, "json.encrypted": 10}, config)
+	assert.Equal(t, err, nil, "mixedMessageFunc failed")
+
+	const total = 10000
+	counts := map[string]int{}
+	for count := uint64(0); count < total; count++ {
+		msg := generateMessage(count, total)
+		counts[msg.messageType()+"/"+msg.format()]++
+	}
+	for kind, share := range map[string]float64{"byte/byte": 0.7, "json/byte": 0.2, "json/encr": 0.1} {
+		got := float64(counts[kind]) / total
+		assert.True(t, math.Abs(got-share) < 0.01, fmt.Sprintf("%s share %.3f, expected %.2f", kind, got, share))
+	}
+
+	// Same picks every time
+	again, _ := mixedMessageFunc(map[string]float64{"byte": 70, "json": 20, "json.encrypted": 10}, config)
+	for count := uint64(0); count < 100; count++ {
+		assert.Equal(t, generateMessage(count, total).format(), again(count, total).format())
+	}
+
+	_, err = mixedMessageFunc(map[string]float64{"byte": 1, "xml": 1}, config)
+	assert.NotEqual(t, err, nil, "Unknown kind should be rejected")
+	_, err = mixedMessageFunc(map[string]float64{"byte": 0}, config)
+	assert.NotEqual(t, err, nil, "Zero weight should be rejected")
+	_, err = mixedMessageFunc(nil, config)
+	assert.NotEqual(t, err, nil, "Empty mix should be rejected")
+}
+
+func TestSlaveMixTypes(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Scenario = "mix"
+	config.Total = 1000
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage, _ := mixedMessageFunc(map[string]float64{"byte": 50, "json.gzip": 30, "json.encrypted": 20}, config)
+
+	// The slave tallies by the header, also when it has no scenario of its own and follows the master
+	for _, slaveScenario := range []string{"mix", ""} {
+		slaveConfig := config
+		slaveConfig.Scenario = slaveScenario
+		nc := newFakeConn()
+		var completion metric
+		nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+			decodeMetric(msg.Data, &completion)
+		})
+		stop, err := startSlave(nc, slaveConfig, nil, log, func() {})
+		assert.Equal(t, err, nil, "startSlave failed")
+
+		sent := map[string]uint64{}
+		publishStart(nc, "go-nats-go.data", 0, generateMessage)
+		for count := uint64(0); count < config.Total; count++ {
+			raw := generateMessage(count, config.Total)
+			sent[raw.messageType()+"/"+raw.format()]++
+			nc.Publish("go-nats-go.data", raw)
+		}
+		stop()
+
+		assert.Equal(t, "received", completion.Job)
+		assert.Equal(t, 3, len(completion.Types))
+		assert.Equal(t, sent, completion.Types)
+	}
+}
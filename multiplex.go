@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- MULTIPLEXING --------------------- */
+
+// Returns the subjects of the data messages. With Subscriptions > 1 they are DataSubject+".0" to ".N-1",
+// otherwise the single DataSubject. The start marker is sent on the first. They are padded to the subject length of the run
+func dataSubjects(config configuration) []string {
+	subjects := []string{config.DataSubject}
+	if config.Subscriptions > 1 {
+		subjects = make([]string, config.Subscriptions)
+		for i := range subjects {
+			subjects[i] = fmt.Sprintf("%s.%d", config.DataSubject, i)
+		}
+	}
+	for i, subject := range subjects {
+		subjects[i], _ = padSubject(subject, config.subjectLength) // Validated with the config
+	}
+	return subjects
+}
+
+// roundRobinPublisher publishes every message on the next of subjects, whatever subject it is given
+type roundRobinPublisher struct {
+	publisher
+	subjects []string
+	next     uint64
+}
+
+func (p *roundRobinPublisher) Publish(subj string, data []byte) error {
+	i := atomic.AddUint64(&p.next, 1) - 1
+	return p.publisher.Publish(p.subjects[i%uint64(len(p.subjects))], data)
+}
+
+// chanSubscriber is the part of *nats.Conn needed to deliver several subscriptions into one channel
+type chanSubscriber interface {
+	ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscription, error)
+}
+
+// Subscribes to every subject and passes the messages to handler from one goroutine, in the order the client
+// received them. The client still demultiplexes every subscription. The goroutine ends when ctx is done
+// capacity is the number of messages buffered for all subscriptions together
+func subscribeMultiplexed(ctx context.Context, nc chanSubscriber, subjects []string, capacity int, handler nats.MsgHandler) ([]*nats.Subscription, error) {
+	ch := make(chan *nats.Msg, capacity)
+	subs := make([]*nats.Subscription, 0, len(subjects))
+	for _, subject := range subjects {
+		sub, err := nc.ChanSubscribe(subject, ch)
+		if err != nil {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+			return nil, errors.Wrapf(err, "nats: unable to subscribe to %s", subject)
+		}
+		subs = append(subs, sub)
+	}
+
+	go handleInOrder(ctx, ch, handler)
+	return subs, nil
+}
+
+// Passes the messages of ch to handler one by one until ctx is done
+func handleInOrder(ctx context.Context, ch <-chan *nats.Msg, handler nats.MsgHandler) {
+	for {
+		select {
+		case msg := <-ch:
+			handler(msg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns the spread of the per subscription counts in percent of their mean: (max-min)/mean*100. 0 means balanced
+func subscriptionImbalance(counts []uint64) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	min, max, sum := counts[0], counts[0], uint64(0)
+	for _, n := range counts {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+		sum += n
+	}
+	if sum == 0 {
+		return 0
+	}
+	mean := float64(sum) / float64(len(counts))
+	return float64(max-min) / mean * 100
+}
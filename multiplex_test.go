@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataSubjects(t *testing.T) {
+	config := testConfig()
+	assert.Equal(t, []string{"go-nats-go.data"}, dataSubjects(config))
+	config.Subscriptions = 3
+	assert.Equal(t, []string{"go-nats-go.data.0", "go-nats-go.data.1", "go-nats-go.data.2"}, dataSubjects(config))
+}
+
+func TestSubscriptionImbalance(t *testing.T) {
+	assert.Equal(t, 0.0, subscriptionImbalance(nil))
+	assert.Equal(t, 0.0, subscriptionImbalance([]uint64{0, 0}))
+	assert.Equal(t, 0.0, subscriptionImbalance([]uint64{5, 5, 5}))
+	assert.InDelta(t, 40.0, subscriptionImbalance([]uint64{6, 4, 5}), 0.001)
+}
+
+func TestSubscriptions(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Subscriptions = 4
+
+	// The in-process slave subscribes to every data subject
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+	for _, subject := range dataSubjects(config) {
+		assert.Equal(t, 1, len(nc.handlers[subject]), "No subscription on "+subject)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Run with Subscriptions should complete")
+
+	// Round-robin, and the counts add up to the total. The start marker goes with the first subject
+	assert.Equal(t, []uint64{3, 3, 2, 2}, res.Subscriptions)
+	var sum uint64
+	for _, n := range res.Subscriptions {
+		sum += n
+	}
+	assert.Equal(t, config.Total, sum)
+	assert.InDelta(t, 40.0, res.SubscriptionImbalance, 0.001)
+	assert.Equal(t, 4, nc.count("go-nats-go.data.0"))
+	assert.Equal(t, 0, nc.count("go-nats-go.data"))
+}
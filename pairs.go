@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- PAIRS --------------------- */
+
+// Returns config for pair i of a run, on its own subjects scoped by runID
+func pairConfig(config configuration, runID string, i int) configuration {
+	config.Subject = fmt.Sprintf("%s.%s.%d", config.Subject, runID, i)
+	config.CompletionSubject = config.Subject + ".done"
+	config.DataSubject = config.Subject + ".data"
+	config.MetricSubject = config.Subject + ".metric"
+	config.Name = fmt.Sprintf("%s/%d", config.Name, i)
+	config.tracer = nil // The counts of the pairs overlap
+	return config
+}
+
+// Wraps a rawMessage generator so concurrent pairs can share it. Some generators, like math/rand payloads, are not safe for concurrent use
+func lockedMessageFunc(generateMessage rawMessageGenerator) rawMessageGenerator {
+	var mu sync.Mutex
+	return func(count uint64, total uint64) rawMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return generateMessage(count, total)
+	}
+}
+
+// runPairs runs config.Master.Pairs independent master/slave pairs concurrently, each with its own connections to url
+// and its own subjects, and returns the aggregate result. Every pair runs config.Total messages
+func runPairs(ctx context.Context, url string, options []nats.Option, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) (result, error) {
+	id := make([]byte, 4)
+	crand.Read(id)
+	runID := hex.EncodeToString(id)
+	generateMessage = lockedMessageFunc(generateMessage)
+	dial := func() (natsConn, error) {
+		nc, err := nats.Connect(url, options...)
+		if err != nil {
+			return nil, err
+		}
+		return nc, nil
+	}
+
+	results := make([]result, config.Master.Pairs)
+	errs := make([]error, config.Master.Pairs)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Master.Pairs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = runPair(ctx, dial, pairConfig(config, runID, i), generateMessage, log)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return result{}, errors.Wrapf(err, "pairs: pair %d failed", i)
+		}
+	}
+	return aggregateResults(results), nil
+}
+
+// Runs one master/slave pair on two connections from dial. The slave is set up before the master starts publishing
+func runPair(ctx context.Context, dial func() (natsConn, error), config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) (result, error) {
+	slaveNC, err := dial()
+	if err != nil {
+		return result{}, errors.Wrap(err, "pairs: unable to connect slave")
+	}
+	defer slaveNC.Close()
+
+	masterNC, err := dial()
+	if err != nil {
+		return result{}, errors.Wrap(err, "pairs: unable to connect master")
+	}
+	defer masterNC.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop, err := startSlave(slaveNC, config, generateMessage, log, cancel)
+	if err != nil {
+		return result{}, err
+	}
+	defer stop()
+
+	// Make sure the server has the slave subscriptions before we publish
+	err = slaveNC.Flush()
+	if err != nil {
+		return result{}, errors.Wrap(err, "pairs: unable to flush slave")
+	}
+
+	return runMaster(ctx, masterNC, config, generateMessage, log)
+}
+
+// Sums the results of pairs that ran concurrently. The total duration is the slowest pair
+func aggregateResults(results []result) result {
+	if len(results) == 0 {
+		return result{}
+	}
+
+	res := results[0]
+	res.TotalMessages, res.PublishFailures = 0, 0
+	res.MessagesPerSecond, res.BytesPerSecond, res.LinkUtilization = 0, 0, 0
+	res.TotalDuration = 0
+	for _, r := range results {
+		if r.Time.Before(res.Time) {
+			res.Time = r.Time
+		}
+		if r.TotalDuration > res.TotalDuration {
+			res.TotalDuration = r.TotalDuration
+		}
+		res.TotalMessages += r.TotalMessages
+		res.PublishFailures += r.PublishFailures
+		res.MessagesPerSecond += r.MessagesPerSecond
+		res.BytesPerSecond += r.BytesPerSecond
+		res.LinkUtilization += r.LinkUtilization
+	}
+	res.Pairs = len(results)
+	if res.TotalMessages > 0 {
+		res.DurationPerMessage = res.TotalDuration / time.Duration(res.TotalMessages)
+	}
+	return res
+}
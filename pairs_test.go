@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPairs(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	config := testConfig()
+	config.Total = 100
+	config.Master.Pairs = 4
+	config.Name = "test"
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runPairs(ctx, s.ClientURL(), nil, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runPairs failed")
+
+	// Every pair completed its own Total
+	assert.Equal(t, 4, res.Pairs)
+	assert.Equal(t, 4*config.Total, res.TotalMessages)
+	assert.Equal(t, uint64(0), res.PublishFailures)
+}
+
+func TestRunPairFakeConn(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	// Master and slave share one in-process fake. Every publish of the master runs the slave's data handler
+	// synchronously, so the whole job is done without a server
+	var conns []*fakeConn
+	nc := newFakeConn()
+	dial := func() (natsConn, error) {
+		conns = append(conns, nc)
+		return nc, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runPair(ctx, dial, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runPair failed")
+	assert.Equal(t, config.Total, res.TotalMessages)
+	assert.Equal(t, 2, len(conns), "One connection for the slave, one for the master")
+	assert.Equal(t, 1, nc.flushes, "Slave subscriptions are flushed before the master publishes")
+	assert.Equal(t, int(config.Total)+1, nc.count(config.DataSubject), "Start marker and the messages")
+	assert.Equal(t, 1, nc.count(config.CompletionSubject), "The slave completed the job")
+	assert.True(t, nc.closed, "Connections are closed after the pair")
+
+	// A failed dial fails the pair
+	_, err = runPair(ctx, func() (natsConn, error) { return nil, errors.New("no server") }, config, generateMessage, log)
+	assert.NotEqual(t, err, nil, "Dial error should fail the pair")
+}
+
+func TestDrainConn(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	nc := newFakeConn()
+	nc.Subscribe("go-nats-go.data", func(msg *nats.Msg) {})
+	drainConn(nc, log)
+	assert.Equal(t, 1, nc.flushes)
+	assert.True(t, nc.drained)
+	assert.Equal(t, 0, len(nc.handlers), "Subscriptions are gone after the drain")
+}
+
+func TestAggregateResults(t *testing.T) {
+	results := []result{
+		{TotalDuration: time.Second, TotalMessages: 100, MessagesPerSecond: 100, BytesPerSecond: 1000, PublishFailures: 1},
+		{TotalDuration: 2 * time.Second, TotalMessages: 100, MessagesPerSecond: 50, BytesPerSecond: 500, PublishFailures: 2},
+	}
+	res := aggregateResults(results)
+	assert.Equal(t, 2, res.Pairs)
+	assert.Equal(t, uint64(200), res.TotalMessages)
+	assert.Equal(t, uint64(3), res.PublishFailures)
+	assert.Equal(t, 150.0, res.MessagesPerSecond)
+	assert.Equal(t, 1500.0, res.BytesPerSecond)
+	assert.Equal(t, 2*time.Second, res.TotalDuration, "Slowest pair sets the duration")
+	assert.Equal(t, 10*time.Millisecond, res.DurationPerMessage)
+}
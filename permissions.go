@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- PERMISSIONS --------------------- */
+
+// The server answers a flush within this long, including any permission errors on the probes before it
+const permissionTimeout = 2 * time.Second
+
+// Returns the subjects the master or slave publishes and subscribes to with config
+func requiredSubjects(config configuration, slave bool) (publish []string, subscribe []string) {
+	if slave {
+		publish = []string{config.MetricSubject, config.CompletionSubject}
+		subscribe = append(allDataSubjects(config), config.Subject+".control", config.Subject+".canary", config.Subject+".received")
+		if config.Slave.StatsInterval > 0 {
+			publish = append(publish, config.Subject+".stats")
+		}
+		if config.RequestReply {
+			subscribe = append(subscribe, config.Subject+".request")
+		}
+		if config.DataQueueGroup != "" {
+			subscribe = append(subscribe, startSubject(config))
+		}
+		if config.UseJetStream {
+			subscribe = append(subscribe, deliverSubject(config))
+		}
+		if config.Bidirectional {
+			publish = append(publish, returnSubject(config))
+		}
+		return publish, subscribe
+	}
+
+	publish = append(allDataSubjects(config), config.Subject+".control", config.Subject+".canary")
+	subscribe = []string{config.CompletionSubject, config.MetricSubject}
+	if config.RequestReply {
+		publish = append(publish, config.Subject+".request")
+	}
+	if config.DataQueueGroup != "" {
+		publish = append(publish, startSubject(config))
+	}
+	if len(config.Master.LossCurveRates) > 0 {
+		publish = append(publish, config.Subject+".received")
+	}
+	if config.Master.PublishResults {
+		publish = append(publish, config.Master.ResultsSubject)
+	}
+	if config.Bidirectional {
+		subscribe = append(subscribe, returnSubject(config))
+	}
+	return publish, subscribe
+}
+
+// The server reports missing permissions asynchronously as "Permissions Violation for Publish to ..."
+func isPermissionError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "permissions violation")
+}
+
+// checkPermissions subscribes to every subject in subscribe and publishes an empty probe on every subject in publish
+// The server silently drops unauthorized messages, so each probe is followed by a flush and a look at the last error
+// The handlers ignore empty messages, so the probes do not disturb a running peer
+func checkPermissions(nc natsConn, publish []string, subscribe []string, timeout time.Duration) error {
+	before := nc.LastError()
+	verify := func(subject string) error {
+		err := nc.FlushTimeout(timeout)
+		if err != nil {
+			return errors.Wrapf(err, "permissions: unable to flush probe on subject %s", subject)
+		}
+		if err := nc.LastError(); err != before && isPermissionError(err) {
+			return errors.New(fmt.Sprintf("permissions: no permission on subject %s err=%v", subject, err))
+		}
+		return nil
+	}
+
+	for _, subject := range subscribe {
+		sub, err := nc.Subscribe(subject, func(*nats.Msg) {})
+		if err != nil {
+			return errors.Wrapf(err, "permissions: no permission on subject %s", subject)
+		}
+		err = verify(subject)
+		sub.Unsubscribe()
+		if err != nil {
+			return err
+		}
+	}
+	for _, subject := range publish {
+		err := nc.Publish(subject, nil)
+		if err != nil {
+			return errors.Wrapf(err, "permissions: no permission on subject %s", subject)
+		}
+		err = verify(subject)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// deniedConn simulates a server that drops messages on denied subjects and reports it asynchronously
+type deniedConn struct {
+	*fakeConn
+	denied  map[string]bool
+	mu      sync.Mutex
+	pending error
+	last    error
+}
+
+func (c *deniedConn) deny(verb, subj string) {
+	if c.denied[subj] {
+		c.mu.Lock()
+		c.pending = errors.New("nats: permissions violation for " + verb + " to \"" + subj + "\"")
+		c.mu.Unlock()
+	}
+}
+
+func (c *deniedConn) Publish(subj string, data []byte) error {
+	c.deny("publish", subj)
+	return c.fakeConn.Publish(subj, data)
+}
+
+func (c *deniedConn) Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	c.deny("subscription", subj)
+	return c.fakeConn.Subscribe(subj, cb)
+}
+
+// The error arrives with the flush, as from a real server
+func (c *deniedConn) FlushTimeout(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending != nil {
+		c.last, c.pending = c.pending, nil
+	}
+	return nil
+}
+
+func (c *deniedConn) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func TestCheckPermissions(t *testing.T) {
+	config := testConfig()
+	publish, subscribe := requiredSubjects(config, false)
+
+	nc := &deniedConn{fakeConn: newFakeConn(), denied: map[string]bool{}}
+	err := checkPermissions(nc, publish, subscribe, time.Second)
+	assert.Equal(t, nil, err, "All subjects permitted")
+
+	nc = &deniedConn{fakeConn: newFakeConn(), denied: map[string]bool{"go-nats-go.data": true}}
+	err = checkPermissions(nc, publish, subscribe, time.Second)
+	assert.NotEqual(t, nil, err, "Publish on data denied")
+	assert.Contains(t, err.Error(), "no permission on subject go-nats-go.data")
+
+	publish, subscribe = requiredSubjects(config, true)
+	nc = &deniedConn{fakeConn: newFakeConn(), denied: map[string]bool{"go-nats-go.data": true}}
+	err = checkPermissions(nc, publish, subscribe, time.Second)
+	assert.NotEqual(t, nil, err, "Subscribe on data denied")
+	assert.Contains(t, err.Error(), "no permission on subject go-nats-go.data")
+
+	// An error from before the check is not ours
+	nc = &deniedConn{fakeConn: newFakeConn(), denied: map[string]bool{}, last: errors.New("nats: permissions violation for publish to \"other\"")}
+	err = checkPermissions(nc, publish, subscribe, time.Second)
+	assert.Equal(t, nil, err, "Stale permission error")
+
+	// Probes are empty and ignored by the handlers
+	received := make(chan metric, 1)
+	unexpected := &unexpectedMetrics{}
+	handler := completionHandler(config.Total, 0, nil, unexpected, received)
+	handler(&nats.Msg{Subject: config.CompletionSubject})
+	assert.Equal(t, 0, len(received), "Empty probe completes nothing")
+	assert.Equal(t, uint64(0), unexpected.count, "Empty probe is not unexpected")
+}
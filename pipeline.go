@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* --------------------- GENERATE PIPELINE --------------------- */
+
+// Messages buffered per generate worker ahead of the publisher
+const pipelineDepth = 64
+
+// messageSource returns the next message to publish and its count, or false when there are no more
+type messageSource func() (uint64, rawMessage, bool)
+
+// Returns a source that generates the messages with counts first to first+total-1 when they are asked for
+func inlineMessages(first uint64, total uint64, tracer *stageTracer, generateMessage rawMessageGenerator) messageSource {
+	return rangeMessages(first, total, total, tracer, generateMessage)
+}
+
+// Returns a source that generates the n messages with counts first to first+n-1 of a job of total messages
+func rangeMessages(first uint64, n uint64, total uint64, tracer *stageTracer, generateMessage rawMessageGenerator) messageSource {
+	var i uint64
+	return func() (uint64, rawMessage, bool) {
+		if i == n {
+			return 0, nil, false
+		}
+		count := first + i
+		i++
+		tracer.begin(count)
+		return count, generateMessage(count, total), true
+	}
+}
+
+// Returns source with wrap applied to every message, e.g. magicMessageFunc. Not safe for concurrent use
+func wrappedSource(source messageSource, total uint64, wrap func(rawMessageGenerator) rawMessageGenerator) messageSource {
+	var next rawMessage
+	wrapped := wrap(func(uint64, uint64) rawMessage { return next })
+	return func() (uint64, rawMessage, bool) {
+		count, msg, ok := source()
+		if !ok {
+			return 0, nil, false
+		}
+		next = msg
+		return count, wrapped(count, total), true
+	}
+}
+
+// generatedMessage is a message made ahead of publishing
+type generatedMessage struct {
+	count uint64
+	msg   rawMessage
+}
+
+// generatePipeline generates messages on a pool of worker goroutines for one publisher
+type generatePipeline struct {
+	out     <-chan generatedMessage
+	tracer  *stageTracer
+	started time.Time
+	busy    int64 // Nanoseconds spent in generateMessage by all workers together
+	last    int64 // Unix nanoseconds when the last message was generated
+}
+
+// Starts workers goroutines generating the messages with counts first to first+total-1. generateMessage must be
+// safe for concurrent use. With ordered the messages come out in count order, every worker taking every workers:th
+// count, otherwise in the order they are done, every worker taking the next count. The workers stop when ctx is done
+func startPipeline(ctx context.Context, workers int, ordered bool, first uint64, total uint64, tracer *stageTracer, generateMessage rawMessageGenerator) *generatePipeline {
+	out := make(chan generatedMessage, workers*pipelineDepth)
+	p := &generatePipeline{out: out, tracer: tracer, started: time.Now()}
+
+	// Generates count and passes it on to ch. Returns false when ctx is done
+	generate := func(count uint64, ch chan<- generatedMessage) bool {
+		tracer.begin(count)
+		began := time.Now()
+		msg := generateMessage(count, total)
+		now := time.Now()
+		atomic.AddInt64(&p.busy, int64(now.Sub(began)))
+		atomic.StoreInt64(&p.last, now.UnixNano())
+		select {
+		case ch <- generatedMessage{count, msg}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if !ordered {
+		var next uint64
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := atomic.AddUint64(&next, 1) - 1; i < total; i = atomic.AddUint64(&next, 1) - 1 {
+					if !generate(first+i, out) {
+						return
+					}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(out)
+		}()
+		return p
+	}
+
+	// Every worker has its own lane, merged round-robin back into count order
+	lanes := make([]chan generatedMessage, workers)
+	for w := range lanes {
+		lanes[w] = make(chan generatedMessage, pipelineDepth)
+		go func(w int, lane chan<- generatedMessage) {
+			for i := uint64(w); i < total; i += uint64(workers) {
+				if !generate(first+i, lane) {
+					return
+				}
+			}
+		}(w, lanes[w])
+	}
+	go func() {
+		defer close(out)
+		for i := uint64(0); i < total; i++ {
+			select {
+			case m := <-lanes[i%uint64(workers)]:
+				select {
+				case out <- m:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Returns the source of the generated messages. The time a traced message waited for the publisher is its "queue" stage
+func (p *generatePipeline) source() messageSource {
+	return func() (uint64, rawMessage, bool) {
+		m, ok := <-p.out
+		if !ok {
+			return 0, nil, false
+		}
+		p.tracer.mark(m.count, "queue")
+		return m.count, m.msg, true
+	}
+}
+
+// Returns the time all workers spent generating divided by the time from start to the last message generated:
+// how many cores worked in parallel on average. 0 before the first message
+func (p *generatePipeline) speedup() float64 {
+	last := atomic.LoadInt64(&p.last)
+	if last == 0 {
+		return 0
+	}
+	wall := time.Unix(0, last).Sub(p.started)
+	if wall <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&p.busy)) / float64(wall)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratePipeline(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, 100)))
+	var first, total uint64 = 100, 1000
+
+	for _, ordered := range []bool{true, false} {
+		for _, workers := range []int{1, 3, 8} {
+			p := startPipeline(context.Background(), workers, ordered, first, total, nil, generateMessage)
+			next := p.source()
+
+			// Every count exactly once
+			seen := map[uint64]bool{}
+			inOrder := true
+			for i := uint64(0); ; i++ {
+				count, msg, ok := next()
+				if !ok {
+					break
+				}
+				assert.False(t, seen[count], "Count generated twice")
+				seen[count] = true
+				assert.Equal(t, count, byteMessage(msg.message()).count(), "Message of another count")
+				inOrder = inOrder && count == first+i
+			}
+			assert.Equal(t, int(total), len(seen), "Counts missing")
+			for count := first; count < first+total; count++ {
+				assert.True(t, seen[count], "Count not generated")
+			}
+			if ordered {
+				assert.True(t, inOrder, "Ordered pipeline out of order")
+			}
+			assert.True(t, p.speedup() > 0, "No speedup reported")
+		}
+	}
+}
+
+func TestGeneratePipelineCancel(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	for _, ordered := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		next := startPipeline(ctx, 4, ordered, 0, 1000000, nil, generateMessage).source()
+		next()
+		cancel()
+
+		// The pipeline ends instead of generating the rest
+		ended := make(chan struct{})
+		go func() {
+			for _, _, ok := next(); ok; _, _, ok = next() {
+			}
+			close(ended)
+		}()
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Pipeline did not stop")
+		}
+	}
+}
+
+func TestRunMasterGenerateWorkers(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Total = 200
+	config.Magic = "GNG"
+	config.Master.GenerateWorkers = 4
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("encr"), encryptedMessageFunc(byteMessageFunc([]byte("data")), config.AESEncryptionKey))
+
+	for _, ordered := range []bool{true, false} {
+		config.Master.GenerateOrdered = ordered
+		nc := newFakeConn()
+		stop, err := startSlave(nc, config, generateMessage, log, func() {})
+		assert.Equal(t, err, nil, "startSlave failed")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := runMaster(ctx, nc, config, generateMessage, log)
+		cancel()
+		stop()
+		assert.Equal(t, err, nil, "Run with generate workers should complete")
+		assert.Equal(t, 4, res.GenerateWorkers)
+		assert.True(t, res.GenerateSpeedup > 0, "No speedup reported")
+		assert.Equal(t, int(config.Total)+1, nc.count("go-nats-go.data"))
+	}
+}
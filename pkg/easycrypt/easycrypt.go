@@ -7,16 +7,54 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
 )
 
-// Encrypt uses aes encryption on text using key
+// PBKDF2 iterations of DeriveKey, OWASP's recommendation for sha256
+const deriveKeyIterations = 310000
+
+// ErrCiphertextTooShort is returned by the Decrypt functions for data shorter than a nonce and an authentication tag.
+// Such data was truncated or never encrypted with this scheme, as opposed to data that fails authentication
+var ErrCiphertextTooShort = errors.New("easycrypt: ciphertext shorter than nonce and tag")
+
+// checkCiphertext returns ErrCiphertextTooShort unless bytes holds the nonce and tag of aead
+func checkCiphertext(bytes []byte, aead cipher.AEAD) error {
+	if len(bytes) < aead.NonceSize()+aead.Overhead() {
+		return errors.Wrapf(ErrCiphertextTooShort, "easycrypt: len(bytes)(%v) < nonceSize(%v) + tagSize(%v)", len(bytes), aead.NonceSize(), aead.Overhead())
+	}
+	return nil
+}
+
+// checkKey returns an error unless key selects AES-128, AES-192 or AES-256
+func checkKey(key string) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("easycrypt: key length %d, expected 16, 24 or 32 bytes (AES-128, AES-192 or AES-256)", len(key)))
+}
+
+// Encrypt uses aes encryption on text using key. A 16, 24 or 32 byte key selects AES-128, AES-192 or AES-256
 func Encrypt(bytes []byte, key string) ([]byte, error) {
+	return EncryptWithAAD(bytes, key, nil)
+}
+
+// EncryptWithAAD works like Encrypt and also authenticates aad, additional data that is not encrypted
+// or included in the result, e.g. a message header. DecryptWithAAD only succeeds with the same aad
+func EncryptWithAAD(bytes []byte, key string, aad []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return []byte{}, err
+	}
 
-	// generate a new aes cipher using our 32 byte long key
+	// generate a new aes cipher using our 16, 24 or 32 byte long key
 	c, err := aes.NewCipher([]byte(key))
 
 	// if there are any errors, handle them
@@ -50,11 +88,19 @@ func Encrypt(bytes []byte, key string) ([]byte, error) {
 	// slice. The nonce must be NonceSize() bytes long and unique for all
 	// time, for a given key.
 	// the WriteFile method returns an error if unsuccessful
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	return gcm.Seal(nonce, nonce, bytes, aad), nil
 }
 
 // Decrypt decrypts bytes using key (aes)
 func Decrypt(bytes []byte, key string) ([]byte, error) {
+	return DecryptWithAAD(bytes, key, nil)
+}
+
+// DecryptWithAAD decrypts bytes from EncryptWithAAD using key. Fails unless aad is the additional data they were encrypted with
+func DecryptWithAAD(bytes []byte, key string, aad []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return []byte{}, err
+	}
 
 	c, err := aes.NewCipher([]byte(key))
 	if err != nil {
@@ -66,15 +112,179 @@ func Decrypt(bytes []byte, key string) ([]byte, error) {
 		return []byte{}, errors.Wrap(err, "easycrypt: cipher.NewGCM issue")
 	}
 
+	if err := checkCiphertext(bytes, gcm); err != nil {
+		return []byte{}, err
+	}
 	nonceSize := gcm.NonceSize()
-	if len(bytes) < nonceSize {
-		return []byte{}, errors.New(fmt.Sprintf("easycrypt: Nonce issue: len(bytes)(%v) < nonceSize(%v)", len(bytes), nonceSize))
+
+	nonce, bytes := bytes[:nonceSize], bytes[nonceSize:]
+	plain, err := gcm.Open(nil, nonce, bytes, aad)
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: gcm.Open issue")
+	}
+	return plain, nil
+}
+
+// Cipher is a stateful aes-gcm cipher. The cipher setup is done once in NewCipher
+// instead of for every message like Encrypt and Decrypt do
+type Cipher struct {
+	gcm cipher.AEAD
+}
+
+// NewCipher sets up a Cipher for key
+func NewCipher(key string) (*Cipher, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "easycrypt: New cipher issue")
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "easycrypt: cipher.NewGCM issue")
+	}
+	return &Cipher{gcm}, nil
+}
+
+// Encrypt works like Encrypt with the key of c
+func (c *Cipher) Encrypt(bytes []byte) ([]byte, error) {
+	nonce := make([]byte, c.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: Nonce issue")
+	}
+	return c.gcm.Seal(nonce, nonce, bytes, nil), nil
+}
+
+// Decrypt works like Decrypt with the key of c
+func (c *Cipher) Decrypt(bytes []byte) ([]byte, error) {
+	if err := checkCiphertext(bytes, c.gcm); err != nil {
+		return []byte{}, err
 	}
+	nonceSize := c.gcm.NonceSize()
 
 	nonce, bytes := bytes[:nonceSize], bytes[nonceSize:]
-	plain, err := gcm.Open(nil, nonce, bytes, nil)
+	plain, err := c.gcm.Open(nil, nonce, bytes, nil)
 	if err != nil {
 		return []byte{}, errors.Wrap(err, "easycrypt: gcm.Open issue")
 	}
 	return plain, nil
 }
+
+// DeriveMessageKey derives a per message key from rootKey and count using HKDF (sha256)
+// The derived key has the same length as rootKey. Same rootKey and count always gives the same key
+func DeriveMessageKey(rootKey string, count uint64) (string, error) {
+
+	// the count is the context info, so every message gets its own key
+	info := make([]byte, len("easycrypt message key")+8)
+	copy(info, "easycrypt message key")
+	binary.BigEndian.PutUint64(info[len("easycrypt message key"):], count)
+
+	key := make([]byte, len(rootKey))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(rootKey), nil, info), key); err != nil {
+		return "", errors.Wrap(err, "easycrypt: hkdf issue")
+	}
+	return string(key), nil
+}
+
+// DeriveKey derives a 32 byte (AES-256) key from passphrase and salt using PBKDF2 (sha256)
+// Same passphrase and salt always gives the same key, so master and slave only share the passphrase and salt
+func DeriveKey(passphrase string, salt []byte) (string, error) {
+	if passphrase == "" {
+		return "", errors.New("easycrypt: empty passphrase")
+	}
+	if len(salt) == 0 {
+		return "", errors.New("easycrypt: empty salt")
+	}
+	return string(pbkdf2.Key([]byte(passphrase), salt, deriveKeyIterations, 32, sha256.New)), nil
+}
+
+// Size of the buffer EncryptStream and DecryptStream copy through
+const streamBufferSize = 32 * 1024
+
+// newCTR returns the aes-ctr stream for key and iv
+func newCTR(key string, iv []byte) (cipher.Stream, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "easycrypt: New cipher issue")
+	}
+	return cipher.NewCTR(c, iv), nil
+}
+
+// EncryptStream encrypts src to dst with aes-ctr using key, streaming through a fixed buffer so any size fits in memory
+// dst gets a random iv followed by the encrypted bytes. Unlike Encrypt nothing is authenticated, a modified stream
+// decrypts to garbage without an error
+func EncryptStream(dst io.Writer, src io.Reader, key string) error {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return errors.Wrap(err, "easycrypt: IV issue")
+	}
+	stream, err := newCTR(key, iv)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(iv); err != nil {
+		return errors.Wrap(err, "easycrypt: unable to write IV")
+	}
+	w := &cipher.StreamWriter{S: stream, W: dst}
+	if _, err := io.CopyBuffer(w, src, make([]byte, streamBufferSize)); err != nil {
+		return errors.Wrap(err, "easycrypt: stream encryption issue")
+	}
+	return nil
+}
+
+// DecryptStream decrypts src from EncryptStream to dst using key
+func DecryptStream(dst io.Writer, src io.Reader, key string) error {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return errors.Wrap(err, "easycrypt: IV issue")
+	}
+	stream, err := newCTR(key, iv)
+	if err != nil {
+		return err
+	}
+	r := &cipher.StreamReader{S: stream, R: src}
+	if _, err := io.CopyBuffer(dst, r, make([]byte, streamBufferSize)); err != nil {
+		return errors.Wrap(err, "easycrypt: stream decryption issue")
+	}
+	return nil
+}
+
+// EncryptChaCha encrypts bytes with ChaCha20-Poly1305 using a 32 byte key. Faster than Encrypt where AES has no
+// hardware support, e.g. on some ARM devices. Only DecryptChaCha decrypts the result
+func EncryptChaCha(bytes []byte, key string) ([]byte, error) {
+	aead, err := chacha20poly1305.New([]byte(key))
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: chacha20poly1305.New issue")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: Nonce issue")
+	}
+	return aead.Seal(nonce, nonce, bytes, nil), nil
+}
+
+// DecryptChaCha decrypts bytes from EncryptChaCha using key
+func DecryptChaCha(bytes []byte, key string) ([]byte, error) {
+	aead, err := chacha20poly1305.New([]byte(key))
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: chacha20poly1305.New issue")
+	}
+
+	if err := checkCiphertext(bytes, aead); err != nil {
+		return []byte{}, err
+	}
+	nonceSize := aead.NonceSize()
+
+	nonce, bytes := bytes[:nonceSize], bytes[nonceSize:]
+	plain, err := aead.Open(nil, nonce, bytes, nil)
+	if err != nil {
+		return []byte{}, errors.Wrap(err, "easycrypt: chacha20poly1305 Open issue")
+	}
+	return plain, nil
+}
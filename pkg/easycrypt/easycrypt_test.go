@@ -1,8 +1,13 @@
 package easycrypt
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"fmt"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,3 +21,221 @@ func TestEncryptDecrypt(t *testing.T) {
 	assert.Equal(t, err, nil, "Failed to Decrypt")
 	assert.Equal(t, originalBytes, copyOfBytes, "Encrypt / Decrypt corrupted the testStr")
 }
+
+func TestEncryptDecryptKeySizes(t *testing.T) {
+	originalBytes := []byte("This is the test string we are encrypting/decrypting")
+	for _, key := range []string{"ThisIs16BytesKey", "ThisIsMy24BytesKeyForAES", "ThisIsMy32BytesKeyForTestingFine"} {
+		encryptedBytes, err := Encrypt(originalBytes, key)
+		assert.Equal(t, err, nil, fmt.Sprintf("Failed to Encrypt with a key of %d bytes", len(key)))
+		copyOfBytes, err := Decrypt(encryptedBytes, key)
+		assert.Equal(t, err, nil, fmt.Sprintf("Failed to Decrypt with a key of %d bytes", len(key)))
+		assert.Equal(t, originalBytes, copyOfBytes)
+
+		c, err := NewCipher(key)
+		assert.Equal(t, err, nil, fmt.Sprintf("Failed to set up cipher with a key of %d bytes", len(key)))
+		copyOfBytes, err = c.Decrypt(encryptedBytes)
+		assert.Equal(t, err, nil, fmt.Sprintf("Failed to Decrypt with a key of %d bytes", len(key)))
+		assert.Equal(t, originalBytes, copyOfBytes)
+	}
+
+	// Any other length is refused with the lengths that work
+	for _, key := range []string{"", "short", "ThisIsMy20BytesKey!!", "ThisIsMy33BytesKeyForTestingFine!"} {
+		_, err := Encrypt(originalBytes, key)
+		assert.NotEqual(t, err, nil, fmt.Sprintf("Encrypt with a key of %d bytes should fail", len(key)))
+		assert.Contains(t, err.Error(), "expected 16, 24 or 32 bytes")
+		_, err = Decrypt(originalBytes, key)
+		assert.NotEqual(t, err, nil, fmt.Sprintf("Decrypt with a key of %d bytes should fail", len(key)))
+		_, err = NewCipher(key)
+		assert.NotEqual(t, err, nil, fmt.Sprintf("NewCipher with a key of %d bytes should fail", len(key)))
+	}
+}
+
+func TestEncryptDecryptWithAAD(t *testing.T) {
+	originalBytes := []byte("This is the test string we are encrypting/decrypting")
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	header := []byte("jsonencr")
+
+	encryptedBytes, err := EncryptWithAAD(originalBytes, key, header)
+	assert.Equal(t, err, nil, "Failed to Encrypt")
+	copyOfBytes, err := DecryptWithAAD(encryptedBytes, key, header)
+	assert.Equal(t, err, nil, "Failed to Decrypt")
+	assert.Equal(t, originalBytes, copyOfBytes)
+
+	// A swapped header, a missing one or a tampered ciphertext is rejected by gcm.Open
+	for _, aad := range [][]byte{[]byte("byteencr"), nil} {
+		_, err = DecryptWithAAD(encryptedBytes, key, aad)
+		assert.NotEqual(t, err, nil, "Decrypt with mismatched aad should fail")
+		assert.Contains(t, err.Error(), "gcm.Open")
+	}
+	_, err = Decrypt(encryptedBytes, key)
+	assert.NotEqual(t, err, nil, "Decrypt without aad should fail")
+	encryptedBytes[len(encryptedBytes)-1] ^= 0xff
+	_, err = DecryptWithAAD(encryptedBytes, key, header)
+	assert.NotEqual(t, err, nil, "Decrypt of tampered ciphertext should fail")
+
+	// Without aad the variants interoperate with Encrypt and Decrypt
+	encryptedBytes, _ = Encrypt(originalBytes, key)
+	copyOfBytes, err = DecryptWithAAD(encryptedBytes, key, nil)
+	assert.Equal(t, err, nil, "Failed to Decrypt")
+	assert.Equal(t, originalBytes, copyOfBytes)
+}
+
+func TestDeriveMessageKey(t *testing.T) {
+	rootKey := "ThisIsMy32BytesKeyForTestingFine"
+
+	key, err := DeriveMessageKey(rootKey, 7)
+	assert.Equal(t, err, nil, "Failed to derive key")
+	assert.Equal(t, len(rootKey), len(key), "Derived key has wrong length")
+	assert.NotEqual(t, rootKey, key, "Derived key is the root key")
+
+	sameKey, _ := DeriveMessageKey(rootKey, 7)
+	assert.Equal(t, key, sameKey, "Same count should derive the same key")
+
+	nextKey, _ := DeriveMessageKey(rootKey, 8)
+	assert.NotEqual(t, key, nextKey, "Different count should derive a different key")
+
+	encryptedBytes, err := Encrypt([]byte("ratchet"), key)
+	assert.Equal(t, err, nil, "Failed to Encrypt with derived key")
+	_, err = Decrypt(encryptedBytes, nextKey)
+	assert.NotEqual(t, err, nil, "Decrypt with the wrong message key should fail")
+}
+
+func TestDeriveKey(t *testing.T) {
+	key, err := DeriveKey("correct horse battery staple", []byte("go-nats-go"))
+	assert.Equal(t, err, nil, "Failed to derive key")
+	assert.Equal(t, 32, len(key), "Derived key is not AES-256")
+
+	sameKey, _ := DeriveKey("correct horse battery staple", []byte("go-nats-go"))
+	assert.Equal(t, key, sameKey, "Same passphrase and salt should derive the same key")
+
+	saltedKey, _ := DeriveKey("correct horse battery staple", []byte("other salt"))
+	assert.NotEqual(t, key, saltedKey, "Different salt should derive a different key")
+
+	otherKey, _ := DeriveKey("correct horse battery stapler", []byte("go-nats-go"))
+	assert.NotEqual(t, key, otherKey, "Different passphrase should derive a different key")
+
+	encryptedBytes, err := Encrypt([]byte("passphrase"), key)
+	assert.Equal(t, err, nil, "Failed to Encrypt with derived key")
+	decryptedBytes, err := Decrypt(encryptedBytes, sameKey)
+	assert.Equal(t, err, nil, "Failed to Decrypt with derived key")
+	assert.Equal(t, []byte("passphrase"), decryptedBytes)
+
+	_, err = DeriveKey("", []byte("go-nats-go"))
+	assert.NotEqual(t, err, nil, "Empty passphrase should fail")
+	_, err = DeriveKey("correct horse battery staple", nil)
+	assert.NotEqual(t, err, nil, "Empty salt should fail")
+}
+
+func TestCipher(t *testing.T) {
+	originalBytes := []byte("This is the test string we are encrypting/decrypting")
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	c, err := NewCipher(key)
+	assert.Equal(t, err, nil, "Failed to set up cipher")
+
+	// Interoperates with Encrypt and Decrypt
+	encryptedBytes, err := c.Encrypt(originalBytes)
+	assert.Equal(t, err, nil, "Failed to Encrypt")
+	copyOfBytes, err := Decrypt(encryptedBytes, key)
+	assert.Equal(t, err, nil, "Failed to Decrypt")
+	assert.Equal(t, originalBytes, copyOfBytes)
+
+	encryptedBytes, _ = Encrypt(originalBytes, key)
+	copyOfBytes, err = c.Decrypt(encryptedBytes)
+	assert.Equal(t, err, nil, "Failed to Decrypt")
+	assert.Equal(t, originalBytes, copyOfBytes)
+
+	// Wrong key
+	other, _ := NewCipher("ThisIsAnother32BytesKeyForTests!")
+	_, err = other.Decrypt(encryptedBytes)
+	assert.NotEqual(t, err, nil, "Decrypt with wrong key should fail")
+
+	_, err = NewCipher("short")
+	assert.NotEqual(t, err, nil, "Short key should fail")
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	key := "ThisIsMy32BytesKeyForTestingFine"
+
+	// Several buffers and a partial one
+	plain := make([]byte, 3*streamBufferSize+1234)
+	rand.Read(plain)
+
+	var encrypted bytes.Buffer
+	err := EncryptStream(&encrypted, bytes.NewReader(plain), key)
+	assert.Equal(t, err, nil, "Failed to EncryptStream")
+	assert.Equal(t, len(plain)+aes.BlockSize, encrypted.Len(), "Encrypted stream is the iv and the data")
+	assert.NotEqual(t, plain, encrypted.Bytes()[aes.BlockSize:], "Stream was not encrypted")
+
+	var decrypted bytes.Buffer
+	err = DecryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), key)
+	assert.Equal(t, err, nil, "Failed to DecryptStream")
+	assert.Equal(t, plain, decrypted.Bytes(), "Stream did not round trip")
+
+	// The wrong key decrypts to something else
+	decrypted.Reset()
+	err = DecryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), "ThisIsMy32BytesKeyForTestingFin!")
+	assert.Equal(t, err, nil, "DecryptStream with the wrong key")
+	assert.NotEqual(t, plain, decrypted.Bytes())
+
+	// Bad keys and a stream without iv fail
+	err = EncryptStream(&encrypted, bytes.NewReader(plain), "short")
+	assert.NotEqual(t, err, nil, "Short key should fail")
+	err = DecryptStream(&decrypted, bytes.NewReader([]byte("tiny")), key)
+	assert.NotEqual(t, err, nil, "Stream without iv should fail")
+}
+
+func TestEncryptDecryptChaCha(t *testing.T) {
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	plain := []byte("This is the test string that is the bulk of our message")
+
+	encryptedBytes, err := EncryptChaCha(plain, key)
+	assert.Equal(t, err, nil, "Failed to EncryptChaCha")
+	assert.NotEqual(t, plain, encryptedBytes)
+	decryptedBytes, err := DecryptChaCha(encryptedBytes, key)
+	assert.Equal(t, err, nil, "Failed to DecryptChaCha")
+	assert.Equal(t, plain, decryptedBytes)
+
+	// Every cipher only decrypts its own messages
+	_, err = Decrypt(encryptedBytes, key)
+	assert.NotEqual(t, err, nil, "Decrypt of a ChaCha20-Poly1305 message should fail")
+	aesBytes, _ := Encrypt(plain, key)
+	_, err = DecryptChaCha(aesBytes, key)
+	assert.NotEqual(t, err, nil, "DecryptChaCha of an AES-GCM message should fail")
+
+	// ChaCha20-Poly1305 only has 32 byte keys
+	_, err = EncryptChaCha(plain, "ThisIs16BytesKey")
+	assert.NotEqual(t, err, nil, "Short key should fail")
+	_, err = DecryptChaCha([]byte("tiny"), key)
+	assert.NotEqual(t, err, nil, "Message without nonce should fail")
+}
+
+func TestDecryptTooShort(t *testing.T) {
+	key := "ThisIsMy32BytesKeyForTestingFine"
+	c, err := NewCipher(key)
+	assert.Equal(t, err, nil, "Failed to create cipher")
+	encryptedBytes, _ := Encrypt([]byte("data"), key)
+	chaChaBytes, _ := EncryptChaCha([]byte("data"), key)
+
+	decrypters := map[string]func([]byte) ([]byte, error){
+		"Decrypt":        func(b []byte) ([]byte, error) { return Decrypt(b, key) },
+		"DecryptWithAAD": func(b []byte) ([]byte, error) { return DecryptWithAAD(b, key, []byte("header")) },
+		"Cipher.Decrypt": c.Decrypt,
+		"DecryptChaCha":  func(b []byte) ([]byte, error) { return DecryptChaCha(b, key) },
+	}
+	for name, decrypt := range decrypters {
+		// Too short to hold a nonce and tag: not for this scheme
+		for _, short := range [][]byte{nil, []byte("tiny"), encryptedBytes[:27]} {
+			_, err := decrypt(short)
+			assert.True(t, errors.Is(err, ErrCiphertextTooShort), fmt.Sprintf("%s of %d bytes: %v", name, len(short), err))
+		}
+	}
+
+	// Long enough but corrupted fails authentication instead
+	for name, ciphertext := range map[string][]byte{"Decrypt": encryptedBytes, "DecryptChaCha": chaChaBytes} {
+		corrupted := append([]byte{}, ciphertext...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		_, err := decrypters[name](corrupted)
+		assert.NotEqual(t, err, nil, name+" of corrupted data should fail")
+		assert.False(t, errors.Is(err, ErrCiphertextTooShort), name+" of corrupted data is not too short")
+	}
+}
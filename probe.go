@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- PROBE --------------------- */
+
+// Subject of the JetStream account info request. Answered by servers with JetStream enabled
+const jetStreamInfoSubject = "$JS.API.INFO"
+
+// serverInfo is what the probe learns about the server before a benchmark
+type serverInfo struct {
+	URL          string
+	ServerID     string
+	Version      string
+	MaxPayload   int64
+	ClusterSize  int      // The connected server and the servers it told about
+	Servers      []string // Known servers, from the URL and discovered
+	AuthRequired bool
+	TLSRequired  bool
+	RTT          time.Duration
+
+	JetStream        bool
+	JetStreamStreams int    `json:",omitempty"`
+	JetStreamStorage uint64 `json:",omitempty"` // File storage used in bytes
+	JetStreamMemory  uint64 `json:",omitempty"` // Memory storage used in bytes
+}
+
+// jetStreamAccountInfo is the part of the JetStream account info response the probe reports
+type jetStreamAccountInfo struct {
+	Memory  uint64 `json:"memory"`
+	Storage uint64 `json:"storage"`
+	Streams int    `json:"streams"`
+	Error   *struct {
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// Returns the info of the server nc is connected to. JetStream is asked for its account info on
+// jetStreamInfoSubject and counts as disabled unless it answers within timeout
+func probeServer(nc *nats.Conn, timeout time.Duration) (serverInfo, error) {
+	rtt, err := nc.RTT()
+	if err != nil {
+		return serverInfo{}, errors.Wrap(err, "probe: server does not answer")
+	}
+	info := serverInfo{
+		URL:          nc.ConnectedUrl(),
+		ServerID:     nc.ConnectedServerId(),
+		Version:      nc.ConnectedServerVersion(),
+		MaxPayload:   nc.MaxPayload(),
+		ClusterSize:  1 + len(nc.DiscoveredServers()),
+		Servers:      nc.Servers(),
+		AuthRequired: nc.AuthRequired(),
+		TLSRequired:  nc.TLSRequired(),
+		RTT:          rtt,
+	}
+
+	msg, err := nc.Request(jetStreamInfoSubject, nil, timeout)
+	switch {
+	case err == nats.ErrTimeout, err == nats.ErrNoResponders: // Nobody answers without JetStream
+		return info, nil
+	case err != nil:
+		return info, errors.Wrap(err, "probe: JetStream request failed")
+	}
+	account := jetStreamAccountInfo{}
+	err = json.Unmarshal(msg.Data, &account)
+	if err != nil {
+		return info, errors.Wrap(err, "probe: unexpected JetStream account info")
+	}
+	if account.Error == nil {
+		info.JetStream = true
+		info.JetStreamStreams, info.JetStreamStorage, info.JetStreamMemory = account.Streams, account.Storage, account.Memory
+	}
+	return info, nil
+}
+
+// Writes info as a table of fields and values
+func writeServerInfo(w io.Writer, info serverInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "URL\t%s\n", info.URL)
+	fmt.Fprintf(tw, "Server ID\t%s\n", info.ServerID)
+	fmt.Fprintf(tw, "Version\t%s\n", info.Version)
+	fmt.Fprintf(tw, "Max payload\t%d (byte)\n", info.MaxPayload)
+	fmt.Fprintf(tw, "Cluster size\t%d\n", info.ClusterSize)
+	fmt.Fprintf(tw, "Servers\t%v\n", info.Servers)
+	fmt.Fprintf(tw, "Auth required\t%v\n", info.AuthRequired)
+	fmt.Fprintf(tw, "TLS required\t%v\n", info.TLSRequired)
+	fmt.Fprintf(tw, "RTT\t%v\n", info.RTT)
+	fmt.Fprintf(tw, "JetStream\t%v\n", info.JetStream)
+	if info.JetStream {
+		fmt.Fprintf(tw, "JetStream streams\t%d\n", info.JetStreamStreams)
+		fmt.Fprintf(tw, "JetStream storage\t%d (byte)\n", info.JetStreamStorage)
+		fmt.Fprintf(tw, "JetStream memory\t%d (byte)\n", info.JetStreamMemory)
+	}
+	return tw.Flush()
+}
+
+// runProbe connects to the server from args, writes its info to w and returns
+func runProbe(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	var url, format string
+	var timeout time.Duration
+	flags.StringVar(&url, "url", nats.DefaultURL, fmt.Sprintf("Set nats server URL to probe"))
+	flags.DurationVar(&timeout, "timeout", time.Second, fmt.Sprintf("Set time to wait for the JetStream account info"))
+	flags.StringVar(&format, "format", "table", fmt.Sprintf("Set output format, table or json"))
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if format != "table" && format != "json" {
+		return errors.New(fmt.Sprintf("probe: unknown format %q", format))
+	}
+
+	nc, err := nats.Connect(url, nats.Name("go-nats-go probe"))
+	if err != nil {
+		return errors.Wrapf(err, "probe: unable to connect to %s", url)
+	}
+	defer nc.Close()
+
+	info, err := probeServer(nc, timeout)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return json.NewEncoder(w).Encode(&info)
+	}
+	return writeServerInfo(w, info)
+}
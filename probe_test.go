@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeServer(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.MaxPayload = 512 * 1024
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+
+	// A single server without JetStream
+	info, err := probeServer(nc, 100*time.Millisecond)
+	assert.Equal(t, err, nil, "probeServer failed")
+	assert.Equal(t, s.ClientURL(), info.URL)
+	assert.NotEqual(t, "", info.Version)
+	assert.NotEqual(t, "", info.ServerID)
+	assert.Equal(t, int64(512*1024), info.MaxPayload)
+	assert.Equal(t, 1, info.ClusterSize)
+	assert.Equal(t, false, info.JetStream)
+
+	// An account with JetStream answers the account info request
+	js, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer js.Close()
+	sub, err := js.Subscribe(jetStreamInfoSubject, func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"type": "io.nats.jetstream.api.v1.account_info_response", "memory": 1024, "storage": 4096, "streams": 3}`))
+	})
+	assert.Equal(t, err, nil, "Subscribe failed")
+	info, err = probeServer(nc, time.Second)
+	assert.Equal(t, err, nil, "probeServer failed")
+	assert.Equal(t, true, info.JetStream)
+	assert.Equal(t, 3, info.JetStreamStreams)
+	assert.Equal(t, uint64(4096), info.JetStreamStorage)
+	assert.Equal(t, uint64(1024), info.JetStreamMemory)
+	sub.Unsubscribe()
+
+	// JetStream not enabled for the account
+	sub, _ = js.Subscribe(jetStreamInfoSubject, func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"type": "io.nats.jetstream.api.v1.account_info_response", "error": {"code": 503, "description": "jetstream not enabled"}}`))
+	})
+	defer sub.Unsubscribe()
+	info, err = probeServer(nc, time.Second)
+	assert.Equal(t, err, nil, "probeServer failed")
+	assert.Equal(t, false, info.JetStream)
+}
+
+func TestRunProbe(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	var out bytes.Buffer
+	err := runProbe([]string{"-url", s.ClientURL(), "-timeout", "100ms", "-format", "json"}, &out)
+	assert.Equal(t, err, nil, "runProbe failed")
+	info := serverInfo{}
+	assert.Equal(t, nil, json.Unmarshal(out.Bytes(), &info))
+	assert.Equal(t, s.ClientURL(), info.URL)
+
+	out.Reset()
+	err = runProbe([]string{"-url", s.ClientURL(), "-timeout", "100ms"}, &out)
+	assert.Equal(t, err, nil, "runProbe failed")
+	assert.Contains(t, out.String(), "Max payload")
+
+	err = runProbe([]string{"-url", s.ClientURL(), "-format", "xml"}, &out)
+	assert.NotEqual(t, err, nil, "Unknown format should fail")
+}
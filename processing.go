@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/* --------------------- PROCESSING TIME --------------------- */
+
+// Max number of processing times kept per job. Beyond that a uniform sample is kept
+const processingSamples = 100000
+
+// processingPercentiles is the time the slave spends in its data handler per message, independent of network
+type processingPercentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	Discarded uint64 `json:",omitempty"` // Warmup times left out of the percentiles
+}
+
+// processingTimes accumulates per message processing times for one job. Not safe for concurrent use,
+// nats calls the handler of a subscription from one goroutine
+type processingTimes struct {
+	samples   []time.Duration
+	seen      uint64
+	max       time.Duration
+	warmup    uint64 // The first warmup times of a job are discarded
+	discarded uint64
+	random    *rand.Rand // Picks the samples to replace. nil means the global source
+}
+
+// Records one processing time, reservoir sampled beyond processingSamples
+func (p *processingTimes) record(d time.Duration) {
+	if p.discarded < p.warmup {
+		p.discarded++
+		return
+	}
+	p.seen++
+	if d > p.max {
+		p.max = d
+	}
+	if len(p.samples) < processingSamples {
+		p.samples = append(p.samples, d)
+		return
+	}
+	replace := rand.Int63n
+	if p.random != nil {
+		replace = p.random.Int63n
+	}
+	if i := replace(int64(p.seen)); i < processingSamples {
+		p.samples[i] = d
+	}
+}
+
+// Starts over for a new job
+func (p *processingTimes) reset() {
+	p.samples = p.samples[:0]
+	p.seen = 0
+	p.max = 0
+	p.discarded = 0
+}
+
+// Returns the percentiles of the times recorded so far, nil if none
+func (p *processingTimes) percentiles() *processingPercentiles {
+	if len(p.samples) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), p.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	return &processingPercentiles{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: p.max, Discarded: p.discarded}
+}
+
+// Wraps handler and records the time spent in it for every message
+func timedHandler(times *processingTimes, handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		began := time.Now()
+		handler(msg)
+		times.record(time.Since(began))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessingTimes(t *testing.T) {
+	times := &processingTimes{}
+	assert.True(t, times.percentiles() == nil, "No percentiles without samples")
+
+	// A fake operation of known duration
+	work := 2 * time.Millisecond
+	handler := timedHandler(times, func(msg *nats.Msg) {
+		time.Sleep(work)
+	})
+	for i := 0; i < 20; i++ {
+		handler(&nats.Msg{})
+	}
+
+	p := times.percentiles()
+	assert.Equal(t, uint64(20), times.seen)
+	assert.True(t, p.P50 >= work, fmt.Sprintf("P50=%v shorter than the work", p.P50))
+	assert.True(t, p.P50 <= p.P90 && p.P90 <= p.P99 && p.P99 <= p.Max, fmt.Sprintf("Percentiles out of order %+v", *p))
+
+	times.reset()
+	assert.True(t, times.percentiles() == nil, "No percentiles after reset")
+
+	// Percentiles of known times
+	for i := 1; i <= 100; i++ {
+		times.record(time.Duration(i) * time.Millisecond)
+	}
+	p = times.percentiles()
+	assert.Equal(t, 50*time.Millisecond, p.P50)
+	assert.Equal(t, 90*time.Millisecond, p.P90)
+	assert.Equal(t, 99*time.Millisecond, p.P99)
+	assert.Equal(t, 100*time.Millisecond, p.Max)
+}
+
+func TestProcessingWarmup(t *testing.T) {
+	times := &processingTimes{warmup: 5}
+
+	// Five slow outliers, then steady state
+	for i := 0; i < 5; i++ {
+		times.record(time.Second)
+	}
+	assert.True(t, times.percentiles() == nil, "Warmup times should not be kept")
+	for i := 1; i <= 100; i++ {
+		times.record(time.Duration(i) * time.Millisecond)
+	}
+	p := times.percentiles()
+	assert.Equal(t, uint64(100), times.seen)
+	assert.Equal(t, uint64(5), p.Discarded)
+	assert.Equal(t, 99*time.Millisecond, p.P99)
+	assert.Equal(t, 100*time.Millisecond, p.Max)
+
+	// A new job warms up again
+	times.reset()
+	times.record(time.Second)
+	assert.True(t, times.percentiles() == nil, "Warmup times should not be kept after reset")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- PROMETHEUS --------------------- */
+
+// promMetric is a single gauge in the Prometheus text exposition format
+type promMetric struct {
+	name     string
+	help     string
+	quantile string // Label of a percentile, gauges of the same name differ by it. Empty for a plain gauge
+	value    float64
+}
+
+// Returns p50, p at quantile mid, p99 and max as gauges name in seconds, labelled by quantile. The max is quantile 1
+func promPercentiles(name string, help string, mid string, p50, p, p99, max time.Duration) []promMetric {
+	return []promMetric{
+		{name, help, "0.5", p50.Seconds()},
+		{name, help, mid, p.Seconds()},
+		{name, help, "0.99", p99.Seconds()},
+		{name, help, "1", max.Seconds()},
+	}
+}
+
+// Escapes a label value for the Prometheus text exposition format
+func promLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Renders res as gauges in the Prometheus text exposition format, labelled with scenario and mode
+func renderPrometheus(res result) string {
+	metrics := []promMetric{
+		{"benchmark_total_duration_seconds", "Time from first message sent to completion on the slave.", "", res.TotalDuration.Seconds()},
+		{"benchmark_duration_per_message_seconds", "Total duration divided by the number of messages.", "", res.DurationPerMessage.Seconds()},
+		{"benchmark_message_generation_seconds", "Time to generate one message.", "", res.MessageGeneration.Seconds()},
+		{"benchmark_message_size_bytes", "Size of one message on the wire.", "", float64(res.MessageSize)},
+		{"benchmark_messages", "Number of messages in the run.", "", float64(res.TotalMessages)},
+		{"benchmark_throughput_messages_per_second", "Achieved message rate.", "", res.MessagesPerSecond},
+		{"benchmark_throughput_bytes_per_second", "Achieved byte rate.", "", res.BytesPerSecond},
+		{"benchmark_publish_failures", "Failed publishes in the run.", "", float64(res.PublishFailures)},
+	}
+	if res.LinkUtilization != 0 {
+		metrics = append(metrics, promMetric{"benchmark_link_utilization_percent", "Percent of the configured link capacity used.", "", res.LinkUtilization})
+	}
+	if res.SchemaViolations != 0 {
+		metrics = append(metrics, promMetric{"benchmark_schema_violations", "Json messages whose data violates Slave.JSONSchema.", "", float64(res.SchemaViolations)})
+	}
+	if res.CompressionRatio != 0 {
+		metrics = append(metrics, promMetric{"benchmark_compression_ratio", "Uncompressed body size divided by compressed body size.", "", res.CompressionRatio})
+	}
+	if p := res.Latency; p != nil {
+		metrics = append(metrics, promPercentiles("benchmark_latency_seconds", "Time from send to receive per data message.", "0.95", p.P50, p.P95, p.P99, p.Max)...)
+	}
+	if p := res.SlaveProcessing; p != nil {
+		metrics = append(metrics, promPercentiles("benchmark_slave_processing_seconds", "Slave time per message in the data handler.", "0.9", p.P50, p.P90, p.P99, p.Max)...)
+	}
+
+	labels := fmt.Sprintf(`scenario="%s",mode="%s"`, promLabelValue(res.Scenario), promLabelValue(res.Mode))
+	var b strings.Builder
+	for i, m := range metrics {
+		if i == 0 || metrics[i-1].name != m.name {
+			fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(&b, "# TYPE %s gauge\n", m.name)
+		}
+		if m.quantile == "" {
+			fmt.Fprintf(&b, "%s{%s} %s\n", m.name, labels, strconv.FormatFloat(m.value, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(&b, "%s{%s,quantile=\"%s\"} %s\n", m.name, labels, m.quantile, strconv.FormatFloat(m.value, 'g', -1, 64))
+		}
+	}
+	return b.String()
+}
+
+// Writes res to fileName in the Prometheus text exposition format, replacing the previous result
+func writePrometheus(fileName string, res result) error {
+	err := ioutil.WriteFile(fileName, []byte(renderPrometheus(res)), 0644)
+	if err != nil {
+		return errors.Wrap(err, "results: unable to write prometheus file")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPrometheus(t *testing.T) {
+	res := result{
+		Scenario:           `file "big"`,
+		Mode:               "byte/gzip",
+		MessageSize:        1024,
+		TotalDuration:      2 * time.Second,
+		TotalMessages:      1000,
+		DurationPerMessage: 2 * time.Millisecond,
+		MessagesPerSecond:  500,
+		BytesPerSecond:     512000,
+		LinkUtilization:    4.096,
+		CompressionRatio:   3.5,
+		SchemaViolations:   3,
+		Latency:            &latencyPercentiles{P50: time.Millisecond, P95: 2 * time.Millisecond, P99: 3 * time.Millisecond, Max: 4 * time.Millisecond},
+		SlaveProcessing:    &processingPercentiles{P50: time.Microsecond, P90: 2 * time.Microsecond, P99: 3 * time.Microsecond, Max: 4 * time.Microsecond},
+	}
+	text := renderPrometheus(res)
+
+	// Every line is a comment or a sample of the text exposition format
+	comment := regexp.MustCompile(`^# (HELP|TYPE) [a-zA-Z_:][a-zA-Z0-9_:]* .+$`)
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*\{([a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*",?)*\} [-+]?[0-9.eE+-]+$`)
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	var samples int
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			assert.True(t, comment.MatchString(line), "Invalid comment: "+line)
+			continue
+		}
+		assert.True(t, sample.MatchString(line), "Invalid sample: "+line)
+		samples++
+	}
+	assert.Equal(t, 19, samples)
+
+	assert.Contains(t, text, `benchmark_throughput_bytes_per_second{scenario="file \"big\"",mode="byte/gzip"} 512000`)
+	assert.Contains(t, text, "# TYPE benchmark_total_duration_seconds gauge")
+	assert.Contains(t, text, `benchmark_total_duration_seconds{scenario="file \"big\"",mode="byte/gzip"} 2`)
+	assert.Contains(t, text, `benchmark_schema_violations{scenario="file \"big\"",mode="byte/gzip"} 3`)
+
+	// Percentiles are gauges of one name labelled by quantile, the max is quantile 1
+	assert.Equal(t, 1, strings.Count(text, "# TYPE benchmark_latency_seconds gauge"))
+	assert.Contains(t, text, `benchmark_latency_seconds{scenario="file \"big\"",mode="byte/gzip",quantile="0.5"} 0.001`)
+	assert.Contains(t, text, `benchmark_latency_seconds{scenario="file \"big\"",mode="byte/gzip",quantile="0.95"} 0.002`)
+	assert.Contains(t, text, `benchmark_latency_seconds{scenario="file \"big\"",mode="byte/gzip",quantile="1"} 0.004`)
+	assert.Contains(t, text, `benchmark_slave_processing_seconds{scenario="file \"big\"",mode="byte/gzip",quantile="0.9"} 2e-06`)
+
+	// Without percentiles in the result there are no percentile gauges
+	assert.NotContains(t, renderPrometheus(result{}), "quantile")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+/* --------------------- PARALLEL PUBLISHERS --------------------- */
+
+// Returns the range of message indexes 0 to total-2 of publisher w of publishers. The last message is left out,
+// it is published alone once every range is done
+func publisherRange(w int, publishers int, total uint64) (uint64, uint64) {
+	body := total - 1
+	return body * uint64(w) / uint64(publishers), body * uint64(w+1) / uint64(publishers)
+}
+
+// publishParallel publishes config.Total messages on subject from config.Master.Publishers goroutines, each
+// publishing a disjoint range of counts with the messages from source(first, n). The slave completes a job on the
+// last count, so that message is published after all ranges are done. config.Master.RateLimit is shared by the
+// publishers. The first error stops all publishers and is returned
+func publishParallel(ctx context.Context, nc publisher, subject string, config configuration, source func(first uint64, n uint64) messageSource) (uint64, error) {
+	publishers := config.Master.Publishers
+	first := config.Master.StartOffset
+	total := config.Total
+	if publishers <= 1 || total < 2 {
+		return publishMessages(ctx, nc, subject, config, source(first, total))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every publisher paces its own range
+	shared := config
+	shared.Master.RateLimit = config.Master.RateLimit / float64(publishers)
+
+	var failures uint64
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < publishers; w++ {
+		lo, hi := publisherRange(w, publishers, total)
+		if lo == hi {
+			continue
+		}
+		wg.Add(1)
+		go func(w int, lo uint64, hi uint64) {
+			defer wg.Done()
+			if config.Master.LockPublisherThreads || config.Master.PinPublishers {
+				unlock, _ := lockPublisher(config.Master.PinPublishers, w)
+				defer unlock()
+			}
+			n, err := publishMessages(ctx, nc, subject, shared, source(first+lo, hi-lo))
+			atomic.AddUint64(&failures, n)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(w, lo, hi)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return failures, firstErr
+	}
+
+	// The ranges are paced already
+	last := config
+	last.Master.RateLimit = 0
+	n, err := publishMessages(ctx, nc, subject, last, source(first+total-1, 1))
+	return failures + n, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingPublisher records the count of every published message. Safe for concurrent use
+type countingPublisher struct {
+	mu        sync.Mutex
+	failOn    uint64
+	published []uint64
+}
+
+func (p *countingPublisher) Publish(subj string, data []byte) error {
+	count := byteMessage(rawMessage(data).message()).count()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failOn > 0 && count == p.failOn {
+		return nats.ErrConnectionClosed
+	}
+	p.published = append(p.published, count)
+	return nil
+}
+
+func TestPublishParallel(t *testing.T) {
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.Total = 1000
+	config.Master.StartOffset = 50
+	source := func(first uint64, n uint64) messageSource {
+		return rangeMessages(first, n, config.Total, config.tracer, generateMessage)
+	}
+
+	for _, publishers := range []int{1, 2, 3, 7, 999, 2000} {
+		config.Master.Publishers = publishers
+		nc := &countingPublisher{}
+		failures, err := publishParallel(context.Background(), nc, "data", config, source)
+		assert.Equal(t, err, nil, fmt.Sprintf("publishParallel with %d publishers failed", publishers))
+		assert.Equal(t, uint64(0), failures)
+
+		// Every count exactly once, the last one after all others
+		assert.Equal(t, int(config.Total), len(nc.published), fmt.Sprintf("Published with %d publishers", publishers))
+		seen := map[uint64]int{}
+		for _, count := range nc.published {
+			seen[count]++
+		}
+		for count := config.Master.StartOffset; count < config.Master.StartOffset+config.Total; count++ {
+			assert.Equal(t, 1, seen[count], fmt.Sprintf("Count %d with %d publishers", count, publishers))
+		}
+		assert.Equal(t, config.Master.StartOffset+config.Total-1, nc.published[len(nc.published)-1], "Last count should be published last")
+	}
+
+	// abort stops every publisher and the last message is not sent
+	config.Master.Publishers = 4
+	config.Master.PublishErrorPolicy = "abort"
+	nc := &countingPublisher{failOn: config.Master.StartOffset + 10}
+	_, err := publishParallel(context.Background(), nc, "data", config, source)
+	assert.Equal(t, nats.ErrConnectionClosed, errors.Cause(err))
+	for _, count := range nc.published {
+		assert.NotEqual(t, config.Master.StartOffset+config.Total-1, count, "Last count published after abort")
+	}
+}
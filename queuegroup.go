@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- DATA QUEUE GROUP --------------------- */
+
+// Slaves in a DataQueueGroup send their partial count at most this often when no Slave.MetricInterval is set
+const defaultPartialInterval = 50 * time.Millisecond
+
+// Returns the subject of the start marker with DataQueueGroup. Every slave in the group subscribes to it,
+// since only one of them would get a start marker on the data subject
+func startSubject(config configuration) string {
+	return config.Subject + ".start"
+}
+
+// chanQueueSubscriber is the part of *nats.Conn needed to deliver queue subscriptions into one channel
+type chanQueueSubscriber interface {
+	chanSubscriber
+	ChanQueueSubscribe(subj, group string, ch chan *nats.Msg) (*nats.Subscription, error)
+}
+
+// Subscribes to the data subjects in queue group and to start as a plain subscription, and passes all messages
+// to handler from one goroutine like subscribeMultiplexed. The start marker is published before the data,
+// so every slave resets before its share of the job arrives. The goroutine ends when ctx is done
+func subscribeQueueGroup(ctx context.Context, nc chanQueueSubscriber, subjects []string, start string, group string, capacity int, handler nats.MsgHandler) ([]*nats.Subscription, error) {
+	ch := make(chan *nats.Msg, capacity)
+	sub, err := nc.ChanSubscribe(start, ch)
+	if err != nil {
+		return nil, errors.Wrapf(err, "nats: unable to subscribe to %s", start)
+	}
+	subs := []*nats.Subscription{sub}
+	for _, subject := range subjects {
+		sub, err := nc.ChanQueueSubscribe(subject, group, ch)
+		if err != nil {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+			return nil, errors.Wrapf(err, "nats: unable to subscribe to %s in queue group %s", subject, group)
+		}
+		subs = append(subs, sub)
+	}
+
+	go handleInOrder(ctx, ch, handler)
+	return subs, nil
+}
+
+// shareTracker sums the partial counts of the slaves that share the data messages of a job in a queue group.
+// Safe for concurrent use
+type shareTracker struct {
+	total uint64
+
+	mu     sync.Mutex
+	shares map[string]uint64 // Latest partial count per slave
+	latest time.Time         // Time of the latest partial count
+	done   bool
+}
+
+func newShareTracker(total uint64) *shareTracker {
+	return &shareTracker{total: total, shares: map[string]uint64{}}
+}
+
+// Records the partial count of a slave at time at. Returns true and the time of the latest partial count when
+// the counts of all slaves reach total the first time
+func (s *shareTracker) record(slave string, count uint64, at time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if count > s.shares[slave] {
+		s.shares[slave] = count
+	}
+	if at.After(s.latest) {
+		s.latest = at
+	}
+	var sum uint64
+	for _, n := range s.shares {
+		sum += n
+	}
+	if s.done || sum < s.total {
+		return time.Time{}, false
+	}
+	s.done = true
+	return s.latest, true
+}
+
+// Returns the latest partial count per slave
+func (s *shareTracker) counts() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]uint64, len(s.shares))
+	for slave, n := range s.shares {
+		counts[slave] = n
+	}
+	return counts
+}
+
+// Handler for the completion subject with DataQueueGroup. Every slave sends "partial" metrics with the messages it
+// received in the job. Done is signalled with a "received" metric at the time of the latest partial count
+// once the counts of all slaves add up to Total
+func shareHandler(shares *shareTracker, job uint64, unexpected *unexpectedMetrics, done chan<- metric) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		m := metric{}
+		err := decodeMetric(msg.Data, &m)
+		switch {
+		case len(msg.Data) == 0: // Permission probe
+		case err != nil:
+			unexpected.malformed(msg.Subject, msg.Data, err)
+		case m.JobID != job:
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job id %d, expected %d", m.JobID, job))
+		case m.Job != "partial":
+			unexpected.record(msg.Subject, msg.Data, fmt.Sprintf("job %q", m.Job))
+		case m.Slave == "":
+			unexpected.record(msg.Subject, msg.Data, "partial count without slave name")
+		default:
+			latest, complete := shares.record(m.Slave, m.Count, m.Time)
+			if !complete {
+				return
+			}
+			select {
+			case done <- metric{Job: "received", Time: latest, Count: shares.total, JobID: job}:
+			default:
+			}
+		}
+	}
+}
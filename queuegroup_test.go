@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataQueueGroup(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	config := testConfig()
+	config.Total = 200
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.DataQueueGroup = "slaves"
+	config.Slave.MetricInterval = 10 * time.Millisecond
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	// Two slaves in the same queue group
+	for _, name := range []string{"first", "second"} {
+		nc, err := nats.Connect(s.ClientURL())
+		assert.Equal(t, err, nil, "Unable to connect slave")
+		defer nc.Close()
+
+		slaveConfig := config
+		slaveConfig.Name = name
+		stop, err := startSlave(nc, slaveConfig, generateMessage, log, func() {})
+		assert.Equal(t, err, nil, "startSlave failed")
+		defer stop()
+		nc.Flush()
+	}
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect master")
+	defer nc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+
+	// Every message is received exactly once, split across the slaves
+	assert.Equal(t, 2, len(res.Shares))
+	assert.NotEqual(t, uint64(0), res.Shares["first"], "First slave received nothing")
+	assert.NotEqual(t, uint64(0), res.Shares["second"], "Second slave received nothing")
+	assert.Equal(t, config.Total, res.Shares["first"]+res.Shares["second"])
+}
+
+func TestShareTracker(t *testing.T) {
+	shares := newShareTracker(10)
+	now := time.Now()
+
+	_, complete := shares.record("first", 4, now)
+	assert.False(t, complete, "4 of 10")
+	_, complete = shares.record("second", 5, now.Add(time.Second))
+	assert.False(t, complete, "9 of 10")
+
+	// Stale counts do not go backwards
+	_, complete = shares.record("first", 2, now)
+	assert.False(t, complete, "Still 9 of 10")
+
+	latest, complete := shares.record("first", 5, now)
+	assert.True(t, complete, "10 of 10")
+	assert.Equal(t, now.Add(time.Second), latest, "Completed at the latest partial count")
+
+	_, complete = shares.record("second", 6, now)
+	assert.False(t, complete, "Completes once")
+	assert.Equal(t, map[string]uint64{"first": 5, "second": 6}, shares.counts())
+}
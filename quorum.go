@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- COMPLETION QUORUM --------------------- */
+
+// Returns the number of slave completions required by policy with slaves slaves: "all" (default), "majority",
+// "any" or a number from 1 to slaves
+func parseQuorum(policy string, slaves int) (int, error) {
+	if slaves < 1 {
+		return 0, errors.New(fmt.Sprintf("quorum: %d slaves, expected at least 1", slaves))
+	}
+	switch policy {
+	case "", "all":
+		return slaves, nil
+	case "majority":
+		return slaves/2 + 1, nil
+	case "any":
+		return 1, nil
+	}
+	n, err := strconv.Atoi(policy)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("quorum: unknown policy %q", policy))
+	}
+	if n < 1 || n > slaves {
+		return 0, errors.New(fmt.Sprintf("quorum: %d not in 1-%d", n, slaves))
+	}
+	return n, nil
+}
+
+// quorumTracker counts the completions of distinct slaves in a run. Not safe for concurrent use,
+// nats calls the completion handler from one goroutine
+type quorumTracker struct {
+	required int
+	slaves   map[string]bool
+	unnamed  int // Completions without a slave name, counted every time
+}
+
+// Returns a tracker for required completions. 0 means 1
+func newQuorumTracker(required int) *quorumTracker {
+	if required < 1 {
+		required = 1
+	}
+	return &quorumTracker{required: required, slaves: map[string]bool{}}
+}
+
+// Records the completion of slave and returns true when it is the one that reaches the quorum
+// A nil tracker is a quorum of one
+func (q *quorumTracker) complete(slave string) bool {
+	if q == nil {
+		return true
+	}
+	before := q.completed()
+	if slave == "" {
+		q.unnamed++
+	} else {
+		q.slaves[slave] = true
+	}
+	return before < q.required && q.completed() >= q.required
+}
+
+// Returns the number of completions so far
+func (q *quorumTracker) completed() int {
+	return len(q.slaves) + q.unnamed
+}
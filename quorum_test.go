@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuorum(t *testing.T) {
+	for _, c := range []struct {
+		policy   string
+		slaves   int
+		required int
+	}{
+		{"", 3, 3},
+		{"all", 3, 3},
+		{"majority", 3, 2},
+		{"majority", 4, 3},
+		{"majority", 1, 1},
+		{"any", 5, 1},
+		{"2", 3, 2},
+	} {
+		required, err := parseQuorum(c.policy, c.slaves)
+		assert.Equal(t, err, nil, c.policy)
+		assert.Equal(t, c.required, required, c.policy)
+	}
+
+	for _, policy := range []string{"most", "0", "4", "-1"} {
+		_, err := parseQuorum(policy, 3)
+		assert.NotEqual(t, err, nil, policy+" should be refused")
+	}
+	_, err := parseQuorum("all", 0)
+	assert.NotEqual(t, err, nil, "No slaves should be refused")
+}
+
+func TestCompletionQuorum(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	var total uint64 = 10
+	reply := func(slave string, count uint64) *nats.Msg {
+		data, _ := json.Marshal(&metric{Job: "received", Time: time.Now(), Count: count, Slave: slave})
+		return &nats.Msg{Subject: "go-nats-go.done", Data: data}
+	}
+
+	// Replies of three slaves, a repeated one and one with a wrong count that never counts
+	replies := []*nats.Msg{reply("a", total), reply("a", total), reply("b", 5), reply("b", total), reply("c", total)}
+	for _, c := range []struct {
+		policy string
+		doneAt int // Index of the reply that completes the run, -1 for never
+	}{
+		{"any", 0},
+		{"majority", 3},
+		{"2", 3},
+		{"all", 4},
+	} {
+		required, _ := parseQuorum(c.policy, 3)
+		done := make(chan metric, 1)
+		handler := completionHandler(total, 0, newQuorumTracker(required), &unexpectedMetrics{log: log}, done)
+		doneAt := -1
+		for i, msg := range replies {
+			handler(msg)
+			if doneAt == -1 && len(done) == 1 {
+				doneAt = i
+			}
+		}
+		assert.Equal(t, c.doneAt, doneAt, c.policy)
+	}
+
+	// Four slaves and only three replied
+	done := make(chan metric, 1)
+	handler := completionHandler(total, 0, newQuorumTracker(4), &unexpectedMetrics{log: log}, done)
+	for _, msg := range replies {
+		handler(msg)
+	}
+	assert.Equal(t, 0, len(done), "Run should not complete without all slaves")
+
+	// Only the completion that reaches the quorum reports it
+	tracker := newQuorumTracker(2)
+	assert.Equal(t, false, tracker.complete("a"))
+	assert.Equal(t, true, tracker.complete("b"))
+	assert.Equal(t, false, tracker.complete("c"), "Quorum is only reached once")
+	assert.Equal(t, 3, tracker.completed())
+}
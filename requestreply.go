@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- REQUEST-REPLY --------------------- */
+
+// requester is the part of *nats.Conn needed to send requests
+type requester interface {
+	Request(subj string, data []byte, timeout time.Duration) (*nats.Msg, error)
+}
+
+// queueSubscriber is the part of *nats.Conn needed to join a queue group
+type queueSubscriber interface {
+	QueueSubscribe(subj, queue string, cb nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// responder is the part of *nats.Conn needed to serve requests
+type responder interface {
+	subscriber
+	queueSubscriber
+}
+
+// reply is the response to every request and stats request: which responder served it and how many it has served so far
+type reply struct {
+	Responder string
+	Served    uint64
+}
+
+// Returns the subject the responders on subject report their served totals on
+func statsSubject(subject string) string {
+	return subject + ".stats"
+}
+
+// Subscribes a responder to subject that replies to every request with its served count
+// With queue set the responder joins the queue group and the requests are load balanced across the group
+// Every responder, in a queue group or not, also answers every request on the stats subject with its served total
+func serveRequests(nc responder, subject string, queue string, name string) ([]*nats.Subscription, error) {
+	var served uint64
+	handler := func(msg *nats.Msg) {
+		bytes, _ := json.Marshal(&reply{name, atomic.AddUint64(&served, 1)})
+		msg.Respond(bytes)
+	}
+
+	var sub *nats.Subscription
+	var err error
+	if queue == "" {
+		sub, err = subscribe(nc, subject, handler)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sub, err = nc.QueueSubscribe(subject, queue, handler)
+		if err != nil {
+			return nil, errors.Wrapf(err, "nats: unable to subscribe to %s in queue group %s", subject, queue)
+		}
+	}
+
+	stats, err := subscribe(nc, statsSubject(subject), func(msg *nats.Msg) {
+		bytes, _ := json.Marshal(&reply{name, atomic.LoadUint64(&served)})
+		msg.Respond(bytes)
+	})
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return []*nats.Subscription{sub, stats}, nil
+}
+
+// statsRequester is the part of *nats.Conn needed to ask the responders for their served totals
+type statsRequester interface {
+	subscriber
+	msgPublisher
+}
+
+// Asks the responders on subject for their served totals on the stats subject and returns every answer
+// that arrives within wait, by responder. Returns ctx.Err() if ctx is done first
+func gatherServed(ctx context.Context, nc statsRequester, subject string, wait time.Duration) (map[string]uint64, error) {
+	var mu sync.Mutex
+	served := map[string]uint64{}
+	inbox := nats.NewInbox()
+	sub, err := subscribe(nc, inbox, func(msg *nats.Msg) {
+		r := reply{}
+		if json.Unmarshal(msg.Data, &r) != nil {
+			return
+		}
+		mu.Lock()
+		served[r.Responder] = r.Served
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	err = nc.PublishMsg(&nats.Msg{Subject: statsSubject(subject), Reply: inbox})
+	if err != nil {
+		return nil, errors.Wrapf(err, "master: unable to ask for the stats on %s", statsSubject(subject))
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	gathered := make(map[string]uint64, len(served))
+	for responder, n := range served {
+		gathered[responder] = n
+	}
+	return gathered, nil
+}
+
+// roundTrips collects the round trip times of one requester
+type roundTrips struct {
+	n   uint64
+	min time.Duration
+	max time.Duration
+	sum time.Duration
+}
+
+func (r *roundTrips) record(rtt time.Duration) {
+	if r.n == 0 || rtt < r.min {
+		r.min = rtt
+	}
+	if rtt > r.max {
+		r.max = rtt
+	}
+	r.sum += rtt
+	r.n++
+}
+
+// Adds the round trips of other to r
+func (r *roundTrips) merge(other roundTrips) {
+	if other.n == 0 {
+		return
+	}
+	if r.n == 0 || other.min < r.min {
+		r.min = other.min
+	}
+	if other.max > r.max {
+		r.max = other.max
+	}
+	r.sum += other.sum
+	r.n += other.n
+}
+
+// Returns the mean round trip time. 0 without round trips
+func (r *roundTrips) mean() time.Duration {
+	if r.n == 0 {
+		return 0
+	}
+	return r.sum / time.Duration(r.n)
+}
+
+// requestReplier is the part of *nats.Conn needed to run request-reply
+type requestReplier interface {
+	requester
+	statsRequester
+}
+
+// runRequestReply sends config.Total requests on subject from config.Master.Requesters concurrent requesters
+// Every request waits for its reply up to config.Master.RequestTimeout. Timed out requests are counted, not retried
+// The round trip of every answered request is timed
+// The requests served per responder are the growth of its served total on the stats subject over the run, so lost
+// replies do not hide them. Every stats request waits config.Master.RequestTimeout for the answers
+// Returns ctx.Err() if ctx is done before all requests are sent
+func runRequestReply(ctx context.Context, nc requestReplier, subject string, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) (result, error) {
+	var mu sync.Mutex
+	var rtts roundTrips
+	var failed uint64
+
+	before, err := gatherServed(ctx, nc, subject, config.Master.RequestTimeout)
+	if err != nil {
+		return result{}, err
+	}
+
+	counts := make(chan uint64)
+	var wg sync.WaitGroup
+
+	base := time.Now()
+	var i uint
+	for ; i < config.Master.Requesters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var own roundTrips
+			defer func() {
+				mu.Lock()
+				rtts.merge(own)
+				mu.Unlock()
+			}()
+			for count := range counts {
+				data := generateMessage(count, config.Total)
+				sent := time.Now()
+				_, err := nc.Request(subject, data, config.Master.RequestTimeout)
+				if err != nil {
+					atomic.AddUint64(&failed, 1)
+					continue
+				}
+				own.record(time.Since(sent))
+			}
+		}()
+	}
+
+	var count uint64
+	for ; count < config.Total; count++ {
+		select {
+		case counts <- count:
+		case <-ctx.Done():
+			close(counts)
+			wg.Wait()
+			return result{}, ctx.Err()
+		}
+	}
+	close(counts)
+	wg.Wait()
+	duration := time.Now().Sub(base)
+
+	after, err := gatherServed(ctx, nc, subject, config.Master.RequestTimeout)
+	if err != nil {
+		return result{}, err
+	}
+	served := map[string]uint64{}
+	for responder, n := range after {
+		served[responder] = n - before[responder]
+	}
+
+	res := newResult(config, generateMessage, duration)
+	res.Served = served
+	res.FailedRequests = failed
+	res.RTTMin, res.RTTAvg, res.RTTMax = rtts.min, rtts.mean(), rtts.max
+	if failed > 0 {
+		log.Logf(logrus.WarnLevel, "%d of %d requests got no reply within RequestTimeout=%v", failed, config.Total, config.Master.RequestTimeout)
+	}
+	return res, nil
+}
+
+// canary sends a single random nonce on subject and expects the slave to echo it within timeout
+// This confirms that master and slave are wired to the same subjects before committing to a long run
+func canary(nc requester, subject string, timeout time.Duration) error {
+	nonce := make([]byte, 16)
+	crand.Read(nonce)
+	msg, err := nc.Request(subject, nonce, timeout)
+	if err != nil {
+		return errors.Wrapf(err, "canary: slave not reachable on subject %s", subject)
+	}
+	if !bytes.Equal(msg.Data, nonce) {
+		return errors.New(fmt.Sprintf("canary: unexpected echo on subject %s", subject))
+	}
+	return nil
+}
+
+// Subscribes to subject and echoes every canary back to the master
+func serveCanary(nc natsConn, subject string) (*nats.Subscription, error) {
+	return subscribe(nc, subject, func(msg *nats.Msg) {
+		nc.Publish(msg.Reply, msg.Data)
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestReplyQueueGroup(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	// Two responders in the same queue group
+	for _, name := range []string{"first", "second"} {
+		nc, err := nats.Connect(s.ClientURL())
+		assert.Equal(t, err, nil, "Unable to connect responder")
+		defer nc.Close()
+
+		_, err = serveRequests(nc, "go-nats-go.request", "responders", name)
+		assert.Equal(t, err, nil, "serveRequests failed")
+		nc.Flush()
+	}
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect requester")
+	defer nc.Close()
+
+	config := testConfig()
+	config.Total = 100
+	config.Master.Requesters = 4
+	config.Master.RequestTimeout = time.Second
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	res, err := runRequestReply(context.Background(), nc, "go-nats-go.request", config, generateMessage, log)
+	assert.Equal(t, err, nil, "runRequestReply failed")
+	assert.Equal(t, uint64(0), res.FailedRequests)
+
+	// Every request is served exactly once, and both responders take a share
+	assert.Equal(t, 2, len(res.Served))
+	assert.NotEqual(t, uint64(0), res.Served["first"], "First responder served nothing")
+	assert.NotEqual(t, uint64(0), res.Served["second"], "Second responder served nothing")
+	assert.Equal(t, config.Total, res.Served["first"]+res.Served["second"])
+
+	// The next run counts its own requests only, from the totals the responders report on the stats subject
+	config.Total = 50
+	res, err = runRequestReply(context.Background(), nc, "go-nats-go.request", config, generateMessage, log)
+	assert.Equal(t, err, nil, "runRequestReply failed")
+	assert.Equal(t, config.Total, res.Served["first"]+res.Served["second"])
+
+	// Requests whose replies are lost are still counted by the responders
+	served, err := gatherServed(context.Background(), nc, "go-nats-go.request", 100*time.Millisecond)
+	assert.Equal(t, err, nil, "gatherServed failed")
+	for i := 0; i < 10; i++ {
+		nc.Publish("go-nats-go.request", []byte("no reply wanted"))
+	}
+	nc.Flush()
+	later, err := gatherServed(context.Background(), nc, "go-nats-go.request", 100*time.Millisecond)
+	assert.Equal(t, err, nil, "gatherServed failed")
+	assert.Equal(t, served["first"]+served["second"]+10, later["first"]+later["second"])
+}
+
+func TestCanary(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect")
+	defer nc.Close()
+
+	_, err = serveCanary(nc, "go-nats-go.canary")
+	assert.Equal(t, err, nil, "serveCanary failed")
+	nc.Flush()
+
+	err = canary(nc, "go-nats-go.canary", time.Second)
+	assert.Equal(t, err, nil, "Canary should be echoed")
+
+	// Nobody listens on a mistyped subject
+	err = canary(nc, "go-nats-go-typo.canary", 100*time.Millisecond)
+	assert.NotEqual(t, err, nil, "Canary without slave should fail")
+	assert.Contains(t, err.Error(), "slave not reachable on subject go-nats-go-typo.canary")
+}
+
+func TestPingPong(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	// The scenario turns on request-reply for master and slave
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "Scenario": "pingpong", "Total": 50}`), 0644), nil, "WriteFile failed")
+	var config configuration
+	assert.Equal(t, readConfig(fileName, false, &config), nil, "readConfig failed")
+	assert.True(t, config.RequestReply, "pingpong should send requests")
+
+	responder, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect responder")
+	defer responder.Close()
+	_, err = serveRequests(responder, "go-nats-go.request", "", "slave")
+	assert.Equal(t, err, nil, "serveRequests failed")
+	responder.Flush()
+
+	nc, err := nats.Connect(s.ClientURL())
+	assert.Equal(t, err, nil, "Unable to connect requester")
+	defer nc.Close()
+
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(make([]byte, 16)))
+	res, err := runRequestReply(context.Background(), nc, "go-nats-go.request", config, generateMessage, log)
+	assert.Equal(t, err, nil, "runRequestReply failed")
+	assert.Equal(t, uint64(0), res.FailedRequests)
+	assert.Equal(t, config.Total, res.Served["slave"])
+
+	// Every round trip took some time, the mean lies within min and max
+	assert.True(t, res.RTTMin > 0, "No min round trip")
+	assert.True(t, res.RTTMin <= res.RTTAvg, fmt.Sprintf("min=%v > avg=%v", res.RTTMin, res.RTTAvg))
+	assert.True(t, res.RTTAvg <= res.RTTMax, fmt.Sprintf("avg=%v > max=%v", res.RTTAvg, res.RTTMax))
+}
+
+func TestRoundTrips(t *testing.T) {
+	var first, second, all roundTrips
+	assert.Equal(t, time.Duration(0), all.mean(), "No round trips")
+	for _, rtt := range []time.Duration{3, 1, 2} {
+		first.record(rtt * time.Millisecond)
+	}
+	second.record(5 * time.Millisecond)
+
+	all.merge(first)
+	all.merge(roundTrips{})
+	all.merge(second)
+	assert.Equal(t, uint64(4), all.n)
+	assert.Equal(t, time.Millisecond, all.min)
+	assert.Equal(t, 5*time.Millisecond, all.max)
+	assert.Equal(t, 11*time.Millisecond/4, all.mean())
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/direktoren/go-nats-go/pkg/easycrypt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- RESULTS --------------------- */
+
+// result is the summary of one master run
+type result struct {
+	Time                 time.Time
+	Scenario             string
+	Mode                 string
+	MessageSize          int
+	MessageSizes         *sizeDistribution `json:",omitempty"` // On the slave, when the sizes varied
+	MessageGeneration    time.Duration
+	TotalDuration        time.Duration
+	SendDuration         time.Duration `json:",omitempty"` // From the first message sent until the server confirmed the last (flush)
+	FirstLatency         time.Duration `json:",omitempty"` // From the first message sent until the slave received it
+	TotalMessages        uint64
+	DurationPerMessage   time.Duration
+	MessagesPerSecond    float64
+	BytesPerSecond       float64 // On-wire message bytes, comparable across message sizes
+	LinkUtilization      float64 `json:",omitempty"` // Percent of LinkCapacityMbps used by BytesPerSecond
+	PublishFailures      uint64
+	TargetRate           float64 `json:",omitempty"` // Master.RateLimit in msgs/sec
+	SendRate             float64 `json:",omitempty"` // With Master.RateLimit: messages / SendDuration, the rate achieved
+	BufferedMessages     uint64  `json:",omitempty"` // Published while disconnected and replayed on reconnect
+	BufferedBytes        uint64  `json:",omitempty"`
+	ChurnSubscribeRate   float64 `json:",omitempty"` // Subject churn: subscribes per second
+	ChurnUnsubscribeRate float64 `json:",omitempty"` // Subject churn: unsubscribes per second
+	ChurnErrors          uint64  `json:",omitempty"`
+	PublisherAffinity    string  `json:",omitempty"` // "locked" or "pinned" publisher threads
+	GenerateWorkers      int     `json:",omitempty"` // Goroutines generating the messages ahead of the publisher
+	GenerateSpeedup      float64 `json:",omitempty"` // Time spent generating / time until the last was generated
+
+	TLS          bool          `json:",omitempty"` // Master connected over TLS
+	TLSHandshake time.Duration `json:",omitempty"` // TLS connect time - plain connect time
+
+	SlaveProcessing *processingPercentiles `json:",omitempty"` // Slave time per message in the data handler: decrypt, unmarshal and verify
+	Latency         *latencyPercentiles    `json:",omitempty"` // StampSendTime: time from send to receive per data message
+
+	Types map[string]uint64 `json:",omitempty"` // Messages received per type/format, from the header of every message
+
+	InjectedDuplicates uint64 `json:",omitempty"` // Messages the master resent on purpose
+	Duplicates         uint64 `json:",omitempty"` // Resent messages the slave dropped
+	ServerDuplicates   uint64 `json:",omitempty"` // DedupMsgID: messages JetStream did not store again
+
+	BadChunks     uint64 `json:",omitempty"` // Scenario "file.stream": chunks with a checksum mismatch
+	FirstBadChunk uint64 `json:",omitempty"` // Offset in the file of the first bad chunk
+
+	Subscriptions         []uint64 `json:",omitempty"` // Messages the slave received per data subscription, with Subscriptions > 1
+	SubscriptionImbalance float64  `json:",omitempty"` // (max-min)/mean of Subscriptions in percent
+
+	SeedTransform string `json:",omitempty"` // Scenario "file.seeded": transform applied to the seed
+	BadSeeded     uint64 `json:",omitempty"` // Scenario "file.seeded": payloads that do not match the transform
+	BadChecksums  uint64 `json:",omitempty"` // Checksum: messages with a crc32 mismatch
+
+	ShortCiphertexts uint64 `json:",omitempty"` // Encrypted messages too short to decrypt: truncated or not encrypted by this scheme
+	SchemaViolations uint64 `json:",omitempty"` // Slave.JSONSchema: json messages whose data violates the schema
+
+	CompressionLevel int     `json:",omitempty"` // gzip and encz: configured level, 0 is gzip default
+	CompressionRatio float64 `json:",omitempty"` // gzip and encz: uncompressed body size / compressed body size
+
+	Pairs int `json:",omitempty"` // Number of concurrent master/slave pairs summed in this result
+
+	StartGoroutines int `json:",omitempty"` // Goroutines in the master process when the run started, with GoroutineInterval
+	MaxGoroutines   int `json:",omitempty"`
+	FinalGoroutines int `json:",omitempty"` // When the run was over
+
+	Served         map[string]uint64 `json:",omitempty"` // Request-reply: requests served per responder
+	Shares         map[string]uint64 `json:",omitempty"` // DataQueueGroup: data messages received per slave
+	FailedRequests uint64            `json:",omitempty"` // Request-reply: requests without reply
+	RTTMin         time.Duration     `json:",omitempty"` // Request-reply: round trip times of the answered requests
+	RTTAvg         time.Duration     `json:",omitempty"`
+	RTTMax         time.Duration     `json:",omitempty"`
+
+	ReturnMessages          uint64        `json:",omitempty"` // Bidirectional: messages of the return stream received by the master
+	ReturnDuration          time.Duration `json:",omitempty"` // From the start marker until the last return message arrived
+	ReturnMessagesPerSecond float64       `json:",omitempty"`
+	ReturnBytesPerSecond    float64       `json:",omitempty"`
+
+	JobID uint64 `json:",omitempty"` // Random ID of the run in every message, to find it in the slave log
+}
+
+// Compiles the result of a run. Generates one extra message to get mode, size and generation time
+func newResult(config configuration, generateMessage rawMessageGenerator, totalDuration time.Duration) result {
+	beforeMessageTime := time.Now()
+	testMessage := generateMessage(1, 1)
+	afterMessageTime := time.Now()
+
+	res := result{
+		Time:               beforeMessageTime,
+		Scenario:           config.Scenario,
+		Mode:               testMessage.messageType() + "/" + testMessage.format(),
+		MessageSize:        len(testMessage),
+		MessageGeneration:  afterMessageTime.Sub(beforeMessageTime),
+		TotalDuration:      totalDuration,
+		TotalMessages:      config.Total,
+		DurationPerMessage: totalDuration / (time.Duration)(config.Total),
+	}
+
+	res.MessagesPerSecond, res.BytesPerSecond, res.LinkUtilization = throughput(config.Total, len(testMessage), totalDuration, config.Master.LinkCapacityMbps)
+
+	if testMessage.format() == "seed" {
+		res.SeedTransform = config.SeedTransform
+	}
+
+	switch testMessage.format() {
+	case "gzip":
+		body, err := decompress(testMessage.message())
+		if err == nil {
+			res.CompressionLevel = config.CompressionLevel
+			res.CompressionRatio = float64(len(body)) / float64(len(testMessage.message()))
+		}
+	case "encz":
+		// The ratio of the compressed body, before encryption
+		compressed, err := easycrypt.Decrypt(testMessage.message(), config.AESEncryptionKey)
+		if err == nil {
+			body, err := decompress(compressed)
+			if err == nil {
+				res.CompressionLevel = config.CompressionLevel
+				res.CompressionRatio = float64(len(body)) / float64(len(compressed))
+			}
+		}
+	}
+	return res
+}
+
+// Returns the achieved message and byte rates of total messages of size bytes in duration
+// With linkCapacityMbps (megabits per second) set, utilization is the percent of the link used. Otherwise it is 0
+func throughput(total uint64, size int, duration time.Duration, linkCapacityMbps float64) (float64, float64, float64) {
+	if duration <= 0 {
+		return 0, 0, 0
+	}
+	messagesPerSecond := float64(total) / duration.Seconds()
+	bytesPerSecond := messagesPerSecond * float64(size)
+	var utilization float64
+	if linkCapacityMbps > 0 {
+		utilization = 100 * bytesPerSecond * 8 / (linkCapacityMbps * 1000000)
+	}
+	return messagesPerSecond, bytesPerSecond, utilization
+}
+
+// Units for durations and throughput in the summary. Throughput units are in bytes per second
+// Note the factor 8 between bytes (B) and bits (bps), and 1000 (kB, MB) vs 1024 (KiB, MiB)
+var (
+	durationUnits = map[string]time.Duration{
+		"ns": time.Nanosecond, "us": time.Microsecond, "µs": time.Microsecond, "ms": time.Millisecond, "s": time.Second,
+	}
+	throughputUnits = map[string]float64{
+		"B/s": 1, "kB/s": 1000, "MB/s": 1000 * 1000, "GB/s": 1000 * 1000 * 1000,
+		"KiB/s": 1024, "MiB/s": 1024 * 1024, "GiB/s": 1024 * 1024 * 1024,
+		"kbps": 1000.0 / 8, "Mbps": 1000 * 1000.0 / 8, "Gbps": 1000 * 1000 * 1000.0 / 8,
+	}
+)
+
+// summaryFormat controls how durations and throughput are shown in the summary
+type summaryFormat struct {
+	durationUnit   string // Empty shows time.Duration as is
+	throughputUnit string
+	precision      int // Decimals of converted values
+}
+
+// Returns the summary format from config. Units are validated by readConfig
+func newSummaryFormat(config configuration) summaryFormat {
+	format := summaryFormat{config.Master.SummaryDurationUnit, config.Master.SummaryThroughputUnit, config.Master.SummaryPrecision}
+	if format.throughputUnit == "" {
+		format.throughputUnit = "B/s"
+	}
+	return format
+}
+
+// Returns d in the duration unit of f, or as time.Duration if no unit is set
+func (f summaryFormat) duration(d time.Duration) string {
+	unit, ok := durationUnits[f.durationUnit]
+	if !ok {
+		return d.String()
+	}
+	return strconv.FormatFloat(float64(d)/float64(unit), 'f', f.precision, 64) + f.durationUnit
+}
+
+// Returns bytesPerSecond in the throughput unit of f
+func (f summaryFormat) throughput(bytesPerSecond float64) string {
+	unit, ok := throughputUnits[f.throughputUnit]
+	if !ok {
+		unit, f.throughputUnit = 1, "B/s"
+	}
+	return strconv.FormatFloat(bytesPerSecond/unit, 'f', f.precision, 64) + " " + f.throughputUnit
+}
+
+// Compile a short summary of the outcome
+func logSummary(log *logrus.Logger, res result, format summaryFormat) {
+	log.Logf(logrus.InfoLevel, "All messages sent & summary message received.")
+	log.Logf(logrus.InfoLevel, "Mode=%s", res.Mode)
+	log.Logf(logrus.InfoLevel, "Message size=%d (byte)", res.MessageSize)
+	if s := res.MessageSizes; s != nil {
+		log.Logf(logrus.InfoLevel, "Message sizes min=%d mean=%.1f max=%d (byte)", s.Min, s.Mean, s.Max)
+	}
+	log.Logf(logrus.InfoLevel, "Message generation=%s", format.duration(res.MessageGeneration))
+	log.Logf(logrus.InfoLevel, "Total duration=%s", format.duration(res.TotalDuration))
+	if res.SendDuration != 0 {
+		log.Logf(logrus.InfoLevel, "Send duration=%s (confirmed by the server)", format.duration(res.SendDuration))
+	}
+	if res.FirstLatency != 0 {
+		log.Logf(logrus.InfoLevel, "First message latency=%s", format.duration(res.FirstLatency))
+	}
+	log.Logf(logrus.InfoLevel, "Total Messages=%d", res.TotalMessages)
+	if res.Pairs > 0 {
+		log.Logf(logrus.InfoLevel, "Pairs=%d", res.Pairs)
+	}
+	log.Logf(logrus.InfoLevel, "Duration/Message=%s", format.duration(res.DurationPerMessage))
+	log.Logf(logrus.InfoLevel, "Throughput=%.0f msgs/sec %s", res.MessagesPerSecond, format.throughput(res.BytesPerSecond))
+	if res.ReturnMessages > 0 {
+		log.Logf(logrus.InfoLevel, "Return throughput=%.0f msgs/sec %s, %d messages from the slave in %s", res.ReturnMessagesPerSecond, format.throughput(res.ReturnBytesPerSecond), res.ReturnMessages, format.duration(res.ReturnDuration))
+	}
+	if res.LinkUtilization != 0 {
+		log.Logf(logrus.InfoLevel, "Link utilization=%.1f%%", res.LinkUtilization)
+	}
+	log.Logf(logrus.InfoLevel, "Publish failures=%d", res.PublishFailures)
+	if res.TargetRate > 0 {
+		log.Logf(logrus.InfoLevel, "Send rate=%.0f msgs/sec of RateLimit=%.0f msgs/sec (%.1f%%)", res.SendRate, res.TargetRate, 100*res.SendRate/res.TargetRate)
+		if res.SendRate < 0.9*res.TargetRate {
+			log.Logf(logrus.WarnLevel, "Send rate below RateLimit. The master cannot publish this fast")
+		}
+	}
+	if res.BufferedMessages > 0 {
+		log.Logf(logrus.InfoLevel, "Buffered during disconnect=%d messages %d bytes", res.BufferedMessages, res.BufferedBytes)
+	}
+	if res.ChurnSubscribeRate != 0 {
+		log.Logf(logrus.InfoLevel, "Subject churn=%.0f subscribes/sec %.0f unsubscribes/sec errors=%d", res.ChurnSubscribeRate, res.ChurnUnsubscribeRate, res.ChurnErrors)
+	}
+	if res.MaxGoroutines > 0 {
+		log.Logf(logrus.InfoLevel, "Goroutines start=%d max=%d final=%d", res.StartGoroutines, res.MaxGoroutines, res.FinalGoroutines)
+		if goroutinesLeaked(res) {
+			log.Logf(logrus.WarnLevel, "Goroutines grew from %d to %d during the run. Possible leak", res.StartGoroutines, res.FinalGoroutines)
+		}
+	}
+	if res.PublisherAffinity != "" {
+		log.Logf(logrus.InfoLevel, "Publisher threads=%s", res.PublisherAffinity)
+	}
+	if res.GenerateWorkers > 0 {
+		log.Logf(logrus.InfoLevel, "Generate workers=%d speedup=%.2fx", res.GenerateWorkers, res.GenerateSpeedup)
+	}
+
+	if p := res.SlaveProcessing; p != nil {
+		log.Logf(logrus.InfoLevel, "Slave processing/Message p50=%s p90=%s p99=%s max=%s", format.duration(p.P50), format.duration(p.P90), format.duration(p.P99), format.duration(p.Max))
+		if p.Discarded > 0 {
+			log.Logf(logrus.InfoLevel, "Slave processing warmup discarded=%d", p.Discarded)
+		}
+	}
+
+	if p := res.Latency; p != nil {
+		log.Logf(logrus.InfoLevel, "Latency/Message p50=%s p95=%s p99=%s max=%s", format.duration(p.P50), format.duration(p.P95), format.duration(p.P99), format.duration(p.Max))
+	}
+
+	if res.Types != nil {
+		types := make([]string, 0, len(res.Types))
+		for t := range res.Types {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			rate, _, _ := throughput(res.Types[t], 0, res.TotalDuration, 0)
+			log.Logf(logrus.InfoLevel, "Type %s=%d (%.0f msgs/sec)", t, res.Types[t], rate)
+		}
+	}
+
+	if res.InjectedDuplicates != 0 || res.Duplicates != 0 {
+		log.Logf(logrus.InfoLevel, "Duplicates injected=%d dropped by slave=%d", res.InjectedDuplicates, res.Duplicates)
+	}
+	if res.ServerDuplicates != 0 {
+		log.Logf(logrus.InfoLevel, "Duplicates suppressed by the server=%d", res.ServerDuplicates)
+	}
+
+	if res.BadChunks > 0 {
+		log.Logf(logrus.WarnLevel, "Bad chunks=%d first at offset %d", res.BadChunks, res.FirstBadChunk)
+	}
+
+	if res.Subscriptions != nil {
+		log.Logf(logrus.InfoLevel, "Subscriptions=%d messages=%v imbalance=%.1f%%", len(res.Subscriptions), res.Subscriptions, res.SubscriptionImbalance)
+	}
+
+	if res.SeedTransform != "" {
+		log.Logf(logrus.InfoLevel, "Seed transform=%s", res.SeedTransform)
+	}
+	if res.BadSeeded > 0 {
+		log.Logf(logrus.WarnLevel, "Bad seeded payloads=%d", res.BadSeeded)
+	}
+	if res.BadChecksums > 0 {
+		log.Logf(logrus.WarnLevel, "Bad checksums=%d", res.BadChecksums)
+	}
+	if res.ShortCiphertexts > 0 {
+		log.Logf(logrus.WarnLevel, "Short ciphertexts=%d", res.ShortCiphertexts)
+	}
+	if res.SchemaViolations > 0 {
+		log.Logf(logrus.WarnLevel, "Schema violations=%d", res.SchemaViolations)
+	}
+
+	if res.CompressionRatio != 0 {
+		log.Logf(logrus.InfoLevel, "Compression level=%d ratio=%.2f", res.CompressionLevel, res.CompressionRatio)
+	}
+
+	if res.Served != nil {
+		var served uint64
+		for responder, count := range res.Served {
+			log.Logf(logrus.InfoLevel, "Served by %s=%d", responder, count)
+			served += count
+		}
+		log.Logf(logrus.InfoLevel, "Served total=%d", served)
+		log.Logf(logrus.InfoLevel, "Failed requests=%d", res.FailedRequests)
+		log.Logf(logrus.InfoLevel, "Round trip min=%s avg=%s max=%s", format.duration(res.RTTMin), format.duration(res.RTTAvg), format.duration(res.RTTMax))
+	}
+
+	for slave, count := range res.Shares {
+		log.Logf(logrus.InfoLevel, "Share of %s=%d", slave, count)
+	}
+}
+
+// Appends res as a single json line to fileName. The file is created if needed
+func appendResult(fileName string, res result) error {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "results: unable to open results file")
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(&res)
+	if err != nil {
+		return errors.Wrap(err, "results: unable to write result")
+	}
+	return nil
+}
+
+// Columns of a results csv file
+var resultsCSVHeader = []string{"Time", "Scenario", "Mode", "MessageSize", "TotalMessages", "TotalDuration", "DurationPerMessage", "MessagesPerSecond", "BytesPerSecond"}
+
+// Appends res as a csv row to fileName. A new or empty file gets the header first. Durations are in nanoseconds
+func appendResultCSV(fileName string, res result) error {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "results: unable to open results file")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "results: unable to stat results file")
+	}
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(resultsCSVHeader)
+	}
+	w.Write([]string{
+		res.Time.Format(time.RFC3339Nano),
+		res.Scenario,
+		res.Mode,
+		strconv.Itoa(res.MessageSize),
+		strconv.FormatUint(res.TotalMessages, 10),
+		strconv.FormatInt(int64(res.TotalDuration), 10),
+		strconv.FormatInt(int64(res.DurationPerMessage), 10),
+		strconv.FormatFloat(res.MessagesPerSecond, 'f', -1, 64),
+		strconv.FormatFloat(res.BytesPerSecond, 'f', -1, 64),
+	})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return errors.Wrap(err, "results: unable to write result")
+	}
+	return nil
+}
+
+// Appends res to fileName in format, "json" or "csv"
+func writeResults(fileName string, format string, res result) error {
+	if format == "csv" {
+		return appendResultCSV(fileName, res)
+	}
+	return appendResult(fileName, res)
+}
+
+// Publishes res as json on subject, so a collector can aggregate runs without file access
+func publishResult(nc publisher, subject string, res result) error {
+	data, err := json.Marshal(&res)
+	if err != nil {
+		return errors.Wrap(err, "results: unable to marshal result")
+	}
+
+	err = nc.Publish(subject, data)
+	if err != nil {
+		return errors.Wrapf(err, "results: unable to publish result on %s", subject)
+	}
+	return nil
+}
+
+// Returns an error if res is below the minimum throughput in config, with actual vs expected
+func checkThroughput(res result, config configuration) error {
+	if min := config.Master.MinMessagesPerSecond; min > 0 && res.MessagesPerSecond < min {
+		return errors.New(fmt.Sprintf("throughput %.0f msgs/sec below expected %.0f msgs/sec", res.MessagesPerSecond, min))
+	}
+	if min := config.Master.MinMBPerSecond; min > 0 && res.BytesPerSecond/1000000 < min {
+		return errors.New(fmt.Sprintf("throughput %.2f MB/sec below expected %.2f MB/sec", res.BytesPerSecond/1000000, min))
+	}
+	return nil
+}
+
+// Logs the outcome of checkThroughput if any minimum is set. Returns false if res falls short
+func throughputMet(log *logrus.Logger, res result, config configuration) bool {
+	if config.Master.MinMessagesPerSecond == 0 && config.Master.MinMBPerSecond == 0 {
+		return true
+	}
+	err := checkThroughput(res, config)
+	if err != nil {
+		log.Logf(logrus.ErrorLevel, "FAILED expected throughput: %v", err)
+		return false
+	}
+	log.Logf(logrus.InfoLevel, "Expected throughput met: %.0f msgs/sec %.2f MB/sec", res.MessagesPerSecond, res.BytesPerSecond/1000000)
+	return true
+}
+
+// Logs the publish failures of res as an error. Returns false if any publish failed, the run may have dropped messages
+func publishSucceeded(log *logrus.Logger, res result) bool {
+	if res.PublishFailures == 0 {
+		return true
+	}
+	log.Logf(logrus.ErrorLevel, "FAILED %d publishes. Messages may have been dropped", res.PublishFailures)
+	return false
+}
+
+// Logs the summary of res and writes it to file and/or publishes it as set in config
+func reportResult(log *logrus.Logger, nc publisher, config configuration, res result) error {
+	logSummary(log, res, newSummaryFormat(config))
+
+	if config.Master.ResultsFile != "" {
+		err := writeResults(config.Master.ResultsFile, config.Master.ResultsFormat, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Master.PrometheusFile != "" {
+		err := writePrometheus(config.Master.PrometheusFile, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Master.PublishResults {
+		err := publishResult(nc, config.Master.ResultsSubject, res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingPublisher struct {
+	subjects []string
+	data     [][]byte
+}
+
+func (p *recordingPublisher) Publish(subj string, data []byte) error {
+	p.subjects = append(p.subjects, subj)
+	p.data = append(p.data, data)
+	return nil
+}
+
+func TestReportResultPublish(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := configuration{Master: masterConfig{PublishResults: true, ResultsSubject: "go-nats-go.results"}}
+	res := result{Scenario: "json", Mode: "json/byte", TotalDuration: time.Second, TotalMessages: 1000}
+
+	nc := &recordingPublisher{}
+	err := reportResult(log, nc, config, res)
+	assert.Equal(t, err, nil, "reportResult failed")
+	assert.Equal(t, []string{"go-nats-go.results"}, nc.subjects)
+
+	copyResult := result{}
+	err = json.Unmarshal(nc.data[0], &copyResult)
+	assert.Equal(t, err, nil, "json.Unmarshal failed")
+	assert.Equal(t, res, copyResult)
+
+	// Not published unless asked for
+	nc = &recordingPublisher{}
+	config.Master.PublishResults = false
+	err = reportResult(log, nc, config, res)
+	assert.Equal(t, err, nil, "reportResult failed")
+	assert.Equal(t, 0, len(nc.subjects))
+}
+
+func TestWriteResults(t *testing.T) {
+	dir := t.TempDir()
+	res := result{Time: time.Unix(1700000000, 0).UTC(), Scenario: "json", Mode: "json/byte", MessageSize: 512, TotalMessages: 1000,
+		TotalDuration: time.Second, DurationPerMessage: time.Millisecond, MessagesPerSecond: 1000, BytesPerSecond: 512000}
+
+	// json lines read back as the result
+	fileName := filepath.Join(dir, "results.json")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, writeResults(fileName, "json", res), nil, "writeResults failed")
+	}
+	content, err := ioutil.ReadFile(fileName)
+	assert.Equal(t, err, nil, "ReadFile failed")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 2, len(lines))
+	copyResult := result{}
+	err = json.Unmarshal([]byte(lines[1]), &copyResult)
+	assert.Equal(t, err, nil, "json.Unmarshal failed")
+	assert.Equal(t, res, copyResult)
+
+	// csv gets the header once
+	fileName = filepath.Join(dir, "results.csv")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, writeResults(fileName, "csv", res), nil, "writeResults failed")
+	}
+	f, err := os.Open(fileName)
+	assert.Equal(t, err, nil, "Open failed")
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	assert.Equal(t, err, nil, "csv ReadAll failed")
+	assert.Equal(t, [][]string{
+		resultsCSVHeader,
+		{"2023-11-14T22:13:20Z", "json", "json/byte", "512", "1000", "1000000000", "1000000", "1000", "512000"},
+		{"2023-11-14T22:13:20Z", "json", "json/byte", "512", "1000", "1000000000", "1000000", "1000", "512000"},
+	}, rows)
+}
+
+func TestThroughput(t *testing.T) {
+	// 1000 messages of 1250 bytes in 1s is 10 megabit/s
+	messagesPerSecond, bytesPerSecond, utilization := throughput(1000, 1250, time.Second, 100)
+	assert.Equal(t, 1000.0, messagesPerSecond)
+	assert.Equal(t, 1250000.0, bytesPerSecond)
+	assert.Equal(t, 10.0, utilization)
+
+	// Same byte rate with larger messages in the same time
+	messagesPerSecond, bytesPerSecond, _ = throughput(100, 12500, 500*time.Millisecond, 100)
+	assert.Equal(t, 200.0, messagesPerSecond)
+	assert.Equal(t, 2500000.0, bytesPerSecond)
+
+	// Unknown capacity gives no utilization
+	_, _, utilization = throughput(1000, 1250, time.Second, 0)
+	assert.Equal(t, 0.0, utilization)
+}
+
+func TestSummaryFormat(t *testing.T) {
+	// Consistent units for durations of different magnitude
+	format := summaryFormat{"ms", "MB/s", 3}
+	assert.Equal(t, "1.235ms", format.duration(1234567*time.Nanosecond))
+	assert.Equal(t, "0.988ms", format.duration(987654*time.Nanosecond))
+	assert.Equal(t, "2000.000ms", format.duration(2*time.Second))
+
+	// Without unit the duration is shown as is
+	assert.Equal(t, "1.234567ms", summaryFormat{}.duration(1234567*time.Nanosecond))
+
+	// Bytes vs bits and 1000 vs 1024
+	bytesPerSecond := 2 * 1024 * 1024.0
+	assert.Equal(t, "2.097 MB/s", format.throughput(bytesPerSecond))
+	assert.Equal(t, "2.00 MiB/s", summaryFormat{"", "MiB/s", 2}.throughput(bytesPerSecond))
+	assert.Equal(t, "16.78 Mbps", summaryFormat{"", "Mbps", 2}.throughput(bytesPerSecond))
+	assert.Equal(t, "2097152 B/s", summaryFormat{"", "B/s", 0}.throughput(bytesPerSecond))
+
+	// Default unit from config
+	assert.Equal(t, "B/s", newSummaryFormat(testConfig()).throughputUnit)
+}
+
+func TestPublishSucceeded(t *testing.T) {
+	var output bytes.Buffer
+	log := logrus.New()
+	log.Out = &output
+
+	assert.True(t, publishSucceeded(log, result{}), "No publish failures should succeed")
+	assert.Equal(t, "", output.String())
+	assert.False(t, publishSucceeded(log, result{PublishFailures: 2}), "Publish failures should fail")
+	assert.Contains(t, output.String(), "FAILED 2 publishes")
+}
+
+func TestCheckThroughput(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	res := result{MessagesPerSecond: 5000, BytesPerSecond: 2500000}
+
+	// No minimum, no check
+	assert.True(t, throughputMet(log, res, configuration{}), "No minimum should always pass")
+
+	config := configuration{Master: masterConfig{MinMessagesPerSecond: 4000}}
+	assert.Equal(t, checkThroughput(res, config), nil, "Above msgs/sec minimum should pass")
+	config.Master.MinMessagesPerSecond = 6000
+	err := checkThroughput(res, config)
+	assert.NotEqual(t, err, nil, "Below msgs/sec minimum should fail")
+	assert.Contains(t, err.Error(), "throughput 5000 msgs/sec below expected 6000 msgs/sec")
+	assert.False(t, throughputMet(log, res, config), "Below msgs/sec minimum should not be met")
+
+	config = configuration{Master: masterConfig{MinMBPerSecond: 2}}
+	assert.Equal(t, checkThroughput(res, config), nil, "Above MB/sec minimum should pass")
+	config.Master.MinMBPerSecond = 3
+	err = checkThroughput(res, config)
+	assert.NotEqual(t, err, nil, "Below MB/sec minimum should fail")
+	assert.Contains(t, err.Error(), "throughput 2.50 MB/sec below expected 3.00 MB/sec")
+}
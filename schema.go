@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- SCHEMA --------------------- */
+
+// schema is the subset of JSON Schema the slave validates json data against
+// Supported keywords: type, properties, required, additionalProperties (bool), items, minItems, minimum and maximum
+type schema struct {
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+// Reads and parses the schema in fileName
+func loadSchema(fileName string) (*schema, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "schema: unable to read schema file")
+	}
+
+	s := &schema{}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, errors.Wrap(err, "schema: unable to parse schema")
+	}
+	return s, nil
+}
+
+// Returns the JSON Schema type of a value decoded by encoding/json
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// validate returns the first violation of s in value, a value decoded by encoding/json into an interface{}
+func (s *schema) validate(value interface{}) error {
+	return s.validateAt("$", value)
+}
+
+func (s *schema) validateAt(path string, value interface{}) error {
+	if t := jsonType(value); s.Type != "" && s.Type != t && !(s.Type == "number" && t == "integer") {
+		return errors.New(fmt.Sprintf("schema: %s is %s, expected %s", path, t, s.Type))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return errors.New(fmt.Sprintf("schema: %s is missing required property %q", path, name))
+			}
+		}
+
+		// Sorted for a deterministic first violation
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return errors.New(fmt.Sprintf("schema: %s has unexpected property %q", path, name))
+				}
+				continue
+			}
+			if err := property.validateAt(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return errors.New(fmt.Sprintf("schema: %s has %d items, expected at least %d", path, len(v), *s.MinItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validateAt(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return errors.New(fmt.Sprintf("schema: %s is %v, below minimum %v", path, v, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return errors.New(fmt.Sprintf("schema: %s is %v, above maximum %v", path, v, *s.Maximum))
+		}
+	}
+	return nil
+}
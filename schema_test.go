@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["Name", "Pets", "LastGolfScores", "Points", "Games"],
+	"properties": {
+		"Name": {"type": "string"},
+		"Pets": {"type": "array", "items": {"type": "object", "required": ["Bites", "CanFly", "Ignores"]}},
+		"LastGolfScores": {"type": "array", "minItems": 1, "items": {"type": "integer", "minimum": 18}},
+		"Points": {"type": "number"},
+		"Games": {"type": "array"}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nats-go")
+	assert.Equal(t, err, nil, "TempDir failed")
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "schema.json")
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(testSchema), 0644), nil, "WriteFile failed")
+
+	s, err := loadSchema(fileName)
+	assert.Equal(t, err, nil, "loadSchema failed")
+
+	// The real payload is valid
+	myStruct := fillBigStruct()
+	generateMessage := rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct))
+	var decoded struct{ Data interface{} }
+	assert.Equal(t, json.Unmarshal(generateMessage(1, 10).message(), &decoded), nil, "Unmarshal failed")
+	assert.Equal(t, s.validate(decoded.Data), nil, "Valid payload failed validation")
+
+	// Mangled payloads that are still valid json
+	for _, mangled := range []string{
+		`{"Name": 42, "Pets": [], "LastGolfScores": [80], "Points": 1, "Games": []}`,
+		`{"Pets": [], "LastGolfScores": [80], "Points": 1, "Games": []}`,
+		`{"Name": "Steve", "Pets": [{"Bites": true}], "LastGolfScores": [80], "Points": 1, "Games": []}`,
+		`{"Name": "Steve", "Pets": [], "LastGolfScores": [80, 8.5], "Points": 1, "Games": []}`,
+		`{"Name": "Steve", "Pets": [], "LastGolfScores": [], "Points": 1, "Games": []}`,
+		`{"Name": "Steve", "Pets": [], "LastGolfScores": [80], "Points": "many", "Games": []}`,
+	} {
+		var value interface{}
+		assert.Equal(t, json.Unmarshal([]byte(mangled), &value), nil, "Unmarshal failed")
+		assert.NotEqual(t, s.validate(value), nil, "Mangled payload passed validation: "+mangled)
+	}
+
+	// Missing schema file
+	_, err = loadSchema(filepath.Join(dir, "missing.json"))
+	assert.NotEqual(t, err, nil, "Missing schema file should fail")
+}
+
+func TestSlaveSchemaViolations(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	fileName := filepath.Join(t.TempDir(), "schema.json")
+	assert.Equal(t, ioutil.WriteFile(fileName, []byte(`{"type": "object", "required": ["Missing"]}`), 0644), nil, "WriteFile failed")
+
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Slave.JSONSchema = fileName
+	myStruct := fillBigStruct()
+	generateMessage := rawMessageFunc([]byte("json"), []byte("byte"), structMessageFunc(&myStruct))
+
+	nc := newFakeConn()
+	var completion metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		decodeMetric(msg.Data, &completion)
+	})
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	// Every message violates the schema and is still counted, the completion reports the violations
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	assert.Equal(t, "received", completion.Job)
+	assert.Equal(t, config.Total, completion.SchemaViolations)
+}
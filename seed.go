@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- SEEDED PAYLOAD --------------------- */
+
+// A seed transform turns the seed into the data of message count. Cheap, and every message differs without fresh data
+type seedTransform func(seed []byte, count uint64) []byte
+
+// The seed transforms by name
+var seedTransforms = map[string]seedTransform{
+	"xor":    xorSeed,
+	"append": appendSeed,
+	"rotate": rotateSeed,
+}
+
+// XORs every byte of the seed with the byte of count (little endian) at the same position modulo 8
+// Distinct for every count if the seed is at least 8 bytes
+func xorSeed(seed []byte, count uint64) []byte {
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], count)
+	data := make([]byte, len(seed))
+	for i, b := range seed {
+		data[i] = b ^ key[i%8]
+	}
+	return data
+}
+
+// Appends count (8 bytes big endian) to the seed. Always distinct
+func appendSeed(seed []byte, count uint64) []byte {
+	data := make([]byte, len(seed)+8)
+	copy(data, seed)
+	binary.BigEndian.PutUint64(data[len(seed):], count)
+	return data
+}
+
+// Rotates the seed left by count bytes. Repeats after len(seed) messages
+func rotateSeed(seed []byte, count uint64) []byte {
+	data := make([]byte, len(seed))
+	if len(seed) == 0 {
+		return data
+	}
+	shift := int(count % uint64(len(seed)))
+	copy(data, seed[shift:])
+	copy(data[len(seed)-shift:], seed[:shift])
+	return data
+}
+
+// Returns a byte message generator with the seed transformed by the named transform for every count
+func seededMessageFunc(seed []byte, transform string) (rawMessageGenerator, error) {
+	apply, ok := seedTransforms[transform]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("seed: unknown transform %q", transform))
+	}
+	return func(count uint64, total uint64) rawMessage {
+		return byteMessageFunc(apply(seed, count))(count, total)
+	}, nil
+}
+
+// Returns true if msg is the message generateMessage makes for its count and total
+func verifySeeded(generateMessage rawMessageGenerator, msg byteMessage) bool {
+	return bytes.Equal(generateMessage(msg.count(), msg.total()).message(), msg)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedTransforms(t *testing.T) {
+	seed := []byte("a seed file of some length")
+	for name := range seedTransforms {
+		generateMessage, err := seededMessageFunc(seed, name)
+		assert.Equal(t, nil, err, name)
+
+		// Every message differs, and the slave verifies it against the transform
+		seen := map[string]bool{}
+		for count := uint64(1); count <= uint64(len(seed)); count++ {
+			msg := byteMessage(generateMessage(count, 100).message())
+			assert.True(t, msg.valid(), fmt.Sprintf("%s: invalid message %d", name, count))
+			assert.False(t, seen[string(msg.data())], fmt.Sprintf("%s: message %d repeats", name, count))
+			seen[string(msg.data())] = true
+			assert.True(t, verifySeeded(generateMessage, msg), fmt.Sprintf("%s: message %d not verified", name, count))
+		}
+
+		// A corrupted payload is caught
+		msg := byteMessage(generateMessage(5, 100).message())
+		msg.data()[0]++
+		assert.False(t, verifySeeded(generateMessage, msg), name+": corrupted message verified")
+	}
+
+	// The transforms are the documented ones
+	assert.Equal(t, []byte{'a' ^ 2, 'b' ^ 0}, xorSeed([]byte("ab"), 2))
+	assert.Equal(t, []byte{'a', 'b', 0, 0, 0, 0, 0, 0, 0, 2}, appendSeed([]byte("ab"), 2))
+	assert.Equal(t, []byte("cab"), rotateSeed([]byte("abc"), 2))
+
+	_, err := seededMessageFunc(seed, "shuffle")
+	assert.NotEqual(t, nil, err, "Unknown transform")
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/direktoren/go-nats-go/pkg/easycrypt"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+/* --------------------- SLAVE --------------------- */
+
+// Errors of messages that decode but fail verification
+var (
+	errLengthMismatch = errors.New("slave: data does not have the declared length")
+	errBadSeeded      = errors.New("slave: payload does not match the seed transform")
+)
+
+// Identifies a byte message that failed the length check by its count, if the count survived, otherwise by received
+func truncatedMessage(body []byte, received func() string) string {
+	if len(body) < 16 {
+		return received()
+	}
+	return fmt.Sprintf("count=%d", byteMessage(body).count())
+}
+
+// Wraps handler so it handles one message at a time. The counters of the slave are plain variables and the job
+// is only complete when every message is counted, so the handler must never run concurrently with itself. A nats
+// subscription calls its handler from one goroutine, but connections that deliver otherwise must not break this
+func lockedHandler(handler nats.MsgHandler) nats.MsgHandler {
+	var mu sync.Mutex
+	return func(msg *nats.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		handler(msg)
+	}
+}
+
+// runSlave handles jobs on nc until ctx is done or the slave aborts itself
+// Returns ctx.Err(), or context.Canceled when the slave aborted
+func runSlave(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop, err := startSlave(nc, config, generateMessage, log, cancel)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// startSlave sets up the slave subscriptions on nc and returns a func that removes them again
+// generateMessage is the slave's own scenario, used to check the master's announcement. It may be nil
+// The slave calls abort on a strict scenario mismatch or a likely key mismatch
+//
+// We listen to the .data subject. A job starts with a start marker, a message with Total 0 and the first Count
+// Send back timestamp when we have received Total amount of messages since the marker and ended with Count == first Count+Total-1
+// Succesful decrypt is required before sending back timestamp. But limited message verification
+// If times are not in sync between master and slave then the message/duration times will be wrong
+func startSlave(nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger, abort func()) (func(), error) {
+	var subs []*nats.Subscription
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := func() {
+		cancel()
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}
+
+	// Check that the master sends what we expect
+	var expectedMessage rawMessage
+	if generateMessage != nil {
+		expectedMessage = generateMessage(1, 1)
+	}
+	sub, err := subscribe(nc, config.Subject+".control", announcementHandler(expectedMessage, config.Name, config.Slave.StrictScenario, log, abort))
+	if err != nil {
+		stop()
+		return nil, errors.Wrap(err, "slave: unable to establish control subscription")
+	}
+	subs = append(subs, sub)
+
+	// Echo the master's canary
+	sub, err = serveCanary(nc, config.Subject+".canary")
+	if err != nil {
+		stop()
+		return nil, errors.Wrap(err, "slave: unable to establish canary subscription")
+	}
+	subs = append(subs, sub)
+
+	// Answer requests, possibly load balanced with other slaves in the queue group
+	if config.RequestReply {
+		requestSubs, err := serveRequests(nc, config.Subject+".request", config.Slave.QueueGroup, config.Name)
+		if err != nil {
+			stop()
+			return nil, errors.Wrap(err, "slave: unable to establish request subscription")
+		}
+		subs = append(subs, requestSubs...)
+		log.Logf(logrus.InfoLevel, "Serving requests as %s in queue group %q", config.Name, config.Slave.QueueGroup)
+	}
+
+	// Optionally check the structure of json data, not just that it unmarshals
+	var jsonSchema *schema
+	if config.Slave.JSONSchema != "" {
+		jsonSchema, err = loadSchema(config.Slave.JSONSchema)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	// The cipher is set up once. A run where every decrypt fails is stopped early
+	aesCipher, err := easycrypt.NewCipher(config.AESEncryptionKey)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	guard := &decryptGuard{threshold: config.Slave.MaxDecryptFailures, abort: func(consecutive uint64) {
+		log.Logf(logrus.FatalLevel, "LIKELY KEY MISMATCH - aborting after %d consecutive decrypt failures. Check AESEncryptionKey", consecutive)
+		abort()
+	}}
+
+	// Bad messages are skipped, or stop the slave on the first one
+	failures := &failurePolicy{abortOnError: config.Slave.ErrorPolicy == "abort", abort: func(message string, err error) {
+		log.Logf(logrus.FatalLevel, "Aborting on the first bad message %s err=%v. Slave.ErrorPolicy is abort", message, err)
+		abort()
+	}}
+
+	var start uint64         // Count of the first message in the job
+	var jobID uint64         // Job ID of the start marker of the job. Data messages of other jobs are dropped
+	var staleMessages uint64 // Data messages of other jobs, dropped
+	var firstPending bool    // The first message of the job is not received yet
+	var seen *dedup          // Counts received in the job, set up on the first message when total is known
+	var duplicates uint64
+	var badChunks uint64 // Streamed chunks with a checksum mismatch
+	var firstBad uint64  // Lowest offset of a bad chunk
+	var badSeeded uint64 // Seeded payloads that do not match the transform
+	var badChecksums uint64
+	var shortCiphertexts uint64 // Encrypted messages too short for a nonce and tag: truncated or not encrypted for us
+	shortCiphertext := func(err error) {
+		if errors.Is(err, easycrypt.ErrCiphertextTooShort) {
+			shortCiphertexts++
+		}
+	}
+	verifySeed := generateMessage != nil && generateMessage(1, 1).format() == "seed"
+	var schemaViolations uint64
+	var lengthMismatches uint64
+	var badHeaders uint64        // Messages with an unknown header version or flags
+	types := map[string]uint64{} // Dispatched messages per type/format from the header, whatever the scenario
+	subjects := dataSubjects(config)
+	listen := allDataSubjects(config) // Padded subjects are counted as the subscription they pad
+	subscriptionIndex := map[string]int{}
+	for i, subject := range listen {
+		subscriptionIndex[subject] = i % len(subjects)
+	}
+	var perSubscription []uint64 // Messages per data subscription with Subscriptions > 1
+	sizes := &sizeStats{}
+	histogram := &latencyHistogram{} // With StampSendTime
+	processing := &processingTimes{warmup: config.Slave.PercentileWarmup, random: seededRand(config.seed, "processing")}
+	trace := newStageTracer(config.TraceEvery) // Every TraceEvery:th message received
+	metrics := newMetricCoalescer(config.Slave.MetricInterval, func(m metric) {
+		bytes := encodeMetric(&m, config.Slave.MetricEncoding)
+		nc.Publish(config.MetricSubject, bytes)
+	}, func(m metric) {
+		bytes := encodeMetric(&m, config.Slave.MetricEncoding)
+		nc.Publish(config.CompletionSubject, bytes)
+	})
+
+	// With DataQueueGroup the slave only sees its share of a job and never completes it. It sends its partial
+	// count on the completion subject instead, at most every MetricInterval, and the master adds them up
+	shared := config.DataQueueGroup != ""
+	partialInterval := config.Slave.MetricInterval
+	if partialInterval <= 0 {
+		partialInterval = defaultPartialInterval
+	}
+	partials := newMetricCoalescer(partialInterval, func(m metric) {
+		bytes := encodeMetric(&m, config.Slave.MetricEncoding)
+		nc.Publish(config.CompletionSubject, bytes)
+	}, nil)
+
+	// Live throughput for any number of observers
+	var dataReceived uint64
+	if config.Slave.StatsInterval > 0 {
+		go streamStats(ctx, config.Slave.StatsInterval, &dataReceived, func(s stats) {
+			bytes, _ := json.Marshal(&s)
+			nc.Publish(config.Subject+".stats", bytes)
+		})
+	}
+
+	// Tell the master how many messages arrived, also when a job never completes
+	sub, err = serveReceived(nc, config.Subject+".received", &dataReceived)
+	if err != nil {
+		stop()
+		return nil, errors.Wrap(err, "slave: unable to establish received subscription")
+	}
+	subs = append(subs, sub)
+
+	// Every data message in a csv row with its latency
+	var latencies *latencyCSV
+	if config.Slave.LatencyFile != "" {
+		latencies, err = createLatencyCSV(config.Slave.LatencyFile)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		subscriptionsStop := stop
+		stop = func() {
+			subscriptionsStop()
+			err := latencies.close()
+			if err != nil {
+				log.Logf(logrus.ErrorLevel, "Unable to write %s err=%v", config.Slave.LatencyFile, err)
+			}
+		}
+	}
+
+	// With Bidirectional every job is answered with a return stream
+	returnMessage := returnMessageFunc(config)
+	stopReturn := context.CancelFunc(func() {})
+
+	magic := &magicFilter{magic: []byte(config.Magic)}
+	dataHandler := lockedHandler(timedHandler(processing, func(msg *nats.Msg) {
+		receivedAt := time.Now()
+
+		// Silently drop messages from other tools on the same subject, and empty permission probes
+		data, ok := magic.filter(msg.Data)
+		if !ok || len(data) == 0 {
+			return
+		}
+
+		var sentAt time.Time
+		if config.StampSendTime {
+			var err error
+			data, sentAt, err = stripSendTime(data)
+			if err != nil {
+				badHeaders++
+				failures.failed("without a send time", err)
+				return
+			}
+		}
+
+		// The header describes the message, no scenario needed. Drop what this slave cannot decode
+		if err := data.checkHeader(); err != nil {
+			badHeaders++
+			failures.failed("with a bad header", err)
+			return
+		}
+		seq := atomic.AddUint64(&dataReceived, 1)
+		trace.begin(seq)
+		received := func() string {
+			return fmt.Sprintf("received=%d", seq)
+		}
+
+		// First decrypt the "message body"
+		var err error
+		msgBytes := data.message()
+		switch data.format() {
+		case "encr":
+			msgBytes, err = aesCipher.Decrypt(msgBytes)
+			guard.record(err)
+			if err != nil {
+				// Ignore messages that cannot be decrypted
+				shortCiphertext(err)
+				failures.failed(received(), err)
+				return
+			}
+		case "chch":
+			msgBytes, err = easycrypt.DecryptChaCha(msgBytes, config.AESEncryptionKey)
+			guard.record(err)
+			if err != nil {
+				// Ignore messages that cannot be decrypted
+				shortCiphertext(err)
+				failures.failed(received(), err)
+				return
+			}
+		case "rtch":
+			msgBytes, err = ratchetDecrypt(msgBytes, config.AESEncryptionKey)
+			guard.record(err)
+			if err != nil {
+				// Ignore messages that cannot be decrypted
+				shortCiphertext(err)
+				failures.failed(received(), err)
+				return
+			}
+		case "encz":
+			msgBytes, err = aesCipher.Decrypt(msgBytes)
+			guard.record(err)
+			if err == nil {
+				msgBytes, err = decompress(msgBytes)
+			}
+			if err != nil {
+				// Ignore messages that cannot be decrypted and decompressed
+				shortCiphertext(err)
+				failures.failed(received(), err)
+				return
+			}
+		case "gzip":
+			msgBytes, err = decompress(msgBytes)
+			if err != nil {
+				// Ignore messages that cannot be decompressed
+				failures.failed(received(), err)
+				return
+			}
+		case "ck32":
+			msgBytes, err = verifyChecksum(msgBytes)
+			if err != nil {
+				// Corrupted on the way. Counted and dropped
+				badChecksums++
+				failures.failed(received(), err)
+				return
+			}
+		case "chan":
+			msgBytes, err = unchainMessage(msgBytes, config)
+			if err != nil {
+				// Ignore messages where the inverse chain fails
+				failures.failed(received(), err)
+				return
+			}
+		case "byte", "strm", "seed":
+		}
+		trace.mark(seq, "decrypt")
+
+		// Extract the message
+		var receivedMessage message
+		var violation bool
+		switch data.messageType() {
+		case "byte":
+			if !byteMessage(msgBytes).valid() {
+				// Truncated or corrupted on the way. Counted and dropped
+				lengthMismatches++
+				failures.failed(truncatedMessage(msgBytes, received), errLengthMismatch)
+				return
+			}
+			receivedMessage = byteMessage(msgBytes)
+		case "json", "tmpl":
+			tmpStruct := structMessage{Data: &bigStruct{}}
+			if data.messageType() == "tmpl" {
+				// Rendered templates have any structure
+				var generic interface{}
+				tmpStruct.Data = &generic
+			}
+			err := json.Unmarshal(msgBytes, &tmpStruct)
+			if err != nil {
+				// Ignore messages that cannot be unmarshalled
+				failures.failed(received(), err)
+				return
+			}
+			receivedMessage = tmpStruct
+
+			if jsonSchema != nil {
+				var decoded struct{ Data interface{} }
+				json.Unmarshal(msgBytes, &decoded)
+				err = jsonSchema.validate(decoded.Data)
+				if err != nil {
+					violation = true
+					failures.failed(fmt.Sprintf("count=%d", tmpStruct.Count), err)
+				}
+			}
+		case "mpck":
+			tmpStruct := structMessage{Data: &bigStruct{}}
+			err := msgpack.Unmarshal(msgBytes, &tmpStruct)
+			if err != nil {
+				// Ignore messages that cannot be unmarshalled
+				failures.failed(received(), err)
+				return
+			}
+			receivedMessage = tmpStruct
+		default:
+			if !byteMessage(msgBytes).valid() {
+				lengthMismatches++
+				failures.failed(truncatedMessage(msgBytes, received), errLengthMismatch)
+				return
+			}
+			receivedMessage = byteMessage(msgBytes)
+		}
+
+		trace.mark(seq, "unmarshal")
+
+		if receivedMessage.total() == 0 {
+			// Start marker. We have a new job counting from count
+			schemaViolations = 0
+			processing.reset()
+			types = map[string]uint64{}
+			firstPending = true
+			seen = nil
+			duplicates = 0
+			badChunks = 0
+			firstBad = 0
+			badSeeded = 0
+			badChecksums = 0
+			shortCiphertexts = 0
+			sizes.reset()
+			histogram.reset()
+			if len(subjects) > 1 {
+				perSubscription = make([]uint64, len(subjects))
+			}
+			start = receivedMessage.count()
+			jobID = data.jobID()
+			log.Logf(logrus.InfoLevel, "Accepted a new job starting at Count=%d with job ID=%d", start, jobID)
+			if config.Bidirectional {
+				// The return stream of the previous job is of no use anymore
+				stopReturn()
+				var returnCtx context.Context
+				returnCtx, stopReturn = context.WithCancel(ctx)
+				stream := jobMessageFunc(jobID, returnMessage)
+				go func() {
+					err := publishReturn(returnCtx, nc, returnSubject(config), config.Total, stream)
+					if err != nil && err != context.Canceled {
+						log.Logf(logrus.ErrorLevel, "Return stream failed err=%v", err)
+					}
+				}()
+			}
+			return
+		}
+
+		// Messages of another run, like late ones of a master that was stopped, are dropped
+		if data.jobID() != jobID {
+			staleMessages++
+			return
+		}
+
+		// Resent messages are dropped, not counted
+		if seen == nil {
+			seen = newDedup(start, receivedMessage.total())
+		}
+		if seen.duplicate(receivedMessage.count()) {
+			duplicates++
+			return
+		}
+
+		// Messages of another job, like stragglers of an earlier one, are not counted
+		if !seen.contains(receivedMessage.count()) {
+			return
+		}
+
+		if perSubscription != nil {
+			perSubscription[subscriptionIndex[msg.Subject]]++
+		}
+		sizes.record(len(msg.Data))
+		latencies.write(receivedMessage.count(), sentAt, receivedAt, len(msg.Data))
+		if config.StampSendTime {
+			histogram.record(receivedAt.Sub(sentAt))
+		}
+
+		if data.format() == "strm" {
+			offset, err := verifyChunk(byteMessage(msgBytes).data())
+			if err != nil {
+				if badChunks == 0 || offset < firstBad {
+					firstBad = offset
+				}
+				badChunks++
+				failures.failed(fmt.Sprintf("count=%d", receivedMessage.count()), err)
+			}
+		}
+
+		if data.format() == "seed" && verifySeed && !verifySeeded(generateMessage, byteMessage(msgBytes)) {
+			badSeeded++
+			failures.failed(fmt.Sprintf("count=%d", receivedMessage.count()), errBadSeeded)
+		}
+
+		if firstPending {
+			// Time to first byte. Never coalesced with progress
+			firstPending = false
+			if config.LogHeaders {
+				log.Logf(logrus.InfoLevel, "Received header count=%d %s", receivedMessage.count(), headerDump(data))
+			}
+			bytes := encodeMetric(&metric{Job: "first", Time: time.Now(), Count: 1, JobID: jobID}, config.Slave.MetricEncoding)
+			nc.Publish(config.MetricSubject, bytes)
+		}
+
+		if violation {
+			schemaViolations++
+		}
+
+		types[data.messageType()+"/"+data.format()]++
+
+		trace.finish(seq, "verify")
+
+		// Only valid messages of the job are counted, each count once
+		distinct := seen.count()
+		if config.Slave.ProgressEvery > 0 && distinct%config.Slave.ProgressEvery == 0 {
+			// Stream progress on the .metric subject. Never mistaken for completion by the master
+			metrics.progress(metric{Job: "progress", Time: time.Now(), Count: distinct, JobID: jobID})
+		}
+
+		if shared {
+			partials.progress(metric{Job: "partial", Time: time.Now(), Count: distinct, Slave: config.Name, JobID: jobID})
+			return
+		}
+
+		if distinct == receivedMessage.total() {
+			// Send back completion when every count of the job is received, in whatever order they arrived
+			metrics.complete(metric{
+				Job:        "received",
+				Time:       time.Now(),
+				Count:      receivedMessage.total(),
+				Slave:      config.Name,
+				Processing: processing.percentiles(),
+				Latency:    histogram.snapshot(),
+				Types:      types,
+				Duplicates: duplicates,
+				BadChunks:  badChunks,
+				FirstBad:   firstBad,
+				BadSeeded:  badSeeded,
+
+				BadChecksums:     badChecksums,
+				ShortCiphertexts: shortCiphertexts,
+				SchemaViolations: schemaViolations,
+
+				Subscriptions: perSubscription,
+				Sizes:         sizes.distribution(),
+				JobID:         jobID,
+			})
+			log.Logf(logrus.InfoLevel, "Completed a job with Total=%d", receivedMessage.total())
+			if err := latencies.flush(); err != nil {
+				log.Logf(logrus.ErrorLevel, "Unable to write %s err=%v", config.Slave.LatencyFile, err)
+			}
+			if config.LogHeaders {
+				log.Logf(logrus.InfoLevel, "Received header count=%d %s", receivedMessage.count(), headerDump(data))
+			}
+			if jsonSchema != nil {
+				log.Logf(logrus.InfoLevel, "Schema violations=%d", schemaViolations)
+			}
+			for t, n := range types {
+				log.Logf(logrus.InfoLevel, "Type %s=%d", t, n)
+			}
+			if averages := trace.averages(); averages != nil {
+				log.Logf(logrus.InfoLevel, "Trace of every %d:th message (folded)\n%s", config.TraceEvery, folded("slave", averages))
+			}
+			if badChunks > 0 {
+				log.Logf(logrus.WarnLevel, "Bad chunks=%d first at offset %d", badChunks, firstBad)
+			}
+			if badSeeded > 0 {
+				log.Logf(logrus.WarnLevel, "Bad seeded payloads=%d", badSeeded)
+			}
+			if badChecksums > 0 {
+				log.Logf(logrus.WarnLevel, "Bad checksums=%d", badChecksums)
+			}
+			if shortCiphertexts > 0 {
+				log.Logf(logrus.WarnLevel, "Short ciphertexts=%d. Truncated, or not encrypted by this scheme", shortCiphertexts)
+			}
+			if duplicates > 0 {
+				log.Logf(logrus.InfoLevel, "Duplicates=%d", duplicates)
+			}
+			if badHeaders > 0 {
+				log.Logf(logrus.WarnLevel, "Bad headers=%d so far. Check that master and slave are the same version", badHeaders)
+			}
+			if staleMessages > 0 {
+				log.Logf(logrus.WarnLevel, "Messages of other jobs=%d so far. Late messages of an earlier run, or another master on the same subject", staleMessages)
+			}
+			if lengthMismatches > 0 {
+				log.Logf(logrus.WarnLevel, "Length mismatches=%d so far", lengthMismatches)
+			}
+			if dropped := magic.droppedCount(); dropped > 0 {
+				log.Logf(logrus.InfoLevel, "Dropped %d messages without Magic so far", dropped)
+			}
+			if perSubscription != nil {
+				log.Logf(logrus.InfoLevel, "Subscriptions=%d messages=%v", len(perSubscription), perSubscription)
+			}
+		}
+	}))
+
+	if config.UseJetStream {
+		// Persisted messages pushed by a durable consumer, acked once handled
+		conn, ok := nc.(jetStreamer)
+		if !ok {
+			stop()
+			return nil, errors.New("slave: UseJetStream needs a connection that supports JetStream")
+		}
+		js, err := jetStreamContext(conn)
+		if err == nil {
+			err = ensureStream(js, config.StreamName, subjects)
+		}
+		if err == nil {
+			sub, err = subscribeDurable(js, config.StreamName, subjects[0], durableName(config), deliverSubject(config), dataHandler)
+		}
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		subs = append(subs, sub)
+		err = setPendingLimits(sub, config)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		log.Logf(logrus.InfoLevel, "Consuming stream %s as %s on %s", config.StreamName, durableName(config), deliverSubject(config))
+		return stop, nil
+	}
+
+	if shared {
+		// Every slave in the group gets the start marker, the data is shared
+		capacity := config.Slave.PendingMsgsLimit
+		if capacity <= 0 {
+			capacity = nats.DefaultSubPendingMsgsLimit
+		}
+		queued, err := subscribeQueueGroup(ctx, nc, listen, startSubject(config), config.DataQueueGroup, capacity, dataHandler)
+		if err != nil {
+			stop()
+			return nil, errors.Wrap(err, "slave: unable to establish data subscriptions")
+		}
+		subs = append(subs, queued...)
+		log.Logf(logrus.InfoLevel, "Sharing data subjects %s in queue group %q as %s", listen[0], config.DataQueueGroup, config.Name)
+		return stop, nil
+	}
+
+	if len(listen) > 1 {
+		// Many subscriptions on one connection, handled in the order they arrived
+		capacity := config.Slave.PendingMsgsLimit
+		if capacity <= 0 {
+			capacity = nats.DefaultSubPendingMsgsLimit
+		}
+		multiplexed, err := subscribeMultiplexed(ctx, nc, listen, capacity, dataHandler)
+		if err != nil {
+			stop()
+			return nil, errors.Wrap(err, "slave: unable to establish data subscriptions")
+		}
+		subs = append(subs, multiplexed...)
+		log.Logf(logrus.InfoLevel, "Subscribed to %d data subjects %s to %s", len(listen), listen[0], listen[len(listen)-1])
+		return stop, nil
+	}
+
+	sub, err = subscribe(nc, subjects[0], dataHandler)
+	if err != nil {
+		stop()
+		return nil, errors.Wrap(err, "slave: unable to establish data subscription")
+	}
+	subs = append(subs, sub)
+
+	err = setPendingLimits(sub, config)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- STREAM --------------------- */
+
+// Default size of the chunks a file is streamed in
+const streamChunkSize = 64 * 1024
+
+// A streamed chunk carries its offset in the file and a checksum, so the slave can pinpoint a corrupted chunk
+//
+// [offset (8 bytes big endian)][crc32 of data (4 bytes big endian)][data]
+const chunkHeaderSize = 12
+
+// Returns data framed as the chunk at offset
+func streamChunk(data []byte, offset uint64) []byte {
+	chunk := make([]byte, chunkHeaderSize+len(data))
+	binary.BigEndian.PutUint64(chunk[:8], offset)
+	binary.BigEndian.PutUint32(chunk[8:12], crc32.ChecksumIEEE(data))
+	copy(chunk[chunkHeaderSize:], data)
+	return chunk
+}
+
+// Returns the offset of chunk in the file, and an error if its checksum does not match
+func verifyChunk(chunk []byte) (uint64, error) {
+	if len(chunk) < chunkHeaderSize {
+		return 0, errors.New(fmt.Sprintf("stream: chunk of %d bytes is too short", len(chunk)))
+	}
+	offset := binary.BigEndian.Uint64(chunk[:8])
+	if crc32.ChecksumIEEE(chunk[chunkHeaderSize:]) != binary.BigEndian.Uint32(chunk[8:12]) {
+		return offset, errors.New(fmt.Sprintf("stream: checksum mismatch in chunk at offset %d", offset))
+	}
+	return offset, nil
+}
+
+// Returns a generator that streams data in chunks of chunkSize, one chunk per message, and the number of chunks
+// The message with count offset carries the first chunk, so a job of that many messages delivers data once
+func streamMessageFunc(data []byte, chunkSize int, offset uint64) (rawMessageGenerator, uint64) {
+	var chunks []rawMessageGenerator
+	for begin := 0; begin < len(data) || len(chunks) == 0; begin += chunkSize {
+		end := begin + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, byteMessageFunc(streamChunk(data[begin:end], uint64(begin))))
+	}
+
+	n := uint64(len(chunks))
+	return func(count uint64, total uint64) rawMessage {
+		return chunks[(count-offset)%n](count, total)
+	}, n
+}
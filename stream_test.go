@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamMessageFunc(t *testing.T) {
+	data := []byte("This is the test string that is streamed in chunks")
+	generateMessage, chunks := streamMessageFunc(data, 8, 100)
+	assert.Equal(t, uint64(7), chunks)
+
+	// One job reassembles the data, every chunk with its offset and a valid checksum
+	var streamed []byte
+	for count := uint64(100); count < 100+chunks; count++ {
+		msg := byteMessage(generateMessage(count, chunks).message())
+		assert.Equal(t, count, msg.count())
+		assert.True(t, msg.valid(), "Message should be valid")
+		offset, err := verifyChunk(msg.data())
+		assert.Equal(t, err, nil, "Chunk should be valid")
+		assert.Equal(t, uint64(len(streamed)), offset)
+		streamed = append(streamed, msg.data()[chunkHeaderSize:]...)
+	}
+	assert.Equal(t, data, streamed)
+
+	// A flipped bit is detected
+	chunk := streamChunk([]byte("chunk"), 40)
+	chunk[len(chunk)-1] ^= 1
+	offset, err := verifyChunk(chunk)
+	assert.NotEqual(t, err, nil, "Corrupted chunk should be detected")
+	assert.Equal(t, uint64(40), offset)
+	_, err = verifyChunk(chunk[:5])
+	assert.NotEqual(t, err, nil, "Short chunk should be detected")
+
+	// Empty data is one empty chunk
+	_, chunks = streamMessageFunc(nil, 8, 0)
+	assert.Equal(t, uint64(1), chunks)
+}
+
+func TestFirstLatency(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	data := bytes.Repeat([]byte("x"), 40)
+	streamMessages, chunks := streamMessageFunc(data, 10, 0)
+	config := testConfig()
+	config.Total = chunks
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+
+	// Chunked delivery with known timing: the first chunk after 20ms, the last after another 30ms
+	firstDelay, lastDelay := 20*time.Millisecond, 30*time.Millisecond
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), func(count uint64, total uint64) rawMessage {
+		switch {
+		case total == 0:
+		case count == 0:
+			time.Sleep(firstDelay)
+		case count == total-1:
+			time.Sleep(lastDelay)
+		}
+		return streamMessages(count, total)
+	})
+
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Streamed run should complete")
+	assert.True(t, res.FirstLatency >= firstDelay && res.FirstLatency < firstDelay+lastDelay, fmt.Sprintf("First latency %v", res.FirstLatency))
+	assert.True(t, res.TotalDuration >= firstDelay+lastDelay, fmt.Sprintf("Full latency %v", res.TotalDuration))
+}
+
+func TestStreamBadChunk(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	streamMessages, chunks := streamMessageFunc(data, 16, 0)
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("strm"), streamMessages)
+	config := testConfig()
+	config.Total = chunks
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+
+	nc := newFakeConn()
+	var completion metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		decodeMetric(msg.Data, &completion)
+	})
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	send := func(corrupt map[uint64]bool) {
+		publishStart(nc, "go-nats-go.data", 0, generateMessage)
+		for count := uint64(0); count < chunks; count++ {
+			raw := generateMessage(count, chunks)
+			if corrupt[count] {
+				raw = append(rawMessage(nil), raw...)
+				raw[len(raw)-1] ^= 0xff
+			}
+			nc.Publish("go-nats-go.data", raw)
+		}
+	}
+
+	// Intact chunks round-trip
+	send(nil)
+	assert.Equal(t, "received", completion.Job)
+	assert.Equal(t, uint64(0), completion.BadChunks)
+
+	// Corrupted chunks are pinpointed by the offset of the first
+	completion = metric{}
+	send(map[uint64]bool{5: true, 3: true})
+	assert.Equal(t, "received", completion.Job)
+	assert.Equal(t, uint64(2), completion.BadChunks)
+	assert.Equal(t, uint64(3*16), completion.FirstBad)
+
+	// The next job starts without the bad chunks of the last
+	completion = metric{}
+	send(nil)
+	assert.Equal(t, "received", completion.Job)
+	assert.Equal(t, uint64(0), completion.BadChunks)
+	assert.Equal(t, uint64(0), completion.FirstBad)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- SUBJECT LENGTH --------------------- */
+
+// Longest subject allowed for SubjectLengths. The server refuses protocol lines over 4096 bytes (max_control_line)
+const maxSubjectLength = 4000
+
+// Pads the last token of subject with 'x' to length bytes. length 0 means no padding
+func padSubject(subject string, length int) (string, error) {
+	if length == 0 {
+		return subject, nil
+	}
+	if length < len(subject) {
+		return "", errors.New(fmt.Sprintf("subject %s is longer than %d", subject, length))
+	}
+	if length > maxSubjectLength {
+		return "", errors.New(fmt.Sprintf("subject length %d exceeds %d", length, maxSubjectLength))
+	}
+	padded := subject + strings.Repeat("x", length-len(subject))
+	return padded, validSubject(padded)
+}
+
+// Returns an error unless subject is a legal subject to publish on: dot separated non-empty tokens,
+// no whitespace and no wildcards
+func validSubject(subject string) error {
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return errors.New(fmt.Sprintf("subject %q contains whitespace", subject))
+	}
+	for _, token := range strings.Split(subject, ".") {
+		switch token {
+		case "":
+			return errors.New(fmt.Sprintf("subject %q has an empty token", subject))
+		case "*", ">":
+			return errors.New(fmt.Sprintf("subject %q has a wildcard", subject))
+		}
+	}
+	return nil
+}
+
+// Returns the data subjects of every run: dataSubjects plus the padded subjects of every SubjectLengths.
+// The slave subscribes to all of them
+func allDataSubjects(config configuration) []string {
+	subjects := dataSubjects(config)
+	all := append([]string{}, subjects...)
+	for _, length := range config.SubjectLengths {
+		for _, subject := range subjects {
+			padded, _ := padSubject(subject, length) // Validated with the config
+			all = append(all, padded)
+		}
+	}
+	return all
+}
+
+// subjectLengthPoint is the throughput with the data subjects padded to one length
+type subjectLengthPoint struct {
+	Length             int
+	MessagesPerSecond  float64
+	DurationPerMessage float64 // Nanoseconds
+}
+
+// Returns the least squares slope of the duration per message over the subject length: nanoseconds per subject byte
+func subjectLengthSlope(points []subjectLengthPoint) float64 {
+	n := float64(len(points))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := float64(p.Length)
+		sumX += x
+		sumY += p.DurationPerMessage
+		sumXY += x * p.DurationPerMessage
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// Returns the points as csv: length,msgs/sec,ns/msg per line
+func subjectLengthCSV(points []subjectLengthPoint) string {
+	var b bytes.Buffer
+	b.WriteString("length,msgs/sec,ns/msg\n")
+	for _, p := range points {
+		fmt.Fprintf(&b, "%d,%.0f,%.0f\n", p.Length, p.MessagesPerSecond, p.DurationPerMessage)
+	}
+	return b.String()
+}
+
+// runSubjectLengths runs config.Total messages with the data subjects padded to every length of config.SubjectLengths
+// and returns the throughput per length
+func runSubjectLengths(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) ([]subjectLengthPoint, error) {
+	points := make([]subjectLengthPoint, 0, len(config.SubjectLengths))
+	for _, length := range config.SubjectLengths {
+		stepConfig := config
+		stepConfig.subjectLength = length
+		res, err := runMaster(ctx, nc, stepConfig, generateMessage, log)
+		if err != nil {
+			return points, errors.Wrapf(err, "subject length %d", length)
+		}
+		log.Logf(logrus.InfoLevel, "Subject length=%d msgs/sec=%.0f", length, res.MessagesPerSecond)
+		points = append(points, subjectLengthPoint{
+			Length:             length,
+			MessagesPerSecond:  res.MessagesPerSecond,
+			DurationPerMessage: float64(res.DurationPerMessage),
+		})
+	}
+	return points, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadSubject(t *testing.T) {
+	padded, err := padSubject("go-nats-go.data", 40)
+	assert.Equal(t, err, nil, "padSubject failed")
+	assert.Equal(t, 40, len(padded))
+	assert.Equal(t, true, strings.HasPrefix(padded, "go-nats-go.data"))
+	assert.Equal(t, nil, validSubject(padded))
+
+	// No padding, and the exact length of the subject
+	for _, length := range []int{0, len("go-nats-go.data")} {
+		padded, err = padSubject("go-nats-go.data", length)
+		assert.Equal(t, err, nil, "padSubject failed")
+		assert.Equal(t, "go-nats-go.data", padded)
+	}
+
+	// Too short, too long or illegal to begin with
+	for _, length := range []int{10, maxSubjectLength + 1} {
+		_, err = padSubject("go-nats-go.data", length)
+		assert.NotEqual(t, nil, err, "Length should be refused")
+	}
+	for _, subject := range []string{"go nats.data", "go-nats-go..data", "go-nats-go.>.data", "*.data", ".data"} {
+		_, err = padSubject(subject, 40)
+		assert.NotEqual(t, nil, err, subject+" should be refused")
+	}
+}
+
+func TestSubjectLengthSlope(t *testing.T) {
+	points := []subjectLengthPoint{{Length: 20, DurationPerMessage: 100}, {Length: 120, DurationPerMessage: 150}, {Length: 220, DurationPerMessage: 200}}
+	assert.InDelta(t, 0.5, subjectLengthSlope(points), 0.0001)
+	assert.Equal(t, 0.0, subjectLengthSlope(points[:1]))
+	assert.Equal(t, "length,msgs/sec,ns/msg\n20,0,100\n120,0,150\n220,0,200\n", subjectLengthCSV(points))
+}
+
+func TestRunSubjectLengths(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.SubjectLengths = []int{0, 64, 255}
+
+	// The in-process slave subscribes to every padded subject
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, generateMessage, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	points, err := runSubjectLengths(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "Every length should complete")
+	assert.Equal(t, 3, len(points))
+	for i, length := range config.SubjectLengths {
+		assert.Equal(t, length, points[i].Length)
+		assert.Equal(t, true, points[i].MessagesPerSecond > 0, "No throughput")
+	}
+	assert.Equal(t, 11, nc.count("go-nats-go.data"))
+	assert.Equal(t, 11, nc.count("go-nats-go.data"+strings.Repeat("x", 64-len("go-nats-go.data"))))
+	assert.Equal(t, 11, nc.count("go-nats-go.data"+strings.Repeat("x", 255-len("go-nats-go.data"))))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+/* --------------------- TEMPLATE --------------------- */
+
+// templateData is what a payload template is rendered with
+type templateData struct {
+	Count uint64
+	Total uint64
+	Vars  map[string]interface{} // TemplateVars from config
+}
+
+// Reads and parses the payload template in fileName
+func loadTemplate(fileName string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "template: unable to read template file")
+	}
+	tmpl, err := template.New(fileName).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrap(err, "template: unable to parse template")
+	}
+	return tmpl, nil
+}
+
+// Renders tmpl for count and total. Returns an error if the result is not valid JSON
+func renderTemplate(tmpl *template.Template, vars map[string]interface{}, count uint64, total uint64) ([]byte, error) {
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, templateData{count, total, vars})
+	if err != nil {
+		return nil, errors.Wrap(err, "template: unable to render")
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, errors.New(fmt.Sprintf("template: message %d is not valid JSON: %.80s", count, b.String()))
+	}
+	return b.Bytes(), nil
+}
+
+// rawMessage generator of rendered templates, wrapped like structMessageFunc so the slave finds count and total
+// Checks that the template renders to JSON once. No error handling after that
+func templateMessageFunc(tmpl *template.Template, vars map[string]interface{}) (rawMessageGenerator, error) {
+	_, err := renderTemplate(tmpl, vars, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func(count uint64, total uint64) rawMessage {
+		rendered, _ := renderTemplate(tmpl, vars, count, total)
+		msgBody, _ := json.Marshal(&structMessage{count, total, json.RawMessage(rendered)})
+		msg := make(rawMessage, headerSize+len(msgBody))
+		copy(msg[headerSize:], msgBody)
+		return msg
+	}, nil
+}
+
+// sizeDistribution is the spread of the message sizes of a job, in bytes on the wire
+type sizeDistribution struct {
+	Min  int
+	Mean float64
+	Max  int
+}
+
+// sizeStats collects the message sizes of a job
+// Not safe for concurrent use. The slave calls it from the data subscription only
+type sizeStats struct {
+	count uint64
+	sum   uint64
+	min   int
+	max   int
+}
+
+func (s *sizeStats) record(size int) {
+	if s.count == 0 || size < s.min {
+		s.min = size
+	}
+	if size > s.max {
+		s.max = size
+	}
+	s.count++
+	s.sum += uint64(size)
+}
+
+func (s *sizeStats) reset() {
+	*s = sizeStats{}
+}
+
+// Returns the distribution of the sizes so far, or nil if all messages had the same size
+func (s *sizeStats) distribution() *sizeDistribution {
+	if s.count == 0 || s.min == s.max {
+		return nil
+	}
+	mean := float64(s.sum) / float64(s.count)
+	return &sizeDistribution{Min: s.min, Mean: math.Round(mean*10) / 10, Max: s.max}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateMessageFunc(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "order.tmpl")
+	text := `{"order": {{.Count}}, "of": {{.Total}}, "shop": "{{.Vars.shop}}", "items": [{{range $i, $_ := .Vars.items}}{{if $i}},{{end}}{{$.Count}}{{end}}]}`
+	err := ioutil.WriteFile(fileName, []byte(text), 0644)
+	assert.Equal(t, err, nil, "WriteFile failed")
+
+	tmpl, err := loadTemplate(fileName)
+	assert.Equal(t, err, nil, "loadTemplate failed")
+	vars := map[string]interface{}{"shop": "north", "items": []interface{}{1, 2, 3}}
+	generateMessage, err := templateMessageFunc(tmpl, vars)
+	assert.Equal(t, err, nil, "templateMessageFunc failed")
+
+	// The count is rendered into the data
+	var decoded struct {
+		Count uint64
+		Total uint64
+		Data  struct {
+			Order uint64
+			Of    uint64
+			Shop  string
+			Items []uint64
+		}
+	}
+	err = json.Unmarshal(generateMessage(1234, 5000).message(), &decoded)
+	assert.Equal(t, err, nil, "Rendered message is not JSON")
+	assert.Equal(t, uint64(1234), decoded.Count)
+	assert.Equal(t, uint64(1234), decoded.Data.Order)
+	assert.Equal(t, uint64(5000), decoded.Data.Of)
+	assert.Equal(t, "north", decoded.Data.Shop)
+	assert.Equal(t, []uint64{1234, 1234, 1234}, decoded.Data.Items)
+
+	// Templates that do not render JSON, or miss a variable, are refused up front
+	for _, bad := range []string{`{"order": {{.Count}}`, `{"shop": "{{.Vars.city}}"}`} {
+		err = ioutil.WriteFile(fileName, []byte(bad), 0644)
+		assert.Equal(t, err, nil, "WriteFile failed")
+		tmpl, err := loadTemplate(fileName)
+		assert.Equal(t, err, nil, "loadTemplate failed")
+		_, err = templateMessageFunc(tmpl, vars)
+		assert.NotEqual(t, nil, err, bad)
+	}
+}
+
+func TestTemplateSlave(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "count.tmpl")
+	err := ioutil.WriteFile(fileName, []byte(`{"count": {{.Count}}, "label": "{{.Vars.label}}"}`), 0644)
+	assert.Equal(t, err, nil, "WriteFile failed")
+	tmpl, _ := loadTemplate(fileName)
+	templateMessages, err := templateMessageFunc(tmpl, map[string]interface{}{"label": "x"})
+	assert.Equal(t, err, nil, "templateMessageFunc failed")
+	generateMessage := rawMessageFunc([]byte("tmpl"), []byte("byte"), templateMessages)
+
+	// The slave decodes the rendered messages as generic json. Counts 8 to 17 render 1 or 2 digits
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Scenario = "json.template"
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Master.StartOffset = 8
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	done := make(chan metric, 1)
+	completionSub, _ := subscribe(nc, config.CompletionSubject, completionHandler(config.Total, 0, nil, &unexpectedMetrics{log: log}, done))
+	defer completionSub.Unsubscribe()
+	publishStart(nc, "go-nats-go.data", config.Master.StartOffset, generateMessage)
+	for count := config.Master.StartOffset; count < config.Master.StartOffset+config.Total; count++ {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	assert.Equal(t, 1, len(done), "Slave did not complete")
+
+	// Two digit counts are one byte longer, twice: in the envelope and in the data
+	m := <-done
+	size := len(generateMessage(8, config.Total))
+	assert.Equal(t, &sizeDistribution{Min: size, Mean: float64(size) + 1.6, Max: size + 2}, m.Sizes)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- TLS COMPARISON --------------------- */
+
+// Wraps connect and stores the time it took to connect in took. For a tls:// URL this includes the TLS handshake
+func timedConnect(took *time.Duration, connect func() (*nats.Conn, error)) func() (*nats.Conn, error) {
+	return func() (*nats.Conn, error) {
+		start := time.Now()
+		nc, err := connect()
+		*took = time.Since(start)
+		return nc, err
+	}
+}
+
+// tlsOverhead is the difference between the same run over TLS and in plain text
+type tlsOverhead struct {
+	Handshake          time.Duration // TLS connect time - plain connect time
+	Throughput         float64       // Change of MessagesPerSecond in percent, negative when TLS is slower
+	DurationPerMessage time.Duration // TLS - plain
+	FirstLatency       time.Duration // TLS - plain
+}
+
+// Returns the overhead attributable to TLS from a plain and a TLS result and their connect times
+func compareTLS(plain result, secure result, plainConnect time.Duration, tlsConnect time.Duration) tlsOverhead {
+	overhead := tlsOverhead{
+		Handshake:          tlsConnect - plainConnect,
+		DurationPerMessage: secure.DurationPerMessage - plain.DurationPerMessage,
+		FirstLatency:       secure.FirstLatency - plain.FirstLatency,
+	}
+	if plain.MessagesPerSecond > 0 {
+		overhead.Throughput = (secure.MessagesPerSecond - plain.MessagesPerSecond) / plain.MessagesPerSecond * 100
+	}
+	return overhead
+}
+
+// Logs the TLS overhead
+func logTLSOverhead(log *logrus.Logger, overhead tlsOverhead) {
+	log.Logf(logrus.InfoLevel, "TLS overhead handshake=%v throughput=%+.1f%% per message=%v first latency=%v", overhead.Handshake, overhead.Throughput, overhead.DurationPerMessage, overhead.FirstLatency)
+}
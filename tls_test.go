@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimedConnect(t *testing.T) {
+	var took time.Duration
+	connect := timedConnect(&took, func() (*nats.Conn, error) {
+		time.Sleep(20 * time.Millisecond) // A slow handshake
+		return nil, nil
+	})
+	_, err := connect()
+	assert.Equal(t, nil, err)
+	assert.True(t, took >= 20*time.Millisecond, "Connect time not captured")
+}
+
+func TestCompareTLS(t *testing.T) {
+	plain := result{MessagesPerSecond: 1000, DurationPerMessage: time.Millisecond, FirstLatency: 2 * time.Millisecond}
+	secure := result{MessagesPerSecond: 800, DurationPerMessage: 1250 * time.Microsecond, FirstLatency: 3 * time.Millisecond}
+
+	overhead := compareTLS(plain, secure, time.Millisecond, 5*time.Millisecond)
+	assert.Equal(t, 4*time.Millisecond, overhead.Handshake, "Handshake")
+	assert.InDelta(t, -20.0, overhead.Throughput, 0.001, "Throughput")
+	assert.Equal(t, 250*time.Microsecond, overhead.DurationPerMessage, "Duration per message")
+	assert.Equal(t, time.Millisecond, overhead.FirstLatency, "First latency")
+
+	// No plain throughput, no percentage
+	overhead = compareTLS(result{}, secure, 0, 0)
+	assert.Equal(t, 0.0, overhead.Throughput)
+}
+
+// Writes a self-signed certificate and its key as PEM files to dir and returns their paths
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, err, nil, "GenerateKey failed")
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-nats-go test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Equal(t, err, nil, "CreateCertificate failed")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, err, nil, "MarshalECPrivateKey failed")
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Equal(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), nil, "WriteFile failed")
+	assert.Equal(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), nil, "WriteFile failed")
+	return certFile, keyFile
+}
+
+func TestBuildConnectOptionsTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	config := testConfig()
+	config.TLSCert, config.TLSKey, config.TLSCACert = certFile, keyFile, certFile
+
+	opts := nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(config, &bufferTracker{}, logrus.New()) {
+		assert.Equal(t, option(&opts), nil, "Option failed")
+	}
+	assert.True(t, opts.Secure, "TLS should be required")
+	assert.NotEqual(t, (*tls.Config)(nil), opts.TLSConfig, "No TLS config")
+	if opts.TLSConfig != nil {
+		assert.Equal(t, 1, len(opts.TLSConfig.Certificates), "Client certificate not loaded")
+		assert.NotEqual(t, (*x509.CertPool)(nil), opts.TLSConfig.RootCAs, "CA not loaded")
+	}
+
+	// Only the CA
+	config.TLSCert, config.TLSKey = "", ""
+	opts = nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(config, &bufferTracker{}, logrus.New()) {
+		assert.Equal(t, option(&opts), nil, "Option failed")
+	}
+	assert.NotEqual(t, (*tls.Config)(nil), opts.TLSConfig, "No TLS config")
+	if opts.TLSConfig != nil {
+		assert.Equal(t, 0, len(opts.TLSConfig.Certificates), "No client certificate expected")
+	}
+
+	// Unset keeps plain connections
+	opts = nats.GetDefaultOptions()
+	for _, option := range buildConnectOptions(testConfig(), &bufferTracker{}, logrus.New()) {
+		option(&opts)
+	}
+	assert.False(t, opts.Secure, "TLS should not be required")
+	assert.Equal(t, (*tls.Config)(nil), opts.TLSConfig)
+}
+
+func TestReadConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	read := func(content string) error {
+		fileName := filepath.Join(dir, "config.json")
+		assert.Equal(t, ioutil.WriteFile(fileName, []byte(content), 0644), nil, "WriteFile failed")
+		var config configuration
+		return readConfig(fileName, false, &config)
+	}
+
+	err := read(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "TLSCert": "cert.pem", "TLSKey": "key.pem"}`)
+	assert.Equal(t, err, nil, "Certificate and key should be accepted")
+	err = read(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "TLSCACert": "ca.pem"}`)
+	assert.Equal(t, err, nil, "CA alone should be accepted")
+
+	err = read(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "TLSCert": "cert.pem"}`)
+	assert.NotEqual(t, err, nil, "Certificate without key should be rejected")
+	err = read(`{"AESEncryptionKey": "ThisIsMy32BytesKeyForTestingFine", "TLSKey": "key.pem"}`)
+	assert.NotEqual(t, err, nil, "Key without certificate should be rejected")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* --------------------- TRACE --------------------- */
+
+// stageTracer records where the time goes per message for every every:th message: the time between the
+// marks of consecutive pipeline stages. A nil *stageTracer records nothing, so it can be used unconditionally
+type stageTracer struct {
+	mu      sync.Mutex
+	every   uint64
+	count   uint64    // Count of the traced message
+	last    time.Time // Time of the last mark. Zero when no message is traced
+	stages  []string  // In the order first recorded
+	sums    map[string]time.Duration
+	samples map[string]uint64
+}
+
+// stageAverage is the average time of one pipeline stage
+type stageAverage struct {
+	Stage   string
+	Average time.Duration
+}
+
+// Returns a tracer for every every:th message, nil if every is 0
+func newStageTracer(every uint64) *stageTracer {
+	if every == 0 {
+		return nil
+	}
+	return &stageTracer{every: every, sums: map[string]time.Duration{}, samples: map[string]uint64{}}
+}
+
+// Returns true if the message with count is traced
+func (t *stageTracer) sampled(count uint64) bool {
+	return t != nil && count%t.every == 0
+}
+
+// Starts tracing the message with count if it is sampled
+func (t *stageTracer) begin(count uint64) {
+	if !t.sampled(count) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count = count
+	t.last = time.Now()
+}
+
+// Records the time since the last mark of the traced message count as stage
+func (t *stageTracer) mark(count uint64, stage string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last.IsZero() || t.count != count {
+		return
+	}
+	now := time.Now()
+	t.add(stage, now.Sub(t.last))
+	t.last = now
+}
+
+// Marks the last stage of the traced message count and ends its trace
+func (t *stageTracer) finish(count uint64, stage string) {
+	if t == nil {
+		return
+	}
+	t.mark(count, stage)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == count {
+		t.last = time.Time{}
+	}
+}
+
+func (t *stageTracer) add(stage string, d time.Duration) {
+	if _, ok := t.samples[stage]; !ok {
+		t.stages = append(t.stages, stage)
+	}
+	t.sums[stage] += d
+	t.samples[stage]++
+}
+
+// Wraps generateMessage and marks stage when it returns
+func (t *stageTracer) stage(stage string, generateMessage rawMessageGenerator) rawMessageGenerator {
+	if t == nil {
+		return generateMessage
+	}
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		t.mark(count, stage)
+		return msg
+	}
+}
+
+// Returns the average time per stage in pipeline order
+func (t *stageTracer) averages() []stageAverage {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	averages := make([]stageAverage, 0, len(t.stages))
+	for _, stage := range t.stages {
+		averages = append(averages, stageAverage{stage, t.sums[stage] / time.Duration(t.samples[stage])})
+	}
+	return averages
+}
+
+// Returns the averages in the folded stack format of flame graph tools, one "root;stage nanoseconds" per line
+func folded(root string, averages []stageAverage) string {
+	var b strings.Builder
+	for _, a := range averages {
+		fmt.Fprintf(&b, "%s;%s %d\n", root, a.Stage, a.Average.Nanoseconds())
+	}
+	return b.String()
+}
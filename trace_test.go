@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageTracer(t *testing.T) {
+	// A stubbed pipeline with stages of known duration
+	trace := newStageTracer(2)
+	sleeping := func(d time.Duration) rawMessageGenerator {
+		return func(count uint64, total uint64) rawMessage {
+			time.Sleep(d)
+			return make(rawMessage, 8)
+		}
+	}
+	encrypt := func(generateMessage rawMessageGenerator) rawMessageGenerator {
+		return func(count uint64, total uint64) rawMessage {
+			msg := generateMessage(count, total)
+			time.Sleep(4 * time.Millisecond)
+			return msg
+		}
+	}
+	generateMessage := trace.stage("encrypt", encrypt(trace.stage("generate", sleeping(2*time.Millisecond))))
+
+	// A single traced message
+	trace.begin(4)
+	generateMessage(4, 10)
+	time.Sleep(6 * time.Millisecond)
+	trace.finish(4, "publish")
+
+	averages := trace.averages()
+	assert.Equal(t, 3, len(averages))
+	for i, expected := range []stageAverage{{"generate", 2 * time.Millisecond}, {"encrypt", 4 * time.Millisecond}, {"publish", 6 * time.Millisecond}} {
+		assert.Equal(t, expected.Stage, averages[i].Stage)
+		assert.True(t, averages[i].Average >= expected.Average && averages[i].Average < expected.Average+5*time.Millisecond,
+			fmt.Sprintf("%s took %v", expected.Stage, averages[i].Average))
+	}
+
+	// Messages that are not sampled, or outside a trace, are not recorded
+	trace.begin(5)
+	generateMessage(5, 10)
+	trace.finish(5, "publish")
+	generateMessage(4, 10)
+	assert.Equal(t, averages, trace.averages())
+
+	assert.Equal(t, "master;generate 2000\nmaster;encrypt 4000\n", folded("master", []stageAverage{{"generate", 2 * time.Microsecond}, {"encrypt", 4 * time.Microsecond}}))
+
+	// A nil tracer is a no-op
+	var off *stageTracer
+	off.begin(0)
+	off.finish(0, "publish")
+	assert.True(t, off.averages() == nil, "Nil tracer has no averages")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/direktoren/go-nats-go/pkg/easycrypt"
+	"github.com/pkg/errors"
+)
+
+/* --------------------- TRANSFORM CHAIN --------------------- */
+
+// transform is one stage of a payload transform chain
+// apply wraps a rawMessage generator like the other message funcs, inverse undoes it on the slave
+type transform struct {
+	name    string // Name in TransformChain, e.g. "compress:gzip"
+	tag     string // 4 byte tag recorded in the message for the slave
+	apply   func(rawMessageGenerator) rawMessageGenerator
+	inverse func([]byte) ([]byte, error)
+}
+
+// Returns the available transforms by name, set up with the key and level from config
+func transformRegistry(config configuration) map[string]transform {
+	key := config.AESEncryptionKey
+	registry := map[string]transform{}
+	for _, t := range []transform{
+		{"compress:gzip", "gzip",
+			func(g rawMessageGenerator) rawMessageGenerator {
+				return compressedMessageFunc(g, config.CompressionLevel)
+			},
+			decompress},
+		{"encrypt:gcm", "encr",
+			func(g rawMessageGenerator) rawMessageGenerator { return encryptedMessageFunc(g, key) },
+			func(body []byte) ([]byte, error) { return easycrypt.Decrypt(body, key) }},
+		{"encrypt:ratchet", "rtch",
+			func(g rawMessageGenerator) rawMessageGenerator { return ratchetMessageFunc(g, key) },
+			func(body []byte) ([]byte, error) { return ratchetDecrypt(body, key) }},
+		{"checksum:crc32", "ck32",
+			checksumMessageFunc,
+			verifyChecksum},
+	} {
+		registry[t.name] = t
+	}
+	return registry
+}
+
+// Returns the transforms of chain in order. Every stage must exist in the registry
+func parseTransformChain(chain []string, config configuration) ([]transform, error) {
+	if len(chain) > 255 {
+		return nil, errors.New(fmt.Sprintf("transform: chain of %d stages is too long", len(chain)))
+	}
+
+	registry := transformRegistry(config)
+	transforms := make([]transform, 0, len(chain))
+	for _, name := range chain {
+		t, ok := registry[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("transform: unknown stage %q", name))
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// Takes a rawMessage generator and applies the transforms in order. The message gets format "chan"
+// The body starts with the number of stages and their tags, so the slave can apply the inverse chain
+//
+// [msgType (4 bytes)]["chan"][version][flags][stages (1 byte)][tag 1 (4 bytes)]...[tag n (4 bytes)][transformed body]
+func chainMessageFunc(generateMessage rawMessageGenerator, chain []transform) rawMessageGenerator {
+	plain := generateMessage(1, 1)
+	msgType, flags := plain.messageType(), plain.flags()
+
+	tags := make([]byte, 0, 1+4*len(chain))
+	tags = append(tags, byte(len(chain)))
+	transformed := generateMessage
+	for _, t := range chain {
+		tags = append(tags, t.tag...)
+		flags |= formatFlags(t.tag) // The tags of the encrypting and compressing stages are their formats
+		transformed = t.apply(transformed)
+	}
+
+	return func(count uint64, total uint64) rawMessage {
+		msg := transformed(count, total)
+		chainedMessage := make(rawMessage, headerSize+len(tags)+len(msg)-headerSize)
+		copy(chainedMessage[0:4], msgType)
+		copy(chainedMessage[4:8], "chan")
+		chainedMessage[8] = headerVersion
+		chainedMessage[9] = flags
+		copy(chainedMessage[headerSize:], tags)
+		copy(chainedMessage[headerSize+len(tags):], msg.message())
+		return chainedMessage
+	}
+}
+
+// Reverses chainMessageFunc. Reads the recorded tags and applies the inverse transforms in reverse order
+func unchainMessage(body []byte, config configuration) ([]byte, error) {
+	if len(body) < 1 {
+		return []byte{}, errors.New("transform: empty body")
+	}
+	stages := int(body[0])
+	if len(body) < 1+4*stages {
+		return []byte{}, errors.New(fmt.Sprintf("transform: len(body)(%v) too short for %d stages", len(body), stages))
+	}
+	tags := body[1 : 1+4*stages]
+	body = body[1+4*stages:]
+
+	byTag := map[string]transform{}
+	for _, t := range transformRegistry(config) {
+		byTag[t.tag] = t
+	}
+
+	for i := stages - 1; i >= 0; i-- {
+		tag := string(tags[4*i : 4*i+4])
+		t, ok := byTag[tag]
+		if !ok {
+			return []byte{}, errors.New(fmt.Sprintf("transform: unknown tag %q", tag))
+		}
+		var err error
+		body, err = t.inverse(body)
+		if err != nil {
+			return []byte{}, errors.Wrapf(err, "transform: %s failed", t.name)
+		}
+	}
+	return body, nil
+}
+
+// Takes a rawMessage generator and appends a crc32 (IEEE) checksum of the body
+func checksumMessageFunc(generateMessage rawMessageGenerator) rawMessageGenerator {
+	return func(count uint64, total uint64) rawMessage {
+		msg := generateMessage(count, total)
+		checksummedMessage := make(rawMessage, len(msg)+4)
+		copy(checksummedMessage[headerSize:], msg.message())
+		binary.BigEndian.PutUint32(checksummedMessage[len(msg):], crc32.ChecksumIEEE(msg.message()))
+		return checksummedMessage
+	}
+}
+
+// Reverses checksumMessageFunc. Returns the body without checksum if it matches
+func verifyChecksum(body []byte) ([]byte, error) {
+	if len(body) < 4 {
+		return []byte{}, errors.New(fmt.Sprintf("checksum: len(body)(%v) < 4", len(body)))
+	}
+	data := body[:len(body)-4]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(body[len(body)-4:]) {
+		return []byte{}, errors.New("checksum: mismatch")
+	}
+	return data, nil
+}
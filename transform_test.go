@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformChain(t *testing.T) {
+	data := []byte("This is the test string that is the bulk of our message")
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+
+	chain, err := parseTransformChain([]string{"compress:gzip", "encrypt:gcm", "checksum:crc32"}, config)
+	assert.Equal(t, err, nil, "parseTransformChain failed")
+	generateMessage := chainMessageFunc(rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc(data)), chain)
+
+	var total uint64 = 10
+	var count uint64
+	for ; count < total; count++ {
+		msg := generateMessage(count, total)
+		assert.Equal(t, "byte", msg.messageType())
+		assert.Equal(t, "chan", msg.format())
+
+		// Every stage's tag is recorded in order
+		body := msg.message()
+		assert.Equal(t, byte(3), body[0])
+		assert.Equal(t, "gzipencrck32", string(body[1:13]))
+
+		unchained, err := unchainMessage(body, config)
+		assert.Equal(t, err, nil, "unchainMessage failed")
+		message := byteMessage(unchained)
+		assert.Equal(t, count, message.count())
+		assert.Equal(t, total, message.total())
+		assert.Equal(t, data, message.data())
+	}
+
+	// A corrupted message fails the checksum
+	body := generateMessage(1, total).message()
+	body[20] ^= 0xff
+	_, err = unchainMessage(body, config)
+	assert.NotEqual(t, err, nil, "Corrupted message should fail")
+
+	// Unknown stages are rejected
+	_, err = parseTransformChain([]string{"compress:snappy"}, config)
+	assert.NotEqual(t, err, nil, "Unknown stage should fail")
+}
+
+func TestChecksum(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	config.Checksum = true
+
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("ck32"), checksumMessageFunc(byteMessageFunc([]byte("data"))))
+	msg := generateMessage(1, config.Total)
+	assert.Equal(t, "ck32", msg.format())
+	data, err := verifyChecksum(msg.message())
+	assert.Equal(t, err, nil, "verifyChecksum failed")
+	assert.Equal(t, []byte("data"), byteMessage(data).data())
+
+	// A flipped byte fails the checksum
+	msg.message()[0] ^= 0xff
+	_, err = verifyChecksum(msg.message())
+	assert.NotEqual(t, err, nil, "Corrupted message should fail")
+
+	// The slave drops and counts corrupted messages
+	nc := newFakeConn()
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	var completion metric
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		decodeMetric(msg.Data, &completion)
+	})
+
+	publishStart(nc, "go-nats-go.data", 0, generateMessage)
+	for count := uint64(0); count < config.Total; count++ {
+		msg := generateMessage(count, config.Total)
+		if count%2 == 0 {
+			msg.message()[len(msg.message())-1] ^= 0xff
+		}
+		nc.Publish("go-nats-go.data", msg)
+	}
+	// Resent intact, the job completes
+	for count := uint64(0); count < config.Total; count += 2 {
+		nc.Publish("go-nats-go.data", generateMessage(count, config.Total))
+	}
+	stop()
+	assert.Equal(t, config.Total/2, completion.BadChecksums, "Every corrupted message should be counted")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/* --------------------- WARMUP --------------------- */
+
+// warmup runs config.Master.WarmupMessages messages as a job of their own, to fill connection buffers and get
+// the first garbage collections over with before the measured run. The job has its own job ID, so the slave
+// never counts its messages in the measured job, and its result is dropped
+func warmup(ctx context.Context, nc natsConn, config configuration, generateMessage rawMessageGenerator, log *logrus.Logger) error {
+	warm := config
+	warm.Total = config.Master.WarmupMessages
+	warm.Master.WarmupMessages = 0
+	warm.LogHeaders = false
+	warm.tracer = nil
+
+	log.Logf(logrus.InfoLevel, "Warming up with %d messages", warm.Total)
+	_, err := runMaster(ctx, nc, warm, generateMessage, log)
+	if err != nil {
+		return errors.Wrap(err, "master: warmup failed")
+	}
+	return nil
+}
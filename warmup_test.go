@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmup(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	config := testConfig()
+	config.Master.WarmupMessages = 50
+	config.AESEncryptionKey = "ThisIsMy32BytesKeyForTestingFine"
+	config.Slave.MaxDecryptFailures = 1000
+	generateMessage := rawMessageFunc([]byte("byte"), []byte("byte"), byteMessageFunc([]byte("data")))
+
+	// Warmup messages are slow to deliver, the messages of the run are not
+	nc := newFakeConn()
+	nc.Subscribe(config.DataSubject, func(msg *nats.Msg) {
+		if byteMessage(rawMessage(msg.Data).message()).total() == config.Master.WarmupMessages {
+			time.Sleep(2 * time.Millisecond)
+		}
+	})
+	var completions []metric
+	var mu sync.Mutex
+	nc.Subscribe(config.CompletionSubject, func(msg *nats.Msg) {
+		var m metric
+		decodeMetric(msg.Data, &m)
+		mu.Lock()
+		completions = append(completions, m)
+		mu.Unlock()
+	})
+	stop, err := startSlave(nc, config, nil, log, func() {})
+	assert.Equal(t, err, nil, "startSlave failed")
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := runMaster(ctx, nc, config, generateMessage, log)
+	assert.Equal(t, err, nil, "runMaster failed")
+
+	// The slave completes the warmup as a job of its own, then the run
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, len(completions))
+	if len(completions) == 2 {
+		assert.Equal(t, config.Master.WarmupMessages, completions[0].Count)
+		assert.Equal(t, config.Total, completions[1].Count)
+		assert.NotEqual(t, completions[0].JobID, completions[1].JobID)
+		assert.Equal(t, completions[1].JobID, res.JobID, "The result is of the measured job")
+	}
+	assert.Equal(t, int(config.Master.WarmupMessages+1+config.Total+1), nc.count(config.DataSubject), "Start markers, warmup and data")
+
+	// Only the run is measured
+	assert.Equal(t, config.Total, res.TotalMessages)
+	assert.True(t, res.TotalDuration < 100*time.Millisecond, "The warmup is not in the duration")
+}